@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/asimpleidea/ship-krew/users/api/internal/cache"
+	"github.com/asimpleidea/ship-krew/users/api/internal/password"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/database"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/lifecycle"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/tracing"
+)
+
+type apiConfig struct {
+	Verbosity             int                `yaml:"verbosity" flag:"verbosity" usage:"the verbosity level"`
+	Database              database.Settings  `yaml:"database" flag:"database"`
+	Migrations            string             `yaml:"migrations" flag:"migrations" usage:"what to do with pending migrations on start: check to refuse to serve, or up to apply them. Defaults to up for sqlite and check otherwise"`
+	MigrationsLockTimeout time.Duration      `yaml:"migrationsLockTimeout" flag:"migrations-lock-timeout" usage:"how long to wait for other replicas to finish migrating"`
+	Auth                  authConfig         `yaml:"auth" flag:"auth"`
+	ListMaxLimit          int                `yaml:"listMaxLimit" flag:"list-max-limit" usage:"the maximum number of users that can be returned in a single page"`
+	ImportMaxSize         int64              `yaml:"importMaxSize" flag:"import-max-size" usage:"the maximum size of the body of an import, in bytes"`
+	Argon2                password.Params    `yaml:"argon2" flag:"password-argon2"`
+	Cache                 cache.Settings     `yaml:"cache" flag:"cache"`
+	Tracing               tracing.Settings   `yaml:"tracing" flag:"tracing"`
+	Shutdown              lifecycle.Settings `yaml:"shutdown" flag:"shutdown"`
+}
+
+type authConfig struct {
+	APIKeysFile string `yaml:"apiKeysFile" flag:"api-keys-file" usage:"the path of the json file containing the api keys and token secrets that services can use"`
+	Disabled    bool   `yaml:"disabled" flag:"disabled" usage:"do not require callers to authenticate: only meant for local runs"`
+}
+
+func defaultConfig() *apiConfig {
+	return &apiConfig{
+		Verbosity: 1,
+		Database: database.Settings{
+			Driver:       database.DriverMySQL,
+			Path:         "users.db",
+			Address:      "localhost",
+			Port:         3306,
+			Charset:      "utf8mb4",
+			ReadTimeout:  2 * time.Minute,
+			WriteTimeout: 2 * time.Minute,
+		},
+		MigrationsLockTimeout: time.Minute,
+		ListMaxLimit:          100,
+		ImportMaxSize:         256 * 1024 * 1024,
+		Argon2:                *password.DefaultParams(),
+		Cache:                 *cache.DefaultSettings(),
+		Tracing:               *tracing.DefaultSettings(),
+		Shutdown:              *lifecycle.DefaultSettings(),
+	}
+}
+
+func (c *apiConfig) Validate() error {
+	if c.Verbosity < 0 || c.Verbosity > 2 {
+		return fmt.Errorf("verbosity must be between 0 and 2")
+	}
+
+	switch c.Database.Driver {
+	case database.DriverMySQL, database.DriverSQLite, database.DriverMemory:
+	default:
+		return fmt.Errorf(`unsupported database driver "%s"`, c.Database.Driver)
+	}
+
+	if c.Migrations == "" {
+		// SQLite is only used for local runs, where the database is
+		// usually created from scratch.
+		c.Migrations = migrationsCheck
+		if c.Database.Driver == database.DriverSQLite {
+			c.Migrations = migrationsUp
+		}
+	}
+
+	if c.Migrations != migrationsCheck && c.Migrations != migrationsUp {
+		return fmt.Errorf(`invalid migrations mode "%s"`, c.Migrations)
+	}
+
+	if c.ListMaxLimit < 1 {
+		return fmt.Errorf("list max limit must be at least 1")
+	}
+
+	if c.ImportMaxSize < 1 {
+		return fmt.Errorf("import max size must be at least 1")
+	}
+
+	if err := c.Argon2.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Cache.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Tracing.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Shutdown.Validate(); err != nil {
+		return err
+	}
+
+	return nil
+}
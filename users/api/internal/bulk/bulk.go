@@ -0,0 +1,274 @@
+// Package bulk imports and exports users in bulk, as newline delimited JSON
+// or as CSV, so that whole communities can be moved in and out.
+package bulk
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"sort"
+	"strings"
+
+	udb "github.com/asimpleidea/ship-krew/users/api/internal/database"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/api"
+	uerrors "github.com/asimpleidea/ship-krew/users/api/pkg/errors"
+)
+
+const (
+	// DefaultBatchSize is how many users are imported in the same
+	// transaction, unless told otherwise.
+	DefaultBatchSize int = 500
+	// MaxBatchSize is the maximum number of users imported in the same
+	// transaction, as all of them are inserted with a single statement.
+	MaxBatchSize int = 1000
+	// exportPageSize is how many users are read at a time while exporting.
+	exportPageSize int = 500
+)
+
+// limitedReader reads from r, failing with errors.ErrImportTooLarge once more than n
+// bytes have been read.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+// LimitReader returns a reader of at most n bytes from r. Unlike
+// io.LimitReader, inputs that are larger fail rather than being cut short,
+// so that they are not imported in part without anyone noticing.
+func LimitReader(r io.Reader, n int64) io.Reader {
+	return &limitedReader{r: r, n: n}
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, uerrors.ErrImportTooLarge
+	}
+
+	// One more byte than allowed is read, to tell whether there is any.
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n + int(l.n), uerrors.ErrImportTooLarge
+	}
+
+	return n, err
+}
+
+// Format is the format users are imported and exported in.
+type Format string
+
+const (
+	FormatNDJSON Format = "ndjson"
+	FormatCSV    Format = "csv"
+)
+
+// ParseFormat returns the format with the provided name or content type.
+func ParseFormat(value string) (Format, error) {
+	if mediaType, _, err := mime.ParseMediaType(value); err == nil {
+		value = mediaType
+	}
+
+	switch strings.ToLower(value) {
+	case string(FormatNDJSON), api.MIMENDJSON:
+		return FormatNDJSON, nil
+	case string(FormatCSV), api.MIMECSV:
+		return FormatCSV, nil
+	default:
+		return "", &uerrors.Error{
+			Code:    uerrors.CodeUnsupportedImportFormat,
+			Message: uerrors.MessageUnsupportedImportFormat,
+			Err:     uerrors.ErrUnsupportedImportFormat,
+		}
+	}
+}
+
+// ContentType returns the content type of the format.
+func (f Format) ContentType() string {
+	if f == FormatCSV {
+		return api.MIMECSV
+	}
+
+	return api.MIMENDJSON
+}
+
+// Reader reads the users to import, one at a time.
+type Reader interface {
+	// Read returns the next user and the line where it starts, or io.EOF
+	// at the end of the input. Users that cannot be read are returned as
+	// an *errors.Error along with their line, and reading can go on after
+	// them: any other error means that the input cannot be read anymore.
+	Read() (*api.ImportedUser, int, error)
+}
+
+// NewReader returns a Reader of users in the provided format. CSV starts
+// with the names of its columns, which are read immediately.
+func NewReader(r io.Reader, format Format) (Reader, error) {
+	if format == FormatCSV {
+		return newCSVReader(r)
+	}
+
+	return newNDJSONReader(r), nil
+}
+
+// Writer writes exported users.
+type Writer interface {
+	Write(user *api.User) error
+	// Flush writes any buffered data, and must be called after the last
+	// user was written.
+	Flush() error
+}
+
+// NewWriter returns a Writer of users in the provided format.
+func NewWriter(w io.Writer, format Format) Writer {
+	if format == FormatCSV {
+		return newCSVWriter(w)
+	}
+
+	return newNDJSONWriter(w)
+}
+
+// Import reads all users from r and imports them in batches of batchSize,
+// each one in its own transaction.
+//
+// Users that cannot be read or imported are reported along with their line,
+// and do not stop the import. An error is only returned if r cannot be read
+// or the store fails: the batches before it are imported nonetheless, and
+// the report tells about them.
+func Import(store udb.UserStore, r Reader, batchSize int, opts *udb.ImportOptions) (*api.ImportReport, error) {
+	if batchSize < 1 || batchSize > MaxBatchSize {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeInvalidImportOptions,
+			Message: uerrors.MessageInvalidImportOptions,
+			Err:     uerrors.ErrInvalidImportOptions,
+		}
+	}
+
+	report := &api.ImportReport{
+		DryRun: opts != nil && opts.DryRun,
+		Errors: []*api.ImportError{},
+	}
+
+	var (
+		batch = make([]*api.ImportedUser, 0, batchSize)
+		lines = make([]int, 0, batchSize)
+	)
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		results, err := store.ImportUsers(batch, opts)
+		if err != nil {
+			return err
+		}
+
+		for i, result := range results {
+			switch {
+			case result.Err != nil:
+				fail(report, lines[i], batch[i].Username, result.Err)
+			case result.Updated:
+				report.Updated++
+			default:
+				report.Created++
+			}
+
+			if result.Rehash {
+				report.Rehash++
+			}
+		}
+
+		batch, lines = batch[:0], lines[:0]
+		return nil
+	}
+
+	for {
+		user, line, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			var uerr *uerrors.Error
+			if !errors.As(err, &uerr) {
+				return report, err
+			}
+
+			fail(report, line, "", uerr)
+			continue
+		}
+
+		batch, lines = append(batch, user), append(lines, line)
+		if len(batch) == batchSize {
+			if err := flush(); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return report, err
+	}
+
+	// Users that cannot be read are reported before the ones of their batch.
+	sort.SliceStable(report.Errors, func(i, j int) bool {
+		return report.Errors[i].Line < report.Errors[j].Line
+	})
+
+	return report, nil
+}
+
+// fail adds a user that could not be imported to report.
+func fail(report *api.ImportReport, line int, username string, err error) {
+	importErr := &api.ImportError{
+		Line:     line,
+		Username: username,
+		Code:     uerrors.CodeInternalServerError,
+		Message:  uerrors.MessageInternalServerError,
+	}
+
+	var uerr *uerrors.Error
+	if errors.As(err, &uerr) {
+		importErr.Code, importErr.Message = uerr.Code, uerr.Message
+	}
+
+	report.Failed++
+	report.Errors = append(report.Errors, importErr)
+}
+
+// Export writes all users that match filters to w, as admins see them, and
+// returns how many were written. Users are read a page at a time, so the
+// page, cursor and limit of filters are not taken into account.
+func Export(store udb.UserStore, filters *udb.ListFilters, w Writer) (int, error) {
+	pageFilters := *filters
+	pageFilters.Role = api.RoleAdmin
+	pageFilters.Page = nil
+	pageFilters.Cursor = ""
+	pageFilters.Limit = exportPageSize
+	pageFilters.WithTotal = false
+
+	written := 0
+	for {
+		list, err := store.ListUsers(&pageFilters)
+		if err != nil {
+			return written, err
+		}
+
+		for _, user := range list.Users {
+			if err := w.Write(user); err != nil {
+				return written, err
+			}
+			written++
+		}
+
+		if !list.HasMore {
+			return written, w.Flush()
+		}
+
+		pageFilters.Cursor = list.NextCursor
+	}
+}
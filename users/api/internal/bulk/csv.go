@@ -0,0 +1,266 @@
+package bulk
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asimpleidea/ship-krew/users/api/pkg/api"
+	uerrors "github.com/asimpleidea/ship-krew/users/api/pkg/errors"
+)
+
+const (
+	// dateLayout is accepted as well as RFC3339 when importing, as it is
+	// how most spreadsheets write dates.
+	dateLayout string = "2006-01-02"
+)
+
+// exportedColumns are the columns of exported CSV, in order. The ones that
+// can be imported have the same name as when they are imported.
+var exportedColumns = []string{
+	"id",
+	"created_at",
+	"updated_at",
+	"deleted_at",
+	"username",
+	"display_name",
+	"email",
+	"email_verified_at",
+	"registration_ip",
+	"bio",
+	"birthday",
+	"version",
+}
+
+// importedColumns sets the field of a user to import from the value of its
+// column, which is never empty: empty values mean that the field is not
+// set.
+var importedColumns = map[string]func(u *api.ImportedUser, value string) error{
+	"username": func(u *api.ImportedUser, value string) error {
+		u.Username = value
+		return nil
+	},
+	"display_name": func(u *api.ImportedUser, value string) error {
+		u.DisplayName = value
+		return nil
+	},
+	"email": func(u *api.ImportedUser, value string) error {
+		u.Email = value
+		return nil
+	},
+	"password": func(u *api.ImportedUser, value string) error {
+		u.Password = &value
+		return nil
+	},
+	"password_hash": func(u *api.ImportedUser, value string) error {
+		u.PasswordHash = value
+		return nil
+	},
+	"password_salt": func(u *api.ImportedUser, value string) error {
+		u.PasswordSalt = value
+		return nil
+	},
+	"registration_ip": func(u *api.ImportedUser, value string) error {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return fmt.Errorf("invalid registration_ip %q", value)
+		}
+
+		u.RegistrationIP = &ip
+		return nil
+	},
+	"bio": func(u *api.ImportedUser, value string) error {
+		u.Bio = &value
+		return nil
+	},
+	"birthday": func(u *api.ImportedUser, value string) (err error) {
+		u.Birthday, err = parseTime("birthday", value)
+		return
+	},
+	"created_at": func(u *api.ImportedUser, value string) (err error) {
+		u.CreatedAt, err = parseTime("created_at", value)
+		return
+	},
+	"email_verified_at": func(u *api.ImportedUser, value string) (err error) {
+		u.EmailVerifiedAt, err = parseTime("email_verified_at", value)
+		return
+	},
+}
+
+func parseTime(column, value string) (*time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		if t, err = time.Parse(dateLayout, value); err != nil {
+			return nil, fmt.Errorf("invalid %s %q", column, value)
+		}
+	}
+
+	return &t, nil
+}
+
+// csvReader reads a user from each row, by the names of the columns in the
+// first one. Columns that are not known, i.e. the ID of exported users, are
+// ignored.
+type csvReader struct {
+	reader *csv.Reader
+	// columns are the names of the columns, in order, or empty for the ones
+	// that are ignored.
+	columns []string
+}
+
+func newCSVReader(r io.Reader) (*csvReader, error) {
+	reader := csv.NewReader(r)
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = errors.New("missing header")
+		}
+
+		return nil, invalidRow(err)
+	}
+
+	// Rows with a different number of fields fail on their own.
+	reader.FieldsPerRecord = len(header)
+
+	columns := make([]string, len(header))
+	seen := map[string]bool{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if i == 0 {
+			// Some editors start files with a byte order mark.
+			name = strings.TrimPrefix(name, "\ufeff")
+		}
+
+		if _, known := importedColumns[name]; !known {
+			continue
+		}
+
+		if seen[name] {
+			return nil, invalidRow(fmt.Errorf("duplicate column %s", name))
+		}
+
+		seen[name] = true
+		columns[i] = name
+	}
+
+	if !seen["username"] {
+		return nil, invalidRow(errors.New("missing username column"))
+	}
+
+	return &csvReader{reader: reader, columns: columns}, nil
+}
+
+func (r *csvReader) Read() (*api.ImportedUser, int, error) {
+	record, err := r.reader.Read()
+	line, _ := r.reader.FieldPos(0)
+
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, parseErr.StartLine, invalidRow(parseErr.Err)
+		}
+
+		return nil, line, err
+	}
+
+	user := &api.ImportedUser{}
+	for i, value := range record {
+		if r.columns[i] == "" || value == "" {
+			continue
+		}
+
+		if err := importedColumns[r.columns[i]](user, value); err != nil {
+			return nil, line, invalidRow(err)
+		}
+	}
+
+	return user, line, nil
+}
+
+// csvWriter writes each user on its own row, after the header.
+type csvWriter struct {
+	writer *csv.Writer
+	header bool
+	record []string
+}
+
+func newCSVWriter(w io.Writer) *csvWriter {
+	return &csvWriter{
+		writer: csv.NewWriter(w),
+		record: make([]string, len(exportedColumns)),
+	}
+}
+
+func (w *csvWriter) writeHeader() error {
+	if w.header {
+		return nil
+	}
+
+	w.header = true
+	return w.writer.Write(exportedColumns)
+}
+
+func (w *csvWriter) Write(user *api.User) error {
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+
+	w.record[0] = strconv.FormatInt(user.ID, 10)
+	w.record[1] = user.CreatedAt.Format(time.RFC3339)
+	w.record[2] = formatTime(user.UpdatedAt)
+	w.record[3] = formatTime(user.DeletedAt)
+	w.record[4] = user.Username
+	w.record[5] = user.DisplayName
+	w.record[6] = formatString(user.Email)
+	w.record[7] = formatTime(user.EmailVerifiedAt)
+	w.record[8] = ""
+	if user.RegistrationIP != nil {
+		w.record[8] = user.RegistrationIP.String()
+	}
+	w.record[9] = formatString(user.Bio)
+	w.record[10] = formatTime(user.Birthday)
+	w.record[11] = strconv.FormatInt(user.Version, 10)
+
+	return w.writer.Write(w.record)
+}
+
+func (w *csvWriter) Flush() error {
+	// Even exports without users have a header.
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+
+	return t.Format(time.RFC3339)
+}
+
+func formatString(s *string) string {
+	if s == nil {
+		return ""
+	}
+
+	return *s
+}
+
+func invalidRow(err error) error {
+	return &uerrors.Error{
+		Code:    uerrors.CodeInvalidImportRow,
+		Message: fmt.Sprintf("%s %s", uerrors.MessageInvalidImportRow, err.Error()),
+		Err:     uerrors.ErrInvalidImportRow,
+	}
+}
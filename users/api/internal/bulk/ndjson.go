@@ -0,0 +1,71 @@
+package bulk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/asimpleidea/ship-krew/users/api/pkg/api"
+)
+
+// maxLineSize is the maximum size of a line of NDJSON, which is way more
+// than any valid user needs.
+const maxLineSize int = 1024 * 1024
+
+// ndjsonReader reads a user from each line, skipping empty ones. Fields
+// that are not known, i.e. the ID of exported users, are ignored.
+type ndjsonReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func newNDJSONReader(r io.Reader) *ndjsonReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+
+	return &ndjsonReader{scanner: scanner}
+}
+
+func (r *ndjsonReader) Read() (*api.ImportedUser, int, error) {
+	for r.scanner.Scan() {
+		r.line++
+
+		line := bytes.TrimSpace(r.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var user api.ImportedUser
+		if err := json.Unmarshal(line, &user); err != nil {
+			return nil, r.line, invalidRow(err)
+		}
+
+		return &user, r.line, nil
+	}
+
+	if err := r.scanner.Err(); err != nil {
+		return nil, r.line + 1, err
+	}
+
+	return nil, r.line, io.EOF
+}
+
+// ndjsonWriter writes each user on its own line, as the API returns it.
+type ndjsonWriter struct {
+	writer  *bufio.Writer
+	encoder *json.Encoder
+}
+
+func newNDJSONWriter(w io.Writer) *ndjsonWriter {
+	writer := bufio.NewWriter(w)
+	return &ndjsonWriter{writer: writer, encoder: json.NewEncoder(writer)}
+}
+
+func (w *ndjsonWriter) Write(user *api.User) error {
+	return w.encoder.Encode(user)
+}
+
+func (w *ndjsonWriter) Flush() error {
+	return w.writer.Flush()
+}
@@ -0,0 +1,86 @@
+// Package cache keeps values for a while, in memory or in Redis, so that
+// the users API does not need to query the database for each lookup.
+package cache
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// BackendNone does not cache anything.
+	BackendNone string = "none"
+	// BackendMemory caches in the memory of each replica.
+	BackendMemory string = "memory"
+	// BackendRedis caches in Redis, and is shared by all replicas.
+	BackendRedis string = "redis"
+)
+
+// Cache is implemented by every backend that is able to keep values for a
+// while. Values must not be modified after they are set or returned.
+type Cache interface {
+	// Get returns the value of key, and false if it is not cached or it
+	// has expired.
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, keys ...string) error
+}
+
+// Settings contains the options used to cache users.
+type Settings struct {
+	Backend     string        `yaml:"backend" flag:"backend" usage:"where users are cached: none, memory or redis. Use redis with more than one replica, as changes are only forgotten by the replica that makes them with memory"`
+	TTL         time.Duration `yaml:"ttl" flag:"ttl" usage:"how long users are cached"`
+	NegativeTTL time.Duration `yaml:"negativeTtl" flag:"negative-ttl" usage:"how long lookups of users that do not exist are cached"`
+	Size        int           `yaml:"size" flag:"size" usage:"how many entries the memory backend keeps"`
+	Redis       RedisSettings `yaml:"redis" flag:"redis"`
+}
+
+// RedisSettings contains the options used to connect to Redis.
+type RedisSettings struct {
+	Endpoints string `yaml:"endpoints" flag:"endpoints" usage:"the host:port of redis"`
+	Password  string `yaml:"password" flag:"password" secret:"true" usage:"authentication password for redis"`
+	DB        int    `yaml:"db" flag:"db" usage:"the redis database to use"`
+}
+
+// DefaultSettings returns settings that do not cache anything.
+func DefaultSettings() *Settings {
+	return &Settings{
+		Backend:     BackendNone,
+		TTL:         time.Minute,
+		NegativeTTL: 10 * time.Second,
+		Size:        10000,
+		Redis: RedisSettings{
+			Endpoints: "localhost:6379",
+		},
+	}
+}
+
+// Validate returns an error if the settings cannot be used.
+func (s *Settings) Validate() error {
+	switch s.Backend {
+	case BackendNone:
+		return nil
+	case BackendMemory:
+		if s.Size <= 0 {
+			return fmt.Errorf("cache size must be positive")
+		}
+	case BackendRedis:
+		if s.Redis.Endpoints == "" {
+			return fmt.Errorf("no redis endpoints set for the cache")
+		}
+	default:
+		return fmt.Errorf(`unknown cache backend "%s"`, s.Backend)
+	}
+
+	if s.TTL <= 0 || s.NegativeTTL <= 0 {
+		return fmt.Errorf("cache ttls must be positive")
+	}
+
+	return nil
+}
+
+var (
+	_ Cache = (*Memory)(nil)
+	_ Cache = (*Redis)(nil)
+)
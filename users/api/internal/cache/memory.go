@@ -0,0 +1,91 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// Memory is a Cache that keeps the most recently used values in memory, up
+// to Size of them.
+type Memory struct {
+	Size int
+
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	// recent has the most recently used entries first.
+	recent *list.List
+}
+
+type memoryEntry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+func (m *Memory) Get(_ context.Context, key string) ([]byte, bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	elem, exists := m.entries[key]
+	if !exists {
+		return nil, false, nil
+	}
+
+	entry := elem.Value.(*memoryEntry)
+	if !time.Now().Before(entry.expiresAt) {
+		m.remove(elem)
+		return nil, false, nil
+	}
+
+	m.recent.MoveToFront(elem)
+	return entry.value, true, nil
+}
+
+func (m *Memory) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.entries == nil {
+		m.entries = map[string]*list.Element{}
+		m.recent = list.New()
+	}
+
+	entry := &memoryEntry{
+		key:       key,
+		value:     value,
+		expiresAt: time.Now().Add(ttl),
+	}
+
+	if elem, exists := m.entries[key]; exists {
+		elem.Value = entry
+		m.recent.MoveToFront(elem)
+		return nil
+	}
+
+	m.entries[key] = m.recent.PushFront(entry)
+	for m.Size > 0 && m.recent.Len() > m.Size {
+		m.remove(m.recent.Back())
+	}
+
+	return nil
+}
+
+func (m *Memory) Delete(_ context.Context, keys ...string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, key := range keys {
+		if elem, exists := m.entries[key]; exists {
+			m.remove(elem)
+		}
+	}
+
+	return nil
+}
+
+func (m *Memory) remove(elem *list.Element) {
+	m.recent.Remove(elem)
+	delete(m.entries, elem.Value.(*memoryEntry).key)
+}
@@ -0,0 +1,100 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// expectValue fails t if key is not cached with value, or if it is cached
+// while value is empty.
+func expectValue(t *testing.T, cache Cache, key, value string) {
+	t.Helper()
+
+	found, exists, err := cache.Get(context.Background(), key)
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case value == "" && exists:
+		t.Fatalf("%s is cached as %q, expected it not to be", key, found)
+	case value != "" && string(found) != value:
+		t.Fatalf("%s is cached as %q (%t), expected %q", key, found, exists, value)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	ctx := context.Background()
+	cache := &Memory{Size: 10}
+
+	expectValue(t, cache, "a", "")
+
+	if err := cache.Set(ctx, "a", []byte("first"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, cache, "a", "first")
+
+	if err := cache.Set(ctx, "a", []byte("second"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, cache, "a", "second")
+
+	if err := cache.Set(ctx, "b", []byte("b"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cache.Delete(ctx, "a", "b", "missing"); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, cache, "a", "")
+	expectValue(t, cache, "b", "")
+}
+
+func TestMemoryExpires(t *testing.T) {
+	ctx := context.Background()
+	cache := &Memory{Size: 10}
+
+	if err := cache.Set(ctx, "short", []byte("short"), time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cache.Set(ctx, "long", []byte("long"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	expectValue(t, cache, "short", "")
+	expectValue(t, cache, "long", "long")
+
+	if len(cache.entries) != 1 {
+		t.Fatalf("%d entries are kept, expected 1", len(cache.entries))
+	}
+}
+
+func TestMemoryEvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	cache := &Memory{Size: 2}
+
+	for _, key := range []string{"a", "b"} {
+		if err := cache.Set(ctx, key, []byte(key), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Getting a makes b the least recently used.
+	expectValue(t, cache, "a", "a")
+
+	if err := cache.Set(ctx, "c", []byte("c"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	expectValue(t, cache, "b", "")
+	expectValue(t, cache, "a", "a")
+	expectValue(t, cache, "c", "c")
+
+	// Overwriting does not evict anything.
+	if err := cache.Set(ctx, "a", []byte("another a"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, cache, "c", "c")
+	expectValue(t, cache, "a", "another a")
+}
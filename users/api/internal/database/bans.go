@@ -0,0 +1,219 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/asimpleidea/ship-krew/users/api/pkg/api"
+	uerrors "github.com/asimpleidea/ship-krew/users/api/pkg/errors"
+	"gorm.io/gorm"
+)
+
+const (
+	bansTable          string = "bans"
+	maxBanReasonLength int    = 500
+)
+
+// Ban is a ban or a suspension of a user. Bans are never deleted, unless
+// the user is hard deleted: they expire, or they are lifted.
+type Ban struct {
+	ID        int64         `gorm:"primarykey;<-:create"`
+	UserID    int64         `gorm:"index;<-:create"`
+	Scope     string        `gorm:"size:20;<-:create"`
+	Reason    string        `gorm:"size:500;<-:create"`
+	IssuedBy  sql.NullInt64 `gorm:"<-:create"`
+	Caller    string        `gorm:"size:100;<-:create"`
+	CreatedAt time.Time     `gorm:"<-:create"`
+	StartsAt  time.Time     `gorm:"index;<-:create"`
+	ExpiresAt sql.NullTime  `gorm:"index;<-:create"`
+	LiftedAt  sql.NullTime
+	LiftedBy  sql.NullInt64
+}
+
+func (Ban) TableName() string {
+	return bansTable
+}
+
+func (b *Ban) ToApiBan() *api.Ban {
+	nullInt64 := func(val sql.NullInt64) *int64 {
+		if !val.Valid {
+			return nil
+		}
+
+		return &val.Int64
+	}
+
+	nullTime := func(val sql.NullTime) *time.Time {
+		if !val.Valid {
+			return nil
+		}
+
+		return &val.Time
+	}
+
+	return &api.Ban{
+		ID:        b.ID,
+		UserID:    b.UserID,
+		Scope:     api.BanScope(b.Scope),
+		Reason:    b.Reason,
+		IssuedBy:  nullInt64(b.IssuedBy),
+		Caller:    b.Caller,
+		CreatedAt: b.CreatedAt,
+		StartsAt:  b.StartsAt,
+		ExpiresAt: nullTime(b.ExpiresAt),
+		LiftedAt:  nullTime(b.LiftedAt),
+		LiftedBy:  nullInt64(b.LiftedBy),
+	}
+}
+
+func validateBanID(id int64) error {
+	if id <= 0 {
+		return &uerrors.Error{
+			Code:    uerrors.CodeInvalidBanID,
+			Message: uerrors.MessageInvalidBanID,
+			Err:     uerrors.ErrInvalidBanID,
+		}
+	}
+
+	return nil
+}
+
+// newBan validates ban and returns the model to store, issued by actor at
+// the provided time. If ban has no start, it starts immediately.
+func newBan(userID int64, ban *api.Ban, actor *Actor, at time.Time) (*Ban, error) {
+	if ban == nil {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeEmptyBody,
+			Message: uerrors.MessageEmptyBody,
+			Err:     uerrors.ErrEmptyBody,
+		}
+	}
+
+	if !ban.Scope.IsValid() {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeInvalidBanScope,
+			Message: uerrors.MessageInvalidBanScope,
+			Err:     uerrors.ErrInvalidBanScope,
+		}
+	}
+
+	if ban.Reason == "" {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeEmptyBanReason,
+			Message: uerrors.MessageEmptyBanReason,
+			Err:     uerrors.ErrEmptyBanReason,
+		}
+	}
+
+	if len(ban.Reason) > maxBanReasonLength {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeBanReasonTooLong,
+			Message: uerrors.MessageBanReasonTooLong,
+			Err:     uerrors.ErrBanReasonTooLong,
+		}
+	}
+
+	created := &Ban{
+		UserID:    userID,
+		Scope:     string(ban.Scope),
+		Reason:    ban.Reason,
+		CreatedAt: at,
+		StartsAt:  ban.StartsAt,
+	}
+
+	if created.StartsAt.IsZero() {
+		created.StartsAt = at
+	}
+
+	if ban.ExpiresAt != nil {
+		if !ban.ExpiresAt.After(created.StartsAt) {
+			return nil, &uerrors.Error{
+				Code:    uerrors.CodeInvalidBanExpiry,
+				Message: uerrors.MessageInvalidBanExpiry,
+				Err:     uerrors.ErrInvalidBanExpiry,
+			}
+		}
+
+		created.ExpiresAt = sql.NullTime{Time: *ban.ExpiresAt, Valid: true}
+	}
+
+	if actor != nil {
+		created.Caller = actor.Caller
+		if actor.UserID != 0 {
+			created.IssuedBy = sql.NullInt64{Int64: actor.UserID, Valid: true}
+		}
+	}
+
+	return created, nil
+}
+
+// lift marks the ban as lifted by actor at the provided time.
+func (b *Ban) lift(actor *Actor, at time.Time) error {
+	if b.LiftedAt.Valid {
+		return &uerrors.Error{
+			Code:    uerrors.CodeBanAlreadyLifted,
+			Message: uerrors.MessageBanAlreadyLifted,
+			Err:     uerrors.ErrBanAlreadyLifted,
+		}
+	}
+
+	b.LiftedAt = sql.NullTime{Time: at, Valid: true}
+	if actor != nil && actor.UserID != 0 {
+		b.LiftedBy = sql.NullInt64{Int64: actor.UserID, Valid: true}
+	}
+
+	return nil
+}
+
+// activeBans only selects the bans in effect at the provided time: this is
+// how bans expire, as nothing needs to be updated.
+func activeBans(at time.Time) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.
+			Where("lifted_at IS NULL AND starts_at <= ?", at).
+			Where("expires_at IS NULL OR expires_at > ?", at)
+	}
+}
+
+// stronger returns true if a should be shown in place of b as the current
+// ban: account bans win over other scopes, then the one that lasts longer.
+func stronger(a, b *api.Ban) bool {
+	if a.Scope != b.Scope {
+		return a.Scope == api.BanScopeAccount
+	}
+
+	switch {
+	case a.ExpiresAt == nil:
+		return b.ExpiresAt != nil
+	case b.ExpiresAt == nil:
+		return false
+	default:
+		return a.ExpiresAt.After(*b.ExpiresAt)
+	}
+}
+
+// attachBans sets the current ban of each user among the provided bans,
+// which are expected to be active. Users are expected to be projected
+// already: bans are only set if role can see them.
+func attachBans(users []*api.User, bans []*Ban, role api.Role) {
+	if !role.CanSee(api.FieldBan) {
+		return
+	}
+
+	byUser := map[int64]*api.User{}
+	for _, user := range users {
+		byUser[user.ID] = user
+	}
+
+	for _, ban := range bans {
+		user, exists := byUser[ban.UserID]
+		if !exists {
+			continue
+		}
+
+		current := ban.ToApiBan()
+		if user.Ban == nil || stronger(current, user.Ban) {
+			user.Ban = current
+		}
+	}
+}
@@ -0,0 +1,615 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asimpleidea/ship-krew/users/api/internal/cache"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/api"
+	uerrors "github.com/asimpleidea/ship-krew/users/api/pkg/errors"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	cacheKindID       string = "id"
+	cacheKindUsername string = "username"
+	cacheKindEmail    string = "email"
+
+	cacheHit   string = "hit"
+	cacheMiss  string = "miss"
+	cacheError string = "error"
+
+	// changedPrefix starts the value cached in place of a user that
+	// changed, followed by the version it changed to.
+	changedPrefix string = "changed:"
+	// flightTimeout is how long a lookup shared by concurrent callers can
+	// take, as it does not end with the request that started it.
+	flightTimeout time.Duration = 30 * time.Second
+)
+
+var cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metrics.Namespace,
+	Subsystem: "api",
+	Name:      "cache_lookups_total",
+	Help:      "The number of users looked up in the cache, by what they were looked up by and whether they were found, including the ones known not to exist.",
+}, []string{"kind", "result"})
+
+// Cached is a UserStore that keeps the users looked up by ID, username or
+// email in a cache, in front of another UserStore, and forgets them when
+// they change. Users that do not exist are cached too, for a shorter time.
+//
+// Only users that are not deleted are cached, as they are seen by admins:
+// each caller gets its own projection. Lists, except the ones of a single
+// email, histories, bans and credentials always come from the store.
+//
+// Changed users are replaced by the version they changed to, rather than
+// just forgotten, and users are only cached if they are not older than what
+// is cached already: lookups that race with a change do not cache the user
+// as it was before. Users replaced by imports are just forgotten, as their
+// version is not known.
+type Cached struct {
+	Store       UserStore
+	Cache       cache.Cache
+	TTL         time.Duration
+	NegativeTTL time.Duration
+	Logger      zerolog.Logger
+
+	ctx context.Context
+	// flight makes concurrent lookups of the same user wait for a single
+	// query, rather than all querying the store when it is not cached.
+	flight *singleflight.Group
+}
+
+// NewCached returns a Cached in front of store.
+func NewCached(store UserStore, c cache.Cache, settings *cache.Settings, log zerolog.Logger) *Cached {
+	return &Cached{
+		Store:       store,
+		Cache:       c,
+		TTL:         settings.TTL,
+		NegativeTTL: settings.NegativeTTL,
+		Logger:      log,
+		ctx:         context.Background(),
+		flight:      &singleflight.Group{},
+	}
+}
+
+func (c *Cached) WithContext(ctx context.Context) UserStore {
+	return c.withContext(ctx)
+}
+
+func (c *Cached) withContext(ctx context.Context) *Cached {
+	return &Cached{
+		Store:       c.Store.WithContext(ctx),
+		Cache:       c.Cache,
+		TTL:         c.TTL,
+		NegativeTTL: c.NegativeTTL,
+		Logger:      c.Logger,
+		ctx:         ctx,
+		flight:      c.flight,
+	}
+}
+
+func (c *Cached) GetUserByID(id int64, opts *GetOptions) (*api.User, error) {
+	if opts.includeDeleted() {
+		return c.Store.GetUserByID(id, opts)
+	}
+
+	if err := validateUserID(id); err != nil {
+		return nil, err
+	}
+
+	user, err := c.userByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return user.Project(opts.role()), nil
+}
+
+func (c *Cached) GetUserByUsername(username string, opts *GetOptions) (*api.User, error) {
+	if opts.includeDeleted() {
+		return c.Store.GetUserByUsername(username, opts)
+	}
+
+	if err := validateUsername(username); err != nil {
+		return nil, err
+	}
+
+	key := usernameCacheKey(username)
+	if value, cached := c.get(cacheKindUsername, key); cached {
+		if len(value) == 0 {
+			return nil, userNotFound()
+		}
+
+		if id, err := strconv.ParseInt(string(value), 10, 64); err == nil {
+			user, err := c.userByID(id)
+			if err != nil {
+				return nil, err
+			}
+
+			// In case a rename raced with the lookup that cached it.
+			if strings.EqualFold(user.Username, username) {
+				return user.Project(opts.role()), nil
+			}
+		}
+	}
+
+	found, err := c.share(key, func(c *Cached) (*api.User, error) {
+		user, err := c.Store.GetUserByUsername(username, &GetOptions{Role: api.RoleAdmin})
+		switch {
+		case err == nil:
+			c.set(key, []byte(strconv.FormatInt(user.ID, 10)), c.TTL)
+			c.setUser(user)
+		case errors.Is(err, uerrors.ErrUserNotFound):
+			c.set(key, []byte{}, c.NegativeTTL)
+		}
+
+		return user, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return found.Project(opts.role()), nil
+}
+
+// userByID returns the user as admins see it, from the cache if possible.
+func (c *Cached) userByID(id int64) (*api.User, error) {
+	key := idCacheKey(id)
+	if value, cached := c.get(cacheKindID, key); cached {
+		if len(value) == 0 {
+			return nil, userNotFound()
+		}
+
+		var user api.User
+		err := json.Unmarshal(value, &user)
+		switch {
+		case err != nil:
+			c.Logger.Err(err).Str("key", key).Msg("could not decode cached user")
+		case user.Ban != nil && !user.Ban.IsActive(time.Now()):
+			// The ban expired while the user was cached.
+		default:
+			return &user, nil
+		}
+	}
+
+	return c.share(key, func(c *Cached) (*api.User, error) {
+		user, err := c.Store.GetUserByID(id, &GetOptions{Role: api.RoleAdmin})
+		switch {
+		case err == nil:
+			c.setUser(user)
+		case errors.Is(err, uerrors.ErrUserNotFound) && c.cachedVersion(id) == 0:
+			// Unless it was restored while it was looked up.
+			c.set(key, []byte{}, c.NegativeTTL)
+		}
+
+		return user, err
+	})
+}
+
+// userByEmail returns the user with email as admins see it, from the cache
+// if possible.
+func (c *Cached) userByEmail(email string) (*api.User, error) {
+	key := emailCacheKey(email)
+	if value, cached := c.get(cacheKindEmail, key); cached {
+		if len(value) == 0 {
+			return nil, userNotFound()
+		}
+
+		if id, err := strconv.ParseInt(string(value), 10, 64); err == nil {
+			user, err := c.userByID(id)
+			if err != nil {
+				return nil, err
+			}
+
+			// In case a change of email raced with the lookup that cached it.
+			if user.Email != nil && strings.EqualFold(*user.Email, email) {
+				return user, nil
+			}
+		}
+	}
+
+	return c.share(key, func(c *Cached) (*api.User, error) {
+		list, err := c.Store.ListUsers(&ListFilters{
+			EmailIn: []string{email},
+			Limit:   1,
+			Role:    api.RoleAdmin,
+		})
+		switch {
+		case err != nil:
+			return nil, err
+		case len(list.Users) == 0:
+			c.set(key, []byte{}, c.NegativeTTL)
+			return nil, userNotFound()
+		}
+
+		user := list.Users[0]
+		c.set(key, []byte(strconv.FormatInt(user.ID, 10)), c.TTL)
+		c.setUser(user)
+		return user, nil
+	})
+}
+
+func (c *Cached) CreateUser(user *api.User) (*api.User, error) {
+	var email string
+	if user.Email != nil {
+		email = *user.Email
+	}
+
+	created, err := c.Store.CreateUser(user)
+	if err != nil {
+		return nil, err
+	}
+
+	// It may have been looked up before it existed.
+	c.forget(usernameCacheKey(created.Username), emailCacheKey(email))
+	return created, nil
+}
+
+// ListUsers serves lists of the user with a single email, i.e. the ones to
+// find who forgot their password, from the cache like lookups by username.
+func (c *Cached) ListUsers(filters *ListFilters) (*api.UserList, error) {
+	email, single := singleEmail(filters)
+	if !single {
+		return c.Store.ListUsers(filters)
+	}
+
+	if err := filters.validate(); err != nil {
+		return nil, err
+	}
+
+	if _, _, err := filters.pagination(); err != nil {
+		return nil, err
+	}
+
+	list := &api.UserList{Users: []*api.User{}}
+
+	user, err := c.userByEmail(email)
+	switch {
+	case err == nil:
+		list.Users = append(list.Users, user.Project(filters.Role))
+	case !errors.Is(err, uerrors.ErrUserNotFound):
+		return nil, err
+	}
+
+	return list, nil
+}
+
+func (c *Cached) UpdateUser(id int64, patch *api.UserPatch, actor *Actor, version int64) (*api.User, error) {
+	before, err := c.userByID(id)
+	if err != nil {
+		return c.Store.UpdateUser(id, patch, actor, version)
+	}
+
+	updated, err := c.Store.UpdateUser(id, patch, actor, version)
+	if err != nil {
+		return nil, err
+	}
+
+	// Both the old username and email, which now belong to nobody, and the
+	// new ones, which may have been looked up before they were taken.
+	c.changed(id, updated.Version,
+		usernameCacheKey(before.Username),
+		usernameCacheKey(updated.Username),
+		emailCacheKey(stringOrEmpty(before.Email)),
+		emailCacheKey(stringOrEmpty(updated.Email)))
+	return updated, nil
+}
+
+func (c *Cached) DeleteUser(id int64, hardDelete bool, version int64) error {
+	var (
+		keys   = []string{}
+		latest int64
+	)
+	if before, err := c.userByID(id); err == nil {
+		keys = append(keys, usernameCacheKey(before.Username), emailCacheKey(stringOrEmpty(before.Email)))
+		latest = before.Version
+	}
+
+	if err := c.Store.DeleteUser(id, hardDelete, version); err != nil {
+		return err
+	}
+
+	c.changed(id, nextVersion(latest), keys...)
+	return nil
+}
+
+func (c *Cached) RestoreUser(id int64) (*api.User, error) {
+	restored, err := c.Store.RestoreUser(id)
+	if err != nil {
+		return nil, err
+	}
+
+	c.changed(id, restored.Version, usernameCacheKey(restored.Username), emailCacheKey(stringOrEmpty(restored.Email)))
+	return restored, nil
+}
+
+func (c *Cached) GetUserHistory(id int64, opts *HistoryOptions) (*api.UserHistory, error) {
+	return c.Store.GetUserHistory(id, opts)
+}
+
+func (c *Cached) SetPassword(id int64, pwd string) error {
+	latest := c.versionOf(id)
+	if err := c.Store.SetPassword(id, pwd); err != nil {
+		return err
+	}
+
+	c.changed(id, nextVersion(latest))
+	return nil
+}
+
+func (c *Cached) VerifyEmail(id int64, email string) (*api.User, error) {
+	verified, err := c.Store.VerifyEmail(id, email)
+	if err != nil {
+		return nil, err
+	}
+
+	c.changed(id, verified.Version)
+	return verified, nil
+}
+
+func (c *Cached) IssueBan(userID int64, ban *api.Ban, actor *Actor) (*api.Ban, error) {
+	latest := c.versionOf(userID)
+	issued, err := c.Store.IssueBan(userID, ban, actor)
+	if err != nil {
+		return nil, err
+	}
+
+	c.changed(userID, nextVersion(latest))
+	return issued, nil
+}
+
+func (c *Cached) ListBans(userID int64, activeOnly bool) (*api.BanList, error) {
+	return c.Store.ListBans(userID, activeOnly)
+}
+
+func (c *Cached) LiftBan(userID, banID int64, actor *Actor) (*api.Ban, error) {
+	latest := c.versionOf(userID)
+	lifted, err := c.Store.LiftBan(userID, banID, actor)
+	if err != nil {
+		return nil, err
+	}
+
+	c.changed(userID, nextVersion(latest))
+	return lifted, nil
+}
+
+func (c *Cached) ImportUsers(users []*api.ImportedUser, opts *ImportOptions) ([]*ImportResult, error) {
+	results, err := c.Store.ImportUsers(users, opts)
+	if err != nil || (opts != nil && opts.DryRun) {
+		return results, err
+	}
+
+	// Replaced users keep their username, except for its case, and created
+	// ones may have been looked up before they existed. Lookups by the old
+	// email of replaced users notice that it changed, as they are forgotten.
+	keys := []string{}
+	for i, result := range results {
+		if result.Err != nil {
+			continue
+		}
+
+		keys = append(keys, usernameCacheKey(users[i].Username), emailCacheKey(users[i].Email))
+		if result.Updated {
+			keys = append(keys, idCacheKey(result.ID))
+		}
+	}
+
+	if len(keys) > 0 {
+		c.forget(keys...)
+	}
+
+	return results, nil
+}
+
+func (c *Cached) VerifyCredentialsByID(id int64, pwd string) (*api.CredentialsVerification, error) {
+	return c.Store.VerifyCredentialsByID(id, pwd)
+}
+
+func (c *Cached) VerifyCredentialsByUsername(username, pwd string) (*api.CredentialsVerification, error) {
+	return c.Store.VerifyCredentialsByUsername(username, pwd)
+}
+
+// get returns the cached value of key. Errors of the cache are logged and
+// count as misses, so that users are still served from the store when the
+// cache is down.
+func (c *Cached) get(kind, key string) ([]byte, bool) {
+	value, cached, err := c.Cache.Get(c.ctx, key)
+	switch {
+	case err != nil:
+		c.Logger.Err(err).Str("key", key).Msg("could not get user from cache")
+		cacheLookups.WithLabelValues(kind, cacheError).Inc()
+	case cached && bytes.HasPrefix(value, []byte(changedPrefix)):
+		// The user changed, and it was not looked up since.
+		cacheLookups.WithLabelValues(kind, cacheMiss).Inc()
+		return nil, false
+	case cached:
+		cacheLookups.WithLabelValues(kind, cacheHit).Inc()
+	default:
+		cacheLookups.WithLabelValues(kind, cacheMiss).Inc()
+	}
+
+	return value, cached
+}
+
+// cachedVersion returns the version of the user with id that is cached, or
+// the one it changed to, or 0 if neither is.
+func (c *Cached) cachedVersion(id int64) int64 {
+	value, cached, err := c.Cache.Get(c.ctx, idCacheKey(id))
+	if err != nil || !cached || len(value) == 0 {
+		return 0
+	}
+
+	if bytes.HasPrefix(value, []byte(changedPrefix)) {
+		version, _ := strconv.ParseInt(string(value[len(changedPrefix):]), 10, 64)
+		return version
+	}
+
+	var user struct {
+		Version int64 `json:"version"`
+	}
+	if err := json.Unmarshal(value, &user); err != nil {
+		return 0
+	}
+
+	return user.Version
+}
+
+// versionOf returns the version of the user with id, before a change that
+// does not return it, or 0 if it cannot be found.
+func (c *Cached) versionOf(id int64) int64 {
+	user, err := c.userByID(id)
+	if err != nil {
+		return 0
+	}
+
+	return user.Version
+}
+
+// share runs lookup once for all callers looking up key at the same time,
+// and returns a copy of the user to each one of them. The lookup has a
+// context of its own, with the values of the one of the first caller, so
+// that callers giving up do not make the others fail.
+func (c *Cached) share(key string, lookup func(c *Cached) (*api.User, error)) (*api.User, error) {
+	found, err, _ := c.flight.Do(key, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(detachedContext{c.ctx}, flightTimeout)
+		defer cancel()
+
+		user, err := lookup(c.withContext(ctx))
+		return user, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return found.(*api.User).Clone(), nil
+}
+
+func (c *Cached) set(key string, value []byte, ttl time.Duration) {
+	if err := c.Cache.Set(c.ctx, key, value, ttl); err != nil {
+		c.Logger.Err(err).Str("key", key).Msg("could not cache user")
+	}
+}
+
+// setUser caches user, unless a later version of it is cached already or it
+// changed since, i.e. if it was looked up before it changed.
+func (c *Cached) setUser(user *api.User) {
+	if c.cachedVersion(user.ID) > user.Version {
+		return
+	}
+
+	value, err := json.Marshal(user)
+	if err != nil {
+		c.Logger.Err(err).Int64("user-id", user.ID).Msg("could not encode user to cache")
+		return
+	}
+
+	c.set(idCacheKey(user.ID), value, c.TTL)
+}
+
+// changed replaces the user with id by the version it changed to, so that
+// lookups that started before the change do not cache it, and forgets
+// keys. If the version is not known, i.e. 0, the user is forgotten too.
+func (c *Cached) changed(id, version int64, keys ...string) {
+	if version > 0 {
+		c.set(idCacheKey(id), []byte(changedPrefix+strconv.FormatInt(version, 10)), c.TTL)
+	} else {
+		keys = append(keys, idCacheKey(id))
+	}
+
+	if len(keys) > 0 {
+		c.forget(keys...)
+	}
+}
+
+// forget removes keys from the cache. If that fails, they are served until
+// they expire.
+func (c *Cached) forget(keys ...string) {
+	if err := c.Cache.Delete(c.ctx, keys...); err != nil {
+		c.Logger.Err(err).Strs("keys", keys).Msg("could not remove users from cache")
+	}
+}
+
+func idCacheKey(id int64) string {
+	return "users:id:" + strconv.FormatInt(id, 10)
+}
+
+// usernameCacheKey returns the key of the ID of the user with username,
+// which is case-insensitive like in the database.
+func usernameCacheKey(username string) string {
+	return "users:username:" + strings.ToLower(username)
+}
+
+// emailCacheKey returns the key of the ID of the user with email, which is
+// case-insensitive like in the database.
+func emailCacheKey(email string) string {
+	return "users:email:" + strings.ToLower(email)
+}
+
+// singleEmail returns the email of filters if they only look for the user
+// with that email, as the cache can serve them.
+func singleEmail(filters *ListFilters) (string, bool) {
+	if filters == nil || len(filters.EmailIn) != 1 ||
+		(filters.Page != nil && *filters.Page > 1) || filters.Cursor != "" || filters.WithTotal ||
+		len(filters.UsernameIn) > 0 || len(filters.IDIn) > 0 ||
+		filters.UsernameStartsWith != "" || filters.DisplayNameContains != "" ||
+		filters.CreatedAfter != nil || filters.CreatedBefore != nil ||
+		filters.IncludeDeleted {
+		return "", false
+	}
+
+	return filters.EmailIn[0], true
+}
+
+// nextVersion returns the version after version, which every change
+// increases, or 0 if version is not known.
+func nextVersion(version int64) int64 {
+	if version == 0 {
+		return 0
+	}
+
+	return version + 1
+}
+
+// detachedContext keeps the values of a context, i.e. its trace, but not its
+// deadline or cancellation.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func stringOrEmpty(s *string) string {
+	if s == nil {
+		return ""
+	}
+
+	return *s
+}
+
+func userNotFound() error {
+	return &uerrors.Error{
+		Code:    uerrors.CodeUserNotFound,
+		Message: uerrors.MessageUserNotFound,
+		Err:     uerrors.ErrUserNotFound,
+	}
+}
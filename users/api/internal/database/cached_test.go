@@ -0,0 +1,262 @@
+package database
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/asimpleidea/ship-krew/users/api/internal/cache"
+	"github.com/asimpleidea/ship-krew/users/api/internal/password"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/api"
+	"github.com/rs/zerolog"
+)
+
+func newCached(store UserStore) *Cached {
+	return NewCached(store, &cache.Memory{Size: 100}, &cache.Settings{
+		TTL:         time.Minute,
+		NegativeTTL: time.Second,
+	}, zerolog.Nop())
+}
+
+func createUser(t *testing.T, store UserStore, username string) *api.User {
+	email, pwd, ip := username+"@example.com", "a-long-enough-password", net.ParseIP("10.0.0.1")
+	created, err := store.CreateUser(&api.User{
+		Username:       username,
+		DisplayName:    username,
+		Email:          &email,
+		Password:       &pwd,
+		RegistrationIP: &ip,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return created
+}
+
+// TestCachedDoesNotCacheStaleUsers caches a user as it was before a change,
+// like a lookup that started before the change and ended after it.
+func TestCachedDoesNotCacheStaleUsers(t *testing.T) {
+	cached := newCached(&Memory{
+		Logger:         zerolog.Nop(),
+		PasswordParams: &password.Params{Time: 1, Memory: 8, Threads: 1, SaltLength: 8, KeyLength: 16},
+	})
+	created := createUser(t, cached, "stale")
+
+	before, err := cached.userByID(created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := "Changed"
+	if _, err := cached.UpdateUser(created.ID, &api.UserPatch{DisplayName: &name}, &Actor{}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	cached.setUser(before)
+
+	after, err := cached.GetUserByID(created.ID, &GetOptions{Role: api.RoleAdmin})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if after.DisplayName != name || after.Version != before.Version+1 {
+		t.Fatalf("got version %d named %s, expected version %d named %s",
+			after.Version, after.DisplayName, before.Version+1, name)
+	}
+}
+
+// slowStore makes lookups by ID wait for release, and fail if their context
+// was cancelled in the meantime.
+type slowStore struct {
+	UserStore
+	ctx     context.Context
+	started chan struct{}
+	release chan struct{}
+	lookups *int32
+}
+
+func (s *slowStore) WithContext(ctx context.Context) UserStore {
+	copied := *s
+	copied.ctx = ctx
+	return &copied
+}
+
+func (s *slowStore) GetUserByID(id int64, opts *GetOptions) (*api.User, error) {
+	atomic.AddInt32(s.lookups, 1)
+	close(s.started)
+	<-s.release
+
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return &api.User{ID: id, Username: "slow", Version: 1}, nil
+}
+
+// TestCachedSharedLookupOutlivesCallers cancels the request that started a
+// lookup, while another one waits for the same user.
+func TestCachedSharedLookupOutlivesCallers(t *testing.T) {
+	store := &slowStore{
+		ctx:     context.Background(),
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+		lookups: new(int32),
+	}
+	cached := newCached(store)
+
+	first, cancel := context.WithCancel(context.Background())
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, 2)
+	)
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, errs[0] = cached.WithContext(first).GetUserByID(1, nil)
+	}()
+
+	<-store.started
+	go func() {
+		defer wg.Done()
+		_, errs[1] = cached.WithContext(context.Background()).GetUserByID(1, nil)
+	}()
+
+	// Gives the second lookup the time to wait for the first one.
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	close(store.release)
+	wg.Wait()
+
+	if lookups := atomic.LoadInt32(store.lookups); lookups != 1 {
+		t.Fatalf("store was queried %d times, expected once", lookups)
+	}
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("lookup #%d failed with %v", i, err)
+		}
+	}
+}
+
+// pausingStore pauses the first lookup by ID once it has read the user,
+// until resume is closed.
+type pausingStore struct {
+	*Memory
+	paused int32
+	read   chan struct{}
+	resume chan struct{}
+}
+
+func (s *pausingStore) WithContext(context.Context) UserStore {
+	return s
+}
+
+func (s *pausingStore) GetUserByID(id int64, opts *GetOptions) (*api.User, error) {
+	user, err := s.Memory.GetUserByID(id, opts)
+	if atomic.CompareAndSwapInt32(&s.paused, 0, 1) {
+		close(s.read)
+		<-s.resume
+	}
+
+	return user, err
+}
+
+// TestCachedLookupRacingUpdate updates a user from another replica while a
+// lookup that read it before the update has yet to cache it.
+func TestCachedLookupRacingUpdate(t *testing.T) {
+	store := &pausingStore{
+		Memory: &Memory{
+			Logger:         zerolog.Nop(),
+			PasswordParams: &password.Params{Time: 1, Memory: 8, Threads: 1, SaltLength: 8, KeyLength: 16},
+		},
+		read:   make(chan struct{}),
+		resume: make(chan struct{}),
+	}
+	created := createUser(t, store.Memory, "racer")
+
+	shared := &cache.Memory{Size: 100}
+	settings := &cache.Settings{TTL: time.Minute, NegativeTTL: time.Second}
+	replica, other := NewCached(store, shared, settings, zerolog.Nop()), NewCached(store, shared, settings, zerolog.Nop())
+
+	looked := make(chan error)
+	go func() {
+		_, err := replica.GetUserByID(created.ID, &GetOptions{Role: api.RoleAdmin})
+		looked <- err
+	}()
+
+	<-store.read
+	name := "Changed"
+	if _, err := other.UpdateUser(created.ID, &api.UserPatch{DisplayName: &name}, &Actor{}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	close(store.resume)
+	if err := <-looked; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []*Cached{replica, other} {
+		found, err := c.GetUserByID(created.ID, &GetOptions{Role: api.RoleAdmin})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if found.DisplayName != name || found.Version != created.Version+1 {
+			t.Fatalf("got version %d named %s, expected version %d named %s",
+				found.Version, found.DisplayName, created.Version+1, name)
+		}
+	}
+}
+
+func TestCachedForgetsOldEmails(t *testing.T) {
+	shared := &cache.Memory{Size: 100}
+	cached := NewCached(&Memory{
+		Logger:         zerolog.Nop(),
+		PasswordParams: &password.Params{Time: 1, Memory: 8, Threads: 1, SaltLength: 8, KeyLength: 16},
+	}, shared, &cache.Settings{TTL: time.Minute, NegativeTTL: time.Minute}, zerolog.Nop())
+	created := createUser(t, cached, "mover")
+
+	// byEmail lists users with email, the way the handler does.
+	byEmail := func(email string) []*api.User {
+		page := 1
+		list, err := cached.ListUsers(&ListFilters{EmailIn: []string{email}, Page: &page, Role: api.RoleAdmin})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return list.Users
+	}
+
+	oldEmail, newEmail := "mover@example.com", "moved@example.com"
+	if users := byEmail(oldEmail); len(users) != 1 || users[0].ID != created.ID {
+		t.Fatalf("found %d users with the old email", len(users))
+	}
+
+	// Looked up before it is taken, so that it is cached as not found.
+	if users := byEmail(newEmail); len(users) != 0 {
+		t.Fatalf("found %d users with the new email", len(users))
+	}
+
+	if _, err := cached.UpdateUser(created.ID, &api.UserPatch{Email: &newEmail}, &Actor{}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, email := range []string{oldEmail, newEmail} {
+		if _, exists, _ := shared.Get(context.Background(), emailCacheKey(email)); exists {
+			t.Errorf("%s is still cached", email)
+		}
+	}
+
+	if users := byEmail(oldEmail); len(users) != 0 {
+		t.Fatalf("found %d users with the old email", len(users))
+	}
+
+	if users := byEmail(newEmail); len(users) != 1 || users[0].ID != created.ID {
+		t.Fatalf("found %d users with the new email", len(users))
+	}
+}
@@ -0,0 +1,58 @@
+package database
+
+import (
+	"errors"
+	"strings"
+
+	uerrors "github.com/asimpleidea/ship-krew/users/api/pkg/errors"
+	"github.com/go-sql-driver/mysql"
+)
+
+// Uniqueness of usernames and emails is enforced by the unique indexes of
+// the users table, which are case-insensitive, rather than by checking
+// before inserting: two concurrent requests could both pass the check.
+
+const (
+	mysqlDuplicateEntry    uint16 = 1062
+	sqliteConstraintUnique int    = 2067
+)
+
+// uniqueViolation returns the error to return to the caller if err was
+// caused by the unique index on usernames or on emails, or nil otherwise.
+func uniqueViolation(err error) error {
+	var (
+		mysqlErr  *mysql.MySQLError
+		sqliteErr interface{ Code() int }
+		index     string
+	)
+
+	switch {
+	case errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry:
+		// i.e. Duplicate entry 'name' for key 'users.idx_users_username'.
+		// The name itself is not looked at, as it is user input.
+		msg := mysqlErr.Message
+		index = msg[strings.LastIndex(msg, " for key ")+1:]
+	case errors.As(err, &sqliteErr) && sqliteErr.Code() == sqliteConstraintUnique:
+		// i.e. UNIQUE constraint failed: users.username.
+		index = err.Error()
+	default:
+		return nil
+	}
+
+	switch {
+	case strings.Contains(index, "username"):
+		return &uerrors.Error{
+			Code:    uerrors.CodeUsernameAlreadyExists,
+			Message: uerrors.MessageUsernameAlreadyExists,
+			Err:     uerrors.ErrUsernameAlreadyExists,
+		}
+	case strings.Contains(index, "email"):
+		return &uerrors.Error{
+			Code:    uerrors.CodeEmailAlreadyExists,
+			Message: uerrors.MessageEmailAlreadyExists,
+			Err:     uerrors.ErrEmailAlreadyExists,
+		}
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,139 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/asimpleidea/ship-krew/users/api/internal/migrations"
+	"github.com/asimpleidea/ship-krew/users/api/internal/password"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/api"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/database"
+	uerrors "github.com/asimpleidea/ship-krew/users/api/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// newSQLiteDatabase returns a Database on a new SQLite file, with the
+// schema created by the migrations.
+func newSQLiteDatabase(t *testing.T) *Database {
+	db, err := database.NewDatabaseConnection(&database.Settings{
+		Driver: database.DriverSQLite,
+		Path:   filepath.Join(t.TempDir(), "users.db"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	migrator := &migrations.Migrator{DB: sqlDB, Driver: database.DriverSQLite, Logger: zerolog.Nop()}
+	if err := migrator.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return &Database{
+		DB:     db,
+		Logger: zerolog.Nop(),
+		// Hashing is not what is tested, so it is made as cheap as possible.
+		PasswordParams: &password.Params{Time: 1, Memory: 8, Threads: 1, SaltLength: 8, KeyLength: 16},
+	}
+}
+
+// TestConcurrentSignups creates the same user from many goroutines at once,
+// with usernames or emails only differing in case: exactly one of them must
+// succeed.
+func TestConcurrentSignups(t *testing.T) {
+	const signups = 32
+
+	cases := []struct {
+		name     string
+		username func(i int) string
+		email    func(i int) string
+		code     int
+	}{
+		{
+			name:     "same username",
+			username: func(i int) string { return sameLetters("racer", i) },
+			email:    func(i int) string { return fmt.Sprintf("racer%d@example.com", i) },
+			code:     uerrors.CodeUsernameAlreadyExists,
+		},
+		{
+			name:     "same email",
+			username: func(i int) string { return fmt.Sprintf("racer%d", i) },
+			email:    func(i int) string { return sameLetters("racer", i) + "@example.com" },
+			code:     uerrors.CodeEmailAlreadyExists,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db := newSQLiteDatabase(t)
+
+			var (
+				start = make(chan struct{})
+				errs  = make(chan error, signups)
+				wg    sync.WaitGroup
+			)
+
+			for i := 0; i < signups; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+
+					email, pwd, ip := c.email(i), "a-long-enough-password", net.ParseIP("10.0.0.1")
+					<-start
+
+					_, err := db.CreateUser(&api.User{
+						Username:       c.username(i),
+						DisplayName:    "Racer",
+						Email:          &email,
+						Password:       &pwd,
+						RegistrationIP: &ip,
+					})
+					errs <- err
+				}(i)
+			}
+
+			close(start)
+			wg.Wait()
+			close(errs)
+
+			created := 0
+			for err := range errs {
+				if err == nil {
+					created++
+					continue
+				}
+
+				if uerr, ok := err.(*uerrors.Error); !ok || uerr.Code != c.code {
+					t.Errorf("error is %v, expected code %d", err, c.code)
+				}
+			}
+
+			if created != 1 {
+				t.Fatalf("%d users were created, expected 1", created)
+			}
+		})
+	}
+}
+
+// sameLetters returns value with some letters in upper case, depending on i,
+// so that the values only differ in case.
+func sameLetters(value string, i int) string {
+	letters := []byte(value)
+	for j := range letters {
+		if i&(1<<j) != 0 {
+			letters[j] = strings.ToUpper(string(letters[j]))[0]
+		}
+	}
+
+	return string(letters)
+}
@@ -1,14 +1,13 @@
 package database
 
 import (
-	"crypto/sha256"
+	"context"
 	"database/sql"
-	"encoding/base64"
 	"errors"
-	"net/mail"
-	"regexp"
 	"strings"
+	"time"
 
+	"github.com/asimpleidea/ship-krew/users/api/internal/password"
 	"github.com/asimpleidea/ship-krew/users/api/pkg/api"
 	uerrors "github.com/asimpleidea/ship-krew/users/api/pkg/errors"
 	"github.com/rs/zerolog"
@@ -23,36 +22,38 @@ const (
 	bioMaxLength         int    = 300
 	emailMaxLength       int    = 200
 	usersTable           string = "users"
+	userChangesTable     string = "user_changes"
 	resultsPerPage       int    = 25
 )
 
+// Database is the UserStore backed by GORM, i.e. MySQL or SQLite.
 type Database struct {
 	DB     *gorm.DB
 	Logger zerolog.Logger
+	// PasswordParams are the parameters used to hash passwords. If nil,
+	// password.DefaultParams is used.
+	PasswordParams *password.Params
 }
 
-func (c *Database) GetUserByUsername(username string) (*api.User, error) {
-	if username == "" {
-		return nil, &uerrors.Error{
-			Code:    uerrors.CodeEmptyUsername,
-			Message: uerrors.MessageEmptyUsername,
-			Err:     uerrors.ErrEmptyUsername,
-		}
+func (c *Database) WithContext(ctx context.Context) UserStore {
+	return &Database{
+		DB:             c.DB.WithContext(ctx),
+		Logger:         c.Logger,
+		PasswordParams: c.PasswordParams,
 	}
+}
 
-	if matched, err := regexp.MatchString(usernameRegexp, username); err != nil || !matched {
-		return nil, &uerrors.Error{
-			Code:    uerrors.CodeInvalidUsername,
-			Message: uerrors.MessageInvalidUsername,
-			Err:     uerrors.ErrInvalidUsername,
-		}
+func (c *Database) GetUserByUsername(username string, opts *GetOptions) (*api.User, error) {
+	if err := validateUsername(username); err != nil {
+		return nil, err
 	}
 
-	// TODO: support getting soft deleted users as well.
-	// TODO: get it from cache.
-
 	var user User
-	res := c.DB.Model(&User{}).Scopes(byUserName(username)).First(&user)
+	res := c.DB.Model(&User{}).
+		Scopes(byUserName(username),
+			withDeleted(opts.includeDeleted()),
+			withRole(opts.role())).
+		First(&user)
 	if res.Error != nil {
 		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
 			return nil, &uerrors.Error{
@@ -69,20 +70,25 @@ func (c *Database) GetUserByUsername(username string) (*api.User, error) {
 		}
 	}
 
-	return user.ToApiUser(), nil
+	found := user.ToApiUser().Project(opts.role())
+	if err := c.loadBans([]*api.User{found}, opts.role()); err != nil {
+		return nil, err
+	}
+
+	return found, nil
 }
 
-func (c *Database) GetUserByID(id int64) (*api.User, error) {
-	if id < 1 {
-		return nil, &uerrors.Error{
-			Code:    uerrors.CodeInvalidUserID,
-			Message: uerrors.MessageInvalidUserID,
-			Err:     uerrors.ErrInvalidUserID,
-		}
+func (c *Database) GetUserByID(id int64, opts *GetOptions) (*api.User, error) {
+	if err := validateUserID(id); err != nil {
+		return nil, err
 	}
 
 	var user User
-	res := c.DB.Model(&User{}).Scopes(byUserID(id)).First(&user)
+	res := c.DB.Model(&User{}).
+		Scopes(byUserID(id),
+			withDeleted(opts.includeDeleted()),
+			withRole(opts.role())).
+		First(&user)
 	if res.Error != nil {
 		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
 			return nil, &uerrors.Error{
@@ -99,233 +105,576 @@ func (c *Database) GetUserByID(id int64) (*api.User, error) {
 		}
 	}
 
-	return user.ToApiUser(), nil
+	found := user.ToApiUser().Project(opts.role())
+	if err := c.loadBans([]*api.User{found}, opts.role()); err != nil {
+		return nil, err
+	}
+
+	return found, nil
 }
 
 func (c *Database) CreateUser(user *api.User) (*api.User, error) {
 	userToCreate := &User{}
 
-	if user.Username == "" {
-		return nil, &uerrors.Error{
-			Code:    uerrors.CodeEmptyUsername,
-			Message: uerrors.MessageEmptyUsername,
-			Err:     uerrors.ErrEmptyUsername,
-		}
+	if err := validateUsername(user.Username); err != nil {
+		return nil, err
 	}
 
-	if len(user.Username) > maxUsernameLength {
-		return nil, &uerrors.Error{
-			Err:     uerrors.ErrInvalidUsername,
-			Code:    uerrors.CodeUsernameTooLong,
-			Message: uerrors.MessageUsernameTooLong,
+	userToCreate.Username = user.Username
+	userToCreate.Version = 1
+
+	if err := validateDisplayName(user.DisplayName); err != nil {
+		return nil, err
+	}
+	userToCreate.DisplayName = user.DisplayName
+
+	if err := validateEmail(user.Email); err != nil {
+		return nil, err
+	}
+
+	userToCreate.Email = *user.Email
+
+	{
+		hash, err := hashPassword(user.Password, c.PasswordParams)
+		if err != nil {
+			return nil, err
 		}
+
+		userToCreate.PasswordHash = []byte(hash)
+	}
+
+	if err := validateRegistrationIP(user.RegistrationIP); err != nil {
+		return nil, err
+	}
+	userToCreate.RegistrationIP = user.RegistrationIP.String()
+
+	if err := validateBio(user.Bio); err != nil {
+		return nil, err
+	}
+
+	if user.Bio != nil {
+		userToCreate.Bio = sql.NullString{String: *user.Bio, Valid: true}
+	}
+
+	if user.Birthday != nil {
+		userToCreate.Birthday = sql.NullTime{Time: *user.Birthday, Valid: true}
 	}
 
-	if matched, err := regexp.MatchString(usernameRegexp, user.Username); err != nil || !matched {
+	// The unique indexes reject usernames and emails that are already
+	// taken, even by concurrent requests: see uniqueViolation.
+	res := c.DB.Table(usersTable).Create(userToCreate)
+	if res.Error != nil {
+		if err := uniqueViolation(res.Error); err != nil {
+			return nil, err
+		}
+
 		return nil, &uerrors.Error{
-			Code:    uerrors.CodeInvalidUsername,
-			Message: uerrors.MessageInvalidUsername,
-			Err:     uerrors.ErrInvalidUsername,
+			Code:    uerrors.CodeInternalServerError,
+			Message: uerrors.MessageInternalServerError,
+			Err:     uerrors.ErrInternalServerError,
 		}
 	}
 
-	{
+	return createdUser(user, userToCreate), nil
+}
+
+func (c *Database) ListUsers(filters *ListFilters) (*api.UserList, error) {
+	if filters == nil {
+		filters = &ListFilters{}
+	}
+
+	if err := filters.validate(); err != nil {
+		return nil, err
+	}
+
+	keys, pivot, err := filters.pagination()
+	if err != nil {
+		return nil, err
+	}
+
+	query := filters.apply(c.DB.Model(&User{}))
+
+	var total *int64
+	if filters.WithTotal {
 		var count int64
-		res := c.DB.Model(&User{}).Scopes(byUserName(user.Username)).Count(&count)
-		if res.Error != nil {
+		if res := query.Session(&gorm.Session{}).Count(&count); res.Error != nil {
 			return nil, &uerrors.Error{
 				Code:    uerrors.CodeInternalServerError,
 				Message: uerrors.MessageInternalServerError,
-				Err:     uerrors.ErrInternalServerError,
+				Err:     res.Error,
 			}
 		}
 
-		if count > 0 {
-			return nil, &uerrors.Error{
-				Code:    uerrors.CodeUsernameAlreadyExists,
-				Message: uerrors.MessageUsernameAlreadyExists,
-				Err:     uerrors.ErrUsernameAlreadyExists,
-			}
-		}
+		total = &count
 	}
-	userToCreate.Username = user.Username
 
-	if user.DisplayName == "" {
-		return nil, &uerrors.Error{
-			Code:    uerrors.CodeEmptyDisplayName,
-			Message: uerrors.MessageEmptyDisplayName,
-			Err:     uerrors.ErrEmptyDisplayName,
-		}
+	limit := filters.limit()
+	switch {
+	case pivot != nil:
+		condition, args := keysetCondition(keys, pivot)
+		query = query.Where(condition, args...)
+	case filters.Page != nil && *filters.Page > 0:
+		query = query.Offset((*filters.Page - 1) * limit)
 	}
 
-	if len(user.DisplayName) > maxDisplayNameLength {
-		return nil, &uerrors.Error{
-			Code:    uerrors.CodeDisplayNameTooLong,
-			Message: uerrors.MessageDisplayNameTooLong,
-			Err:     uerrors.ErrDisplayNameTooLong,
+	for _, key := range keys {
+		order := key.column
+		if key.desc {
+			order += " DESC"
 		}
+
+		query = query.Order(order)
 	}
-	userToCreate.DisplayName = user.DisplayName
 
-	if user.Email == nil {
+	var users []*User
+	res := query.Scopes(withRole(filters.Role)).
+		Limit(limit + 1).
+		Find(&users)
+	if res.Error != nil {
 		return nil, &uerrors.Error{
-			Code:    uerrors.CodeEmptyEmail,
-			Message: uerrors.MessageEmptyEmail,
-			Err:     uerrors.ErrEmptyEmail,
+			Code:    uerrors.CodeInternalServerError,
+			Message: uerrors.MessageInternalServerError,
+			Err:     res.Error,
 		}
 	}
 
-	if len(*user.Email) > emailMaxLength {
-		return nil, &uerrors.Error{
-			Code:    uerrors.CodeEmailTooLong,
-			Message: uerrors.MessageEmailTooLong,
-			Err:     uerrors.ErrEmailTooLong,
+	list := pageOf(users, limit, keys, total, filters.Role)
+	if err := c.loadBans(list.Users, filters.Role); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+func (c *Database) UpdateUser(id int64, patch *api.UserPatch, actor *Actor, version int64) (*api.User, error) {
+	if err := validateUserID(id); err != nil {
+		return nil, err
+	}
+
+	if err := validatePatch(patch); err != nil {
+		return nil, err
+	}
+
+	before, err := c.GetUserByID(id, &GetOptions{Role: api.RoleAdmin})
+	if err != nil {
+		return nil, err
+	}
+
+	if version != 0 && before.Version != version {
+		return nil, versionMismatch()
+	}
+
+	colsToUpd := map[string]interface{}{}
+	after := before.Clone()
+
+	if patch.Username != nil &&
+		!strings.EqualFold(*patch.Username, before.Username) {
+		colsToUpd["username"] = *patch.Username
+		after.Username = *patch.Username
+	}
+
+	if patch.DisplayName != nil && *patch.DisplayName != before.DisplayName {
+		colsToUpd["display_name"] = *patch.DisplayName
+		after.DisplayName = *patch.DisplayName
+	}
+
+	if patch.Email != nil &&
+		!strings.EqualFold(*patch.Email, *before.Email) {
+		colsToUpd["email"] = *patch.Email
+		after.Email = patch.Email
+
+		// The new address must be verified again.
+		colsToUpd["email_verified_at"] = nil
+	}
+
+	if patch.Password != nil {
+		hash, err := hashPassword(patch.Password, c.PasswordParams)
+		if err != nil {
+			return nil, err
 		}
+
+		colsToUpd["password_hash"] = []byte(hash)
+
+		// The salt is now part of the hash, so the one of the legacy format
+		// is not needed anymore.
+		colsToUpd["salt"] = nil
 	}
 
-	if _, err := mail.ParseAddress(*user.Email); err != nil {
+	switch {
+	case patch.Bio != nil:
+		colsToUpd["bio"] = *patch.Bio
+	case patch.RemoveBio:
+		colsToUpd["bio"] = nil
+	}
+
+	switch {
+	case patch.Birthday != nil:
+		colsToUpd["birthday"] = *patch.Birthday
+		after.Birthday = patch.Birthday
+	case patch.RemoveBirthday:
+		colsToUpd["birthday"] = nil
+		after.Birthday = nil
+	}
+
+	if len(colsToUpd) == 0 {
+		return before, nil
+	}
+
+	colsToUpd["version"] = gorm.Expr("version + 1")
+	changes := diffUser(before, after, actor, time.Now())
+
+	err = c.DB.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&User{}).
+			Scopes(byUserID(id), atVersion(version)).
+			Updates(colsToUpd)
+		if res.Error != nil {
+			return res.Error
+		}
+
+		// It was changed or deleted after it was read.
+		if res.RowsAffected == 0 {
+			if version != 0 {
+				return versionMismatch()
+			}
+
+			return &uerrors.Error{
+				Code:    uerrors.CodeUserNotFound,
+				Message: uerrors.MessageUserNotFound,
+				Err:     uerrors.ErrUserNotFound,
+			}
+		}
+
+		if len(changes) == 0 {
+			return nil
+		}
+
+		return tx.Create(&changes).Error
+	})
+	if err != nil {
+		var uerr *uerrors.Error
+		if errors.As(err, &uerr) {
+			return nil, uerr
+		}
+
+		if uerr := uniqueViolation(err); uerr != nil {
+			return nil, uerr
+		}
+
 		return nil, &uerrors.Error{
-			Code:    uerrors.CodeInvalidEmail,
-			Message: uerrors.MessageInvalidEmail,
-			Err:     uerrors.ErrInvalidEmail,
+			Code:    uerrors.CodeInternalServerError,
+			Message: uerrors.MessageInternalServerError,
+			Err:     err,
 		}
 	}
 
-	{
-		var (
-			count int64
-			email string = *user.Email
-		)
+	return c.GetUserByID(id, &GetOptions{Role: api.RoleAdmin})
+}
 
-		res := c.DB.Model(&User{}).Scopes(byEmail(email)).Count(&count)
+func (c *Database) DeleteUser(id int64, hardDelete bool, version int64) error {
+	{
+		var user User
+		res := c.DB.Model(&User{}).
+			Select("id", "version").
+			Scopes(byUserID(id)).
+			First(&user)
 		if res.Error != nil {
-			return nil, &uerrors.Error{
+			if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+				return &uerrors.Error{
+					Code:    uerrors.CodeUserNotFound,
+					Message: uerrors.MessageUserNotFound,
+					Err:     uerrors.ErrUserNotFound,
+				}
+			}
+
+			return &uerrors.Error{
 				Code:    uerrors.CodeInternalServerError,
 				Message: uerrors.MessageInternalServerError,
 				Err:     uerrors.ErrInternalServerError,
 			}
 		}
 
-		if count > 0 {
-			return nil, &uerrors.Error{
-				Code:    uerrors.CodeEmailAlreadyExists,
-				Message: uerrors.MessageEmailAlreadyExists,
-				Err:     uerrors.ErrEmailAlreadyExists,
+		if version != 0 && user.Version != version {
+			return versionMismatch()
+		}
+	}
+
+	colsToUpd := map[string]interface{}{
+		"version": gorm.Expr("version + 1"),
+	}
+	if !hardDelete {
+		colsToUpd["deleted_at"] = time.Now()
+	}
+
+	err := c.DB.Transaction(func(tx *gorm.DB) error {
+		// Changing the version first also locks the user until it is
+		// deleted.
+		res := tx.Model(&User{}).
+			Scopes(byUserID(id), atVersion(version)).
+			UpdateColumns(colsToUpd)
+		if res.Error != nil {
+			return res.Error
+		}
+
+		if res.RowsAffected == 0 {
+			if version != 0 {
+				return versionMismatch()
 			}
+
+			return &uerrors.Error{
+				Code:    uerrors.CodeUserNotFound,
+				Message: uerrors.MessageUserNotFound,
+				Err:     uerrors.ErrUserNotFound,
+			}
+		}
+
+		if !hardDelete {
+			return nil
+		}
+
+		if err := tx.Where("user_id = ?", id).Delete(&UserChange{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("user_id = ?", id).Delete(&Ban{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Unscoped().Delete(&User{}, id).Error
+	})
+	if err != nil {
+		var uerr *uerrors.Error
+		if errors.As(err, &uerr) {
+			return uerr
+		}
+
+		return &uerrors.Error{
+			Code:    uerrors.CodeInternalServerError,
+			Message: uerrors.MessageInternalServerError,
+			Err:     err,
 		}
 	}
-	userToCreate.Email = *user.Email
+
+	return nil
+}
+
+func (c *Database) RestoreUser(id int64) (*api.User, error) {
+	if err := validateUserID(id); err != nil {
+		return nil, err
+	}
+
+	deleted, err := c.GetUserByID(id, &GetOptions{
+		IncludeDeleted: true,
+		Role:           api.RoleAdmin,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if deleted.DeletedAt == nil {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeUserNotDeleted,
+			Message: uerrors.MessageUserNotDeleted,
+			Err:     uerrors.ErrUserNotDeleted,
+		}
+	}
+
+	res := c.DB.Model(&User{}).
+		Scopes(byUserID(id), withDeleted(true)).
+		Updates(map[string]interface{}{
+			"deleted_at": nil,
+			"version":    gorm.Expr("version + 1"),
+		})
+	if res.Error != nil {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeInternalServerError,
+			Message: uerrors.MessageInternalServerError,
+			Err:     res.Error,
+		}
+	}
+
+	return c.GetUserByID(id, &GetOptions{Role: api.RoleAdmin})
+}
+
+func (c *Database) GetUserHistory(id int64, opts *HistoryOptions) (*api.UserHistory, error) {
+	if err := validateUserID(id); err != nil {
+		return nil, err
+	}
+
+	fields, err := opts.fields()
+	if err != nil {
+		return nil, err
+	}
 
 	{
-		salt, err := GenerateRandomBytes(sha256.Size)
-		if err != nil {
+		var count int64
+		res := c.DB.Model(&User{}).Scopes(byUserID(id)).Count(&count)
+		if res.Error != nil {
 			return nil, &uerrors.Error{
 				Code:    uerrors.CodeInternalServerError,
 				Message: uerrors.MessageInternalServerError,
-				Err:     err,
+				Err:     res.Error,
 			}
 		}
 
-		saltString := base64.StdEncoding.EncodeToString(salt)
-		user.Base64Salt = &saltString
-		userToCreate.Salt = salt
-	}
-
-	{
-		if user.Base64PasswordHash == nil {
+		if count == 0 {
 			return nil, &uerrors.Error{
-				Code:    uerrors.CodeEmptyPasswordHash,
-				Message: uerrors.MessageEmptyPasswordHash,
-				Err:     uerrors.ErrEmptyPasswordHash,
+				Code:    uerrors.CodeUserNotFound,
+				Message: uerrors.MessageUserNotFound,
+				Err:     uerrors.ErrUserNotFound,
 			}
 		}
+	}
 
-		password, err := base64.StdEncoding.DecodeString(*user.Base64PasswordHash)
-		if err != nil {
+	changes := []*UserChange{}
+	if len(fields) > 0 {
+		res := c.DB.Model(&UserChange{}).
+			Where("user_id = ? AND field IN ?", id, fields).
+			Order("changed_at DESC").
+			Order("id DESC").
+			Find(&changes)
+		if res.Error != nil {
 			return nil, &uerrors.Error{
-				Code:    uerrors.CodeIncompatiblePasswordHash,
-				Message: uerrors.MessageIncompatiblePasswordHash,
-				Err:     uerrors.ErrIncompatiblePasswordHash,
+				Code:    uerrors.CodeInternalServerError,
+				Message: uerrors.MessageInternalServerError,
+				Err:     res.Error,
 			}
 		}
+	}
+
+	return historyOf(changes), nil
+}
 
-		// TODO: check this
-		password = append(password, userToCreate.Salt...)
-		userToCreate.PasswordHash = password
+func (c *Database) SetPassword(id int64, pwd string) error {
+	if err := validateUserID(id); err != nil {
+		return err
 	}
 
-	if user.RegistrationIP == nil || (user.RegistrationIP != nil && user.RegistrationIP.String() == "") {
-		return nil, &uerrors.Error{
-			Code:    uerrors.CodeEmptyRegistrationIP,
-			Message: uerrors.MessageEmptyRegistrationIP,
-			Err:     uerrors.ErrEmptyRegistrationIP,
+	hash, err := hashPassword(&pwd, c.PasswordParams)
+	if err != nil {
+		return err
+	}
+
+	res := c.DB.Model(&User{}).
+		Scopes(byUserID(id)).
+		Updates(map[string]interface{}{
+			"password_hash": []byte(hash),
+			// See UpdateUser.
+			"salt":    nil,
+			"version": gorm.Expr("version + 1"),
+		})
+	if res.Error != nil {
+		return &uerrors.Error{
+			Code:    uerrors.CodeInternalServerError,
+			Message: uerrors.MessageInternalServerError,
+			Err:     res.Error,
 		}
 	}
-	userToCreate.RegistrationIP = user.RegistrationIP.String()
 
-	if user.Bio != nil {
-		if len(*user.Bio) > bioMaxLength {
-			return nil, &uerrors.Error{
-				Code:    uerrors.CodeBioTooLong,
-				Message: uerrors.MessageBioTooLong,
-				Err:     uerrors.ErrBioTooLong,
-			}
+	if res.RowsAffected == 0 {
+		return &uerrors.Error{
+			Code:    uerrors.CodeUserNotFound,
+			Message: uerrors.MessageUserNotFound,
+			Err:     uerrors.ErrUserNotFound,
 		}
+	}
 
-		userToCreate.Bio = sql.NullString{String: *user.Bio, Valid: true}
+	return nil
+}
+
+func (c *Database) VerifyEmail(id int64, email string) (*api.User, error) {
+	if err := validateUserID(id); err != nil {
+		return nil, err
 	}
 
-	if user.Birthday != nil {
-		userToCreate.Birthday = sql.NullTime{Time: *user.Birthday, Valid: true}
+	user, err := c.GetUserByID(id, &GetOptions{Role: api.RoleService})
+	if err != nil {
+		return nil, err
 	}
 
-	res := c.DB.Table(usersTable).Create(userToCreate)
+	if !strings.EqualFold(*user.Email, email) {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeEmailMismatch,
+			Message: uerrors.MessageEmailMismatch,
+			Err:     uerrors.ErrEmailMismatch,
+		}
+	}
+
+	if user.EmailVerifiedAt != nil {
+		return user, nil
+	}
+
+	// The condition on the email prevents verifying an address that was
+	// changed in the meantime.
+	now := time.Now()
+	res := c.DB.Model(&User{}).
+		Scopes(byUserID(id), byEmail(*user.Email)).
+		Where("email_verified_at IS NULL").
+		Updates(map[string]interface{}{
+			"email_verified_at": now,
+			"version":           gorm.Expr("version + 1"),
+		})
 	if res.Error != nil {
 		return nil, &uerrors.Error{
 			Code:    uerrors.CodeInternalServerError,
 			Message: uerrors.MessageInternalServerError,
-			Err:     uerrors.ErrInternalServerError,
+			Err:     res.Error,
 		}
 	}
 
-	// Return minimum amount of information
-	user.ID = userToCreate.ID
-	user.Base64PasswordHash = nil
-	user.Base64Salt = nil
-	user.CreatedAt = userToCreate.CreatedAt
-	user.Email = nil
-	user.RegistrationIP = nil
-
-	return user, nil
+	return c.GetUserByID(id, &GetOptions{Role: api.RoleService})
 }
 
-type ListFilters struct {
-	Page       *int
-	UsernameIn []string
-	EmailIn    []string
-	IDIn       []int64
-}
+func (c *Database) IssueBan(userID int64, ban *api.Ban, actor *Actor) (*api.Ban, error) {
+	if err := validateUserID(userID); err != nil {
+		return nil, err
+	}
 
-func (c *Database) ListUsers(filters *ListFilters) ([]*api.User, error) {
-	query := c.DB
-	var users []*User
+	created, err := newBan(userID, ban, actor, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.checkUserExists(userID); err != nil {
+		return nil, err
+	}
 
-	if filters != nil {
-		if filters.Page != nil && *filters.Page > 0 {
-			query = query.Offset((*filters.Page - 1) * resultsPerPage)
+	err = c.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(created).Error; err != nil {
+			return err
 		}
 
-		switch {
-		case len(filters.UsernameIn) > 0:
-			query = query.Where("username IN ?", filters.UsernameIn)
-		case len(filters.EmailIn) > 0:
-			query = query.Where("email IN ?", filters.EmailIn)
-		case len(filters.IDIn) > 0:
-			query = query.Where("id IN ?", filters.IDIn)
+		return bumpVersion(tx, userID)
+	})
+	if err != nil {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeInternalServerError,
+			Message: uerrors.MessageInternalServerError,
+			Err:     err,
 		}
 	}
 
-	res := query.Limit(resultsPerPage).Model([]*User{}).Find(&users)
+	return created.ToApiBan(), nil
+}
+
+func (c *Database) ListBans(userID int64, activeOnly bool) (*api.BanList, error) {
+	if err := validateUserID(userID); err != nil {
+		return nil, err
+	}
+
+	if err := c.checkUserExists(userID); err != nil {
+		return nil, err
+	}
+
+	query := c.DB.Model(&Ban{}).Where("user_id = ?", userID)
+	if activeOnly {
+		query = query.Scopes(activeBans(time.Now()))
+	}
+
+	var bans []*Ban
+	res := query.
+		Order("starts_at DESC").
+		Order("id DESC").
+		Find(&bans)
 	if res.Error != nil {
 		return nil, &uerrors.Error{
 			Code:    uerrors.CodeInternalServerError,
@@ -334,177 +683,230 @@ func (c *Database) ListUsers(filters *ListFilters) ([]*api.User, error) {
 		}
 	}
 
-	if res.RowsAffected == 0 {
-		return []*api.User{}, nil
-	}
-
-	apiUsers := make([]*api.User, len(users))
-	for i := 0; i < len(users); i++ {
-		apiUsers[i] = users[i].ToApiUser()
+	list := &api.BanList{Bans: make([]*api.Ban, len(bans))}
+	for i, ban := range bans {
+		list.Bans[i] = ban.ToApiBan()
 	}
 
-	return apiUsers, nil
+	return list, nil
 }
 
-func (c *Database) UpdateUser(id int64, newData *api.User) error {
-	if id < 1 {
-		return &uerrors.Error{
-			Code:    uerrors.CodeInvalidUserID,
-			Message: uerrors.MessageInvalidUserID,
-			Err:     uerrors.ErrInvalidUserID,
-		}
+func (c *Database) LiftBan(userID, banID int64, actor *Actor) (*api.Ban, error) {
+	if err := validateUserID(userID); err != nil {
+		return nil, err
 	}
-	colsToUpd := map[string]interface{}{}
 
-	before, err := c.GetUserByID(id)
-	if err != nil {
-		return err
+	if err := validateBanID(banID); err != nil {
+		return nil, err
 	}
 
-	if newData.Username != "" &&
-		!strings.EqualFold(newData.Username, before.Username) {
-		if len(newData.Username) > maxUsernameLength {
-			return &uerrors.Error{
-				Err:     uerrors.ErrInvalidUsername,
-				Code:    uerrors.CodeUsernameTooLong,
-				Message: uerrors.MessageUsernameTooLong,
+	var ban Ban
+	res := c.DB.Model(&Ban{}).
+		Where("id = ? AND user_id = ?", banID, userID).
+		First(&ban)
+	if res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return nil, &uerrors.Error{
+				Code:    uerrors.CodeBanNotFound,
+				Message: uerrors.MessageBanNotFound,
+				Err:     uerrors.ErrBanNotFound,
 			}
 		}
 
-		if matched, err := regexp.MatchString(usernameRegexp, newData.Username); err != nil || !matched {
-			return &uerrors.Error{
-				Code:    uerrors.CodeInvalidUsername,
-				Message: uerrors.MessageInvalidUsername,
-				Err:     uerrors.ErrInvalidUsername,
-			}
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeInternalServerError,
+			Message: uerrors.MessageInternalServerError,
+			Err:     res.Error,
 		}
+	}
 
-		var count int64
-		res := c.DB.Model(&User{}).
-			Scopes(byUserName(newData.Username)).Count(&count)
+	if err := ban.lift(actor, time.Now()); err != nil {
+		return nil, err
+	}
+
+	// The condition on lifted_at prevents lifting the same ban twice, in
+	// case someone else lifted it in the meantime.
+	err := c.DB.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&ban).
+			Where("lifted_at IS NULL").
+			Updates(map[string]interface{}{
+				"lifted_at": ban.LiftedAt,
+				"lifted_by": ban.LiftedBy,
+			})
 		if res.Error != nil {
-			return &uerrors.Error{
-				Code:    uerrors.CodeInternalServerError,
-				Message: uerrors.MessageInternalServerError,
-				Err:     uerrors.ErrInternalServerError,
-			}
+			return res.Error
 		}
 
-		if count > 0 {
+		if res.RowsAffected == 0 {
 			return &uerrors.Error{
-				Code:    uerrors.CodeUsernameAlreadyExists,
-				Message: uerrors.MessageUsernameAlreadyExists,
-				Err:     uerrors.ErrUsernameAlreadyExists,
+				Code:    uerrors.CodeBanAlreadyLifted,
+				Message: uerrors.MessageBanAlreadyLifted,
+				Err:     uerrors.ErrBanAlreadyLifted,
 			}
 		}
 
-		colsToUpd["username"] = newData.Username
+		return bumpVersion(tx, userID)
+	})
+	if err != nil {
+		var uerr *uerrors.Error
+		if errors.As(err, &uerr) {
+			return nil, uerr
+		}
+
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeInternalServerError,
+			Message: uerrors.MessageInternalServerError,
+			Err:     err,
+		}
 	}
 
-	if newData.DisplayName != "" && newData.DisplayName != before.Username {
-		if len(newData.DisplayName) > maxDisplayNameLength {
-			return &uerrors.Error{
-				Code:    uerrors.CodeEmptyDisplayName,
-				Message: uerrors.MessageEmptyDisplayName,
-				Err:     uerrors.ErrEmptyDisplayName,
-			}
+	return ban.ToApiBan(), nil
+}
+
+func (c *Database) ImportUsers(users []*api.ImportedUser, opts *ImportOptions) ([]*ImportResult, error) {
+	if opts == nil {
+		opts = &ImportOptions{}
+	}
+
+	now := time.Now()
+	plan := planImport(users, c.PasswordParams, !opts.DryRun, now)
+
+	usernames, emails := plan.keys()
+	if len(usernames) == 0 {
+		return plan.results, nil
+	}
+
+	// Deleted users are included, as the unique indexes cover them as well.
+	var existing []*User
+	res := c.DB.Model(&User{}).
+		Unscoped().
+		Where("username IN ? OR email IN ?", usernames, emails).
+		Find(&existing)
+	if res.Error != nil {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeInternalServerError,
+			Message: uerrors.MessageInternalServerError,
+			Err:     res.Error,
 		}
+	}
 
-		colsToUpd["display_name"] = newData.DisplayName
+	plan.resolve(existing, opts.Upsert)
+	if opts.DryRun {
+		return plan.results, nil
 	}
 
-	if newData.Email != nil &&
-		!strings.EqualFold(*newData.Email, *before.Email) {
-		if len(*newData.Email) > emailMaxLength {
-			return &uerrors.Error{
-				Code:    uerrors.CodeEmailTooLong,
-				Message: uerrors.MessageEmailTooLong,
-				Err:     uerrors.ErrEmailTooLong,
+	err := c.DB.Transaction(func(tx *gorm.DB) error {
+		if created := plan.created(); len(created) > 0 {
+			if err := tx.Create(&created).Error; err != nil {
+				return err
 			}
 		}
 
-		if _, err := mail.ParseAddress(*newData.Email); err != nil {
-			return &uerrors.Error{
-				Code:    uerrors.CodeInvalidEmail,
-				Message: uerrors.MessageInvalidEmail,
-				Err:     uerrors.ErrInvalidEmail,
+		for i, before := range plan.replaced {
+			if before == nil || plan.users[i] == nil {
+				continue
 			}
-		}
 
-		var count int64
-		res := c.DB.Model(&User{}).
-			Scopes(byEmail(*newData.Email)).Count(&count)
-		if res.Error != nil {
-			return &uerrors.Error{
-				Code:    uerrors.CodeInternalServerError,
-				Message: uerrors.MessageInternalServerError,
-				Err:     uerrors.ErrInternalServerError,
+			after, colsToUpd := plan.replacement(i, now)
+			if len(colsToUpd) == 0 {
+				continue
 			}
-		}
 
-		if count > 0 {
-			return &uerrors.Error{
-				Code:    uerrors.CodeEmailAlreadyExists,
-				Message: uerrors.MessageEmailAlreadyExists,
-				Err:     uerrors.ErrEmailAlreadyExists,
+			res := tx.Model(&User{}).
+				Scopes(byUserID(before.ID), atVersion(before.Version)).
+				Updates(colsToUpd)
+			if res.Error != nil {
+				return res.Error
 			}
-		}
 
-		colsToUpd["email"] = *newData.Email
-	}
+			// It was changed or deleted after it was read.
+			if res.RowsAffected == 0 {
+				return versionMismatch()
+			}
 
-	if newData.Base64PasswordHash != nil {
-		password, err := base64.StdEncoding.DecodeString(*newData.Base64PasswordHash)
-		if err != nil {
-			return &uerrors.Error{
-				Code:    uerrors.CodeIncompatiblePasswordHash,
-				Message: uerrors.MessageIncompatiblePasswordHash,
-				Err:     uerrors.ErrIncompatiblePasswordHash,
+			changes := diffUser(before.ToApiUser(), after.ToApiUser(), opts.Actor, now)
+			if len(changes) == 0 {
+				continue
 			}
-		}
 
-		if len(password) != sha256.Size {
-			return &uerrors.Error{
-				Code:    uerrors.CodeIncompatiblePasswordHash,
-				Message: uerrors.MessageIncompatiblePasswordHash,
-				Err:     uerrors.ErrIncompatiblePasswordHash,
+			if err := tx.Create(&changes).Error; err != nil {
+				return err
 			}
 		}
 
-		colsToUpd["password_hash"] = password
+		return nil
+	})
+	if err != nil {
+		// The batch can be imported again, as none of it was written.
+		var uerr *uerrors.Error
+		if errors.As(err, &uerr) {
+			plan.failAll(uerr)
+			return plan.results, nil
+		}
 
-		// If a new password is provided we generate a new salt as well
-		salt, err := GenerateRandomBytes(sha256.Size)
-		if err != nil {
-			return &uerrors.Error{
-				Code:    uerrors.CodeInternalServerError,
-				Message: uerrors.MessageInternalServerError,
-				Err:     err,
-			}
+		if uerr := uniqueViolation(err); uerr != nil {
+			plan.failAll(uerr)
+			return plan.results, nil
+		}
+
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeInternalServerError,
+			Message: uerrors.MessageInternalServerError,
+			Err:     err,
 		}
-		colsToUpd["salt"] = salt
 	}
 
-	if newData.Bio != nil {
-		if len(*newData.Bio) > bioMaxLength {
-			return &uerrors.Error{
-				Code:    uerrors.CodeBioTooLong,
-				Message: uerrors.MessageBioTooLong,
-				Err:     uerrors.ErrBioTooLong,
-			}
+	plan.done()
+	return plan.results, nil
+}
+
+// bumpVersion increases the version of the user, as its ban is part of it.
+func bumpVersion(tx *gorm.DB, id int64) error {
+	return tx.Model(&User{}).
+		Scopes(byUserID(id)).
+		UpdateColumn("version", gorm.Expr("version + 1")).Error
+}
+
+// checkUserExists returns an error if the user does not exist or was
+// soft-deleted.
+func (c *Database) checkUserExists(id int64) error {
+	var count int64
+	res := c.DB.Model(&User{}).Scopes(byUserID(id)).Count(&count)
+	if res.Error != nil {
+		return &uerrors.Error{
+			Code:    uerrors.CodeInternalServerError,
+			Message: uerrors.MessageInternalServerError,
+			Err:     res.Error,
 		}
 	}
-	colsToUpd["bio"] = newData.Bio
-	colsToUpd["birthday"] = newData.Birthday
 
-	if len(colsToUpd) == 0 {
+	if count == 0 {
+		return &uerrors.Error{
+			Code:    uerrors.CodeUserNotFound,
+			Message: uerrors.MessageUserNotFound,
+			Err:     uerrors.ErrUserNotFound,
+		}
+	}
+
+	return nil
+}
+
+// loadBans sets the current ban of the provided users, if role can see it.
+func (c *Database) loadBans(users []*api.User, role api.Role) error {
+	if len(users) == 0 || !role.CanSee(api.FieldBan) {
 		return nil
 	}
 
-	res := c.DB.Model(&User{}).
-		Scopes(byUserID(id)).
-		Updates(colsToUpd)
+	ids := make([]int64, len(users))
+	for i, user := range users {
+		ids[i] = user.ID
+	}
 
+	var bans []*Ban
+	res := c.DB.Model(&Ban{}).
+		Where("user_id IN ?", ids).
+		Scopes(activeBans(time.Now())).
+		Find(&bans)
 	if res.Error != nil {
 		return &uerrors.Error{
 			Code:    uerrors.CodeInternalServerError,
@@ -513,44 +915,62 @@ func (c *Database) UpdateUser(id int64, newData *api.User) error {
 		}
 	}
 
+	attachBans(users, bans, role)
 	return nil
 }
 
-func (c *Database) DeleteUser(id int64, hardDelete bool) error {
-	{
-		var count int64
-		res := c.DB.Model(&User{}).
-			Scopes(byUserID(id)).Count(&count)
-		if res.Error != nil {
-			return &uerrors.Error{
-				Code:    uerrors.CodeInternalServerError,
-				Message: uerrors.MessageInternalServerError,
-				Err:     uerrors.ErrInternalServerError,
-			}
+func (c *Database) VerifyCredentialsByID(id int64, pwd string) (*api.CredentialsVerification, error) {
+	if err := validateUserID(id); err != nil {
+		return nil, err
+	}
+
+	return c.verifyCredentials(byUserID(id), pwd)
+}
+
+func (c *Database) VerifyCredentialsByUsername(username, pwd string) (*api.CredentialsVerification, error) {
+	if err := validateUsername(username); err != nil {
+		return nil, err
+	}
+
+	return c.verifyCredentials(byUserName(username), pwd)
+}
+
+func (c *Database) verifyCredentials(scope func(*gorm.DB) *gorm.DB, pwd string) (*api.CredentialsVerification, error) {
+	if pwd == "" {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeEmptyPassword,
+			Message: uerrors.MessageEmptyPassword,
+			Err:     uerrors.ErrEmptyPassword,
 		}
+	}
 
-		if count == 0 {
-			return &uerrors.Error{
+	var user User
+	res := c.DB.Model(&User{}).
+		Select("id", "password_hash", "salt").
+		Scopes(scope).
+		First(&user)
+	if res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return nil, &uerrors.Error{
 				Code:    uerrors.CodeUserNotFound,
 				Message: uerrors.MessageUserNotFound,
 				Err:     uerrors.ErrUserNotFound,
 			}
 		}
-	}
-
-	op := c.DB
-	if hardDelete {
-		op = op.Unscoped()
-	}
 
-	res := op.Delete(&User{}, id)
-	if res.Error != nil {
-		return &uerrors.Error{
+		return nil, &uerrors.Error{
 			Code:    uerrors.CodeInternalServerError,
 			Message: uerrors.MessageInternalServerError,
-			Err:     res.Error,
+			Err:     uerrors.ErrInternalServerError,
 		}
 	}
 
-	return nil
+	verification, err := verifyPassword(pwd, &user, c.PasswordParams)
+	if err != nil {
+		c.Logger.Err(err).Int64("user-id", user.ID).
+			Msg("could not verify password with stored hash")
+		return nil, err
+	}
+
+	return verification, nil
 }
@@ -1,28 +1,60 @@
 package database
 
-import "gorm.io/gorm"
+import (
+	"github.com/asimpleidea/ship-krew/users/api/pkg/api"
+	"gorm.io/gorm"
+)
 
-// TODO: withRole("admin|guest") => return Select()
+// Soft-deleted users are excluded by GORM itself, unless the query is
+// Unscoped: see withDeleted.
 
 func byUserName(username string) func(db *gorm.DB) *gorm.DB {
-	// TODO: support get deleted ones too
 	return func(db *gorm.DB) *gorm.DB {
 		return db.
-			Where("username = ? AND deleted_at IS NULL", username)
+			Where("username = ?", username)
 	}
 }
 
 func byUserID(id int64) func(db *gorm.DB) *gorm.DB {
-	// TODO: support get deleted ones too
 	return func(db *gorm.DB) *gorm.DB {
 		return db.
-			Where("id = ? AND deleted_at IS NULL", id)
+			Where("id = ?", id)
 	}
 }
 
 func byEmail(email string) func(db *gorm.DB) *gorm.DB {
 	return func(db *gorm.DB) *gorm.DB {
 		return db.
-			Where("email = ? AND deleted_at IS NULL", email)
+			Where("email = ?", email)
+	}
+}
+
+// atVersion only matches users that are at the provided version, unless it
+// is zero.
+func atVersion(version int64) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if version == 0 {
+			return db
+		}
+
+		return db.Where("version = ?", version)
+	}
+}
+
+// withDeleted returns soft-deleted users as well, if include is true.
+func withDeleted(include bool) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if include {
+			return db.Unscoped()
+		}
+
+		return db
+	}
+}
+
+// withRole only selects the columns that role can see.
+func withRole(role api.Role) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Select(api.VisibleFields(role))
 	}
 }
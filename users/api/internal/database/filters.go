@@ -0,0 +1,189 @@
+package database
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/asimpleidea/ship-krew/users/api/pkg/api"
+	uerrors "github.com/asimpleidea/ship-krew/users/api/pkg/errors"
+	"gorm.io/gorm"
+)
+
+const (
+	likeEscape string = "!"
+)
+
+var likeEscaper = strings.NewReplacer(likeEscape, likeEscape+likeEscape, "%", likeEscape+"%", "_", likeEscape+"_")
+
+// ListFilters contains the filters to apply when listing users. All
+// filters are combined with AND.
+type ListFilters struct {
+	// Page is only used when Cursor is empty, and it is kept for backwards
+	// compatibility: cursors should always be preferred.
+	Page *int
+	// Cursor is the opaque cursor returned with the previous page.
+	Cursor string
+	// Limit is the maximum number of users to return. If zero,
+	// resultsPerPage is used.
+	Limit int
+	// Sort is a comma separated list of columns to sort users by, each one
+	// optionally prefixed by "-" for descending order. Users are always
+	// sorted by ID at last.
+	Sort string
+	// WithTotal tells whether to count all users that match the filters.
+	WithTotal bool
+	// Role is the role of who is listing users, and determines the fields
+	// returned for each one of them and the filters that can be used.
+	Role api.Role
+
+	UsernameIn          []string
+	EmailIn             []string
+	IDIn                []int64
+	UsernameStartsWith  string
+	DisplayNameContains string
+	CreatedAfter        *time.Time
+	CreatedBefore       *time.Time
+	IncludeDeleted      bool
+}
+
+func (f *ListFilters) validate() error {
+	// Filtering on fields that cannot be seen would reveal them anyway.
+	if (len(f.EmailIn) > 0 && !f.Role.CanSee(api.FieldEmail)) ||
+		(f.IncludeDeleted && !f.Role.CanSee(api.FieldDeletedAt)) {
+		return &uerrors.Error{
+			Code:    uerrors.CodeForbidden,
+			Message: uerrors.MessageForbidden,
+			Err:     uerrors.ErrForbidden,
+		}
+	}
+
+	if f.UsernameStartsWith != "" {
+		if matched, err := regexp.MatchString(usernameRegexp, f.UsernameStartsWith); err != nil ||
+			!matched || len(f.UsernameStartsWith) > maxUsernameLength {
+			return &uerrors.Error{
+				Code:    uerrors.CodeInvalidUsernameStartsWith,
+				Message: uerrors.MessageInvalidUsernameStartsWith,
+				Err:     uerrors.ErrInvalidUsernameStartsWith,
+			}
+		}
+	}
+
+	if len(f.DisplayNameContains) > maxDisplayNameLength {
+		return &uerrors.Error{
+			Code:    uerrors.CodeInvalidDisplayNameContains,
+			Message: uerrors.MessageInvalidDisplayNameContains,
+			Err:     uerrors.ErrInvalidDisplayNameContains,
+		}
+	}
+
+	if f.CreatedAfter != nil && f.CreatedBefore != nil &&
+		!f.CreatedAfter.Before(*f.CreatedBefore) {
+		return &uerrors.Error{
+			Code:    uerrors.CodeInvalidDateRange,
+			Message: uerrors.MessageInvalidDateRange,
+			Err:     uerrors.ErrInvalidDateRange,
+		}
+	}
+
+	return nil
+}
+
+// apply adds the filters to query. Pagination is not applied here.
+func (f *ListFilters) apply(query *gorm.DB) *gorm.DB {
+	if f.IncludeDeleted {
+		query = query.Unscoped()
+	}
+
+	if len(f.UsernameIn) > 0 {
+		query = query.Where("username IN ?", f.UsernameIn)
+	}
+
+	if len(f.EmailIn) > 0 {
+		query = query.Where("email IN ?", f.EmailIn)
+	}
+
+	if len(f.IDIn) > 0 {
+		query = query.Where("id IN ?", f.IDIn)
+	}
+
+	if f.UsernameStartsWith != "" {
+		query = query.Where("username LIKE ? ESCAPE '"+likeEscape+"'",
+			likeEscaper.Replace(f.UsernameStartsWith)+"%")
+	}
+
+	if f.DisplayNameContains != "" {
+		query = query.Where("display_name LIKE ? ESCAPE '"+likeEscape+"'",
+			"%"+likeEscaper.Replace(f.DisplayNameContains)+"%")
+	}
+
+	if f.CreatedAfter != nil {
+		query = query.Where("created_at > ?", *f.CreatedAfter)
+	}
+
+	if f.CreatedBefore != nil {
+		query = query.Where("created_at < ?", *f.CreatedBefore)
+	}
+
+	return query
+}
+
+// matches returns true if u satisfies the filters, with the same semantics
+// as apply.
+func (f *ListFilters) matches(u *User) bool {
+	if u.DeletedAt.Valid && !f.IncludeDeleted {
+		return false
+	}
+
+	if len(f.UsernameIn) > 0 && !containsFold(f.UsernameIn, u.Username) {
+		return false
+	}
+
+	if len(f.EmailIn) > 0 && !containsFold(f.EmailIn, u.Email) {
+		return false
+	}
+
+	if len(f.IDIn) > 0 {
+		found := false
+		for _, id := range f.IDIn {
+			if id == u.ID {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if f.UsernameStartsWith != "" &&
+		!strings.HasPrefix(strings.ToLower(u.Username), strings.ToLower(f.UsernameStartsWith)) {
+		return false
+	}
+
+	if f.DisplayNameContains != "" &&
+		!strings.Contains(strings.ToLower(u.DisplayName), strings.ToLower(f.DisplayNameContains)) {
+		return false
+	}
+
+	if f.CreatedAfter != nil && !u.CreatedAt.After(*f.CreatedAfter) {
+		return false
+	}
+
+	if f.CreatedBefore != nil && !u.CreatedAt.Before(*f.CreatedBefore) {
+		return false
+	}
+
+	return true
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,173 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/asimpleidea/ship-krew/users/api/pkg/api"
+	uerrors "github.com/asimpleidea/ship-krew/users/api/pkg/errors"
+)
+
+const (
+	birthdayFormat string = time.RFC3339
+)
+
+// historyFields are the fields whose changes are recorded in the history.
+var historyFields = []string{
+	api.FieldUsername,
+	api.FieldDisplayName,
+	api.FieldEmail,
+	api.FieldBirthday,
+}
+
+// Actor is who makes a change, as recorded in the history.
+type Actor struct {
+	// Caller is the name of the service making the change.
+	Caller string
+	// UserID is the ID of the user on whose behalf the service is making
+	// the change, or zero if the service is acting on its own.
+	UserID int64
+}
+
+// HistoryOptions contains the options for getting the history of a user.
+// A nil *HistoryOptions is valid and means the defaults.
+type HistoryOptions struct {
+	// Fields only returns changes to these fields. If empty, changes to
+	// all fields that Role can see are returned.
+	Fields []string
+	// Role is the role of who is getting the history: changes to fields
+	// they cannot see are never returned.
+	Role api.Role
+}
+
+// fields returns the fields to get the history of, after validating them.
+func (o *HistoryOptions) fields() ([]string, error) {
+	var role api.Role
+	var requested []string
+	if o != nil {
+		role, requested = o.Role, o.Fields
+	}
+
+	if len(requested) == 0 {
+		fields := []string{}
+		for _, field := range historyFields {
+			if role.CanSee(field) {
+				fields = append(fields, field)
+			}
+		}
+
+		return fields, nil
+	}
+
+	for _, field := range requested {
+		tracked := false
+		for _, f := range historyFields {
+			if f == field {
+				tracked = true
+				break
+			}
+		}
+
+		if !tracked {
+			return nil, &uerrors.Error{
+				Code:    uerrors.CodeInvalidHistoryField,
+				Message: uerrors.MessageInvalidHistoryField,
+				Err:     fmt.Errorf("%w: %s", uerrors.ErrInvalidHistoryField, field),
+			}
+		}
+
+		if !role.CanSee(field) {
+			return nil, &uerrors.Error{
+				Code:    uerrors.CodeForbidden,
+				Message: uerrors.MessageForbidden,
+				Err:     fmt.Errorf("%w: cannot see %s", uerrors.ErrForbidden, field),
+			}
+		}
+	}
+
+	return requested, nil
+}
+
+// diffUser returns the changes between before and after, made by actor at
+// the provided time.
+func diffUser(before, after *api.User, actor *Actor, at time.Time) []*UserChange {
+	changes := []*UserChange{}
+	add := func(field string, oldValue, newValue *string) {
+		change := &UserChange{
+			UserID:    before.ID,
+			Field:     field,
+			ChangedAt: at,
+		}
+
+		if oldValue != nil {
+			change.OldValue = sql.NullString{String: *oldValue, Valid: true}
+		}
+
+		if newValue != nil {
+			change.NewValue = sql.NullString{String: *newValue, Valid: true}
+		}
+
+		if actor != nil {
+			change.Caller = actor.Caller
+			if actor.UserID != 0 {
+				change.ActorID = sql.NullInt64{Int64: actor.UserID, Valid: true}
+			}
+		}
+
+		changes = append(changes, change)
+	}
+
+	if before.Username != after.Username {
+		add(api.FieldUsername, &before.Username, &after.Username)
+	}
+
+	if before.DisplayName != after.DisplayName {
+		add(api.FieldDisplayName, &before.DisplayName, &after.DisplayName)
+	}
+
+	if !equalStrings(before.Email, after.Email) {
+		add(api.FieldEmail, before.Email, after.Email)
+	}
+
+	if !equalTimes(before.Birthday, after.Birthday) {
+		add(api.FieldBirthday, formatBirthday(before.Birthday), formatBirthday(after.Birthday))
+	}
+
+	return changes
+}
+
+func equalStrings(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return *a == *b
+}
+
+func equalTimes(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.Equal(*b)
+}
+
+func formatBirthday(birthday *time.Time) *string {
+	if birthday == nil {
+		return nil
+	}
+
+	formatted := birthday.UTC().Format(birthdayFormat)
+	return &formatted
+}
+
+func historyOf(changes []*UserChange) *api.UserHistory {
+	history := &api.UserHistory{Changes: make([]*api.UserChange, len(changes))}
+	for i, change := range changes {
+		c := *change
+		history.Changes[i] = c.ToApiUserChange()
+	}
+
+	return history
+}
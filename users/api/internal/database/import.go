@@ -0,0 +1,435 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/asimpleidea/ship-krew/users/api/internal/password"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/api"
+	uerrors "github.com/asimpleidea/ship-krew/users/api/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// ImportOptions contains the options for importing users. A nil
+// *ImportOptions is valid and means the defaults.
+type ImportOptions struct {
+	// Upsert replaces the users that already exist with the same username,
+	// rather than failing them.
+	Upsert bool
+	// DryRun only validates the users and tells what would happen to them.
+	DryRun bool
+	// Actor is who imports the users, as recorded in the history of the
+	// ones that are replaced.
+	Actor *Actor
+}
+
+// ImportResult is the outcome of importing a single user.
+type ImportResult struct {
+	// ID is the ID of the user. It is zero if the user failed, or if it
+	// would be created by a dry run.
+	ID int64
+	// Updated tells whether an existing user was replaced.
+	Updated bool
+	// Rehash tells whether the password of the user will be hashed again
+	// at their next login.
+	Rehash bool
+	Err    error
+}
+
+// importPlan is what happens to each user of a batch being imported: the
+// ones with a model are written, the others failed.
+type importPlan struct {
+	users []*User
+	// passwords tells whether each user has a new password.
+	passwords []bool
+	// replaced contains the existing user that each one replaces, if any.
+	replaced []*User
+	results  []*ImportResult
+
+	usernames map[string]bool
+	emails    map[string]bool
+}
+
+// planImport validates the users to import and builds their models. Users
+// that share their username or email with one before them fail.
+//
+// Passwords are only hashed if hash is true, as it is expensive on purpose:
+// dry runs only validate them.
+func planImport(users []*api.ImportedUser, params *password.Params, hash bool, now time.Time) *importPlan {
+	if params == nil {
+		params = password.DefaultParams()
+	}
+
+	plan := &importPlan{
+		users:     make([]*User, len(users)),
+		passwords: make([]bool, len(users)),
+		replaced:  make([]*User, len(users)),
+		results:   make([]*ImportResult, len(users)),
+		usernames: map[string]bool{},
+		emails:    map[string]bool{},
+	}
+
+	for i, imported := range users {
+		plan.results[i] = &ImportResult{}
+
+		user, err := importedUser(imported, now)
+		if err == nil {
+			plan.passwords[i], plan.results[i].Rehash, err = importedPassword(user, imported, params, hash)
+		}
+
+		if err == nil {
+			switch {
+			case plan.usernames[strings.ToLower(user.Username)]:
+				err = usernameTaken()
+			case plan.emails[strings.ToLower(user.Email)]:
+				err = emailTaken()
+			}
+		}
+
+		if err != nil {
+			plan.fail(i, err)
+			continue
+		}
+
+		plan.users[i] = user
+		plan.usernames[strings.ToLower(user.Username)] = true
+		plan.emails[strings.ToLower(user.Email)] = true
+	}
+
+	return plan
+}
+
+// importedUser validates the fields of imported, except the password, and
+// returns the model of the user to create.
+func importedUser(imported *api.ImportedUser, now time.Time) (*User, error) {
+	if err := validateUsername(imported.Username); err != nil {
+		return nil, err
+	}
+
+	if err := validateDisplayName(imported.DisplayName); err != nil {
+		return nil, err
+	}
+
+	if err := validateEmail(&imported.Email); err != nil {
+		return nil, err
+	}
+
+	if err := validateRegistrationIP(imported.RegistrationIP); err != nil {
+		return nil, err
+	}
+
+	if err := validateBio(imported.Bio); err != nil {
+		return nil, err
+	}
+
+	user := &User{
+		CreatedAt:      now,
+		UpdatedAt:      now,
+		Version:        1,
+		Username:       imported.Username,
+		DisplayName:    imported.DisplayName,
+		Email:          imported.Email,
+		RegistrationIP: imported.RegistrationIP.String(),
+	}
+
+	if imported.CreatedAt != nil {
+		user.CreatedAt = *imported.CreatedAt
+	}
+
+	if imported.EmailVerifiedAt != nil {
+		user.EmailVerifiedAt = sql.NullTime{Time: *imported.EmailVerifiedAt, Valid: true}
+	}
+
+	if imported.Bio != nil {
+		user.Bio = sql.NullString{String: *imported.Bio, Valid: true}
+	}
+
+	if imported.Birthday != nil {
+		user.Birthday = sql.NullTime{Time: *imported.Birthday, Valid: true}
+	}
+
+	return user, nil
+}
+
+// importedPassword sets the password hash of user from imported, and tells
+// whether it has one and whether it will need a rehash.
+func importedPassword(user *User, imported *api.ImportedUser, params *password.Params, hash bool) (bool, bool, error) {
+	switch {
+	case imported.Password != nil && imported.PasswordHash != "":
+		return false, false, invalidImportRow("either a password or a password hash can be provided")
+	case imported.Password != nil:
+		if !hash {
+			return true, false, validatePassword(imported.Password)
+		}
+
+		h, err := hashPassword(imported.Password, params)
+		if err != nil {
+			return false, false, err
+		}
+
+		user.PasswordHash = []byte(h)
+		return true, false, nil
+	case imported.PasswordHash != "":
+		encoded, salt, err := importedHash(imported.PasswordHash, imported.PasswordSalt)
+		if err != nil {
+			return false, false, err
+		}
+
+		user.PasswordHash, user.Salt = encoded, salt
+		return true, params.NeedsRehash(encoded), nil
+	case imported.PasswordSalt != "":
+		return false, false, invalidImportRow("a password salt needs a password hash")
+	default:
+		return false, false, nil
+	}
+}
+
+// importedHash returns the hash and the salt to store for a hash that was
+// produced somewhere else.
+func importedHash(hash, salt string) ([]byte, []byte, error) {
+	if !password.IsLegacy([]byte(hash)) {
+		if salt != "" {
+			return nil, nil, invalidImportRow("the salt is part of the password hash")
+		}
+
+		if err := password.CheckHash([]byte(hash)); err != nil {
+			return nil, nil, &uerrors.Error{
+				Code:    uerrors.CodeIncompatiblePasswordHash,
+				Message: uerrors.MessageIncompatiblePasswordHash,
+				Err:     err,
+			}
+		}
+
+		return []byte(hash), nil, nil
+	}
+
+	decodedSalt, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil {
+		return nil, nil, &uerrors.Error{
+			Code:    uerrors.CodeInvalidBase64Salt,
+			Message: uerrors.MessageInvalidBase64Salt,
+			Err:     uerrors.ErrInvalidBase64Salt,
+		}
+	}
+
+	if len(decodedSalt) == 0 {
+		return nil, nil, &uerrors.Error{
+			Code:    uerrors.CodeInvalidSaltLength,
+			Message: uerrors.MessageInvalidSaltLength,
+			Err:     uerrors.ErrInvalidSaltLength,
+		}
+	}
+
+	digest, err := base64.StdEncoding.DecodeString(hash)
+	if err != nil {
+		return nil, nil, &uerrors.Error{
+			Code:    uerrors.CodeIncompatiblePasswordHash,
+			Message: uerrors.MessageIncompatiblePasswordHash,
+			Err:     uerrors.ErrIncompatiblePasswordHash,
+		}
+	}
+
+	encoded, err := password.LegacyHash(digest, decodedSalt)
+	if err != nil {
+		return nil, nil, &uerrors.Error{
+			Code:    uerrors.CodeIncompatiblePasswordHash,
+			Message: uerrors.MessageIncompatiblePasswordHash,
+			Err:     err,
+		}
+	}
+
+	return encoded, decodedSalt, nil
+}
+
+// keys returns the usernames and the emails of the users to write, in
+// lowercase.
+func (p *importPlan) keys() ([]string, []string) {
+	usernames := make([]string, 0, len(p.usernames))
+	for username := range p.usernames {
+		usernames = append(usernames, username)
+	}
+
+	emails := make([]string, 0, len(p.emails))
+	for email := range p.emails {
+		emails = append(emails, email)
+	}
+
+	return usernames, emails
+}
+
+// conflicts tells whether u has the username or the email of any of the
+// users to write.
+func (p *importPlan) conflicts(u *User) bool {
+	return p.usernames[strings.ToLower(u.Username)] || p.emails[strings.ToLower(u.Email)]
+}
+
+// resolve decides whether each user is created or replaces one of existing,
+// which must contain all users, deleted ones included, that conflict with
+// the users to write.
+func (p *importPlan) resolve(existing []*User, upsert bool) {
+	for i, user := range p.users {
+		if user == nil {
+			continue
+		}
+
+		var replaced *User
+		for _, e := range existing {
+			if strings.EqualFold(e.Username, user.Username) {
+				replaced = e
+				break
+			}
+		}
+
+		var err error
+		switch {
+		// Deleted users are not brought back by imports.
+		case replaced != nil && (!upsert || replaced.DeletedAt.Valid):
+			err = usernameTaken()
+		case replaced == nil && !p.passwords[i]:
+			err = &uerrors.Error{
+				Code:    uerrors.CodeEmptyPassword,
+				Message: uerrors.MessageEmptyPassword,
+				Err:     uerrors.ErrEmptyPassword,
+			}
+		default:
+			for _, e := range existing {
+				if strings.EqualFold(e.Email, user.Email) && (replaced == nil || e.ID != replaced.ID) {
+					err = emailTaken()
+					break
+				}
+			}
+		}
+
+		if err != nil {
+			p.fail(i, err)
+			continue
+		}
+
+		if replaced != nil {
+			p.replaced[i] = replaced
+			p.results[i].ID = replaced.ID
+			p.results[i].Updated = true
+		}
+	}
+}
+
+// created returns the users to create.
+func (p *importPlan) created() []*User {
+	created := []*User{}
+	for i, user := range p.users {
+		if user != nil && p.replaced[i] == nil {
+			created = append(created, user)
+		}
+	}
+
+	return created
+}
+
+// replacement returns the user that replaced user i as it is after being
+// replaced, and the columns that are changed. No columns are returned if the
+// user is the same as before, i.e. when importing again what was exported,
+// so that its version stays the same.
+func (p *importPlan) replacement(i int, now time.Time) (*User, map[string]interface{}) {
+	before, user := p.replaced[i], p.users[i]
+
+	after := *before
+	after.Username = user.Username
+	after.DisplayName = user.DisplayName
+	after.Email = user.Email
+	after.Bio = user.Bio
+	after.Birthday = user.Birthday
+
+	switch {
+	case user.EmailVerifiedAt.Valid:
+		after.EmailVerifiedAt = user.EmailVerifiedAt
+	case !strings.EqualFold(before.Email, user.Email):
+		// The new address must be verified again.
+		after.EmailVerifiedAt = sql.NullTime{}
+	}
+
+	if p.passwords[i] {
+		after.PasswordHash, after.Salt = user.PasswordHash, user.Salt
+	}
+
+	if !p.passwords[i] &&
+		after.Username == before.Username &&
+		after.DisplayName == before.DisplayName &&
+		after.Email == before.Email &&
+		after.Bio == before.Bio &&
+		sameTime(after.Birthday, before.Birthday) &&
+		sameTime(after.EmailVerifiedAt, before.EmailVerifiedAt) {
+		return before, nil
+	}
+
+	after.UpdatedAt = now
+	after.Version++
+
+	return &after, map[string]interface{}{
+		"username":          after.Username,
+		"display_name":      after.DisplayName,
+		"email":             after.Email,
+		"email_verified_at": after.EmailVerifiedAt,
+		"bio":               after.Bio,
+		"birthday":          after.Birthday,
+		"password_hash":     after.PasswordHash,
+		"salt":              after.Salt,
+		"version":           gorm.Expr("version + 1"),
+	}
+}
+
+func sameTime(a, b sql.NullTime) bool {
+	return a.Valid == b.Valid && a.Time.Equal(b.Time)
+}
+
+// done sets the IDs of the users that were created.
+func (p *importPlan) done() {
+	for i, user := range p.users {
+		if user != nil && p.replaced[i] == nil {
+			p.results[i].ID = user.ID
+		}
+	}
+}
+
+func (p *importPlan) fail(i int, err error) {
+	p.users[i] = nil
+	p.results[i].ID = 0
+	p.results[i].Updated = false
+	p.results[i].Rehash = false
+	p.results[i].Err = err
+}
+
+// failAll fails all the users to write, i.e. when the batch could not be
+// written.
+func (p *importPlan) failAll(err error) {
+	for i, user := range p.users {
+		if user != nil {
+			p.fail(i, err)
+		}
+	}
+}
+
+func usernameTaken() error {
+	return &uerrors.Error{
+		Code:    uerrors.CodeUsernameAlreadyExists,
+		Message: uerrors.MessageUsernameAlreadyExists,
+		Err:     uerrors.ErrUsernameAlreadyExists,
+	}
+}
+
+func emailTaken() error {
+	return &uerrors.Error{
+		Code:    uerrors.CodeEmailAlreadyExists,
+		Message: uerrors.MessageEmailAlreadyExists,
+		Err:     uerrors.ErrEmailAlreadyExists,
+	}
+}
+
+func invalidImportRow(reason string) error {
+	return &uerrors.Error{
+		Code:    uerrors.CodeInvalidImportRow,
+		Message: uerrors.MessageInvalidImportRow + " " + reason,
+		Err:     uerrors.ErrInvalidImportRow,
+	}
+}
@@ -0,0 +1,46 @@
+package database
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/asimpleidea/ship-krew/users/api/pkg/api"
+	uerrors "github.com/asimpleidea/ship-krew/users/api/pkg/errors"
+)
+
+func TestPlanImportRejectsUnusableHashes(t *testing.T) {
+	const salt, key = "c29tZXNhbHRzb21lc2FsdA", "RdescudvJCsgt3ub+b+dWRWJTmaaJObGRdescudvJCs"
+
+	cases := []struct {
+		name   string
+		params string
+		code   int
+	}{
+		{"valid", "m=65536,t=3,p=2", 0},
+		{"no passes", "m=65536,t=0,p=2", uerrors.CodeIncompatiblePasswordHash},
+		{"no threads", "m=65536,t=3,p=0", uerrors.CodeIncompatiblePasswordHash},
+		{"too much memory", "m=4294967295,t=3,p=2", uerrors.CodeIncompatiblePasswordHash},
+	}
+
+	ip := net.ParseIP("10.0.0.1")
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			plan := planImport([]*api.ImportedUser{{
+				Username:       "imported",
+				DisplayName:    "Imported",
+				Email:          "imported@example.com",
+				PasswordHash:   "$argon2id$v=19$" + c.params + "$" + salt + "$" + key,
+				RegistrationIP: &ip,
+			}}, nil, false, time.Now())
+
+			err := plan.results[0].Err
+			switch {
+			case c.code == 0 && err != nil:
+				t.Fatalf("unexpected error %v", err)
+			case c.code != 0 && (err == nil || err.(*uerrors.Error).Code != c.code):
+				t.Fatalf("error is %v, expected code %d", err, c.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,834 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asimpleidea/ship-krew/users/api/internal/password"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/api"
+	uerrors "github.com/asimpleidea/ship-krew/users/api/pkg/errors"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+)
+
+// Memory is a UserStore that keeps all users in memory, and is therefore
+// lost when the program exits. It is meant for local runs and tests, where
+// no external database is available.
+//
+// Usernames and emails are compared case-insensitively, just like MySQL
+// does with the default collation.
+//
+// The zero value is ready to use.
+type Memory struct {
+	Logger zerolog.Logger
+	// PasswordParams are the parameters used to hash passwords. If nil,
+	// password.DefaultParams is used.
+	PasswordParams *password.Params
+
+	lock         sync.RWMutex
+	users        map[int64]*User
+	lastID       int64
+	changes      map[int64][]*UserChange
+	lastChangeID int64
+	bans         map[int64][]*Ban
+	lastBanID    int64
+}
+
+// WithContext returns m itself, as there are no queries to trace.
+func (m *Memory) WithContext(context.Context) UserStore {
+	return m
+}
+
+// find returns the first non-deleted user that satisfies match. It must be
+// called with the lock held.
+func (m *Memory) find(match func(*User) bool) *User {
+	for _, user := range m.users {
+		if !user.DeletedAt.Valid && match(user) {
+			return user
+		}
+	}
+
+	return nil
+}
+
+// taken returns true if any user satisfies match, deleted ones included, as
+// the unique indexes of the databases cover them as well. It must be called
+// with the lock held.
+func (m *Memory) taken(match func(*User) bool) bool {
+	for _, user := range m.users {
+		if match(user) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *Memory) GetUserByUsername(username string, opts *GetOptions) (*api.User, error) {
+	if err := validateUsername(username); err != nil {
+		return nil, err
+	}
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	var user *User
+	for _, u := range m.users {
+		if (!u.DeletedAt.Valid || opts.includeDeleted()) &&
+			strings.EqualFold(u.Username, username) {
+			user = u
+			break
+		}
+	}
+
+	if user == nil {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeUserNotFound,
+			Message: uerrors.MessageUserNotFound,
+			Err:     uerrors.ErrUserNotFound,
+		}
+	}
+
+	found := *user
+	projected := found.ToApiUser().Project(opts.role())
+	m.loadBans([]*api.User{projected}, opts.role())
+
+	return projected, nil
+}
+
+func (m *Memory) GetUserByID(id int64, opts *GetOptions) (*api.User, error) {
+	if err := validateUserID(id); err != nil {
+		return nil, err
+	}
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	user, exists := m.users[id]
+	if !exists || (user.DeletedAt.Valid && !opts.includeDeleted()) {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeUserNotFound,
+			Message: uerrors.MessageUserNotFound,
+			Err:     uerrors.ErrUserNotFound,
+		}
+	}
+
+	found := *user
+	projected := found.ToApiUser().Project(opts.role())
+	m.loadBans([]*api.User{projected}, opts.role())
+
+	return projected, nil
+}
+
+func (m *Memory) CreateUser(user *api.User) (*api.User, error) {
+	if err := validateUsername(user.Username); err != nil {
+		return nil, err
+	}
+
+	if err := validateDisplayName(user.DisplayName); err != nil {
+		return nil, err
+	}
+
+	if err := validateEmail(user.Email); err != nil {
+		return nil, err
+	}
+
+	if err := validateRegistrationIP(user.RegistrationIP); err != nil {
+		return nil, err
+	}
+
+	if err := validateBio(user.Bio); err != nil {
+		return nil, err
+	}
+
+	// Hash before taking the lock, as it is expensive on purpose.
+	hash, err := hashPassword(user.Password, m.PasswordParams)
+	if err != nil {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.taken(func(u *User) bool {
+		return strings.EqualFold(u.Username, user.Username)
+	}) {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeUsernameAlreadyExists,
+			Message: uerrors.MessageUsernameAlreadyExists,
+			Err:     uerrors.ErrUsernameAlreadyExists,
+		}
+	}
+
+	if m.taken(func(u *User) bool {
+		return strings.EqualFold(u.Email, *user.Email)
+	}) {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeEmailAlreadyExists,
+			Message: uerrors.MessageEmailAlreadyExists,
+			Err:     uerrors.ErrEmailAlreadyExists,
+		}
+	}
+
+	now := time.Now()
+	m.lastID++
+	userToCreate := &User{
+		ID:             m.lastID,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+		Version:        1,
+		PasswordHash:   []byte(hash),
+		Username:       user.Username,
+		DisplayName:    user.DisplayName,
+		Email:          *user.Email,
+		RegistrationIP: user.RegistrationIP.String(),
+	}
+
+	if user.Bio != nil {
+		userToCreate.Bio = sql.NullString{String: *user.Bio, Valid: true}
+	}
+
+	if user.Birthday != nil {
+		userToCreate.Birthday = sql.NullTime{Time: *user.Birthday, Valid: true}
+	}
+
+	if m.users == nil {
+		m.users = map[int64]*User{}
+	}
+	m.users[userToCreate.ID] = userToCreate
+
+	return createdUser(user, userToCreate), nil
+}
+
+func (m *Memory) ListUsers(filters *ListFilters) (*api.UserList, error) {
+	if filters == nil {
+		filters = &ListFilters{}
+	}
+
+	if err := filters.validate(); err != nil {
+		return nil, err
+	}
+
+	keys, pivot, err := filters.pagination()
+	if err != nil {
+		return nil, err
+	}
+
+	m.lock.RLock()
+	users := []*User{}
+	for _, user := range m.users {
+		if filters.matches(user) {
+			users = append(users, user)
+		}
+	}
+	m.lock.RUnlock()
+
+	var total *int64
+	if filters.WithTotal {
+		count := int64(len(users))
+		total = &count
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return compareUsers(keys, users[i], users[j]) < 0
+	})
+
+	limit := filters.limit()
+	switch {
+	case pivot != nil:
+		start := sort.Search(len(users), func(i int) bool {
+			return compareUsers(keys, users[i], pivot) > 0
+		})
+		users = users[start:]
+	case filters.Page != nil && *filters.Page > 0:
+		offset := (*filters.Page - 1) * limit
+		if offset > len(users) {
+			offset = len(users)
+		}
+		users = users[offset:]
+	}
+
+	if len(users) > limit+1 {
+		users = users[:limit+1]
+	}
+
+	list := pageOf(users, limit, keys, total, filters.Role)
+
+	m.lock.RLock()
+	m.loadBans(list.Users, filters.Role)
+	m.lock.RUnlock()
+
+	return list, nil
+}
+
+func (m *Memory) UpdateUser(id int64, patch *api.UserPatch, actor *Actor, version int64) (*api.User, error) {
+	if err := validateUserID(id); err != nil {
+		return nil, err
+	}
+
+	if err := validatePatch(patch); err != nil {
+		return nil, err
+	}
+
+	var hash string
+	if patch.Password != nil {
+		h, err := hashPassword(patch.Password, m.PasswordParams)
+		if err != nil {
+			return nil, err
+		}
+
+		hash = h
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	user, exists := m.users[id]
+	if !exists || user.DeletedAt.Valid {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeUserNotFound,
+			Message: uerrors.MessageUserNotFound,
+			Err:     uerrors.ErrUserNotFound,
+		}
+	}
+
+	if version != 0 && user.Version != version {
+		return nil, versionMismatch()
+	}
+
+	if patch.Username != nil &&
+		!strings.EqualFold(*patch.Username, user.Username) &&
+		m.taken(func(u *User) bool {
+			return strings.EqualFold(u.Username, *patch.Username)
+		}) {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeUsernameAlreadyExists,
+			Message: uerrors.MessageUsernameAlreadyExists,
+			Err:     uerrors.ErrUsernameAlreadyExists,
+		}
+	}
+
+	if patch.Email != nil &&
+		!strings.EqualFold(*patch.Email, user.Email) &&
+		m.taken(func(u *User) bool {
+			return strings.EqualFold(u.Email, *patch.Email)
+		}) {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeEmailAlreadyExists,
+			Message: uerrors.MessageEmailAlreadyExists,
+			Err:     uerrors.ErrEmailAlreadyExists,
+		}
+	}
+
+	// Work on a copy, so that readers that already have the user never see
+	// a half-updated one.
+	updated := *user
+
+	// Like the columns updated by Database, so that the version only changes
+	// with the user.
+	changed := false
+
+	if patch.Username != nil && !strings.EqualFold(*patch.Username, user.Username) {
+		updated.Username = *patch.Username
+		changed = true
+	}
+
+	if patch.DisplayName != nil && *patch.DisplayName != user.DisplayName {
+		updated.DisplayName = *patch.DisplayName
+		changed = true
+	}
+
+	if patch.Email != nil && !strings.EqualFold(*patch.Email, user.Email) {
+		// The new address must be verified again.
+		updated.EmailVerifiedAt = sql.NullTime{}
+		updated.Email = *patch.Email
+		changed = true
+	}
+
+	if hash != "" {
+		updated.PasswordHash = []byte(hash)
+		updated.Salt = nil
+		changed = true
+	}
+
+	switch {
+	case patch.Bio != nil:
+		updated.Bio = sql.NullString{String: *patch.Bio, Valid: true}
+		changed = true
+	case patch.RemoveBio:
+		updated.Bio = sql.NullString{}
+		changed = true
+	}
+
+	switch {
+	case patch.Birthday != nil:
+		updated.Birthday = sql.NullTime{Time: *patch.Birthday, Valid: true}
+		changed = true
+	case patch.RemoveBirthday:
+		updated.Birthday = sql.NullTime{}
+		changed = true
+	}
+
+	if !changed {
+		found := *user
+		projected := found.ToApiUser().Project(api.RoleAdmin)
+		m.loadBans([]*api.User{projected}, api.RoleAdmin)
+
+		return projected, nil
+	}
+
+	updated.UpdatedAt = time.Now()
+	updated.Version++
+
+	before, after := *user, updated
+	changes := diffUser(before.ToApiUser(), after.ToApiUser(), actor, updated.UpdatedAt)
+	if len(changes) > 0 && m.changes == nil {
+		m.changes = map[int64][]*UserChange{}
+	}
+
+	for _, change := range changes {
+		m.lastChangeID++
+		change.ID = m.lastChangeID
+		m.changes[id] = append(m.changes[id], change)
+	}
+
+	m.users[id] = &updated
+
+	found := updated
+	projected := found.ToApiUser().Project(api.RoleAdmin)
+	m.loadBans([]*api.User{projected}, api.RoleAdmin)
+
+	return projected, nil
+}
+
+func (m *Memory) DeleteUser(id int64, hardDelete bool, version int64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	user, exists := m.users[id]
+	if !exists || user.DeletedAt.Valid {
+		return &uerrors.Error{
+			Code:    uerrors.CodeUserNotFound,
+			Message: uerrors.MessageUserNotFound,
+			Err:     uerrors.ErrUserNotFound,
+		}
+	}
+
+	if version != 0 && user.Version != version {
+		return versionMismatch()
+	}
+
+	if hardDelete {
+		delete(m.users, id)
+		delete(m.changes, id)
+		delete(m.bans, id)
+		return nil
+	}
+
+	deleted := *user
+	deleted.DeletedAt = gorm.DeletedAt{Time: time.Now(), Valid: true}
+	deleted.Version++
+	m.users[id] = &deleted
+
+	return nil
+}
+
+func (m *Memory) RestoreUser(id int64) (*api.User, error) {
+	if err := validateUserID(id); err != nil {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	user, exists := m.users[id]
+	if !exists {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeUserNotFound,
+			Message: uerrors.MessageUserNotFound,
+			Err:     uerrors.ErrUserNotFound,
+		}
+	}
+
+	if !user.DeletedAt.Valid {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeUserNotDeleted,
+			Message: uerrors.MessageUserNotDeleted,
+			Err:     uerrors.ErrUserNotDeleted,
+		}
+	}
+
+	restored := *user
+	restored.DeletedAt = gorm.DeletedAt{}
+	restored.UpdatedAt = time.Now()
+	restored.Version++
+	m.users[id] = &restored
+
+	found := restored
+	projected := found.ToApiUser()
+	m.loadBans([]*api.User{projected}, api.RoleAdmin)
+
+	return projected, nil
+}
+
+func (m *Memory) GetUserHistory(id int64, opts *HistoryOptions) (*api.UserHistory, error) {
+	if err := validateUserID(id); err != nil {
+		return nil, err
+	}
+
+	fields, err := opts.fields()
+	if err != nil {
+		return nil, err
+	}
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	user, exists := m.users[id]
+	if !exists || user.DeletedAt.Valid {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeUserNotFound,
+			Message: uerrors.MessageUserNotFound,
+			Err:     uerrors.ErrUserNotFound,
+		}
+	}
+
+	// Changes are stored in chronological order, but the most recent ones
+	// must come first.
+	changes := []*UserChange{}
+	userChanges := m.changes[id]
+	for i := len(userChanges) - 1; i >= 0; i-- {
+		for _, field := range fields {
+			if userChanges[i].Field == field {
+				changes = append(changes, userChanges[i])
+				break
+			}
+		}
+	}
+
+	return historyOf(changes), nil
+}
+
+func (m *Memory) SetPassword(id int64, pwd string) error {
+	if err := validateUserID(id); err != nil {
+		return err
+	}
+
+	hash, err := hashPassword(&pwd, m.PasswordParams)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	user, exists := m.users[id]
+	if !exists || user.DeletedAt.Valid {
+		return &uerrors.Error{
+			Code:    uerrors.CodeUserNotFound,
+			Message: uerrors.MessageUserNotFound,
+			Err:     uerrors.ErrUserNotFound,
+		}
+	}
+
+	updated := *user
+	updated.PasswordHash = []byte(hash)
+	updated.Salt = nil
+	updated.UpdatedAt = time.Now()
+	updated.Version++
+	m.users[id] = &updated
+
+	return nil
+}
+
+func (m *Memory) VerifyEmail(id int64, email string) (*api.User, error) {
+	if err := validateUserID(id); err != nil {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	user, exists := m.users[id]
+	if !exists || user.DeletedAt.Valid {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeUserNotFound,
+			Message: uerrors.MessageUserNotFound,
+			Err:     uerrors.ErrUserNotFound,
+		}
+	}
+
+	if !strings.EqualFold(user.Email, email) {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeEmailMismatch,
+			Message: uerrors.MessageEmailMismatch,
+			Err:     uerrors.ErrEmailMismatch,
+		}
+	}
+
+	if !user.EmailVerifiedAt.Valid {
+		verified := *user
+		verified.UpdatedAt = time.Now()
+		verified.Version++
+		verified.EmailVerifiedAt = sql.NullTime{Time: verified.UpdatedAt, Valid: true}
+		m.users[id] = &verified
+		user = &verified
+	}
+
+	found := *user
+	projected := found.ToApiUser().Project(api.RoleService)
+	m.loadBans([]*api.User{projected}, api.RoleService)
+
+	return projected, nil
+}
+
+func (m *Memory) IssueBan(userID int64, ban *api.Ban, actor *Actor) (*api.Ban, error) {
+	if err := validateUserID(userID); err != nil {
+		return nil, err
+	}
+
+	created, err := newBan(userID, ban, actor, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err := m.checkUserExists(userID); err != nil {
+		return nil, err
+	}
+
+	m.lastBanID++
+	created.ID = m.lastBanID
+	if m.bans == nil {
+		m.bans = map[int64][]*Ban{}
+	}
+	m.bans[userID] = append(m.bans[userID], created)
+	m.bumpVersion(userID)
+
+	stored := *created
+	return stored.ToApiBan(), nil
+}
+
+func (m *Memory) ListBans(userID int64, activeOnly bool) (*api.BanList, error) {
+	if err := validateUserID(userID); err != nil {
+		return nil, err
+	}
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if err := m.checkUserExists(userID); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	list := &api.BanList{Bans: []*api.Ban{}}
+	for _, ban := range m.bans[userID] {
+		stored := *ban
+		found := stored.ToApiBan()
+		if !activeOnly || found.IsActive(now) {
+			list.Bans = append(list.Bans, found)
+		}
+	}
+
+	sort.Slice(list.Bans, func(i, j int) bool {
+		a, b := list.Bans[i], list.Bans[j]
+		if !a.StartsAt.Equal(b.StartsAt) {
+			return a.StartsAt.After(b.StartsAt)
+		}
+
+		return a.ID > b.ID
+	})
+
+	return list, nil
+}
+
+func (m *Memory) LiftBan(userID, banID int64, actor *Actor) (*api.Ban, error) {
+	if err := validateUserID(userID); err != nil {
+		return nil, err
+	}
+
+	if err := validateBanID(banID); err != nil {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for i, ban := range m.bans[userID] {
+		if ban.ID != banID {
+			continue
+		}
+
+		lifted := *ban
+		if err := lifted.lift(actor, time.Now()); err != nil {
+			return nil, err
+		}
+		m.bans[userID][i] = &lifted
+		m.bumpVersion(userID)
+
+		found := lifted
+		return found.ToApiBan(), nil
+	}
+
+	return nil, &uerrors.Error{
+		Code:    uerrors.CodeBanNotFound,
+		Message: uerrors.MessageBanNotFound,
+		Err:     uerrors.ErrBanNotFound,
+	}
+}
+
+// checkUserExists returns an error if the user does not exist or was
+// soft-deleted. It must be called with the lock held.
+func (m *Memory) checkUserExists(id int64) error {
+	user, exists := m.users[id]
+	if !exists || user.DeletedAt.Valid {
+		return &uerrors.Error{
+			Code:    uerrors.CodeUserNotFound,
+			Message: uerrors.MessageUserNotFound,
+			Err:     uerrors.ErrUserNotFound,
+		}
+	}
+
+	return nil
+}
+
+func (m *Memory) ImportUsers(users []*api.ImportedUser, opts *ImportOptions) ([]*ImportResult, error) {
+	if opts == nil {
+		opts = &ImportOptions{}
+	}
+
+	// Hash before taking the lock, as it is expensive on purpose.
+	now := time.Now()
+	plan := planImport(users, m.PasswordParams, !opts.DryRun, now)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	existing := []*User{}
+	for _, user := range m.users {
+		// Deleted users are included, as for Database.
+		if plan.conflicts(user) {
+			existing = append(existing, user)
+		}
+	}
+
+	plan.resolve(existing, opts.Upsert)
+	if opts.DryRun {
+		return plan.results, nil
+	}
+
+	for i, user := range plan.users {
+		if user == nil {
+			continue
+		}
+
+		if before := plan.replaced[i]; before != nil {
+			after, colsToUpd := plan.replacement(i, now)
+			if len(colsToUpd) == 0 {
+				continue
+			}
+
+			changes := diffUser(before.ToApiUser(), after.ToApiUser(), opts.Actor, now)
+			if len(changes) > 0 && m.changes == nil {
+				m.changes = map[int64][]*UserChange{}
+			}
+
+			for _, change := range changes {
+				m.lastChangeID++
+				change.ID = m.lastChangeID
+				m.changes[before.ID] = append(m.changes[before.ID], change)
+			}
+
+			m.users[before.ID] = after
+			continue
+		}
+
+		m.lastID++
+		user.ID = m.lastID
+
+		created := *user
+		if m.users == nil {
+			m.users = map[int64]*User{}
+		}
+		m.users[created.ID] = &created
+	}
+
+	plan.done()
+	return plan.results, nil
+}
+
+// bumpVersion increases the version of the user, as its ban is part of it.
+// It must be called with the lock held.
+func (m *Memory) bumpVersion(id int64) {
+	if user, exists := m.users[id]; exists {
+		bumped := *user
+		bumped.Version++
+		m.users[id] = &bumped
+	}
+}
+
+// loadBans sets the current ban of the provided users, if role can see it.
+// It must be called with the lock held.
+func (m *Memory) loadBans(users []*api.User, role api.Role) {
+	now := time.Now()
+	active := []*Ban{}
+	for _, user := range users {
+		for _, ban := range m.bans[user.ID] {
+			stored := *ban
+			if stored.ToApiBan().IsActive(now) {
+				active = append(active, &stored)
+			}
+		}
+	}
+
+	attachBans(users, active, role)
+}
+
+func (m *Memory) VerifyCredentialsByID(id int64, pwd string) (*api.CredentialsVerification, error) {
+	if err := validateUserID(id); err != nil {
+		return nil, err
+	}
+
+	m.lock.RLock()
+	user, exists := m.users[id]
+	m.lock.RUnlock()
+
+	if !exists || user.DeletedAt.Valid {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeUserNotFound,
+			Message: uerrors.MessageUserNotFound,
+			Err:     uerrors.ErrUserNotFound,
+		}
+	}
+
+	return verifyPassword(pwd, user, m.PasswordParams)
+}
+
+func (m *Memory) VerifyCredentialsByUsername(username, pwd string) (*api.CredentialsVerification, error) {
+	if err := validateUsername(username); err != nil {
+		return nil, err
+	}
+
+	m.lock.RLock()
+	user := m.find(func(u *User) bool {
+		return strings.EqualFold(u.Username, username)
+	})
+	m.lock.RUnlock()
+
+	if user == nil {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeUserNotFound,
+			Message: uerrors.MessageUserNotFound,
+			Err:     uerrors.ErrUserNotFound,
+		}
+	}
+
+	return verifyPassword(pwd, user, m.PasswordParams)
+}
@@ -2,7 +2,6 @@ package database
 
 import (
 	"database/sql"
-	"encoding/base64"
 	"net"
 	"time"
 
@@ -17,13 +16,15 @@ type User struct {
 	DeletedAt    gorm.DeletedAt `gorm:"index"`
 	PasswordHash []byte
 	// TODO: salt must become readonly
-	Salt           []byte
-	Username       string         `gorm:"unique;size:100"`
-	DisplayName    string         `gorm:"size:100"`
-	Email          string         `gorm:"unique;size:300"`
-	RegistrationIP string         `gorm:"size:50;<-:create"`
-	Bio            sql.NullString `gorm:"unique;size:500"`
-	Birthday       sql.NullTime   `json:"birthday,omitempty" yaml:"birthday,omitempty"`
+	Salt            []byte
+	Username        string `gorm:"unique;size:100"`
+	DisplayName     string `gorm:"size:100"`
+	Email           string `gorm:"unique;size:300"`
+	EmailVerifiedAt sql.NullTime
+	RegistrationIP  string         `gorm:"size:50;<-:create"`
+	Bio             sql.NullString `gorm:"size:500"`
+	Birthday        sql.NullTime   `json:"birthday,omitempty" yaml:"birthday,omitempty"`
+	Version         int64
 }
 
 func (User) TableName() string {
@@ -42,24 +43,20 @@ func (u *User) ToApiUser() *api.User {
 
 			return nil
 		}(),
-		Base64PasswordHash: func() *string {
-			if len(u.PasswordHash) == 0 {
-				return nil
-			}
-
-			encoded := base64.URLEncoding.EncodeToString(u.PasswordHash)
-			return &encoded
+		Version:     u.Version,
+		Username:    u.Username,
+		DisplayName: u.DisplayName,
+		Email: func() *string {
+			email := u.Email
+			return &email
 		}(),
-		Base64Salt: func() *string {
-			if len(u.Salt) == 0 {
+		EmailVerifiedAt: func() *time.Time {
+			if !u.EmailVerifiedAt.Valid {
 				return nil
 			}
 
-			encoded := base64.URLEncoding.EncodeToString(u.Salt)
-			return &encoded
+			return &u.EmailVerifiedAt.Time
 		}(),
-		Username:    u.Username,
-		DisplayName: u.DisplayName,
 		RegistrationIP: func() *net.IP {
 			ip := net.ParseIP(u.RegistrationIP)
 			return &ip
@@ -80,3 +77,48 @@ func (u *User) ToApiUser() *api.User {
 		}(),
 	}
 }
+
+// UserChange is a change to a field of a user, as recorded in the history.
+type UserChange struct {
+	ID        int64          `gorm:"primarykey;<-:create"`
+	UserID    int64          `gorm:"index;<-:create"`
+	Field     string         `gorm:"size:50;<-:create"`
+	OldValue  sql.NullString `gorm:"size:300;<-:create"`
+	NewValue  sql.NullString `gorm:"size:300;<-:create"`
+	ChangedAt time.Time      `gorm:"index;<-:create"`
+	Caller    string         `gorm:"size:100;<-:create"`
+	ActorID   sql.NullInt64  `gorm:"<-:create"`
+}
+
+func (UserChange) TableName() string {
+	return userChangesTable
+}
+
+func (c *UserChange) ToApiUserChange() *api.UserChange {
+	return &api.UserChange{
+		Field: c.Field,
+		OldValue: func() *string {
+			if !c.OldValue.Valid {
+				return nil
+			}
+
+			return &c.OldValue.String
+		}(),
+		NewValue: func() *string {
+			if !c.NewValue.Valid {
+				return nil
+			}
+
+			return &c.NewValue.String
+		}(),
+		ChangedAt: c.ChangedAt,
+		Caller:    c.Caller,
+		ActorID: func() *int64 {
+			if !c.ActorID.Valid {
+				return nil
+			}
+
+			return &c.ActorID.Int64
+		}(),
+	}
+}
@@ -0,0 +1,349 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asimpleidea/ship-krew/users/api/pkg/api"
+	uerrors "github.com/asimpleidea/ship-krew/users/api/pkg/errors"
+)
+
+const (
+	idColumn          string = "id"
+	createdAtColumn   string = "created_at"
+	updatedAtColumn   string = "updated_at"
+	usernameColumn    string = "username"
+	displayNameColumn string = "display_name"
+	sortSeparator     string = ","
+	sortDescPrefix    string = "-"
+)
+
+func (f *ListFilters) limit() int {
+	if f.Limit > 0 {
+		return f.Limit
+	}
+
+	return resultsPerPage
+}
+
+// pagination returns the sort keys to use and, if a cursor was provided,
+// the pivot user to start from.
+func (f *ListFilters) pagination() ([]sortKey, *User, error) {
+	if f.Limit < 0 {
+		return nil, nil, &uerrors.Error{
+			Code:    uerrors.CodeInvalidLimit,
+			Message: uerrors.MessageInvalidLimit,
+			Err:     uerrors.ErrInvalidLimit,
+		}
+	}
+
+	keys, err := parseSort(f.Sort)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Values of sort keys end up in cursors.
+	for _, key := range keys {
+		if !f.Role.CanSee(key.column) {
+			return nil, nil, &uerrors.Error{
+				Code:    uerrors.CodeForbidden,
+				Message: uerrors.MessageForbidden,
+				Err:     fmt.Errorf("%w: cannot sort by %s", uerrors.ErrForbidden, key.column),
+			}
+		}
+	}
+
+	if f.Cursor == "" {
+		return keys, nil, nil
+	}
+
+	pivot, err := decodeCursor(f.Cursor, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return keys, pivot, nil
+}
+
+// sortColumn describes a column that users can be sorted by, and therefore
+// that can be part of a cursor.
+type sortColumn struct {
+	// encode returns the value of the column for u, as it is stored in a
+	// cursor.
+	encode func(u *User) string
+	// decode sets the value of the column in u, as it was stored in a
+	// cursor.
+	decode func(u *User, value string) error
+	// value returns the value of the column for u, as it is passed to SQL.
+	value func(u *User) interface{}
+	// compare returns a negative number if a comes before b, a positive
+	// one if it comes after b and zero if they have the same value.
+	compare func(a, b *User) int
+}
+
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// compareFold compares strings case-insensitively, like MySQL does with the
+// default collation.
+func compareFold(a, b string) int {
+	return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+}
+
+var sortColumns = map[string]*sortColumn{
+	idColumn: {
+		encode: func(u *User) string { return strconv.FormatInt(u.ID, 10) },
+		decode: func(u *User, value string) (err error) {
+			u.ID, err = strconv.ParseInt(value, 10, 64)
+			return
+		},
+		value: func(u *User) interface{} { return u.ID },
+		compare: func(a, b *User) int {
+			switch {
+			case a.ID < b.ID:
+				return -1
+			case a.ID > b.ID:
+				return 1
+			default:
+				return 0
+			}
+		},
+	},
+	createdAtColumn: {
+		encode: func(u *User) string { return u.CreatedAt.UTC().Format(time.RFC3339Nano) },
+		decode: func(u *User, value string) (err error) {
+			u.CreatedAt, err = time.Parse(time.RFC3339Nano, value)
+			return
+		},
+		value:   func(u *User) interface{} { return u.CreatedAt },
+		compare: func(a, b *User) int { return compareTimes(a.CreatedAt, b.CreatedAt) },
+	},
+	updatedAtColumn: {
+		encode: func(u *User) string { return u.UpdatedAt.UTC().Format(time.RFC3339Nano) },
+		decode: func(u *User, value string) (err error) {
+			u.UpdatedAt, err = time.Parse(time.RFC3339Nano, value)
+			return
+		},
+		value:   func(u *User) interface{} { return u.UpdatedAt },
+		compare: func(a, b *User) int { return compareTimes(a.UpdatedAt, b.UpdatedAt) },
+	},
+	usernameColumn: {
+		encode: func(u *User) string { return u.Username },
+		decode: func(u *User, value string) error {
+			u.Username = value
+			return nil
+		},
+		value:   func(u *User) interface{} { return u.Username },
+		compare: func(a, b *User) int { return compareFold(a.Username, b.Username) },
+	},
+	displayNameColumn: {
+		encode: func(u *User) string { return u.DisplayName },
+		decode: func(u *User, value string) error {
+			u.DisplayName = value
+			return nil
+		},
+		value:   func(u *User) interface{} { return u.DisplayName },
+		compare: func(a, b *User) int { return compareFold(a.DisplayName, b.DisplayName) },
+	},
+}
+
+type sortKey struct {
+	column string
+	desc   bool
+}
+
+func (k sortKey) String() string {
+	if k.desc {
+		return sortDescPrefix + k.column
+	}
+
+	return k.column
+}
+
+// parseSort parses values like "created_at" or "-created_at" into a list
+// of sort keys. The ID is always appended as the last key, if not already
+// there, so that the order is total and cursors are stable.
+func parseSort(sort string) ([]sortKey, error) {
+	keys := []sortKey{}
+	hasID := false
+
+	if sort != "" {
+		for _, field := range strings.Split(sort, sortSeparator) {
+			key := sortKey{column: strings.TrimPrefix(field, sortDescPrefix)}
+			key.desc = key.column != field
+
+			if _, exists := sortColumns[key.column]; !exists {
+				return nil, &uerrors.Error{
+					Code:    uerrors.CodeInvalidSort,
+					Message: uerrors.MessageInvalidSort,
+					Err:     fmt.Errorf("%w: %s", uerrors.ErrInvalidSort, field),
+				}
+			}
+
+			for _, other := range keys {
+				if other.column == key.column {
+					return nil, &uerrors.Error{
+						Code:    uerrors.CodeInvalidSort,
+						Message: uerrors.MessageInvalidSort,
+						Err:     fmt.Errorf("%w: %s is repeated", uerrors.ErrInvalidSort, key.column),
+					}
+				}
+			}
+
+			if key.column == idColumn {
+				hasID = true
+			}
+
+			keys = append(keys, key)
+		}
+	}
+
+	if !hasID {
+		keys = append(keys, sortKey{column: idColumn})
+	}
+
+	return keys, nil
+}
+
+func sortString(keys []sortKey) string {
+	fields := make([]string, len(keys))
+	for i, key := range keys {
+		fields[i] = key.String()
+	}
+
+	return strings.Join(fields, sortSeparator)
+}
+
+// cursor is what is encoded inside the opaque cursor returned to clients.
+type cursor struct {
+	// Sort is the sort the cursor was created for: a cursor cannot be used
+	// with a different one.
+	Sort string `json:"s"`
+	// Values contains the values of the sort keys of the last user in the
+	// page, in the same order.
+	Values []string `json:"v"`
+}
+
+func encodeCursor(keys []sortKey, last *User) string {
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		values[i] = sortColumns[key.column].encode(last)
+	}
+
+	// Marshalling strings cannot fail.
+	encoded, _ := json.Marshal(&cursor{Sort: sortString(keys), Values: values})
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// decodeCursor returns a user that has the values contained in the cursor,
+// to be used as the pivot to get the next page.
+func decodeCursor(encoded string, keys []sortKey) (*User, error) {
+	invalidCursor := func(err error) error {
+		return &uerrors.Error{
+			Code:    uerrors.CodeInvalidCursor,
+			Message: uerrors.MessageInvalidCursor,
+			Err:     fmt.Errorf("%w: %s", uerrors.ErrInvalidCursor, err.Error()),
+		}
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, invalidCursor(err)
+	}
+
+	var c cursor
+	if err := json.Unmarshal(decoded, &c); err != nil {
+		return nil, invalidCursor(err)
+	}
+
+	if c.Sort != sortString(keys) || len(c.Values) != len(keys) {
+		return nil, invalidCursor(fmt.Errorf("cursor was created for a different sort"))
+	}
+
+	pivot := &User{}
+	for i, key := range keys {
+		if err := sortColumns[key.column].decode(pivot, c.Values[i]); err != nil {
+			return nil, invalidCursor(err)
+		}
+	}
+
+	return pivot, nil
+}
+
+// keysetCondition returns the SQL condition that selects all users that
+// come after pivot with the provided sort, i.e. for "created_at,id":
+// ((created_at > ?) OR (created_at = ? AND id > ?)).
+func keysetCondition(keys []sortKey, pivot *User) (string, []interface{}) {
+	ors := make([]string, len(keys))
+	args := []interface{}{}
+
+	for i, key := range keys {
+		ands := make([]string, 0, i+1)
+		for _, prev := range keys[:i] {
+			ands = append(ands, prev.column+" = ?")
+			args = append(args, sortColumns[prev.column].value(pivot))
+		}
+
+		op := " > ?"
+		if key.desc {
+			op = " < ?"
+		}
+		ands = append(ands, key.column+op)
+		args = append(args, sortColumns[key.column].value(pivot))
+
+		ors[i] = "(" + strings.Join(ands, " AND ") + ")"
+	}
+
+	return "(" + strings.Join(ors, " OR ") + ")", args
+}
+
+// compareUsers compares a and b with the provided sort, with the same
+// semantics as sortColumn.compare.
+func compareUsers(keys []sortKey, a, b *User) int {
+	for _, key := range keys {
+		if cmp := sortColumns[key.column].compare(a, b); cmp != 0 {
+			if key.desc {
+				return -cmp
+			}
+
+			return cmp
+		}
+	}
+
+	return 0
+}
+
+// pageOf builds the list to return from users, which must contain at most
+// limit + 1 users: the extra one only tells that there are more. Users are
+// projected for role.
+func pageOf(users []*User, limit int, keys []sortKey, total *int64, role api.Role) *api.UserList {
+	list := &api.UserList{
+		Users: make([]*api.User, 0, limit),
+		Total: total,
+	}
+
+	if len(users) > limit {
+		list.HasMore = true
+		users = users[:limit]
+		list.NextCursor = encodeCursor(keys, users[len(users)-1])
+	}
+
+	for _, user := range users {
+		found := *user
+		list.Users = append(list.Users, found.ToApiUser().Project(role))
+	}
+
+	return list
+}
@@ -0,0 +1,109 @@
+package database
+
+import (
+	"context"
+
+	"github.com/asimpleidea/ship-krew/users/api/pkg/api"
+	uerrors "github.com/asimpleidea/ship-krew/users/api/pkg/errors"
+)
+
+// UserStore is implemented by every backend that is able to store users.
+//
+// All methods return errors as *errors.Error, so that they can be
+// forwarded to clients as they are.
+type UserStore interface {
+	GetUserByID(id int64, opts *GetOptions) (*api.User, error)
+	GetUserByUsername(username string, opts *GetOptions) (*api.User, error)
+	CreateUser(user *api.User) (*api.User, error)
+	ListUsers(filters *ListFilters) (*api.UserList, error)
+	// UpdateUser changes the fields of the user set in patch, records the
+	// changes made by actor in its history and returns the user as admins
+	// see it. If version is not zero, the user is only changed if it is
+	// still at that version.
+	UpdateUser(id int64, patch *api.UserPatch, actor *Actor, version int64) (*api.User, error)
+	// DeleteUser deletes the user. Hard deleting it also removes its
+	// history and its bans. If version is not zero, the user is only
+	// deleted if it is still at that version.
+	DeleteUser(id int64, hardDelete bool, version int64) error
+	// RestoreUser undeletes a soft-deleted user. Deleted users keep their
+	// username and email, which nobody else can take in the meantime.
+	RestoreUser(id int64) (*api.User, error)
+	GetUserHistory(id int64, opts *HistoryOptions) (*api.UserHistory, error)
+	// SetPassword replaces the password of the user, i.e. when they reset
+	// it. Sessions are not known here: callers must invalidate them.
+	SetPassword(id int64, pwd string) error
+	// VerifyEmail marks the email of the user as verified, as long as it is
+	// still the provided one. Changing the email makes it unverified again.
+	VerifyEmail(id int64, email string) (*api.User, error)
+	// IssueBan bans the user. If the ban has no start, it starts
+	// immediately. The moderator and the caller are taken from actor.
+	IssueBan(userID int64, ban *api.Ban, actor *Actor) (*api.Ban, error)
+	// ListBans returns the bans of the user, the most recent first. If
+	// activeOnly is true, expired and lifted bans are not returned.
+	ListBans(userID int64, activeOnly bool) (*api.BanList, error)
+	// LiftBan ends a ban before it expires.
+	LiftBan(userID, banID int64, actor *Actor) (*api.Ban, error)
+	// ImportUsers creates the users, or replaces the ones that already exist
+	// if opts.Upsert is set, all in the same transaction. Users that cannot
+	// be imported fail on their own in the results, which are in the same
+	// order as users: an error is only returned if none could be imported.
+	ImportUsers(users []*api.ImportedUser, opts *ImportOptions) ([]*ImportResult, error)
+	VerifyCredentialsByID(id int64, pwd string) (*api.CredentialsVerification, error)
+	VerifyCredentialsByUsername(username, pwd string) (*api.CredentialsVerification, error)
+	// WithContext returns a store that runs its queries with ctx, so that
+	// they are part of the trace of the request that needs them.
+	WithContext(ctx context.Context) UserStore
+}
+
+// GetOptions contains the options for getting a single user. A nil
+// *GetOptions is valid and means the defaults.
+type GetOptions struct {
+	// IncludeDeleted also returns the user if it was soft-deleted.
+	IncludeDeleted bool
+	// Role is the role of who is getting the user, and determines the
+	// fields that are returned.
+	Role api.Role
+}
+
+func (o *GetOptions) includeDeleted() bool {
+	return o != nil && o.IncludeDeleted
+}
+
+func (o *GetOptions) role() api.Role {
+	if o == nil {
+		return api.RoleAnonymous
+	}
+
+	return o.Role
+}
+
+var (
+	_ UserStore = (*Database)(nil)
+	_ UserStore = (*Memory)(nil)
+	_ UserStore = (*Cached)(nil)
+)
+
+// createdUser returns the minimum amount of information about a user that
+// has just been created.
+func createdUser(user *api.User, created *User) *api.User {
+	user.ID = created.ID
+	user.Password = nil
+	user.CreatedAt = created.CreatedAt
+	user.Version = created.Version
+	user.Email = nil
+	user.RegistrationIP = nil
+	user.EmailVerifiedAt = nil
+	user.Ban = nil
+
+	return user
+}
+
+// versionMismatch returns the error for a user that is not at the version
+// the caller expected anymore.
+func versionMismatch() error {
+	return &uerrors.Error{
+		Code:    uerrors.CodeVersionMismatch,
+		Message: uerrors.MessageVersionMismatch,
+		Err:     uerrors.ErrVersionMismatch,
+	}
+}
@@ -0,0 +1,148 @@
+package database
+
+import (
+	"net"
+	"testing"
+
+	"github.com/asimpleidea/ship-krew/users/api/internal/password"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/api"
+	uerrors "github.com/asimpleidea/ship-krew/users/api/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// stores returns a new, empty store of every kind, so that they can be
+// tested for behaving the same.
+func stores(t *testing.T) map[string]UserStore {
+	newMemory := func() *Memory {
+		return &Memory{
+			Logger:         zerolog.Nop(),
+			PasswordParams: &password.Params{Time: 1, Memory: 8, Threads: 1, SaltLength: 8, KeyLength: 16},
+		}
+	}
+
+	return map[string]UserStore{
+		"memory": newMemory(),
+		"sqlite": newSQLiteDatabase(t),
+		"cached": newCached(newMemory()),
+	}
+}
+
+// expectCode fails t if err is not an error with code.
+func expectCode(t *testing.T, err error, code int) {
+	t.Helper()
+
+	if uerr, ok := err.(*uerrors.Error); !ok || uerr.Code != code {
+		t.Fatalf("error is %v, expected code %d", err, code)
+	}
+}
+
+func TestStoresKeepDeletedUsersUnique(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			ip := net.ParseIP("10.0.0.1")
+			deleted := createUser(t, store, "deleted")
+			if err := store.DeleteUser(deleted.ID, false, 0); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := store.CreateUser(&api.User{
+				Username:       "DELETED",
+				DisplayName:    "Deleted",
+				Email:          strPtr("another@example.com"),
+				Password:       strPtr("a-long-enough-password"),
+				RegistrationIP: &ip,
+			})
+			expectCode(t, err, uerrors.CodeUsernameAlreadyExists)
+
+			_, err = store.CreateUser(&api.User{
+				Username:       "another",
+				DisplayName:    "Another",
+				Email:          strPtr("Deleted@Example.com"),
+				Password:       strPtr("a-long-enough-password"),
+				RegistrationIP: &ip,
+			})
+			expectCode(t, err, uerrors.CodeEmailAlreadyExists)
+
+			live := createUser(t, store, "live")
+			_, err = store.UpdateUser(live.ID, &api.UserPatch{Username: strPtr("Deleted")}, &Actor{}, 0)
+			expectCode(t, err, uerrors.CodeUsernameAlreadyExists)
+
+			_, err = store.UpdateUser(live.ID, &api.UserPatch{Email: strPtr("deleted@example.com")}, &Actor{}, 0)
+			expectCode(t, err, uerrors.CodeEmailAlreadyExists)
+
+			restored, err := store.RestoreUser(deleted.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if restored.Username != "deleted" || restored.DeletedAt != nil {
+				t.Fatalf("restored user is %s, deleted at %v", restored.Username, restored.DeletedAt)
+			}
+
+			_, err = store.RestoreUser(deleted.ID)
+			expectCode(t, err, uerrors.CodeUserNotDeleted)
+		})
+	}
+}
+
+func TestStoresOnlyChangeVersionsWithUsers(t *testing.T) {
+	cases := []struct {
+		name    string
+		patch   *api.UserPatch
+		changed bool
+	}{
+		{name: "empty", patch: &api.UserPatch{}},
+		{name: "same display name", patch: &api.UserPatch{DisplayName: strPtr("user")}},
+		{name: "same username in upper case", patch: &api.UserPatch{Username: strPtr("USER")}},
+		{name: "same email in upper case", patch: &api.UserPatch{Email: strPtr("USER@example.com")}},
+		{name: "display name", patch: &api.UserPatch{DisplayName: strPtr("User")}, changed: true},
+		{name: "email", patch: &api.UserPatch{Email: strPtr("new@example.com")}, changed: true},
+		{name: "password", patch: &api.UserPatch{Password: strPtr("another-long-password")}, changed: true},
+		{name: "bio", patch: &api.UserPatch{Bio: strPtr("bio")}, changed: true},
+	}
+
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, c := range cases {
+				t.Run(c.name, func(t *testing.T) {
+					user := createUser(t, store, "user")
+					t.Cleanup(func() {
+						if err := store.DeleteUser(user.ID, true, 0); err != nil {
+							t.Fatal(err)
+						}
+					})
+
+					updated, err := store.UpdateUser(user.ID, c.patch, &Actor{}, user.Version)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					expected := user.Version
+					if c.changed {
+						expected++
+					}
+
+					if updated.Version != expected {
+						t.Fatalf("version is %d, expected %d", updated.Version, expected)
+					}
+
+					found, err := store.GetUserByID(user.ID, &GetOptions{Role: api.RoleAdmin})
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					if found.Version != expected {
+						t.Fatalf("stored version is %d, expected %d", found.Version, expected)
+					}
+
+					_, err = store.UpdateUser(user.ID, &api.UserPatch{DisplayName: strPtr("Other")}, &Actor{}, expected+1)
+					expectCode(t, err, uerrors.CodeVersionMismatch)
+				})
+			}
+		})
+	}
+}
+
+func strPtr(value string) *string {
+	return &value
+}
@@ -0,0 +1,225 @@
+package database
+
+import (
+	"net"
+	"net/mail"
+	"regexp"
+
+	"github.com/asimpleidea/ship-krew/users/api/internal/password"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/api"
+	uerrors "github.com/asimpleidea/ship-krew/users/api/pkg/errors"
+)
+
+// The functions in this file contain the validation rules shared by all
+// stores, so that a user that is valid for one store is valid for all of
+// them.
+
+func validateUsername(username string) error {
+	if username == "" {
+		return &uerrors.Error{
+			Code:    uerrors.CodeEmptyUsername,
+			Message: uerrors.MessageEmptyUsername,
+			Err:     uerrors.ErrEmptyUsername,
+		}
+	}
+
+	if len(username) > maxUsernameLength {
+		return &uerrors.Error{
+			Err:     uerrors.ErrInvalidUsername,
+			Code:    uerrors.CodeUsernameTooLong,
+			Message: uerrors.MessageUsernameTooLong,
+		}
+	}
+
+	if matched, err := regexp.MatchString(usernameRegexp, username); err != nil || !matched {
+		return &uerrors.Error{
+			Code:    uerrors.CodeInvalidUsername,
+			Message: uerrors.MessageInvalidUsername,
+			Err:     uerrors.ErrInvalidUsername,
+		}
+	}
+
+	return nil
+}
+
+func validateDisplayName(displayName string) error {
+	if displayName == "" {
+		return &uerrors.Error{
+			Code:    uerrors.CodeEmptyDisplayName,
+			Message: uerrors.MessageEmptyDisplayName,
+			Err:     uerrors.ErrEmptyDisplayName,
+		}
+	}
+
+	if len(displayName) > maxDisplayNameLength {
+		return &uerrors.Error{
+			Code:    uerrors.CodeDisplayNameTooLong,
+			Message: uerrors.MessageDisplayNameTooLong,
+			Err:     uerrors.ErrDisplayNameTooLong,
+		}
+	}
+
+	return nil
+}
+
+func validateEmail(email *string) error {
+	if email == nil || *email == "" {
+		return &uerrors.Error{
+			Code:    uerrors.CodeEmptyEmail,
+			Message: uerrors.MessageEmptyEmail,
+			Err:     uerrors.ErrEmptyEmail,
+		}
+	}
+
+	if len(*email) > emailMaxLength {
+		return &uerrors.Error{
+			Code:    uerrors.CodeEmailTooLong,
+			Message: uerrors.MessageEmailTooLong,
+			Err:     uerrors.ErrEmailTooLong,
+		}
+	}
+
+	if _, err := mail.ParseAddress(*email); err != nil {
+		return &uerrors.Error{
+			Code:    uerrors.CodeInvalidEmail,
+			Message: uerrors.MessageInvalidEmail,
+			Err:     uerrors.ErrInvalidEmail,
+		}
+	}
+
+	return nil
+}
+
+func validateRegistrationIP(ip *net.IP) error {
+	if ip == nil || len(*ip) == 0 {
+		return &uerrors.Error{
+			Code:    uerrors.CodeEmptyRegistrationIP,
+			Message: uerrors.MessageEmptyRegistrationIP,
+			Err:     uerrors.ErrEmptyRegistrationIP,
+		}
+	}
+
+	return nil
+}
+
+func validateBio(bio *string) error {
+	if bio != nil && len(*bio) > bioMaxLength {
+		return &uerrors.Error{
+			Code:    uerrors.CodeBioTooLong,
+			Message: uerrors.MessageBioTooLong,
+			Err:     uerrors.ErrBioTooLong,
+		}
+	}
+
+	return nil
+}
+
+// validatePatch validates the fields that patch changes.
+func validatePatch(patch *api.UserPatch) error {
+	if patch.Username != nil {
+		if err := validateUsername(*patch.Username); err != nil {
+			return err
+		}
+	}
+
+	if patch.DisplayName != nil {
+		if err := validateDisplayName(*patch.DisplayName); err != nil {
+			return err
+		}
+	}
+
+	if patch.Email != nil {
+		if err := validateEmail(patch.Email); err != nil {
+			return err
+		}
+	}
+
+	return validateBio(patch.Bio)
+}
+
+func validateUserID(id int64) error {
+	if id < 1 {
+		return &uerrors.Error{
+			Code:    uerrors.CodeInvalidUserID,
+			Message: uerrors.MessageInvalidUserID,
+			Err:     uerrors.ErrInvalidUserID,
+		}
+	}
+
+	return nil
+}
+
+func validatePassword(pwd *string) error {
+	if pwd == nil || *pwd == "" {
+		return &uerrors.Error{
+			Code:    uerrors.CodeEmptyPassword,
+			Message: uerrors.MessageEmptyPassword,
+			Err:     uerrors.ErrEmptyPassword,
+		}
+	}
+
+	if len(*pwd) < api.MinPasswordLength {
+		return &uerrors.Error{
+			Code:    uerrors.CodePasswordTooShort,
+			Message: uerrors.MessagePasswordTooShort,
+			Err:     uerrors.ErrPasswordTooShort,
+		}
+	}
+
+	if len(*pwd) > api.MaxPasswordLength {
+		return &uerrors.Error{
+			Code:    uerrors.CodePasswordTooLong,
+			Message: uerrors.MessagePasswordTooLong,
+			Err:     uerrors.ErrPasswordTooLong,
+		}
+	}
+
+	return nil
+}
+
+func hashPassword(pwd *string, params *password.Params) (string, error) {
+	if err := validatePassword(pwd); err != nil {
+		return "", err
+	}
+
+	hash, err := password.Hash(*pwd, params)
+	if err != nil {
+		return "", &uerrors.Error{
+			Code:    uerrors.CodeInternalServerError,
+			Message: uerrors.MessageInternalServerError,
+			Err:     err,
+		}
+	}
+
+	return hash, nil
+}
+
+func verifyPassword(pwd string, user *User, params *password.Params) (*api.CredentialsVerification, error) {
+	if pwd == "" {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeEmptyPassword,
+			Message: uerrors.MessageEmptyPassword,
+			Err:     uerrors.ErrEmptyPassword,
+		}
+	}
+
+	match, err := password.Verify(pwd, user.PasswordHash, user.Salt)
+	if err != nil {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeInternalServerError,
+			Message: uerrors.MessageInternalServerError,
+			Err:     err,
+		}
+	}
+
+	verification := &api.CredentialsVerification{Match: match}
+	if match {
+		if params == nil {
+			params = password.DefaultParams()
+		}
+
+		verification.NeedsRehash = params.NeedsRehash(user.PasswordHash)
+	}
+
+	return verification, nil
+}
@@ -0,0 +1,122 @@
+// Package migrations creates and evolves the schema of the users database.
+//
+// Migrations are SQL files embedded in the binary, in a directory for each
+// driver, named like 0001_create_users.up.sql and
+// 0001_create_users.down.sql. Statements in a file must end with a
+// semicolon at the end of a line. The versions that were applied are kept
+// in the schema_migrations table.
+//
+// Databases created before migrations, i.e. by GORM's AutoMigrate, are
+// migrated as they are: tables are only created if they do not exist, and
+// statements adding a column that already exists are skipped, assuming the
+// column is the same.
+package migrations
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed mysql/*.sql sqlite/*.sql
+var files embed.FS
+
+var fileRegexp = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is a versioned change to the schema, and how to revert it.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      []string
+	Down    []string
+}
+
+// Load returns the migrations for the provided driver, sorted by version.
+func Load(driver string) ([]*Migration, error) {
+	entries, err := fs.ReadDir(files, driver)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for driver %s", driver)
+	}
+
+	byVersion := map[int64]*Migration{}
+	for _, entry := range entries {
+		matches := fileRegexp.FindStringSubmatch(entry.Name())
+		if matches == nil {
+			return nil, fmt.Errorf("invalid migration file name %s", entry.Name())
+		}
+
+		version, err := strconv.ParseInt(matches[1], 10, 64)
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("invalid migration version in %s", entry.Name())
+		}
+
+		migration, exists := byVersion[version]
+		if !exists {
+			migration = &Migration{Version: version, Name: matches[2]}
+			byVersion[version] = migration
+		}
+
+		if migration.Name != matches[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s",
+				version, migration.Name, matches[2])
+		}
+
+		contents, err := files.ReadFile(path.Join(driver, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %w", entry.Name(), err)
+		}
+
+		if matches[3] == "up" {
+			migration.Up = splitStatements(string(contents))
+		} else {
+			migration.Down = splitStatements(string(contents))
+		}
+	}
+
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if len(migration.Up) == 0 || len(migration.Down) == 0 {
+			return nil, fmt.Errorf("migration %d must have both up and down statements",
+				migration.Version)
+		}
+
+		migrations = append(migrations, migration)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// splitStatements splits a file in statements, as drivers do not always
+// accept more than one at a time. Lines starting with "--" are comments.
+func splitStatements(contents string) []string {
+	statements := []string{}
+	current := []string{}
+
+	for _, line := range strings.Split(contents, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+
+		current = append(current, line)
+		if strings.HasSuffix(trimmed, ";") {
+			statements = append(statements, strings.Join(current, "\n"))
+			current = []string{}
+		}
+	}
+
+	if len(current) > 0 {
+		statements = append(statements, strings.Join(current, "\n"))
+	}
+
+	return statements
+}
@@ -0,0 +1,113 @@
+package migrations
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	udb "github.com/asimpleidea/ship-krew/users/api/internal/database"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/database"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+)
+
+// TestMigrationsCoverModels fails when a model has a table or column that
+// the migrations do not create: schema changes must ship with the code that
+// needs them.
+func TestMigrationsCoverModels(t *testing.T) {
+	db, migrator := newSQLiteMigrator(t)
+	if err := migrator.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, model := range []interface{}{&udb.User{}, &udb.UserChange{}, &udb.Ban{}} {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			t.Fatal(err)
+		}
+
+		if !db.Migrator().HasTable(model) {
+			t.Errorf("no migration creates table %s", stmt.Schema.Table)
+			continue
+		}
+
+		for _, field := range stmt.Schema.Fields {
+			if field.DBName != "" && !db.Migrator().HasColumn(model, field.DBName) {
+				t.Errorf("no migration creates column %s.%s", stmt.Schema.Table, field.DBName)
+			}
+		}
+	}
+}
+
+// TestMigrationsOnExistingSchema migrates a database whose schema was
+// created before its versions were recorded, i.e. by AutoMigrate.
+func TestMigrationsOnExistingSchema(t *testing.T) {
+	ctx := context.Background()
+
+	_, migrator := newSQLiteMigrator(t)
+	if err := migrator.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := migrator.DB.ExecContext(ctx, "DROP TABLE schema_migrations"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrator.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := migrator.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(status.Pending) > 0 || status.Current != status.Latest {
+		t.Fatalf("schema is at version %d, expected %d", status.Current, status.Latest)
+	}
+}
+
+// TestMigrationsMatchAcrossDrivers fails when a migration is only written
+// for some of the drivers.
+func TestMigrationsMatchAcrossDrivers(t *testing.T) {
+	mysql, err := Load(database.DriverMySQL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sqlite, err := Load(database.DriverSQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mysql) != len(sqlite) {
+		t.Fatalf("%d migrations for mysql and %d for sqlite", len(mysql), len(sqlite))
+	}
+
+	for i := range mysql {
+		if mysql[i].Version != sqlite[i].Version || mysql[i].Name != sqlite[i].Name {
+			t.Errorf("migration %d_%s for mysql is %d_%s for sqlite",
+				mysql[i].Version, mysql[i].Name, sqlite[i].Version, sqlite[i].Name)
+		}
+	}
+}
+
+// newSQLiteMigrator returns a migrator for a new SQLite file, and the
+// connection to it.
+func newSQLiteMigrator(t *testing.T) (*gorm.DB, *Migrator) {
+	db, err := database.NewDatabaseConnection(&database.Settings{
+		Driver: database.DriverSQLite,
+		Path:   filepath.Join(t.TempDir(), "users.db"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	return db, &Migrator{DB: sqlDB, Driver: database.DriverSQLite, Logger: zerolog.Nop()}
+}
@@ -0,0 +1,398 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/asimpleidea/ship-krew/users/api/pkg/database"
+	"github.com/go-sql-driver/mysql"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// mysqlDuplicateColumn is the MySQL error for adding a column that
+	// already exists.
+	mysqlDuplicateColumn uint16 = 1060
+
+	// lockName is the name of the MySQL lock held while migrating, so that
+	// replicas starting at the same time do not apply the same migrations.
+	lockName           string        = "users_schema_migrations"
+	defaultLockTimeout time.Duration = time.Minute
+
+	createVersionsTable string = `CREATE TABLE IF NOT EXISTS schema_migrations (
+    version BIGINT NOT NULL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    applied_at DATETIME NOT NULL
+)`
+)
+
+var (
+	// ErrLockTimeout is returned when another process kept the migration
+	// lock for longer than the lock timeout.
+	ErrLockTimeout = errors.New("timed out while waiting for the migration lock")
+)
+
+// Applied is a migration that was applied to the database.
+type Applied struct {
+	Version   int64
+	Name      string
+	AppliedAt time.Time
+}
+
+// Status is the state of the schema, compared to the migrations that this
+// binary knows about.
+type Status struct {
+	// Current is the highest applied version, or 0 if none was applied.
+	Current int64
+	// Latest is the highest version known to this binary.
+	Latest  int64
+	Applied []*Applied
+	Pending []*Migration
+	// Unknown are versions that were applied, i.e. by a newer release, but
+	// that this binary does not know about.
+	Unknown []int64
+}
+
+// Migrator applies and reverts migrations.
+type Migrator struct {
+	DB     *sql.DB
+	Driver string
+	Logger zerolog.Logger
+	// LockTimeout is how long to wait for other processes to finish
+	// migrating. Defaults to a minute.
+	LockTimeout time.Duration
+}
+
+// Status returns the state of the schema.
+func (m *Migrator) Status(ctx context.Context) (*Status, error) {
+	migrations, err := Load(m.Driver)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get database connection: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, createVersionsTable); err != nil {
+		return nil, fmt.Errorf("could not create versions table: %w", err)
+	}
+
+	applied, err := listApplied(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	return newStatus(migrations, applied), nil
+}
+
+// Up applies all pending migrations.
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.migrate(ctx, func(migrations []*Migration, applied []*Applied) ([]*Migration, []*Migration, error) {
+		return newStatus(migrations, applied).Pending, nil, nil
+	})
+}
+
+// Down reverts the last applied migration.
+func (m *Migrator) Down(ctx context.Context) error {
+	return m.migrate(ctx, func(migrations []*Migration, applied []*Applied) ([]*Migration, []*Migration, error) {
+		if len(applied) == 0 {
+			return nil, nil, nil
+		}
+
+		last := applied[len(applied)-1]
+		migration := find(migrations, last.Version)
+		if migration == nil {
+			return nil, nil, fmt.Errorf("cannot revert unknown migration %d", last.Version)
+		}
+
+		return nil, []*Migration{migration}, nil
+	})
+}
+
+// To applies or reverts migrations until the schema is at the provided
+// version. Version 0 reverts all migrations.
+func (m *Migrator) To(ctx context.Context, version int64) error {
+	return m.migrate(ctx, func(migrations []*Migration, applied []*Applied) ([]*Migration, []*Migration, error) {
+		if version != 0 && find(migrations, version) == nil {
+			return nil, nil, fmt.Errorf("unknown migration version %d", version)
+		}
+
+		ups, downs := []*Migration{}, []*Migration{}
+		for _, migration := range newStatus(migrations, applied).Pending {
+			if migration.Version <= version {
+				ups = append(ups, migration)
+			}
+		}
+
+		for i := len(applied) - 1; i >= 0; i-- {
+			if applied[i].Version <= version {
+				continue
+			}
+
+			migration := find(migrations, applied[i].Version)
+			if migration == nil {
+				return nil, nil, fmt.Errorf("cannot revert unknown migration %d", applied[i].Version)
+			}
+
+			downs = append(downs, migration)
+		}
+
+		return ups, downs, nil
+	})
+}
+
+// migrate holds the lock, and applies the migrations returned by plan after
+// reverting the ones it returns as downs.
+func (m *Migrator) migrate(ctx context.Context, plan func(migrations []*Migration, applied []*Applied) (ups, downs []*Migration, err error)) error {
+	migrations, err := Load(m.Driver)
+	if err != nil {
+		return err
+	}
+
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("could not get database connection: %w", err)
+	}
+	defer conn.Close()
+
+	unlock, err := m.lock(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	// The versions must be read while holding the lock, as another replica
+	// may have just finished migrating.
+	err = func() error {
+		if _, err := conn.ExecContext(ctx, createVersionsTable); err != nil {
+			return fmt.Errorf("could not create versions table: %w", err)
+		}
+
+		applied, err := listApplied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		ups, downs, err := plan(migrations, applied)
+		if err != nil {
+			return err
+		}
+
+		if len(ups) == 0 && len(downs) == 0 {
+			m.Logger.Info().Msg("database schema is up to date")
+			return nil
+		}
+
+		for _, migration := range downs {
+			if err := m.revert(ctx, conn, migration); err != nil {
+				return err
+			}
+		}
+
+		for _, migration := range ups {
+			if err := m.apply(ctx, conn, migration); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}()
+
+	return unlock(err)
+}
+
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, migration *Migration) error {
+	l := m.Logger.With().Int64("version", migration.Version).Str("name", migration.Name).Logger()
+	l.Info().Msg("applying migration...")
+
+	for _, statement := range migration.Up {
+		if _, err := conn.ExecContext(ctx, statement); err != nil {
+			if duplicateColumn(err) {
+				l.Warn().Err(err).Msg("column already exists, skipping statement")
+				continue
+			}
+
+			return fmt.Errorf("could not apply migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+	}
+
+	if _, err := conn.ExecContext(ctx,
+		"INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+		migration.Version, migration.Name, time.Now().UTC()); err != nil {
+		return fmt.Errorf("could not record migration %d: %w", migration.Version, err)
+	}
+
+	l.Info().Msg("migration applied")
+	return nil
+}
+
+func (m *Migrator) revert(ctx context.Context, conn *sql.Conn, migration *Migration) error {
+	l := m.Logger.With().Int64("version", migration.Version).Str("name", migration.Name).Logger()
+	l.Info().Msg("reverting migration...")
+
+	for _, statement := range migration.Down {
+		if _, err := conn.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("could not revert migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+	}
+
+	if _, err := conn.ExecContext(ctx,
+		"DELETE FROM schema_migrations WHERE version = ?", migration.Version); err != nil {
+		return fmt.Errorf("could not record migration %d: %w", migration.Version, err)
+	}
+
+	l.Info().Msg("migration reverted")
+	return nil
+}
+
+// lock prevents other processes from migrating at the same time. The
+// returned function releases the lock and returns the error it is passed,
+// or the one that happened while releasing the lock.
+func (m *Migrator) lock(ctx context.Context, conn *sql.Conn) (func(error) error, error) {
+	timeout := m.LockTimeout
+	if timeout <= 0 {
+		timeout = defaultLockTimeout
+	}
+
+	switch m.Driver {
+	case database.DriverMySQL:
+		// MySQL commits implicitly after each DDL statement, so a
+		// transaction would not help here: a named lock is used instead.
+		var acquired sql.NullInt64
+		if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)",
+			lockName, int64(timeout.Seconds())).Scan(&acquired); err != nil {
+			return nil, fmt.Errorf("could not get migration lock: %w", err)
+		}
+
+		if !acquired.Valid || acquired.Int64 != 1 {
+			return nil, ErrLockTimeout
+		}
+
+		return func(err error) error {
+			// Use a new context, in case ctx was canceled.
+			if _, relErr := conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", lockName); relErr != nil && err == nil {
+				return fmt.Errorf("could not release migration lock: %w", relErr)
+			}
+
+			return err
+		}, nil
+	case database.DriverSQLite:
+		// DDL statements are transactional in SQLite, so all migrations are
+		// applied in a single write transaction, which also acts as a lock.
+		if _, err := conn.ExecContext(ctx, fmt.Sprintf("PRAGMA busy_timeout = %d", timeout.Milliseconds())); err != nil {
+			return nil, fmt.Errorf("could not set busy timeout: %w", err)
+		}
+
+		if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+			return nil, fmt.Errorf("could not get migration lock: %w", err)
+		}
+
+		return func(err error) error {
+			if err != nil {
+				if _, rbErr := conn.ExecContext(context.Background(), "ROLLBACK"); rbErr != nil {
+					m.Logger.Err(rbErr).Msg("could not roll back migrations")
+				}
+
+				return err
+			}
+
+			if _, err := conn.ExecContext(ctx, "COMMIT"); err != nil {
+				return fmt.Errorf("could not commit migrations: %w", err)
+			}
+
+			return nil
+		}, nil
+	default:
+		return nil, fmt.Errorf(`unsupported database driver "%s"`, m.Driver)
+	}
+}
+
+func listApplied(ctx context.Context, conn *sql.Conn) ([]*Applied, error) {
+	rows, err := conn.QueryContext(ctx,
+		"SELECT version, name, applied_at FROM schema_migrations ORDER BY version")
+	if err != nil {
+		return nil, fmt.Errorf("could not list applied migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := []*Applied{}
+	for rows.Next() {
+		a := &Applied{}
+		if err := rows.Scan(&a.Version, &a.Name, &a.AppliedAt); err != nil {
+			return nil, fmt.Errorf("could not read applied migration: %w", err)
+		}
+
+		applied = append(applied, a)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not list applied migrations: %w", err)
+	}
+
+	return applied, nil
+}
+
+func newStatus(migrations []*Migration, applied []*Applied) *Status {
+	status := &Status{
+		Applied: applied,
+		Pending: []*Migration{},
+		Unknown: []int64{},
+	}
+
+	isApplied := map[int64]bool{}
+	for _, a := range applied {
+		isApplied[a.Version] = true
+		if a.Version > status.Current {
+			status.Current = a.Version
+		}
+
+		if find(migrations, a.Version) == nil {
+			status.Unknown = append(status.Unknown, a.Version)
+		}
+	}
+
+	for _, migration := range migrations {
+		if migration.Version > status.Latest {
+			status.Latest = migration.Version
+		}
+
+		if !isApplied[migration.Version] {
+			status.Pending = append(status.Pending, migration)
+		}
+	}
+
+	sort.Slice(status.Unknown, func(i, j int) bool {
+		return status.Unknown[i] < status.Unknown[j]
+	})
+
+	return status
+}
+
+func find(migrations []*Migration, version int64) *Migration {
+	for _, migration := range migrations {
+		if migration.Version == version {
+			return migration
+		}
+	}
+
+	return nil
+}
+
+// duplicateColumn returns true if err was caused by adding a column that
+// already exists.
+func duplicateColumn(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == mysqlDuplicateColumn
+	}
+
+	// SQLite has no specific code for it.
+	return strings.Contains(err.Error(), "duplicate column name")
+}
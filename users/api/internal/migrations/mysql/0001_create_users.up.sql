@@ -0,0 +1,19 @@
+-- The table may already exist in databases created before migrations.
+CREATE TABLE IF NOT EXISTS users (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    created_at DATETIME(3) NULL,
+    updated_at DATETIME(3) NULL,
+    deleted_at DATETIME(3) NULL,
+    password_hash LONGBLOB,
+    salt LONGBLOB,
+    username VARCHAR(100),
+    display_name VARCHAR(100),
+    email VARCHAR(300),
+    registration_ip VARCHAR(50),
+    bio VARCHAR(500),
+    birthday DATETIME(3) NULL,
+    PRIMARY KEY (id),
+    UNIQUE INDEX idx_users_username (username),
+    UNIQUE INDEX idx_users_email (email),
+    INDEX idx_users_deleted_at (deleted_at)
+);
@@ -0,0 +1,14 @@
+-- The table may already exist in databases created before migrations.
+CREATE TABLE IF NOT EXISTS user_changes (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    user_id BIGINT,
+    field VARCHAR(50),
+    old_value VARCHAR(300) NULL,
+    new_value VARCHAR(300) NULL,
+    changed_at DATETIME(3) NULL,
+    caller VARCHAR(100),
+    actor_id BIGINT NULL,
+    PRIMARY KEY (id),
+    INDEX idx_user_changes_user_id (user_id),
+    INDEX idx_user_changes_changed_at (changed_at)
+);
@@ -0,0 +1,18 @@
+-- The table may already exist in databases created before migrations.
+CREATE TABLE IF NOT EXISTS bans (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    user_id BIGINT,
+    scope VARCHAR(20),
+    reason VARCHAR(500),
+    issued_by BIGINT NULL,
+    caller VARCHAR(100),
+    created_at DATETIME(3) NULL,
+    starts_at DATETIME(3) NULL,
+    expires_at DATETIME(3) NULL,
+    lifted_at DATETIME(3) NULL,
+    lifted_by BIGINT NULL,
+    PRIMARY KEY (id),
+    INDEX idx_bans_user_id (user_id),
+    INDEX idx_bans_starts_at (starts_at),
+    INDEX idx_bans_expires_at (expires_at)
+);
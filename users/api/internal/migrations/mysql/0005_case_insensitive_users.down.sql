@@ -0,0 +1,4 @@
+-- Go back to the default collation of the table.
+ALTER TABLE users
+    MODIFY username VARCHAR(100),
+    MODIFY email VARCHAR(300);
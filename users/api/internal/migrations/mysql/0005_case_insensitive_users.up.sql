@@ -0,0 +1,6 @@
+-- The default collation of the server may be case-sensitive, i.e. a binary
+-- one, so it is set explicitly. This fails if some usernames or emails only
+-- differ in case: they must be fixed first.
+ALTER TABLE users
+    MODIFY username VARCHAR(100) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci,
+    MODIFY email VARCHAR(300) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci;
@@ -0,0 +1,13 @@
+-- The table may already exist in databases created before migrations.
+CREATE TABLE IF NOT EXISTS user_changes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER,
+    field TEXT,
+    old_value TEXT,
+    new_value TEXT,
+    changed_at DATETIME,
+    caller TEXT,
+    actor_id INTEGER
+);
+CREATE INDEX IF NOT EXISTS idx_user_changes_user_id ON user_changes (user_id);
+CREATE INDEX IF NOT EXISTS idx_user_changes_changed_at ON user_changes (changed_at);
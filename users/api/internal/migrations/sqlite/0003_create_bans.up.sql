@@ -0,0 +1,17 @@
+-- The table may already exist in databases created before migrations.
+CREATE TABLE IF NOT EXISTS bans (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER,
+    scope TEXT,
+    reason TEXT,
+    issued_by INTEGER,
+    caller TEXT,
+    created_at DATETIME,
+    starts_at DATETIME,
+    expires_at DATETIME,
+    lifted_at DATETIME,
+    lifted_by INTEGER
+);
+CREATE INDEX IF NOT EXISTS idx_bans_user_id ON bans (user_id);
+CREATE INDEX IF NOT EXISTS idx_bans_starts_at ON bans (starts_at);
+CREATE INDEX IF NOT EXISTS idx_bans_expires_at ON bans (expires_at);
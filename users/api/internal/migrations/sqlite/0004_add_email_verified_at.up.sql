@@ -0,0 +1,3 @@
+-- The column may already exist in databases created before migrations:
+-- the migrator skips the statement then.
+ALTER TABLE users ADD COLUMN email_verified_at DATETIME;
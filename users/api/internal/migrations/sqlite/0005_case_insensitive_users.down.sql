@@ -0,0 +1,22 @@
+CREATE TABLE users_binary (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at DATETIME,
+    updated_at DATETIME,
+    deleted_at DATETIME,
+    password_hash BLOB,
+    salt BLOB,
+    username TEXT,
+    display_name TEXT,
+    email TEXT,
+    registration_ip TEXT,
+    bio TEXT,
+    birthday DATETIME,
+    email_verified_at DATETIME
+);
+INSERT INTO users_binary (id, created_at, updated_at, deleted_at, password_hash, salt, username, display_name, email, registration_ip, bio, birthday, email_verified_at)
+    SELECT id, created_at, updated_at, deleted_at, password_hash, salt, username, display_name, email, registration_ip, bio, birthday, email_verified_at FROM users;
+DROP TABLE users;
+ALTER TABLE users_binary RENAME TO users;
+CREATE UNIQUE INDEX idx_users_username ON users (username);
+CREATE UNIQUE INDEX idx_users_email ON users (email);
+CREATE INDEX idx_users_deleted_at ON users (deleted_at);
@@ -0,0 +1,25 @@
+-- SQLite cannot change the collation of a column, so the table is created
+-- again with case-insensitive usernames and emails. This fails if some
+-- usernames or emails only differ in case: they must be fixed first.
+CREATE TABLE users_nocase (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at DATETIME,
+    updated_at DATETIME,
+    deleted_at DATETIME,
+    password_hash BLOB,
+    salt BLOB,
+    username TEXT COLLATE NOCASE,
+    display_name TEXT,
+    email TEXT COLLATE NOCASE,
+    registration_ip TEXT,
+    bio TEXT,
+    birthday DATETIME,
+    email_verified_at DATETIME
+);
+INSERT INTO users_nocase (id, created_at, updated_at, deleted_at, password_hash, salt, username, display_name, email, registration_ip, bio, birthday, email_verified_at)
+    SELECT id, created_at, updated_at, deleted_at, password_hash, salt, username, display_name, email, registration_ip, bio, birthday, email_verified_at FROM users;
+DROP TABLE users;
+ALTER TABLE users_nocase RENAME TO users;
+CREATE UNIQUE INDEX idx_users_username ON users (username);
+CREATE UNIQUE INDEX idx_users_email ON users (email);
+CREATE INDEX idx_users_deleted_at ON users (deleted_at);
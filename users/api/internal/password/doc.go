@@ -0,0 +1,7 @@
+// Package password contains functions to hash passwords with Argon2id and
+// to verify them, in PHC string format.
+//
+// Passwords hashed with the legacy format, i.e. the SHA-256 digest of the
+// password followed by the salt, can still be verified, but they are
+// always reported as needing a rehash.
+package password
@@ -0,0 +1,236 @@
+package password
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	// DefaultTime is the default number of passes over the memory.
+	DefaultTime uint32 = 3
+	// DefaultMemory is the default amount of memory used, in KiB.
+	DefaultMemory uint32 = 64 * 1024
+	// DefaultThreads is the default number of threads used.
+	DefaultThreads uint8 = 2
+	// DefaultSaltLength is the default length of the random salt, in bytes.
+	DefaultSaltLength uint32 = 16
+	// DefaultKeyLength is the default length of the generated key, in bytes.
+	DefaultKeyLength uint32 = 32
+	// MaxTime is the maximum number of passes over the memory.
+	MaxTime uint32 = 64
+	// MaxMemory is the maximum amount of memory used, in KiB. Hashes are
+	// verified at every login, so more than this would let a single one
+	// exhaust the memory of the server.
+	MaxMemory uint32 = 1024 * 1024
+
+	argon2idID      string = "argon2id"
+	argon2idPrefix  string = "$" + argon2idID + "$"
+	legacyHashSize  int    = sha256.Size
+	phcSegments     int    = 6
+	phcParamsFormat string = "m=%d,t=%d,p=%d"
+)
+
+var (
+	ErrEmptyPassword         error = errors.New("empty password")
+	ErrInvalidHash           error = errors.New("hash is not in a supported format")
+	ErrIncompatibleVersion   error = errors.New("incompatible argon2 version")
+	ErrInvalidParams         error = errors.New("invalid argon2 parameters")
+	ErrRandomnessUnavailable error = errors.New("crypto/rand is unavailable")
+)
+
+// Params contains the parameters used by Argon2id to hash a password.
+type Params struct {
+	Time       uint32 `json:"time" yaml:"time" flag:"time" usage:"the number of passes over the memory when hashing passwords"`
+	Memory     uint32 `json:"memory" yaml:"memory" flag:"memory" usage:"the memory used when hashing passwords, in KiB"`
+	Threads    uint8  `json:"threads" yaml:"threads" flag:"threads" usage:"the number of threads used when hashing passwords"`
+	SaltLength uint32 `json:"salt_length" yaml:"saltLength" flag:"salt-length" usage:"the length of the salt generated for each password, in bytes"`
+	KeyLength  uint32 `json:"key_length" yaml:"keyLength" flag:"key-length" usage:"the length of the hash generated for each password, in bytes"`
+}
+
+// DefaultParams returns the parameters that are used when none are
+// provided.
+func DefaultParams() *Params {
+	return &Params{
+		Time:       DefaultTime,
+		Memory:     DefaultMemory,
+		Threads:    DefaultThreads,
+		SaltLength: DefaultSaltLength,
+		KeyLength:  DefaultKeyLength,
+	}
+}
+
+// Validate returns an error if any of the parameters is not usable.
+func (p *Params) Validate() error {
+	switch {
+	case p.Time < 1:
+		return fmt.Errorf("%w: time must be at least 1", ErrInvalidParams)
+	case p.Time > MaxTime:
+		return fmt.Errorf("%w: time must be at most %d", ErrInvalidParams, MaxTime)
+	case p.Memory < 8*uint32(p.Threads):
+		return fmt.Errorf("%w: memory must be at least 8 KiB per thread", ErrInvalidParams)
+	case p.Memory > MaxMemory:
+		return fmt.Errorf("%w: memory must be at most %d KiB", ErrInvalidParams, MaxMemory)
+	case p.Threads < 1:
+		return fmt.Errorf("%w: threads must be at least 1", ErrInvalidParams)
+	case p.SaltLength < 8:
+		return fmt.Errorf("%w: salt length must be at least 8 bytes", ErrInvalidParams)
+	case p.KeyLength < 16:
+		return fmt.Errorf("%w: key length must be at least 16 bytes", ErrInvalidParams)
+	}
+
+	return nil
+}
+
+// Hash returns the PHC string of password hashed with Argon2id and the
+// provided parameters. If params is nil, DefaultParams is used.
+func Hash(password string, params *Params) (string, error) {
+	if password == "" {
+		return "", ErrEmptyPassword
+	}
+
+	if params == nil {
+		params = DefaultParams()
+	}
+
+	if err := params.Validate(); err != nil {
+		return "", err
+	}
+
+	salt := make([]byte, params.SaltLength)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", fmt.Errorf("%w: %s", ErrRandomnessUnavailable, err.Error())
+	}
+
+	key := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLength)
+
+	return fmt.Sprintf("%sv=%d$%s$%s$%s",
+		argon2idPrefix,
+		argon2.Version,
+		fmt.Sprintf(phcParamsFormat, params.Memory, params.Time, params.Threads),
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify returns true if password matches the encoded hash. The comparison
+// is always done in constant time.
+//
+// encoded can either be a PHC string produced by Hash or a legacy hash: in
+// that case legacySalt must be the salt that was stored with it.
+func Verify(password string, encoded, legacySalt []byte) (bool, error) {
+	if !IsLegacy(encoded) {
+		params, salt, key, err := decode(encoded)
+		if err != nil {
+			return false, err
+		}
+
+		other := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLength)
+		return subtle.ConstantTimeCompare(key, other) == 1, nil
+	}
+
+	if len(encoded) != legacyHashSize+len(legacySalt) {
+		return false, ErrInvalidHash
+	}
+
+	digest := sha256.Sum256([]byte(password))
+	withSalt := append(digest[:], legacySalt...)
+
+	return subtle.ConstantTimeCompare(withSalt, encoded) == 1, nil
+}
+
+// CheckHash returns an error if encoded is not a PHC string that can be
+// verified, i.e. one produced by Hash with parameters that Validate
+// accepts. Hashes produced somewhere else must be checked with it before
+// they are stored.
+func CheckHash(encoded []byte) error {
+	_, _, _, err := decode(encoded)
+	return err
+}
+
+// LegacyHash returns the legacy hash to store, given the SHA-256 digest of
+// the password and its salt, as they are kept by systems that still use
+// the legacy format.
+func LegacyHash(digest, salt []byte) ([]byte, error) {
+	if len(digest) != legacyHashSize || len(salt) == 0 {
+		return nil, ErrInvalidHash
+	}
+
+	encoded := make([]byte, 0, len(digest)+len(salt))
+	return append(append(encoded, digest...), salt...), nil
+}
+
+// IsLegacy returns true if encoded is not a PHC string produced by Hash.
+func IsLegacy(encoded []byte) bool {
+	return !bytes.HasPrefix(encoded, []byte(argon2idPrefix))
+}
+
+// NeedsRehash returns true if encoded was produced with the legacy format
+// or with parameters different than p, e.g. because the cost has been
+// raised in the meantime.
+func (p *Params) NeedsRehash(encoded []byte) bool {
+	if IsLegacy(encoded) {
+		return true
+	}
+
+	params, salt, _, err := decode(encoded)
+	if err != nil {
+		return true
+	}
+
+	return params.Time != p.Time ||
+		params.Memory != p.Memory ||
+		params.Threads != p.Threads ||
+		params.KeyLength != p.KeyLength ||
+		uint32(len(salt)) != p.SaltLength
+}
+
+func decode(encoded []byte) (*Params, []byte, []byte, error) {
+	// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+	segments := strings.Split(string(encoded), "$")
+	if len(segments) != phcSegments || segments[1] != argon2idID {
+		return nil, nil, nil, ErrInvalidHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(segments[2], "v=%d", &version); err != nil {
+		return nil, nil, nil, ErrInvalidHash
+	}
+
+	if version != argon2.Version {
+		return nil, nil, nil, ErrIncompatibleVersion
+	}
+
+	params := &Params{}
+	if _, err := fmt.Sscanf(segments[3], phcParamsFormat,
+		&params.Memory, &params.Time, &params.Threads); err != nil {
+		return nil, nil, nil, ErrInvalidHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(segments[4])
+	if err != nil {
+		return nil, nil, nil, ErrInvalidHash
+	}
+	params.SaltLength = uint32(len(salt))
+
+	key, err := base64.RawStdEncoding.DecodeString(segments[5])
+	if err != nil {
+		return nil, nil, nil, ErrInvalidHash
+	}
+	params.KeyLength = uint32(len(key))
+
+	// Hashes can come from somewhere else, i.e. imports, and argon2 panics
+	// or runs out of memory with parameters out of range.
+	if err := params.Validate(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	return params, salt, key, nil
+}
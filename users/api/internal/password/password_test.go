@@ -0,0 +1,42 @@
+package password
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDecodeRejectsParamsOutOfRange(t *testing.T) {
+	const salt, key = "c29tZXNhbHRzb21lc2FsdA", "RdescudvJCsgt3ub+b+dWRWJTmaaJObGRdescudvJCs"
+
+	cases := []struct {
+		name   string
+		params string
+		err    error
+	}{
+		{"valid", "m=65536,t=3,p=2", nil},
+		{"no passes", "m=65536,t=0,p=2", ErrInvalidParams},
+		{"too many passes", "m=65536,t=1000,p=2", ErrInvalidParams},
+		{"no threads", "m=65536,t=3,p=0", ErrInvalidParams},
+		{"too little memory", "m=8,t=3,p=2", ErrInvalidParams},
+		{"too much memory", "m=4294967295,t=3,p=2", ErrInvalidParams},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			encoded := []byte("$argon2id$v=19$" + c.params + "$" + salt + "$" + key)
+
+			if err := CheckHash(encoded); !errors.Is(err, c.err) {
+				t.Fatalf("CheckHash returned %v, expected %v", err, c.err)
+			}
+
+			// It must fail rather than panic.
+			if _, err := Verify("password", encoded, nil); !errors.Is(err, c.err) {
+				t.Fatalf("Verify returned %v, expected %v", err, c.err)
+			}
+
+			if c.err != nil && !DefaultParams().NeedsRehash(encoded) {
+				t.Fatal("NeedsRehash returned false for a hash that cannot be verified")
+			}
+		})
+	}
+}
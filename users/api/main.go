@@ -1,181 +1,353 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net/url"
 	"os"
-	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/asimpleidea/ship-krew/users/api/internal/bulk"
+	"github.com/asimpleidea/ship-krew/users/api/internal/cache"
 	udb "github.com/asimpleidea/ship-krew/users/api/internal/database"
+	"github.com/asimpleidea/ship-krew/users/api/internal/migrations"
 	"github.com/asimpleidea/ship-krew/users/api/pkg/api"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/auth"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/config"
 	"github.com/asimpleidea/ship-krew/users/api/pkg/database"
 	uerrors "github.com/asimpleidea/ship-krew/users/api/pkg/errors"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/health"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/lifecycle"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/logging"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/metrics"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/tracing"
+	"github.com/go-redis/redis/v8"
 	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/rs/zerolog"
+	"github.com/uptrace/opentelemetry-go-extra/otelgorm"
 )
 
 const (
 	fiberAppName string = "Users API Server"
+	// dbStatsName is the db_name label of the connection pool metrics.
+	dbStatsName        string = "users"
+	tracingServiceName string = "users-api"
+
+	// migrationsCheck refuses to serve if the schema is behind, while
+	// migrationsUp applies the pending migrations first.
+	migrationsCheck string = "check"
+	migrationsUp    string = "up"
 )
 
 var (
 	log zerolog.Logger
+
+	signups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "api",
+		Name:      "signups_total",
+		Help:      "The number of users created, or that could not be created, i.e. because their username was taken.",
+	}, []string{"result"})
 )
 
 func main() {
 	var (
-		verbosity  int
-		dbSettings = &database.Settings{}
+		cfg           = defaultConfig()
+		authenticator *auth.Authenticator
 	)
 
-	flag.IntVar(&verbosity, "verbosity", 1, "the verbosity level")
+	log = zerolog.New(os.Stderr).With().Logger()
 
-	flag.StringVar(&dbSettings.Name, "database-name", "", "the name of the database to connect to")
-	flag.StringVar(&dbSettings.User, "database-user", "", "the username to connect as")
-	flag.StringVar(&dbSettings.Password, "database-password", "", "the password to use for the provided user")
-	flag.StringVar(&dbSettings.Address, "database-address", "localhost", "the address where mysql is running")
-	flag.IntVar(&dbSettings.Port, "database-port", 3306, "the port mysql is exposing")
-	flag.StringVar(&dbSettings.Charset, "database-charset", "utf8mb4", "the charset used by the database")
-	flag.DurationVar(&dbSettings.ReadTimeout, "database-readtimeout", 2*time.Minute, "the charset used by the database")
-	flag.DurationVar(&dbSettings.WriteTimeout, "database-writetimeout", 2*time.Minute, "the charset used by the database")
-	flag.Parse()
+	loaded, err := config.Load(cfg, os.Args[1:])
+	if err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			log.Err(err).Msg("error while loading configuration")
+		}
+		return
+	}
 
-	log = zerolog.New(os.Stderr).With().Logger()
-	log.Info().Int("verbosity", verbosity).Msg("starting...")
+	if loaded.Print {
+		if err := config.Print(os.Stdout, cfg); err != nil {
+			log.Err(err).Msg("error while printing configuration")
+		}
+		return
+	}
+
+	log.Info().Int("verbosity", cfg.Verbosity).Str("config", loaded.File).Msg("starting...")
 
 	{
 		logLevels := [4]zerolog.Level{zerolog.DebugLevel, zerolog.InfoLevel, zerolog.ErrorLevel}
-		log = log.Level(logLevels[verbosity])
+		log = log.Level(logLevels[cfg.Verbosity])
 	}
 
-	db, err := database.NewDatabaseConnection(dbSettings)
-	if err != nil {
-		log.Err(err).Msg("error while establishing connection to the database")
-		return
-	}
+	if args := loaded.Args; len(args) > 0 {
+		var err error
+		switch args[0] {
+		case "migrate":
+			err = runMigrate(&cfg.Database, cfg.MigrationsLockTimeout, args[1:])
+		case "export":
+			err = runExport(cfg, args[1:])
+		case "import":
+			err = runImport(cfg, args[1:])
+		default:
+			log.Error().Str("command", args[0]).Msg("unknown command")
+			os.Exit(1)
+		}
 
-	usersDB := &udb.Database{DB: db, Logger: log}
+		if err != nil {
+			log.Err(err).Str("command", args[0]).Msg("error while running command")
+			os.Exit(1)
+		}
 
-	app := fiber.New(fiber.Config{
-		AppName:               fiberAppName,
-		ReadTimeout:           time.Minute,
-		DisableStartupMessage: verbosity > 0,
-	})
+		return
+	}
 
-	users := app.Group("/users")
+	shutdownTracing, err := tracing.Setup(context.Background(), tracingServiceName, &cfg.Tracing)
+	if err != nil {
+		log.Err(err).Msg("error while setting up tracing")
+		return
+	}
 
-	users.Get("/", func(c *fiber.Ctx) error {
-		filters := &udb.ListFilters{}
+	if cfg.Auth.Disabled {
+		log.Warn().Msg("authentication is disabled: anyone can perform any operation")
+	} else {
+		creds := &auth.Credentials{}
 
-		page, err := func() (int, error) {
-			p, err := url.QueryUnescape(c.Query("page", "1"))
+		if cfg.Auth.APIKeysFile != "" {
+			c, err := auth.LoadCredentials(cfg.Auth.APIKeysFile)
 			if err != nil {
-				return 0, fmt.Errorf("error while unescaping page: %w", err)
+				log.Err(err).Msg("error while loading api keys")
+				return
 			}
-
-			return strconv.Atoi(p)
-		}()
-		if err != nil || page < 1 {
-			return c.Status(fiber.StatusBadRequest).
-				JSON(&uerrors.Error{
-					Code:    uerrors.CodeInvalidPage,
-					Message: uerrors.MessageInvalidPage,
-					Err:     err,
-				})
+			creds = c
 		}
-		filters.Page = &page
 
-		nameIn, err := url.QueryUnescape(c.Query("usernameIn"))
+		a, err := auth.NewAuthenticator(creds)
 		if err != nil {
-			return c.Status(fiber.StatusBadRequest).
-				JSON(&uerrors.Error{
-					Code:    uerrors.CodeInvalidNameIn,
-					Message: uerrors.MessageInvalidNameIn,
-					Err:     err,
-				})
+			log.Err(err).Msg("cannot authenticate callers: provide api keys, token issuers or disable authentication")
+			return
 		}
+		authenticator = a
+	}
 
-		emailIn, err := url.QueryUnescape(c.Query("emailIn"))
+	// The memory driver has no dependencies, so it is always ready.
+	readiness := &health.Checker{}
+	closers := []lifecycle.Closer{}
+
+	var usersDB udb.UserStore
+	switch cfg.Database.Driver {
+	case database.DriverMemory:
+		log.Warn().Msg("users are kept in memory and will be lost on exit")
+		usersDB = &udb.Memory{Logger: log, PasswordParams: &cfg.Argon2}
+	default:
+		db, err := database.NewDatabaseConnection(&cfg.Database)
 		if err != nil {
-			return c.Status(fiber.StatusBadRequest).
-				JSON(&uerrors.Error{
-					Code:    uerrors.CodeInvalidEmailIn,
-					Message: uerrors.MessageInvalidEmailIn,
-					Err:     err,
-				})
+			log.Err(err).Msg("error while establishing connection to the database")
+			return
 		}
 
-		idIn, err := url.QueryUnescape(c.Query("idIn"))
+		sqlDB, err := db.DB()
 		if err != nil {
-			return c.Status(fiber.StatusBadRequest).
-				JSON(&uerrors.Error{
-					Code:    uerrors.CodeInvalidIdIn,
-					Message: uerrors.MessageInvalidIdIn,
-					Err:     err,
-				})
+			log.Err(err).Msg("error while getting the database connection pool")
+			return
 		}
 
-		switch {
-		case idIn != "":
-			filters.IDIn = func() (filteredIds []int64) {
-				ids := strings.Split(idIn, ",")
-				for _, id := range ids {
-					if val, err := strconv.ParseInt(id, 10, 64); err == nil && val > 0 {
-						filteredIds = append(filteredIds, val)
-					}
-				}
+		migrator := &migrations.Migrator{
+			DB:          sqlDB,
+			Driver:      cfg.Database.Driver,
+			Logger:      log,
+			LockTimeout: cfg.MigrationsLockTimeout,
+		}
+
+		if cfg.Migrations == migrationsUp {
+			if err := migrator.Up(context.Background()); err != nil {
+				log.Err(err).Msg("error while applying migrations")
 				return
-			}()
-		case nameIn != "":
-			filters.UsernameIn = strings.Split(nameIn, ",")
-		case emailIn != "":
-			filters.EmailIn = strings.Split(emailIn, ",")
+			}
 		}
 
-		users, err := usersDB.ListUsers(filters)
+		status, err := migrator.Status(context.Background())
 		if err != nil {
-			code := err.(*uerrors.Error).Code
+			log.Err(err).Msg("error while checking the database schema")
+			return
+		}
 
-			return c.
-				Status(uerrors.ToHTTPStatusCode(code)).
-				JSON(err)
+		if len(status.Pending) > 0 {
+			log.Error().
+				Int64("current", status.Current).
+				Int64("latest", status.Latest).
+				Msg("database schema is behind: run the migrate command or start with --migrations=up")
+			return
 		}
 
-		return c.JSON(users)
-	})
+		if len(status.Unknown) > 0 {
+			log.Warn().
+				Interface("versions", status.Unknown).
+				Msg("database has migrations unknown to this version")
+		}
 
-	users.Get("/username/:username", func(c *fiber.Ctx) error {
-		username := c.Params("username")
+		prometheus.MustRegister(collectors.NewDBStatsCollector(sqlDB, dbStatsName))
 
-		uname, err := url.PathUnescape(username)
-		if err != nil || uname == "" {
-			return c.
-				Status(fiber.StatusBadRequest).
-				JSON(&uerrors.Error{
-					Err:     uerrors.ErrInvalidUsername,
-					Code:    uerrors.CodeInvalidUsername,
-					Message: uerrors.MessageInvalidUsername,
-				})
+		// Values are left out of traced queries, as they include emails and
+		// password hashes.
+		if err := db.Use(otelgorm.NewPlugin(
+			otelgorm.WithDBName(cfg.Database.Name),
+			otelgorm.WithoutQueryVariables(),
+			otelgorm.WithoutMetrics())); err != nil {
+			log.Err(err).Msg("error while setting up database tracing")
+			return
 		}
 
-		user, err := usersDB.GetUserByUsername(username)
-		if err != nil {
-			code := err.(*uerrors.Error).Code
+		// Closed only once requests in flight are served.
+		closers = append(closers, lifecycle.Closer{
+			Name: "database",
+			Close: func(context.Context) error {
+				return sqlDB.Close()
+			},
+		})
 
-			return c.
-				Status(uerrors.ToHTTPStatusCode(code)).
-				JSON(err)
-		}
+		readiness.Checks = append(readiness.Checks, health.Check{
+			Name:  "database",
+			Check: sqlDB.PingContext,
+		})
 
-		return c.JSON(user)
+		usersDB = &udb.Database{DB: db, Logger: log, PasswordParams: &cfg.Argon2}
+	}
+
+	switch cfg.Cache.Backend {
+	case cache.BackendMemory:
+		usersDB = udb.NewCached(usersDB, &cache.Memory{Size: cfg.Cache.Size}, &cfg.Cache, log)
+	case cache.BackendRedis:
+		// The cache is not a dependency for readiness: users are read
+		// from the database when it is down.
+		redisClient := redis.NewClient(&redis.Options{
+			Addr:     cfg.Cache.Redis.Endpoints,
+			Password: cfg.Cache.Redis.Password,
+			DB:       cfg.Cache.Redis.DB,
+		})
+		closers = append(closers, lifecycle.Closer{
+			Name: "cache",
+			Close: func(context.Context) error {
+				return redisClient.Close()
+			},
+		})
+
+		usersDB = udb.NewCached(usersDB, &cache.Redis{Client: redisClient}, &cfg.Cache, log)
+	}
+
+	app := fiber.New(fiber.Config{
+		AppName:               fiberAppName,
+		ReadTimeout:           time.Minute,
+		DisableStartupMessage: cfg.Verbosity > 0,
 	})
+	app.Use(metrics.Middleware(), tracing.Middleware(), logging.Middleware(log))
+
+	serveUsers(app.Group("/users"), authenticator, usersDB, cfg.ListMaxLimit)
+
+	// Request bodies are streamed, so that imports can be larger than the
+	// maximum body size.
+	internalEndpoints := fiber.New(fiber.Config{
+		AppName:               fiberAppName,
+		ReadTimeout:           time.Minute,
+		DisableStartupMessage: cfg.Verbosity > 0,
+		StreamRequestBody:     true,
+	})
+
+	internalEndpoints.Use(logging.Middleware(log))
+
+	internalEndpoints.Get("/startupz", readiness.StartupHandler())
+	internalEndpoints.Get("/readyz", readiness.ReadinessHandler())
+
+	internalEndpoints.Get("/livez", func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	})
+
+	internalEndpoints.Get("/metrics", metrics.Handler())
+
+	// Admin endpoints are only served internally, as the internal port is
+	// not exposed by the service: support staff reach them with a
+	// port-forward, and still need a key with the admin scope.
+	adminUsers := internalEndpoints.Group("/users")
+	adminUsers.Use(authenticate(authenticator),
+		requireScope(auth.ScopeAdmin),
+		identifyActor(usersDB, true))
+	adminUsers.Get("/", listUsers(usersDB, cfg.ListMaxLimit))
+	adminUsers.Get("/export", exportUsers(usersDB, cfg.ListMaxLimit))
+	adminUsers.Post("/import", importUsers(usersDB, cfg.ImportMaxSize))
+	adminUsers.Get("/username/:username", getUserByUsername(usersDB))
+	adminUsers.Get("/id/:id", getUserByID(usersDB))
+	adminUsers.Get("/id/:id/history", getUserHistory(usersDB))
+	adminUsers.Post("/:id/restore", restoreUser(usersDB))
+	adminUsers.Get("/id/:id/bans", listBans(usersDB))
+	adminUsers.Post("/id/:id/bans", issueBan(usersDB))
+	adminUsers.Post("/id/:id/bans/:banID/lift", liftBan(usersDB))
+
+	go func() {
+		if err := app.Listen(":8080"); err != nil {
+			log.Err(err).Msg("error while listening")
+		}
+	}()
+
+	go func() {
+		if err := internalEndpoints.Listen(":8081"); err != nil {
+			log.Err(err).Msg("error while listening")
+		}
+	}()
+
+	// Graceful Shutdown
+
+	sig := lifecycle.WaitForSignal()
+	log.Info().Str("signal", sig.String()).Msg("shutting down...")
+
+	shutdown := &lifecycle.Shutdown{
+		Settings:  &cfg.Shutdown,
+		Logger:    log,
+		Readiness: readiness,
+		Apps:      []*fiber.App{app, internalEndpoints},
+		Closers: append(closers, lifecycle.Closer{
+			Name:  "tracing",
+			Close: shutdownTracing,
+		}),
+	}
+	if err := shutdown.Run(); err != nil {
+		log.Err(err).Msg("error while shutting down")
+		os.Exit(1)
+	}
+	log.Info().Msg("goodbye!")
+}
 
-	users.Get("/id/:id", func(c *fiber.Ctx) error {
+// serveUsers serves the users API of the public app on users.
+func serveUsers(users fiber.Router, authenticator *auth.Authenticator, usersDB udb.UserStore, listMaxLimit int) {
+	users.Use(authenticate(authenticator), identifyActor(usersDB, false))
+
+	users.Get("/", requireScope(auth.ScopeRead), listUsers(usersDB, listMaxLimit))
+
+	users.Get("/username/:username", requireScope(auth.ScopeRead), getUserByUsername(usersDB))
+
+	users.Get("/id/:id", requireScope(auth.ScopeRead), getUserByID(usersDB))
+
+	users.Get("/id/:id/history", requireScope(auth.ScopeRead), getUserHistory(usersDB))
+
+	users.Post("/id/:id/email/verify", requireScope(auth.ScopeWrite), verifyEmail(usersDB))
+
+	// Passwords are only set by the services handling credentials, i.e. when
+	// resetting them: updating users is not enough.
+	users.Put("/id/:id/password", requireScope(auth.ScopeCredentials), setPassword(usersDB))
+
+	users.Post("/id/:id/credentials/verify", requireScope(auth.ScopeRead), func(c *fiber.Ctx) error {
 		id := c.Params("id")
 
 		id, err := url.PathUnescape(id)
@@ -200,19 +372,53 @@ func main() {
 				})
 		}
 
-		user, err := usersDB.GetUserByID(uid)
+		creds, err := parseCredentials(c)
 		if err != nil {
-			code := err.(*uerrors.Error).Code
+			return c.
+				Status(uerrors.ToHTTPStatusCode(err.(*uerrors.Error).Code)).
+				JSON(err)
+		}
 
+		verification, err := usersDB.WithContext(c.UserContext()).VerifyCredentialsByID(uid, creds.Password)
+		if err != nil {
 			return c.
-				Status(uerrors.ToHTTPStatusCode(code)).
+				Status(uerrors.ToHTTPStatusCode(err.(*uerrors.Error).Code)).
 				JSON(err)
 		}
 
-		return c.JSON(user)
+		return c.JSON(verification)
 	})
 
-	users.Post("/", func(c *fiber.Ctx) error {
+	users.Post("/username/:username/credentials/verify", requireScope(auth.ScopeRead), func(c *fiber.Ctx) error {
+		uname, err := url.PathUnescape(c.Params("username"))
+		if err != nil || uname == "" {
+			return c.
+				Status(fiber.StatusBadRequest).
+				JSON(&uerrors.Error{
+					Err:     uerrors.ErrInvalidUsername,
+					Code:    uerrors.CodeInvalidUsername,
+					Message: uerrors.MessageInvalidUsername,
+				})
+		}
+
+		creds, err := parseCredentials(c)
+		if err != nil {
+			return c.
+				Status(uerrors.ToHTTPStatusCode(err.(*uerrors.Error).Code)).
+				JSON(err)
+		}
+
+		verification, err := usersDB.WithContext(c.UserContext()).VerifyCredentialsByUsername(uname, creds.Password)
+		if err != nil {
+			return c.
+				Status(uerrors.ToHTTPStatusCode(err.(*uerrors.Error).Code)).
+				JSON(err)
+		}
+
+		return c.JSON(verification)
+	})
+
+	users.Post("/", requireScope(auth.ScopeWrite), func(c *fiber.Ctx) error {
 		c.Accepts(fiber.MIMEApplicationJSON)
 
 		var newUser api.User
@@ -238,19 +444,21 @@ func main() {
 				})
 		}
 
-		createdUser, err := usersDB.CreateUser(&newUser)
+		createdUser, err := usersDB.WithContext(c.UserContext()).CreateUser(&newUser)
 		if err != nil {
+			signups.WithLabelValues("rejected").Inc()
 			return c.
 				Status(uerrors.ToHTTPStatusCode(err.(*uerrors.Error).Code)).
 				JSON(err)
 		}
 
+		signups.WithLabelValues("created").Inc()
 		return c.
 			Status(fiber.StatusCreated).
 			JSON(createdUser)
 	})
 
-	users.Put("/:id", func(c *fiber.Ctx) error {
+	users.Put("/:id", requireScope(auth.ScopeWrite), func(c *fiber.Ctx) error {
 		c.Accepts(fiber.MIMEApplicationJSON)
 
 		var userToUpd api.User
@@ -299,21 +507,44 @@ func main() {
 				})
 		}
 
-		if userToUpd.ID != uid {
-			// Just in case...
-			userToUpd.ID = uid
+		// Replaces the whole user, so all the fields that cannot be removed
+		// are needed. Bio and birthday are removed if missing.
+		if userToUpd.Email == nil {
+			return c.
+				Status(fiber.StatusBadRequest).
+				JSON(&uerrors.Error{
+					Err:     uerrors.ErrEmptyEmail,
+					Code:    uerrors.CodeEmptyEmail,
+					Message: uerrors.MessageEmptyEmail,
+				})
+		}
+
+		store := usersDB.WithContext(c.UserContext())
+		version, err := ifMatch(c, store, uid)
+		if err != nil {
+			return c.
+				Status(uerrors.ToHTTPStatusCode(err.(*uerrors.Error).Code)).
+				JSON(err)
 		}
 
 		// TODO: check if user is admin or owner of this profile
-		if err = usersDB.UpdateUser(uid, &userToUpd); err != nil {
+		actor := &udb.Actor{
+			Caller: identityOf(c).Name,
+			UserID: actorOf(c).id,
+		}
+		updated, err := store.UpdateUser(uid, api.ReplaceUser(&userToUpd), actor, version)
+		if err != nil {
 			return c.
 				Status(uerrors.ToHTTPStatusCode(err.(*uerrors.Error).Code)).
 				JSON(err)
 		}
 
+		setETag(c, updated.Version, actorOf(c).roleOn(uid, ""))
 		return c.SendStatus(fiber.StatusOK)
 	})
 
+	users.Patch("/:id", requireScope(auth.ScopeWrite), patchUser(usersDB))
+
 	users.Delete("/:id", func(c *fiber.Ctx) error {
 		id := c.Params("id")
 
@@ -344,10 +575,32 @@ func main() {
 			hardDelete = "false"
 		}
 
-		// TODO: check if user CAN hard delete
-		// TODO: check if user is admin or owner of this profile
+		// Hard deleting requires its own scope, as it cannot be undone.
+		scope := auth.ScopeDelete
+		if hardDelete == "true" {
+			scope = auth.ScopeHardDelete
+		}
+
+		if !identityOf(c).Has(scope) {
+			return c.
+				Status(fiber.StatusForbidden).
+				JSON(&uerrors.Error{
+					Err:     fmt.Errorf("%w: missing %s scope", uerrors.ErrForbidden, scope),
+					Code:    uerrors.CodeForbidden,
+					Message: uerrors.MessageForbidden,
+				})
+		}
+
+		store := usersDB.WithContext(c.UserContext())
+		version, err := ifMatch(c, store, uid)
+		if err != nil {
+			return c.
+				Status(uerrors.ToHTTPStatusCode(err.(*uerrors.Error).Code)).
+				JSON(err)
+		}
 
-		if err = usersDB.DeleteUser(uid, hardDelete == "true"); err != nil {
+		// TODO: check if user is admin or owner of this profile
+		if err = store.DeleteUser(uid, hardDelete == "true", version); err != nil {
 			return c.
 				Status(uerrors.ToHTTPStatusCode(err.(*uerrors.Error).Code)).
 				JSON(err)
@@ -355,49 +608,1427 @@ func main() {
 
 		return c.SendStatus(fiber.StatusGone)
 	})
+}
 
-	internalEndpoints := fiber.New(fiber.Config{
-		AppName:               fiberAppName,
-		ReadTimeout:           time.Minute,
-		DisableStartupMessage: verbosity > 0,
-	})
+func parseCredentials(c *fiber.Ctx) (*api.Credentials, error) {
+	if len(c.Body()) == 0 {
+		return nil, &uerrors.Error{
+			Err:     uerrors.ErrEmptyBody,
+			Code:    uerrors.CodeEmptyBody,
+			Message: uerrors.MessageEmptyBody,
+		}
+	}
 
-	internalEndpoints.Get("/readyz", func(c *fiber.Ctx) error {
-		if db != nil {
-			return c.SendStatus(fiber.StatusOK)
+	var creds api.Credentials
+	if err := json.Unmarshal(c.Body(), &creds); err != nil {
+		return nil, &uerrors.Error{
+			Err:     fmt.Errorf("invalid credentials body"),
+			Code:    uerrors.CodeInvalidUserPost,
+			Message: fmt.Sprintf("%s %s", uerrors.MessageInvalidUserPost, err.Error()),
 		}
+	}
 
-		return c.SendStatus(fiber.StatusInternalServerError)
-	})
+	return &creds, nil
+}
 
-	internalEndpoints.Get("/livez", func(c *fiber.Ctx) error {
-		return c.SendStatus(fiber.StatusOK)
-	})
+// listUsers returns the handler that lists users.
+func listUsers(usersDB udb.UserStore, maxListLimit int) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		filters, err := parseListFilters(c, maxListLimit)
+		if err != nil {
+			return c.
+				Status(uerrors.ToHTTPStatusCode(err.(*uerrors.Error).Code)).
+				JSON(err)
+		}
 
-	go func() {
-		if err := app.Listen(":8080"); err != nil {
-			log.Err(err).Msg("error while listening")
+		users, err := usersDB.WithContext(c.UserContext()).ListUsers(filters)
+		if err != nil {
+			code := err.(*uerrors.Error).Code
+
+			return c.
+				Status(uerrors.ToHTTPStatusCode(code)).
+				JSON(err)
 		}
-	}()
 
-	go func() {
-		if err := internalEndpoints.Listen(":8081"); err != nil {
-			log.Err(err).Msg("error while listening")
+		return c.JSON(users)
+	}
+}
+
+// parseListFilters returns the filters to list users with, as they are
+// provided in the query of the request.
+func parseListFilters(c *fiber.Ctx, maxListLimit int) (*udb.ListFilters, error) {
+	filters := &udb.ListFilters{Role: actorOf(c).role}
+
+	page, err := func() (int, error) {
+		p, err := url.QueryUnescape(c.Query("page", "1"))
+		if err != nil {
+			return 0, fmt.Errorf("error while unescaping page: %w", err)
 		}
+
+		return strconv.Atoi(p)
 	}()
+	if err != nil || page < 1 {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeInvalidPage,
+			Message: uerrors.MessageInvalidPage,
+			Err:     err,
+		}
+	}
+	filters.Page = &page
+
+	filters.Cursor = c.Query("cursor")
+	filters.Sort = c.Query("sort")
+	filters.WithTotal = strings.EqualFold(c.Query("withTotal"), "true")
+
+	if limit := c.Query("limit"); limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l < 1 {
+			return nil, &uerrors.Error{
+				Code:    uerrors.CodeInvalidLimit,
+				Message: uerrors.MessageInvalidLimit,
+				Err:     uerrors.ErrInvalidLimit,
+			}
+		}
 
-	// Graceful Shutdown
+		if l > maxListLimit {
+			l = maxListLimit
+		}
+		filters.Limit = l
+	}
 
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt)
-	<-stop
+	nameIn, err := url.QueryUnescape(c.Query("usernameIn"))
+	if err != nil {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeInvalidNameIn,
+			Message: uerrors.MessageInvalidNameIn,
+			Err:     err,
+		}
+	}
+
+	emailIn, err := url.QueryUnescape(c.Query("emailIn"))
+	if err != nil {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeInvalidEmailIn,
+			Message: uerrors.MessageInvalidEmailIn,
+			Err:     err,
+		}
+	}
+
+	idIn, err := url.QueryUnescape(c.Query("idIn"))
+	if err != nil {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeInvalidIdIn,
+			Message: uerrors.MessageInvalidIdIn,
+			Err:     err,
+		}
+	}
 
-	log.Info().Msg("shutting down...")
-	if err := app.Shutdown(); err != nil {
-		log.Err(err).Msg("error while waiting for server to shutdown")
+	if idIn != "" {
+		filters.IDIn = func() (filteredIds []int64) {
+			ids := strings.Split(idIn, ",")
+			for _, id := range ids {
+				if val, err := strconv.ParseInt(id, 10, 64); err == nil && val > 0 {
+					filteredIds = append(filteredIds, val)
+				}
+			}
+			return
+		}()
 	}
-	if err := internalEndpoints.Shutdown(); err != nil {
-		log.Err(err).Msg("error while waiting for server to shutdown")
+
+	if nameIn != "" {
+		filters.UsernameIn = strings.Split(nameIn, ",")
 	}
-	log.Info().Msg("goodbye!")
+
+	if emailIn != "" {
+		filters.EmailIn = strings.Split(emailIn, ",")
+	}
+
+	filters.UsernameStartsWith = c.Query("usernameStartsWith")
+	filters.DisplayNameContains = c.Query("displayNameContains")
+
+	if createdAfter := c.Query("createdAfter"); createdAfter != "" {
+		t, err := time.Parse(time.RFC3339, createdAfter)
+		if err != nil {
+			return nil, &uerrors.Error{
+				Code:    uerrors.CodeInvalidCreatedAfter,
+				Message: uerrors.MessageInvalidCreatedAfter,
+				Err:     err,
+			}
+		}
+		filters.CreatedAfter = &t
+	}
+
+	if createdBefore := c.Query("createdBefore"); createdBefore != "" {
+		t, err := time.Parse(time.RFC3339, createdBefore)
+		if err != nil {
+			return nil, &uerrors.Error{
+				Code:    uerrors.CodeInvalidCreatedBefore,
+				Message: uerrors.MessageInvalidCreatedBefore,
+				Err:     err,
+			}
+		}
+		filters.CreatedBefore = &t
+	}
+
+	includeDeleted, err := parseIncludeDeleted(c, filters.Role)
+	if err != nil {
+		return nil, err
+	}
+	filters.IncludeDeleted = includeDeleted
+
+	return filters, nil
+}
+
+// getUserByUsername returns the handler that gets a user by its username.
+func getUserByUsername(usersDB udb.UserStore) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		username := c.Params("username")
+
+		uname, err := url.PathUnescape(username)
+		if err != nil || uname == "" {
+			return c.
+				Status(fiber.StatusBadRequest).
+				JSON(&uerrors.Error{
+					Err:     uerrors.ErrInvalidUsername,
+					Code:    uerrors.CodeInvalidUsername,
+					Message: uerrors.MessageInvalidUsername,
+				})
+		}
+
+		role := actorOf(c).roleOn(0, uname)
+		includeDeleted, err := parseIncludeDeleted(c, role)
+		if err != nil {
+			return c.
+				Status(uerrors.ToHTTPStatusCode(err.(*uerrors.Error).Code)).
+				JSON(err)
+		}
+
+		user, err := usersDB.WithContext(c.UserContext()).GetUserByUsername(uname, &udb.GetOptions{
+			IncludeDeleted: includeDeleted,
+			Role:           role,
+		})
+		if err != nil {
+			code := err.(*uerrors.Error).Code
+
+			return c.
+				Status(uerrors.ToHTTPStatusCode(code)).
+				JSON(err)
+		}
+
+		return sendUser(c, user, role)
+	}
+}
+
+// getUserByID returns the handler that gets a user by its ID.
+func getUserByID(usersDB udb.UserStore) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id := c.Params("id")
+
+		id, err := url.PathUnescape(id)
+		if err != nil || id == "" {
+			return c.
+				Status(fiber.StatusBadRequest).
+				JSON(&uerrors.Error{
+					Err:     uerrors.ErrInvalidUserID,
+					Code:    uerrors.CodeInvalidUserID,
+					Message: uerrors.MessageInvalidUserID,
+				})
+		}
+
+		uid, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return c.
+				Status(fiber.StatusBadRequest).
+				JSON(&uerrors.Error{
+					Err:     uerrors.ErrInvalidUserID,
+					Code:    uerrors.CodeInvalidUserID,
+					Message: uerrors.MessageInvalidUserID,
+				})
+		}
+
+		role := actorOf(c).roleOn(uid, "")
+		includeDeleted, err := parseIncludeDeleted(c, role)
+		if err != nil {
+			return c.
+				Status(uerrors.ToHTTPStatusCode(err.(*uerrors.Error).Code)).
+				JSON(err)
+		}
+
+		user, err := usersDB.WithContext(c.UserContext()).GetUserByID(uid, &udb.GetOptions{
+			IncludeDeleted: includeDeleted,
+			Role:           role,
+		})
+		if err != nil {
+			code := err.(*uerrors.Error).Code
+
+			return c.
+				Status(uerrors.ToHTTPStatusCode(code)).
+				JSON(err)
+		}
+
+		return sendUser(c, user, role)
+	}
+}
+
+// getUserHistory returns the handler that gets the history of a user,
+// optionally only for the fields in the comma separated "fields" query
+// parameter.
+func getUserHistory(usersDB udb.UserStore) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := url.PathUnescape(c.Params("id"))
+		if err != nil || id == "" {
+			return c.
+				Status(fiber.StatusBadRequest).
+				JSON(&uerrors.Error{
+					Err:     uerrors.ErrInvalidUserID,
+					Code:    uerrors.CodeInvalidUserID,
+					Message: uerrors.MessageInvalidUserID,
+				})
+		}
+
+		uid, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return c.
+				Status(fiber.StatusBadRequest).
+				JSON(&uerrors.Error{
+					Err:     uerrors.ErrInvalidUserID,
+					Code:    uerrors.CodeInvalidUserID,
+					Message: uerrors.MessageInvalidUserID,
+				})
+		}
+
+		opts := &udb.HistoryOptions{Role: actorOf(c).roleOn(uid, "")}
+		if fields := c.Query("fields"); fields != "" {
+			opts.Fields = strings.Split(fields, ",")
+		}
+
+		history, err := usersDB.WithContext(c.UserContext()).GetUserHistory(uid, opts)
+		if err != nil {
+			return c.
+				Status(uerrors.ToHTTPStatusCode(err.(*uerrors.Error).Code)).
+				JSON(err)
+		}
+
+		return c.JSON(history)
+	}
+}
+
+// parseIncludeDeleted parses the includeDeleted query parameter, which can
+// only be true for roles that can see deleted users.
+func parseIncludeDeleted(c *fiber.Ctx, role api.Role) (bool, error) {
+	includeDeleted := c.Query("includeDeleted")
+	if includeDeleted == "" {
+		return false, nil
+	}
+
+	include, err := strconv.ParseBool(includeDeleted)
+	if err != nil {
+		return false, &uerrors.Error{
+			Code:    uerrors.CodeInvalidIncludeDeleted,
+			Message: uerrors.MessageInvalidIncludeDeleted,
+			Err:     err,
+		}
+	}
+
+	if include && !role.CanSee(api.FieldDeletedAt) {
+		return false, &uerrors.Error{
+			Code:    uerrors.CodeForbidden,
+			Message: uerrors.MessageForbidden,
+			Err:     fmt.Errorf("%w: deleted users can only be included by admins", uerrors.ErrForbidden),
+		}
+	}
+
+	return include, nil
+}
+
+// sendUser sends user as role sees it, with its version and role as ETag,
+// or only tells the client that its copy is still fresh if it has the same
+// version as seen by the same role.
+func sendUser(c *fiber.Ctx, user *api.User, role api.Role) error {
+	setETag(c, user.Version, role)
+
+	cond, err := api.ParseETagCondition(c.Get(fiber.HeaderIfNoneMatch))
+	if err == nil && cond != nil && cond.MatchesRepresentation(user.Version, role) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	return c.JSON(user)
+}
+
+// setETag sets the ETag of the user as role sees it. As the role depends on
+// the actor, so does the response.
+func setETag(c *fiber.Ctx, version int64, role api.Role) {
+	c.Set(fiber.HeaderETag, api.ETag(version, role))
+	c.Vary(api.HeaderActor)
+}
+
+// ifMatch returns the version the user must still be at for the request
+// to be fulfilled, according to its If-Match header, or zero if any version
+// will do.
+func ifMatch(c *fiber.Ctx, store udb.UserStore, id int64) (int64, error) {
+	cond, err := api.ParseETagCondition(c.Get(fiber.HeaderIfMatch))
+	if err != nil {
+		return 0, &uerrors.Error{
+			Code:    uerrors.CodeInvalidETag,
+			Message: fmt.Sprintf("%s %s", uerrors.MessageInvalidETag, err.Error()),
+			Err:     uerrors.ErrInvalidETag,
+		}
+	}
+
+	switch {
+	case cond == nil, cond.Any:
+		return 0, nil
+	case len(cond.Versions()) == 1:
+		return cond.Versions()[0], nil
+	}
+
+	// Only one version can be expected: the current one, if it is listed.
+	current, err := store.GetUserByID(id, &udb.GetOptions{Role: api.RoleAdmin})
+	if err != nil {
+		return 0, err
+	}
+
+	if !cond.Matches(current.Version) {
+		return 0, &uerrors.Error{
+			Code:    uerrors.CodeVersionMismatch,
+			Message: uerrors.MessageVersionMismatch,
+			Err:     uerrors.ErrVersionMismatch,
+		}
+	}
+
+	return current.Version, nil
+}
+
+// patchUser returns the handler that changes some fields of a user, with a
+// JSON merge patch or a JSON patch, and returns it.
+func patchUser(usersDB udb.UserStore) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id := c.Params("id")
+
+		id, err := url.PathUnescape(id)
+		if err != nil || id == "" {
+			return c.
+				Status(fiber.StatusBadRequest).
+				JSON(&uerrors.Error{
+					Err:     uerrors.ErrInvalidUserID,
+					Code:    uerrors.CodeInvalidUserID,
+					Message: uerrors.MessageInvalidUserID,
+				})
+		}
+
+		uid, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return c.
+				Status(fiber.StatusBadRequest).
+				JSON(&uerrors.Error{
+					Err:     uerrors.ErrInvalidUserID,
+					Code:    uerrors.CodeInvalidUserID,
+					Message: uerrors.MessageInvalidUserID,
+				})
+		}
+
+		if len(c.Body()) == 0 {
+			return c.
+				Status(fiber.StatusBadRequest).
+				JSON(&uerrors.Error{
+					Err:     uerrors.ErrEmptyBody,
+					Code:    uerrors.CodeEmptyBody,
+					Message: uerrors.MessageEmptyBody,
+				})
+		}
+
+		store := usersDB.WithContext(c.UserContext())
+		version, err := ifMatch(c, store, uid)
+		if err != nil {
+			return c.
+				Status(uerrors.ToHTTPStatusCode(err.(*uerrors.Error).Code)).
+				JSON(err)
+		}
+
+		var patch *api.UserPatch
+		switch contentType := strings.TrimSpace(strings.Split(c.Get(fiber.HeaderContentType), ";")[0]); contentType {
+		case api.MIMEMergePatch, fiber.MIMEApplicationJSON:
+			patch = &api.UserPatch{}
+			err = json.Unmarshal(c.Body(), patch)
+		case api.MIMEJSONPatch:
+			var ops api.JSONPatch
+			if err = json.Unmarshal(c.Body(), &ops); err != nil {
+				break
+			}
+
+			// Operations are applied to the user as it is now, i.e. to
+			// test its values.
+			current, gerr := store.GetUserByID(uid, &udb.GetOptions{Role: api.RoleAdmin})
+			if gerr != nil {
+				return c.
+					Status(uerrors.ToHTTPStatusCode(gerr.(*uerrors.Error).Code)).
+					JSON(gerr)
+			}
+
+			patch, err = ops.UserPatch(current)
+		default:
+			return c.
+				Status(fiber.StatusUnsupportedMediaType).
+				JSON(&uerrors.Error{
+					Err:     uerrors.ErrUnsupportedPatchType,
+					Code:    uerrors.CodeUnsupportedPatchType,
+					Message: uerrors.MessageUnsupportedPatchType,
+				})
+		}
+		if err != nil {
+			if errors.Is(err, api.ErrPatchTestFailed) {
+				return c.
+					Status(fiber.StatusConflict).
+					JSON(&uerrors.Error{
+						Err:     uerrors.ErrPatchTestFailed,
+						Code:    uerrors.CodePatchTestFailed,
+						Message: fmt.Sprintf("%s %s", uerrors.MessagePatchTestFailed, err.Error()),
+					})
+			}
+
+			return c.
+				Status(fiber.StatusBadRequest).
+				JSON(&uerrors.Error{
+					Err:     uerrors.ErrInvalidPatch,
+					Code:    uerrors.CodeInvalidPatch,
+					Message: fmt.Sprintf("%s %s", uerrors.MessageInvalidPatch, err.Error()),
+				})
+		}
+
+		// TODO: check if user is admin or owner of this profile
+		actor := &udb.Actor{
+			Caller: identityOf(c).Name,
+			UserID: actorOf(c).id,
+		}
+		updated, err := store.UpdateUser(uid, patch, actor, version)
+		if err != nil {
+			return c.
+				Status(uerrors.ToHTTPStatusCode(err.(*uerrors.Error).Code)).
+				JSON(err)
+		}
+
+		role := actorOf(c).roleOn(uid, "")
+		setETag(c, updated.Version, role)
+		return c.JSON(updated.Project(role))
+	}
+}
+
+// restoreUser returns the handler that restores a soft-deleted user.
+func restoreUser(usersDB udb.UserStore) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := url.PathUnescape(c.Params("id"))
+		if err != nil || id == "" {
+			return c.
+				Status(fiber.StatusBadRequest).
+				JSON(&uerrors.Error{
+					Err:     uerrors.ErrInvalidUserID,
+					Code:    uerrors.CodeInvalidUserID,
+					Message: uerrors.MessageInvalidUserID,
+				})
+		}
+
+		uid, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return c.
+				Status(fiber.StatusBadRequest).
+				JSON(&uerrors.Error{
+					Err:     uerrors.ErrInvalidUserID,
+					Code:    uerrors.CodeInvalidUserID,
+					Message: uerrors.MessageInvalidUserID,
+				})
+		}
+
+		user, err := usersDB.WithContext(c.UserContext()).RestoreUser(uid)
+		if err != nil {
+			return c.
+				Status(uerrors.ToHTTPStatusCode(err.(*uerrors.Error).Code)).
+				JSON(err)
+		}
+
+		logging.Logger(c).Info().Int64("user-id", uid).Msg("user restored")
+		return c.JSON(user)
+	}
+}
+
+// setPassword returns the handler that replaces the password of a user.
+func setPassword(usersDB udb.UserStore) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := url.PathUnescape(c.Params("id"))
+		if err != nil || id == "" {
+			return c.
+				Status(fiber.StatusBadRequest).
+				JSON(&uerrors.Error{
+					Err:     uerrors.ErrInvalidUserID,
+					Code:    uerrors.CodeInvalidUserID,
+					Message: uerrors.MessageInvalidUserID,
+				})
+		}
+
+		uid, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return c.
+				Status(fiber.StatusBadRequest).
+				JSON(&uerrors.Error{
+					Err:     uerrors.ErrInvalidUserID,
+					Code:    uerrors.CodeInvalidUserID,
+					Message: uerrors.MessageInvalidUserID,
+				})
+		}
+
+		creds, err := parseCredentials(c)
+		if err != nil {
+			return c.
+				Status(uerrors.ToHTTPStatusCode(err.(*uerrors.Error).Code)).
+				JSON(err)
+		}
+
+		if err := usersDB.WithContext(c.UserContext()).SetPassword(uid, creds.Password); err != nil {
+			return c.
+				Status(uerrors.ToHTTPStatusCode(err.(*uerrors.Error).Code)).
+				JSON(err)
+		}
+
+		logging.Logger(c).Info().Int64("user-id", uid).Msg("password replaced")
+		return c.SendStatus(fiber.StatusOK)
+	}
+}
+
+// verifyEmail returns the handler that marks the email of a user as
+// verified, once they proved they own it. The email is in the body, so that
+// an address that was changed in the meantime is not verified.
+func verifyEmail(usersDB udb.UserStore) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if len(c.Body()) == 0 {
+			return c.
+				Status(fiber.StatusBadRequest).
+				JSON(&uerrors.Error{
+					Err:     uerrors.ErrEmptyBody,
+					Code:    uerrors.CodeEmptyBody,
+					Message: uerrors.MessageEmptyBody,
+				})
+		}
+
+		id, err := url.PathUnescape(c.Params("id"))
+		if err != nil || id == "" {
+			return c.
+				Status(fiber.StatusBadRequest).
+				JSON(&uerrors.Error{
+					Err:     uerrors.ErrInvalidUserID,
+					Code:    uerrors.CodeInvalidUserID,
+					Message: uerrors.MessageInvalidUserID,
+				})
+		}
+
+		uid, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return c.
+				Status(fiber.StatusBadRequest).
+				JSON(&uerrors.Error{
+					Err:     uerrors.ErrInvalidUserID,
+					Code:    uerrors.CodeInvalidUserID,
+					Message: uerrors.MessageInvalidUserID,
+				})
+		}
+
+		var verification api.EmailVerification
+		if err := json.Unmarshal(c.Body(), &verification); err != nil {
+			return c.
+				Status(fiber.StatusBadRequest).
+				JSON(&uerrors.Error{
+					Err:     fmt.Errorf("invalid email verification body"),
+					Code:    uerrors.CodeInvalidUserPost,
+					Message: fmt.Sprintf("%s %s", uerrors.MessageInvalidUserPost, err.Error()),
+				})
+		}
+
+		user, err := usersDB.WithContext(c.UserContext()).VerifyEmail(uid, verification.Email)
+		if err != nil {
+			return c.
+				Status(uerrors.ToHTTPStatusCode(err.(*uerrors.Error).Code)).
+				JSON(err)
+		}
+
+		return c.JSON(user.Project(actorOf(c).roleOn(uid, "")))
+	}
+}
+
+// listBans returns the handler that lists the bans of a user, only the
+// ones in effect if the "active" query parameter is true.
+func listBans(usersDB udb.UserStore) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := url.PathUnescape(c.Params("id"))
+		if err != nil || id == "" {
+			return c.
+				Status(fiber.StatusBadRequest).
+				JSON(&uerrors.Error{
+					Err:     uerrors.ErrInvalidUserID,
+					Code:    uerrors.CodeInvalidUserID,
+					Message: uerrors.MessageInvalidUserID,
+				})
+		}
+
+		uid, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return c.
+				Status(fiber.StatusBadRequest).
+				JSON(&uerrors.Error{
+					Err:     uerrors.ErrInvalidUserID,
+					Code:    uerrors.CodeInvalidUserID,
+					Message: uerrors.MessageInvalidUserID,
+				})
+		}
+
+		bans, err := usersDB.WithContext(c.UserContext()).ListBans(uid, c.Query("active") == "true")
+		if err != nil {
+			return c.
+				Status(uerrors.ToHTTPStatusCode(err.(*uerrors.Error).Code)).
+				JSON(err)
+		}
+
+		return c.JSON(bans)
+	}
+}
+
+// issueBan returns the handler that bans a user. The moderator issuing it
+// is taken from the api.HeaderActor header.
+func issueBan(usersDB udb.UserStore) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if len(c.Body()) == 0 {
+			return c.
+				Status(fiber.StatusBadRequest).
+				JSON(&uerrors.Error{
+					Err:     uerrors.ErrEmptyBody,
+					Code:    uerrors.CodeEmptyBody,
+					Message: uerrors.MessageEmptyBody,
+				})
+		}
+
+		id, err := url.PathUnescape(c.Params("id"))
+		if err != nil || id == "" {
+			return c.
+				Status(fiber.StatusBadRequest).
+				JSON(&uerrors.Error{
+					Err:     uerrors.ErrInvalidUserID,
+					Code:    uerrors.CodeInvalidUserID,
+					Message: uerrors.MessageInvalidUserID,
+				})
+		}
+
+		uid, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return c.
+				Status(fiber.StatusBadRequest).
+				JSON(&uerrors.Error{
+					Err:     uerrors.ErrInvalidUserID,
+					Code:    uerrors.CodeInvalidUserID,
+					Message: uerrors.MessageInvalidUserID,
+				})
+		}
+
+		var ban api.Ban
+		if err := json.Unmarshal(c.Body(), &ban); err != nil {
+			return c.
+				Status(fiber.StatusBadRequest).
+				JSON(&uerrors.Error{
+					Err:     fmt.Errorf("invalid ban post body"),
+					Code:    uerrors.CodeInvalidUserPost,
+					Message: fmt.Sprintf("%s %s", uerrors.MessageInvalidUserPost, err.Error()),
+				})
+		}
+
+		moderator := &udb.Actor{
+			Caller: identityOf(c).Name,
+			UserID: actorOf(c).id,
+		}
+		issued, err := usersDB.WithContext(c.UserContext()).IssueBan(uid, &ban, moderator)
+		if err != nil {
+			return c.
+				Status(uerrors.ToHTTPStatusCode(err.(*uerrors.Error).Code)).
+				JSON(err)
+		}
+
+		logging.Logger(c).Info().Int64("user-id", uid).Int64("ban-id", issued.ID).
+			Str("scope", string(issued.Scope)).Int64("moderator", moderator.UserID).
+			Msg("user banned")
+		return c.Status(fiber.StatusCreated).JSON(issued)
+	}
+}
+
+// liftBan returns the handler that lifts a ban before it expires. The
+// moderator lifting it is taken from the api.HeaderActor header.
+func liftBan(usersDB udb.UserStore) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := url.PathUnescape(c.Params("id"))
+		if err != nil || id == "" {
+			return c.
+				Status(fiber.StatusBadRequest).
+				JSON(&uerrors.Error{
+					Err:     uerrors.ErrInvalidUserID,
+					Code:    uerrors.CodeInvalidUserID,
+					Message: uerrors.MessageInvalidUserID,
+				})
+		}
+
+		uid, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return c.
+				Status(fiber.StatusBadRequest).
+				JSON(&uerrors.Error{
+					Err:     uerrors.ErrInvalidUserID,
+					Code:    uerrors.CodeInvalidUserID,
+					Message: uerrors.MessageInvalidUserID,
+				})
+		}
+
+		banID, err := strconv.ParseInt(c.Params("banID"), 10, 64)
+		if err != nil {
+			return c.
+				Status(fiber.StatusBadRequest).
+				JSON(&uerrors.Error{
+					Err:     uerrors.ErrInvalidBanID,
+					Code:    uerrors.CodeInvalidBanID,
+					Message: uerrors.MessageInvalidBanID,
+				})
+		}
+
+		moderator := &udb.Actor{
+			Caller: identityOf(c).Name,
+			UserID: actorOf(c).id,
+		}
+		lifted, err := usersDB.WithContext(c.UserContext()).LiftBan(uid, banID, moderator)
+		if err != nil {
+			return c.
+				Status(uerrors.ToHTTPStatusCode(err.(*uerrors.Error).Code)).
+				JSON(err)
+		}
+
+		logging.Logger(c).Info().Int64("user-id", uid).Int64("ban-id", banID).
+			Int64("moderator", moderator.UserID).Msg("ban lifted")
+		return c.JSON(lifted)
+	}
+}
+
+// exportUsers returns the handler that streams all users that match the
+// filters of listUsers, as NDJSON or CSV.
+func exportUsers(usersDB udb.UserStore, maxListLimit int) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		format, err := bulk.ParseFormat(c.Query("format", string(bulk.FormatNDJSON)))
+		if err != nil {
+			return c.
+				Status(uerrors.ToHTTPStatusCode(err.(*uerrors.Error).Code)).
+				JSON(err)
+		}
+
+		filters, err := parseListFilters(c, maxListLimit)
+		if err != nil {
+			return c.
+				Status(uerrors.ToHTTPStatusCode(err.(*uerrors.Error).Code)).
+				JSON(err)
+		}
+
+		// Filters are tried before streaming, so that the ones that are not
+		// valid are reported with their status code.
+		probe := *filters
+		probe.Limit = 1
+		if _, err := usersDB.WithContext(c.UserContext()).ListUsers(&probe); err != nil {
+			return c.
+				Status(uerrors.ToHTTPStatusCode(err.(*uerrors.Error).Code)).
+				JSON(err)
+		}
+
+		// Users are written after the handler returns, when the request has
+		// been traced already.
+		logger := logging.Logger(c)
+		c.Set(fiber.HeaderContentType, format.ContentType())
+		c.Set(fiber.HeaderContentDisposition, `attachment; filename="users.`+string(format)+`"`)
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			written, err := bulk.Export(usersDB, filters, bulk.NewWriter(w, format))
+			if err != nil {
+				// The status has been sent already: the export is cut short.
+				logger.Err(err).Int("written", written).Msg("error while exporting users")
+				return
+			}
+
+			logger.Info().Int("written", written).Str("format", string(format)).Msg("users exported")
+		})
+
+		return nil
+	}
+}
+
+// importUsers returns the handler that imports users from NDJSON or CSV, as
+// told by the content type, and reports what happened to them. Bodies larger
+// than maxSize are refused.
+func importUsers(usersDB udb.UserStore, maxSize int64) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		format, err := bulk.ParseFormat(c.Get(fiber.HeaderContentType))
+		if err != nil {
+			return c.
+				Status(uerrors.ToHTTPStatusCode(err.(*uerrors.Error).Code)).
+				JSON(err)
+		}
+
+		opts := &udb.ImportOptions{
+			DryRun: strings.EqualFold(c.Query("dryRun"), "true"),
+			Actor: &udb.Actor{
+				Caller: identityOf(c).Name,
+				UserID: actorOf(c).id,
+			},
+		}
+
+		switch api.ImportMode(c.Query("mode", string(api.ImportModeCreate))) {
+		case api.ImportModeCreate:
+		case api.ImportModeUpsert:
+			opts.Upsert = true
+		default:
+			return c.
+				Status(fiber.StatusBadRequest).
+				JSON(&uerrors.Error{
+					Err:     uerrors.ErrInvalidImportOptions,
+					Code:    uerrors.CodeInvalidImportOptions,
+					Message: fmt.Sprintf("%s %s", uerrors.MessageInvalidImportOptions, "mode must be create or upsert"),
+				})
+		}
+
+		batchSize := bulk.DefaultBatchSize
+		if size := c.Query("batchSize"); size != "" {
+			s, err := strconv.Atoi(size)
+			if err != nil || s < 1 || s > bulk.MaxBatchSize {
+				return c.
+					Status(fiber.StatusBadRequest).
+					JSON(&uerrors.Error{
+						Err:     uerrors.ErrInvalidImportOptions,
+						Code:    uerrors.CodeInvalidImportOptions,
+						Message: fmt.Sprintf("%s batchSize must be between 1 and %d", uerrors.MessageInvalidImportOptions, bulk.MaxBatchSize),
+					})
+			}
+			batchSize = s
+		}
+
+		if c.Request().Header.ContentLength() > int(maxSize) {
+			return c.
+				Status(fiber.StatusRequestEntityTooLarge).
+				JSON(&uerrors.Error{
+					Err:     uerrors.ErrImportTooLarge,
+					Code:    uerrors.CodeImportTooLarge,
+					Message: uerrors.MessageImportTooLarge,
+				})
+		}
+
+		// Bodies are streamed, so that whole communities are not kept in
+		// memory: Body would read all of it, so it is only used when there
+		// is no stream.
+		var body io.Reader
+		if stream := c.Context().RequestBodyStream(); stream != nil {
+			body = stream
+		} else {
+			body = bytes.NewReader(c.Body())
+		}
+
+		reader, err := bulk.NewReader(bulk.LimitReader(body, maxSize), format)
+		if err != nil {
+			return c.
+				Status(uerrors.ToHTTPStatusCode(err.(*uerrors.Error).Code)).
+				JSON(err)
+		}
+
+		report, err := bulk.Import(usersDB.WithContext(c.UserContext()), reader, batchSize, opts)
+		if err != nil {
+			var uerr *uerrors.Error
+			switch {
+			case errors.As(err, &uerr):
+			case errors.Is(err, uerrors.ErrImportTooLarge):
+				uerr = &uerrors.Error{
+					Code:    uerrors.CodeImportTooLarge,
+					Message: uerrors.MessageImportTooLarge,
+					Err:     err,
+				}
+			default:
+				uerr = &uerrors.Error{
+					Code:    uerrors.CodeInvalidImportRow,
+					Message: fmt.Sprintf("%s %s", uerrors.MessageInvalidImportRow, err.Error()),
+					Err:     err,
+				}
+			}
+
+			// The batches before the error were imported nonetheless.
+			if report != nil {
+				logging.Logger(c).Err(err).Int("created", report.Created).
+					Int("updated", report.Updated).Int("failed", report.Failed).
+					Msg("import interrupted")
+			} else {
+				logging.Logger(c).Err(err).Msg("import failed")
+			}
+			return c.
+				Status(uerrors.ToHTTPStatusCode(uerr.Code)).
+				JSON(uerr)
+		}
+
+		logging.Logger(c).Info().Bool("dry-run", report.DryRun).
+			Int("created", report.Created).Int("updated", report.Updated).
+			Int("failed", report.Failed).Int("rehash", report.Rehash).
+			Msg("users imported")
+		return c.JSON(report)
+	}
+}
+
+const actorLocal string = "actor"
+
+// actor is whoever a request is made on behalf of.
+type actor struct {
+	// role is the role of the actor regardless of the user the request is
+	// about, so it is never api.RoleSelf.
+	role api.Role
+	// id and username are only set for logged in users. For admins, only id
+	// is set, if provided, and it is the ID of the moderator.
+	id       int64
+	username string
+}
+
+// roleOn returns the role the actor has on the user with the provided ID or
+// username.
+func (a *actor) roleOn(id int64, username string) api.Role {
+	if a.role != api.RoleAdmin && a.id != 0 &&
+		(a.id == id || strings.EqualFold(a.username, username)) {
+		return api.RoleSelf
+	}
+
+	return a.role
+}
+
+func actorOf(c *fiber.Ctx) *actor {
+	if a, ok := c.Locals(actorLocal).(*actor); ok {
+		return a
+	}
+
+	return &actor{role: api.RoleAnonymous}
+}
+
+// identifyActor finds out on whose behalf the request is made, from the
+// api.HeaderActor header. Requests served on the internal port are always
+// made by admins, and the header only tells which moderator is acting.
+func identifyActor(usersDB udb.UserStore, admin bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		a := &actor{role: api.RoleService}
+		header := c.Get(api.HeaderActor)
+
+		switch {
+		case admin:
+			a.role = api.RoleAdmin
+
+			// Moderators are not looked up: their ID is only recorded in
+			// what they do, i.e. bans.
+			if id, err := strconv.ParseInt(header, 10, 64); err == nil && id > 0 {
+				a.id = id
+			}
+		case header == "":
+			// The service itself, which is already authenticated.
+		case header == api.ActorAnonymous:
+			a.role = api.RoleAnonymous
+		default:
+			a.role = api.RoleAnonymous
+
+			id, err := strconv.ParseInt(header, 10, 64)
+			if err != nil || id < 1 {
+				return c.
+					Status(fiber.StatusBadRequest).
+					JSON(&uerrors.Error{
+						Err:     uerrors.ErrInvalidActor,
+						Code:    uerrors.CodeInvalidActor,
+						Message: uerrors.MessageInvalidActor,
+					})
+			}
+
+			user, err := usersDB.WithContext(c.UserContext()).GetUserByID(id, nil)
+			if err != nil {
+				code := err.(*uerrors.Error).Code
+				if code != uerrors.CodeUserNotFound {
+					return c.
+						Status(uerrors.ToHTTPStatusCode(code)).
+						JSON(err)
+				}
+
+				// The user may have been deleted in the meantime: they can
+				// still see public data.
+				logging.Logger(c).Debug().Int64("actor", id).Msg("actor not found")
+				break
+			}
+
+			a.id, a.username = user.ID, user.Username
+		}
+
+		if a.id != 0 {
+			logging.With(c, func(l zerolog.Context) zerolog.Context {
+				return l.Int64("actor-id", a.id)
+			})
+		}
+
+		c.Locals(actorLocal, a)
+		return c.Next()
+	}
+}
+
+const identityLocal string = "identity"
+
+// unauthenticated is the identity of all callers when authentication is
+// disabled.
+var unauthenticated = &auth.Identity{
+	Name: "unauthenticated",
+	Scopes: []auth.Scope{
+		auth.ScopeRead,
+		auth.ScopeWrite,
+		auth.ScopeDelete,
+		auth.ScopeHardDelete,
+		auth.ScopeCredentials,
+		auth.ScopeAdmin,
+	},
+}
+
+func identityOf(c *fiber.Ctx) *auth.Identity {
+	if identity, ok := c.Locals(identityLocal).(*auth.Identity); ok {
+		return identity
+	}
+
+	return &auth.Identity{}
+}
+
+// authenticate finds out which service is calling, and adds it to the
+// logger of the request. If authenticator is nil, all callers are trusted.
+func authenticate(authenticator *auth.Authenticator) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		identity := unauthenticated
+		if authenticator != nil {
+			id, err := authenticator.Authenticate(c.Get(auth.HeaderAPIKey), c.Get(auth.HeaderAuthorization))
+			if err != nil {
+				logging.Logger(c).Info().Err(err).
+					Msg("rejected request with invalid credentials")
+				return c.
+					Status(fiber.StatusUnauthorized).
+					JSON(&uerrors.Error{
+						Err:     uerrors.ErrUnauthorized,
+						Code:    uerrors.CodeUnauthorized,
+						Message: uerrors.MessageUnauthorized,
+					})
+			}
+
+			identity = id
+		}
+
+		c.Locals(identityLocal, identity)
+		logging.With(c, func(l zerolog.Context) zerolog.Context {
+			return l.Str("caller", identity.Name)
+		})
+
+		return c.Next()
+	}
+}
+
+// requireScope rejects requests from callers that were not granted scope.
+func requireScope(scope auth.Scope) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !identityOf(c).Has(scope) {
+			return c.
+				Status(fiber.StatusForbidden).
+				JSON(&uerrors.Error{
+					Err:     fmt.Errorf("%w: missing %s scope", uerrors.ErrForbidden, scope),
+					Code:    uerrors.CodeForbidden,
+					Message: uerrors.MessageForbidden,
+				})
+		}
+
+		return c.Next()
+	}
+}
+
+// runMigrate runs the migrate command, i.e.
+// users-api [flags] migrate up|down|status|to <version>
+func runMigrate(dbSettings *database.Settings, lockTimeout time.Duration, args []string) error {
+	if dbSettings.Driver == database.DriverMemory {
+		return fmt.Errorf("the %s driver has no schema to migrate", database.DriverMemory)
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up|down|status|to <version>")
+	}
+
+	db, err := database.NewDatabaseConnection(dbSettings)
+	if err != nil {
+		return err
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	defer sqlDB.Close()
+
+	migrator := &migrations.Migrator{
+		DB:          sqlDB,
+		Driver:      dbSettings.Driver,
+		Logger:      log,
+		LockTimeout: lockTimeout,
+	}
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		return migrator.Up(ctx)
+	case "down":
+		return migrator.Down(ctx)
+	case "to":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: migrate to <version>")
+		}
+
+		version, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || version < 0 {
+			return fmt.Errorf("invalid version %s", args[1])
+		}
+
+		return migrator.To(ctx, version)
+	case "status":
+		status, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("current version: %d, latest version: %d\n", status.Current, status.Latest)
+		for _, applied := range status.Applied {
+			fmt.Printf("%04d applied %s %s\n", applied.Version, applied.AppliedAt.Format(time.RFC3339), applied.Name)
+		}
+
+		for _, pending := range status.Pending {
+			fmt.Printf("%04d pending %s\n", pending.Version, pending.Name)
+		}
+
+		for _, unknown := range status.Unknown {
+			fmt.Printf("%04d unknown to this version\n", unknown)
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %s", args[0])
+	}
+}
+
+// openStore connects to the database for the commands that work on users,
+// which need its schema to be up to date. Users cached by running replicas
+// are not invalidated: they are served until they expire.
+func openStore(cfg *apiConfig) (*udb.Database, *sql.DB, error) {
+	if cfg.Database.Driver == database.DriverMemory {
+		return nil, nil, fmt.Errorf("the %s driver has no users to work on", database.DriverMemory)
+	}
+
+	db, err := database.NewDatabaseConnection(&cfg.Database)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	migrator := &migrations.Migrator{
+		DB:          sqlDB,
+		Driver:      cfg.Database.Driver,
+		Logger:      log,
+		LockTimeout: cfg.MigrationsLockTimeout,
+	}
+
+	status, err := migrator.Status(context.Background())
+	if err != nil {
+		sqlDB.Close()
+		return nil, nil, err
+	}
+
+	if len(status.Pending) > 0 {
+		sqlDB.Close()
+		return nil, nil, fmt.Errorf("database schema is behind: run the migrate command first")
+	}
+
+	return &udb.Database{DB: db, Logger: log, PasswordParams: &cfg.Argon2}, sqlDB, nil
+}
+
+// runExport runs the export command, i.e.
+// users-api [flags] export [--format ndjson|csv] [--output <file>] [filters]
+func runExport(cfg *apiConfig, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	formatName := fs.String("format", string(bulk.FormatNDJSON), "the format to export users in: ndjson or csv")
+	output := fs.String("output", "-", "the file to write users to, or - for the standard output")
+	sort := fs.String("sort", "", "the columns to sort users by, as when listing them")
+	usernameStartsWith := fs.String("username-starts-with", "", "only export users whose username starts with this")
+	displayNameContains := fs.String("display-name-contains", "", "only export users whose display name contains this")
+	createdAfter := fs.String("created-after", "", "only export users created after this RFC3339 time")
+	createdBefore := fs.String("created-before", "", "only export users created before this RFC3339 time")
+	includeDeleted := fs.Bool("include-deleted", false, "export soft-deleted users as well")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() > 0 {
+		return fmt.Errorf("usage: export [--format ndjson|csv] [--output <file>] [filters]")
+	}
+
+	format, err := bulk.ParseFormat(*formatName)
+	if err != nil {
+		return fmt.Errorf("unknown format %s", *formatName)
+	}
+
+	filters := &udb.ListFilters{
+		Role:                api.RoleAdmin,
+		Sort:                *sort,
+		UsernameStartsWith:  *usernameStartsWith,
+		DisplayNameContains: *displayNameContains,
+		IncludeDeleted:      *includeDeleted,
+	}
+
+	if *createdAfter != "" {
+		t, err := time.Parse(time.RFC3339, *createdAfter)
+		if err != nil {
+			return fmt.Errorf("invalid created-after: %w", err)
+		}
+		filters.CreatedAfter = &t
+	}
+
+	if *createdBefore != "" {
+		t, err := time.Parse(time.RFC3339, *createdBefore)
+		if err != nil {
+			return fmt.Errorf("invalid created-before: %w", err)
+		}
+		filters.CreatedBefore = &t
+	}
+
+	store, sqlDB, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer sqlDB.Close()
+
+	var (
+		out  io.Writer = os.Stdout
+		file *os.File
+	)
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out, file = f, f
+	}
+
+	written, err := bulk.Export(store, filters, bulk.NewWriter(out, format))
+	if err != nil {
+		return err
+	}
+
+	log.Info().Int("written", written).Str("format", string(format)).Msg("users exported")
+	if file != nil {
+		return file.Close()
+	}
+
+	return nil
+}
+
+// runImport runs the import command, i.e.
+// users-api [flags] import [--mode create|upsert] [--dry-run] <file>|-
+func runImport(cfg *apiConfig, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	formatName := fs.String("format", "", "the format of the users to import: ndjson or csv. Defaults to csv for .csv files and to ndjson otherwise")
+	mode := fs.String("mode", string(api.ImportModeCreate), "create to fail the users that already exist, or upsert to replace them")
+	dryRun := fs.Bool("dry-run", false, "only validate the users and report what would happen to them")
+	batchSize := fs.Int("batch-size", bulk.DefaultBatchSize, "how many users to import in each transaction")
+	moderator := fs.Int64("actor", 0, "the ID of the admin the import is made on behalf of, as recorded in the history of replaced users")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: import [--mode create|upsert] [--dry-run] <file>|-")
+	}
+
+	opts := &udb.ImportOptions{
+		DryRun: *dryRun,
+		Actor:  &udb.Actor{Caller: tracingServiceName, UserID: *moderator},
+	}
+
+	switch api.ImportMode(*mode) {
+	case api.ImportModeCreate:
+	case api.ImportModeUpsert:
+		opts.Upsert = true
+	default:
+		return fmt.Errorf("unknown mode %s", *mode)
+	}
+
+	if *batchSize < 1 || *batchSize > bulk.MaxBatchSize {
+		return fmt.Errorf("batch size must be between 1 and %d", bulk.MaxBatchSize)
+	}
+
+	path := fs.Arg(0)
+	if *formatName == "" {
+		*formatName = string(bulk.FormatNDJSON)
+		if strings.EqualFold(filepath.Ext(path), ".csv") {
+			*formatName = string(bulk.FormatCSV)
+		}
+	}
+
+	format, err := bulk.ParseFormat(*formatName)
+	if err != nil {
+		return fmt.Errorf("unknown format %s", *formatName)
+	}
+
+	store, sqlDB, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer sqlDB.Close()
+
+	in := os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	reader, err := bulk.NewReader(bufio.NewReader(in), format)
+	if err != nil {
+		return err
+	}
+
+	report, err := bulk.Import(store, reader, *batchSize, opts)
+	if report != nil {
+		printImportReport(report)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if report.Failed > 0 {
+		return fmt.Errorf("%d users could not be imported", report.Failed)
+	}
+
+	return nil
+}
+
+func printImportReport(report *api.ImportReport) {
+	for _, importErr := range report.Errors {
+		if importErr.Username != "" {
+			fmt.Printf("line %d: %s: %s\n", importErr.Line, importErr.Username, importErr.Message)
+			continue
+		}
+
+		fmt.Printf("line %d: %s\n", importErr.Line, importErr.Message)
+	}
+
+	if report.DryRun {
+		fmt.Print("dry run, nothing was imported: ")
+	}
+
+	fmt.Printf("created: %d, updated: %d, failed: %d, to rehash: %d\n",
+		report.Created, report.Updated, report.Failed, report.Rehash)
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	udb "github.com/asimpleidea/ship-krew/users/api/internal/database"
+	"github.com/asimpleidea/ship-krew/users/api/internal/password"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/api"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/auth"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+func TestSetPasswordRequiresCredentialsScope(t *testing.T) {
+	keys := map[string][]auth.Scope{
+		"writer": {auth.ScopeRead, auth.ScopeWrite},
+		"admin":  {auth.ScopeAdmin},
+		"login":  {auth.ScopeCredentials},
+	}
+
+	creds := &auth.Credentials{}
+	for name, scopes := range keys {
+		creds.Keys = append(creds.Keys, &auth.APIKey{
+			Name:   name,
+			Key:    strings.Repeat(name[:1], auth.MinKeyLength),
+			Scopes: scopes,
+		})
+	}
+
+	data, err := json.Marshal(creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if creds, err = auth.LoadCredentials(path); err != nil {
+		t.Fatal(err)
+	}
+
+	authenticator, err := auth.NewAuthenticator(creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := &udb.Memory{
+		Logger:         zerolog.Nop(),
+		PasswordParams: &password.Params{Time: 1, Memory: 8, Threads: 1, SaltLength: 8, KeyLength: 16},
+	}
+	email, pwd, ip := "user@example.com", "the-old-password", net.ParseIP("10.0.0.1")
+	user, err := store.CreateUser(&api.User{
+		Username:       "user",
+		DisplayName:    "User",
+		Email:          &email,
+		Password:       &pwd,
+		RegistrationIP: &ip,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	serveUsers(app.Group("/users"), authenticator, store, 100)
+
+	cases := []struct {
+		key    string
+		status int
+	}{
+		{key: "writer", status: fiber.StatusForbidden},
+		{key: "admin", status: fiber.StatusForbidden},
+		{key: "login", status: fiber.StatusOK},
+	}
+
+	for _, c := range cases {
+		t.Run(c.key, func(t *testing.T) {
+			newPwd := "a-new-password-set-by-" + c.key
+			req := httptest.NewRequest(fiber.MethodPut,
+				"/users/id/"+strconv.FormatInt(user.ID, 10)+"/password",
+				strings.NewReader(`{"password": "`+newPwd+`"}`))
+			req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+			req.Header.Set(auth.HeaderAPIKey, strings.Repeat(c.key[:1], auth.MinKeyLength))
+
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.StatusCode != c.status {
+				t.Fatalf("status is %d, expected %d", resp.StatusCode, c.status)
+			}
+
+			verification, err := store.VerifyCredentialsByID(user.ID, newPwd)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if verification.Match != (c.status == fiber.StatusOK) {
+				t.Fatalf("password was replaced: %t", verification.Match)
+			}
+		})
+	}
+}
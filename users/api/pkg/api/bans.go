@@ -0,0 +1,93 @@
+package api
+
+import "time"
+
+// BanScope is what a ban prevents the user from doing.
+type BanScope string
+
+const (
+	// BanScopeAccount bans the user from the whole website: they cannot
+	// even log in.
+	BanScopeAccount BanScope = "account"
+	// BanScopeProfile is a suspension that only prevents the user from
+	// changing their profile.
+	BanScopeProfile BanScope = "profile"
+)
+
+// IsValid returns true if s is one of the known scopes.
+func (s BanScope) IsValid() bool {
+	switch s {
+	case BanScopeAccount, BanScopeProfile:
+		return true
+	default:
+		return false
+	}
+}
+
+// Ban is a ban or a suspension issued to a user.
+//
+// A ban is in effect from StartsAt until ExpiresAt, or forever if
+// ExpiresAt is nil, unless it is lifted earlier.
+type Ban struct {
+	ID     int64    `json:"id" yaml:"id"`
+	UserID int64    `json:"user_id" yaml:"userID"`
+	Scope  BanScope `json:"scope" yaml:"scope"`
+	Reason string   `json:"reason" yaml:"reason"`
+	// IssuedBy is the ID of the moderator that issued the ban, if it was
+	// issued on behalf of one.
+	IssuedBy *int64 `json:"issued_by,omitempty" yaml:"issuedBy,omitempty"`
+	// Caller is the name of the service that issued the ban.
+	Caller    string     `json:"caller,omitempty" yaml:"caller,omitempty"`
+	CreatedAt time.Time  `json:"created_at" yaml:"createdAt"`
+	StartsAt  time.Time  `json:"starts_at" yaml:"startsAt"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty" yaml:"expiresAt,omitempty"`
+	LiftedAt  *time.Time `json:"lifted_at,omitempty" yaml:"liftedAt,omitempty"`
+	// LiftedBy is the ID of the moderator that lifted the ban, if it was
+	// lifted on behalf of one.
+	LiftedBy *int64 `json:"lifted_by,omitempty" yaml:"liftedBy,omitempty"`
+}
+
+// IsActive returns true if the ban is in effect at the provided time.
+func (b *Ban) IsActive(at time.Time) bool {
+	if b.LiftedAt != nil || b.StartsAt.After(at) {
+		return false
+	}
+
+	return b.ExpiresAt == nil || b.ExpiresAt.After(at)
+}
+
+// Prevents returns true if the ban, when active, prevents the user from
+// doing what is covered by scope. Account bans cover everything.
+func (b *Ban) Prevents(scope BanScope) bool {
+	return b.Scope == BanScopeAccount || b.Scope == scope
+}
+
+func (b *Ban) Clone() *Ban {
+	return &Ban{
+		ID:        b.ID,
+		UserID:    b.UserID,
+		Scope:     b.Scope,
+		Reason:    b.Reason,
+		IssuedBy:  copyInt64Pointer(b.IssuedBy),
+		Caller:    b.Caller,
+		CreatedAt: b.CreatedAt,
+		StartsAt:  b.StartsAt,
+		ExpiresAt: copyTimePointer(b.ExpiresAt),
+		LiftedAt:  copyTimePointer(b.LiftedAt),
+		LiftedBy:  copyInt64Pointer(b.LiftedBy),
+	}
+}
+
+func copyInt64Pointer(val *int64) *int64 {
+	if val == nil {
+		return nil
+	}
+
+	copied := *val
+	return &copied
+}
+
+// BanList contains the bans of a user, the most recent first.
+type BanList struct {
+	Bans []*Ban `json:"bans" yaml:"bans"`
+}
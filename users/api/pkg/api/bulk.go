@@ -0,0 +1,76 @@
+package api
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	// MIMENDJSON is the content type of newline delimited JSON, where each
+	// line is a user.
+	MIMENDJSON string = "application/x-ndjson"
+	// MIMECSV is the content type of CSV, where the first row contains the
+	// names of the fields and each other row is a user.
+	MIMECSV string = "text/csv"
+)
+
+// ImportMode tells what happens to the users being imported that already
+// exist.
+type ImportMode string
+
+const (
+	// ImportModeCreate only creates users: the ones whose username or email
+	// is already taken fail.
+	ImportModeCreate ImportMode = "create"
+	// ImportModeUpsert replaces the users that already exist with the same
+	// username, and creates the others.
+	ImportModeUpsert ImportMode = "upsert"
+)
+
+// ImportedUser is a user to import in bulk, i.e. from another community.
+//
+// New users need either a password or the hash of their password: a PHC
+// string of Argon2id, or the base64 encoded SHA-256 digest of the legacy
+// format with its salt. Users whose hash is not in the current format are
+// asked to send their password again at their next login, so that it is
+// hashed again. Replaced users keep their password if neither is set.
+type ImportedUser struct {
+	Username     string  `json:"username" yaml:"username"`
+	DisplayName  string  `json:"display_name" yaml:"displayName"`
+	Email        string  `json:"email" yaml:"email"`
+	Password     *string `json:"password,omitempty" yaml:"password,omitempty"`
+	PasswordHash string  `json:"password_hash,omitempty" yaml:"passwordHash,omitempty"`
+	// PasswordSalt is the base64 encoded salt of a legacy PasswordHash.
+	PasswordSalt   string     `json:"password_salt,omitempty" yaml:"passwordSalt,omitempty"`
+	RegistrationIP *net.IP    `json:"registration_ip,omitempty" yaml:"registrationIP,omitempty"`
+	Bio            *string    `json:"bio,omitempty" yaml:"bio,omitempty"`
+	Birthday       *time.Time `json:"birthday,omitempty" yaml:"birthday,omitempty"`
+	// CreatedAt is when the user registered. Defaults to when the user is
+	// imported, and it is left as it is for replaced users.
+	CreatedAt *time.Time `json:"created_at,omitempty" yaml:"createdAt,omitempty"`
+	// EmailVerifiedAt is when the email was verified, if it was.
+	EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty" yaml:"emailVerifiedAt,omitempty"`
+}
+
+// ImportReport is the outcome of an import.
+type ImportReport struct {
+	// DryRun tells that nothing was imported: the counts are of what would
+	// have happened.
+	DryRun  bool `json:"dry_run" yaml:"dryRun"`
+	Created int  `json:"created" yaml:"created"`
+	Updated int  `json:"updated" yaml:"updated"`
+	Failed  int  `json:"failed" yaml:"failed"`
+	// Rehash is how many of the imported users will have their password
+	// hashed again at their next login.
+	Rehash int            `json:"rehash" yaml:"rehash"`
+	Errors []*ImportError `json:"errors" yaml:"errors"`
+}
+
+// ImportError tells why a user could not be imported.
+type ImportError struct {
+	// Line is the line of the input where the user starts.
+	Line     int    `json:"line" yaml:"line"`
+	Username string `json:"username,omitempty" yaml:"username,omitempty"`
+	Code     int    `json:"code" yaml:"code"`
+	Message  string `json:"message" yaml:"message"`
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// etagRoleSeparator separates the version from the role in entity tags.
+	etagRoleSeparator string = "-"
+)
+
+// ETag returns the entity tag of the provided version of a user, as role
+// sees it: each role sees different fields of the same version. Without a
+// role, it only tells the version, which is enough for If-Match.
+func ETag(version int64, role Role) string {
+	tag := strconv.FormatInt(version, 10)
+	if role != "" {
+		tag += etagRoleSeparator + string(role)
+	}
+
+	return `"` + tag + `"`
+}
+
+// ETagCondition is the value of an If-Match or If-None-Match header.
+type ETagCondition struct {
+	// Any is true for "*", which matches all versions.
+	Any  bool
+	Tags []EntityTag
+}
+
+// EntityTag is a version of a user, as seen by a role if it is not empty.
+type EntityTag struct {
+	Version int64
+	Role    Role
+}
+
+// ParseETagCondition parses the value of an If-Match or If-None-Match
+// header, i.e. "*" or a comma separated list of entity tags. It returns nil
+// if the value is empty.
+//
+// Weak tags are accepted as well, as all versions are strong anyway.
+func ParseETagCondition(value string) (*ETagCondition, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+
+	if value == "*" {
+		return &ETagCondition{Any: true}, nil
+	}
+
+	cond := &ETagCondition{}
+	for _, tag := range strings.Split(value, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if len(tag) < 2 || !strings.HasPrefix(tag, `"`) || !strings.HasSuffix(tag, `"`) {
+			return nil, fmt.Errorf("invalid entity tag %s", tag)
+		}
+
+		value, role := tag[1:len(tag)-1], ""
+		if i := strings.Index(value, etagRoleSeparator); i >= 0 {
+			value, role = value[:i], value[i+1:]
+			if !Role(role).IsValid() {
+				return nil, fmt.Errorf("unknown entity tag %s", tag)
+			}
+		}
+
+		version, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("unknown entity tag %s", tag)
+		}
+
+		cond.Tags = append(cond.Tags, EntityTag{Version: version, Role: Role(role)})
+	}
+
+	return cond, nil
+}
+
+// Versions returns the versions of the tags of the condition, once each.
+func (c *ETagCondition) Versions() []int64 {
+	versions := []int64{}
+	for _, tag := range c.Tags {
+		if !containsVersion(versions, tag.Version) {
+			versions = append(versions, tag.Version)
+		}
+	}
+
+	return versions
+}
+
+// Matches tells whether version is one of the versions of the condition,
+// as seen by any role. This is what If-Match needs, as changes are made to
+// the user, whatever the fields that the client could see.
+func (c *ETagCondition) Matches(version int64) bool {
+	return c.Any || containsVersion(c.Versions(), version)
+}
+
+// MatchesRepresentation tells whether the condition has the tag of version
+// as role sees it. This is what If-None-Match needs, as clients must get
+// the fields their role can see even if they have the same version.
+func (c *ETagCondition) MatchesRepresentation(version int64, role Role) bool {
+	if c.Any {
+		return true
+	}
+
+	for _, tag := range c.Tags {
+		if tag.Version == version && tag.Role == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsVersion(versions []int64, version int64) bool {
+	for _, v := range versions {
+		if v == version {
+			return true
+		}
+	}
+
+	return false
+}
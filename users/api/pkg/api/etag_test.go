@@ -0,0 +1,48 @@
+package api
+
+import "testing"
+
+func TestETagCondition(t *testing.T) {
+	cases := []struct {
+		value   string
+		invalid bool
+		// matches and fresh are the results of Matches and
+		// MatchesRepresentation for version 3 as RoleSelf sees it.
+		matches bool
+		fresh   bool
+	}{
+		{value: ETag(3, RoleSelf), matches: true, fresh: true},
+		{value: ETag(3, RoleAdmin), matches: true, fresh: false},
+		{value: ETag(3, ""), matches: true, fresh: false},
+		{value: "W/" + ETag(3, RoleSelf), matches: true, fresh: true},
+		{value: ETag(2, RoleSelf) + ", " + ETag(3, RoleSelf), matches: true, fresh: true},
+		{value: ETag(2, RoleSelf), matches: false, fresh: false},
+		{value: "*", matches: true, fresh: true},
+		{value: "3", invalid: true},
+		{value: `"3-owner"`, invalid: true},
+		{value: `"three"`, invalid: true},
+		{value: `"0"`, invalid: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.value, func(t *testing.T) {
+			cond, err := ParseETagCondition(c.value)
+			switch {
+			case c.invalid && err == nil:
+				t.Fatal("invalid condition was parsed")
+			case c.invalid:
+				return
+			case err != nil:
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			if matches := cond.Matches(3); matches != c.matches {
+				t.Errorf("Matches returned %t, expected %t", matches, c.matches)
+			}
+
+			if fresh := cond.MatchesRepresentation(3, RoleSelf); fresh != c.fresh {
+				t.Errorf("MatchesRepresentation returned %t, expected %t", fresh, c.fresh)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	// MIMEMergePatch is the content type of JSON merge patches (RFC 7386).
+	MIMEMergePatch string = "application/merge-patch+json"
+	// MIMEJSONPatch is the content type of JSON patches (RFC 6902).
+	MIMEJSONPatch string = "application/json-patch+json"
+
+	// fieldPassword can be changed but is never returned, so it is not one
+	// of the fields of User.
+	fieldPassword string = "password"
+)
+
+// ErrPatchTestFailed is returned when a test operation of a JSON patch does
+// not match the user.
+var ErrPatchTestFailed = errors.New("test operation failed")
+
+// UserPatch contains the changes to some of the fields of a user: the ones
+// that are nil are left as they are. Bio and birthday can also be removed.
+//
+// It is encoded as a JSON merge patch, where removed fields are null.
+type UserPatch struct {
+	Username       *string
+	DisplayName    *string
+	Email          *string
+	Password       *string
+	Bio            *string
+	RemoveBio      bool
+	Birthday       *time.Time
+	RemoveBirthday bool
+}
+
+// ReplaceUser returns the patch that replaces all the fields of a user that
+// can be changed with the ones of u, which removes its bio and birthday if
+// u has none. The password is only changed if u has one.
+func ReplaceUser(u *User) *UserPatch {
+	username, displayName := u.Username, u.DisplayName
+
+	return &UserPatch{
+		Username:       &username,
+		DisplayName:    &displayName,
+		Email:          copyStringPointer(u.Email),
+		Password:       copyStringPointer(u.Password),
+		Bio:            copyStringPointer(u.Bio),
+		RemoveBio:      u.Bio == nil,
+		Birthday:       copyTimePointer(u.Birthday),
+		RemoveBirthday: u.Birthday == nil,
+	}
+}
+
+// IsEmpty tells whether the patch changes nothing.
+func (p *UserPatch) IsEmpty() bool {
+	return *p == UserPatch{}
+}
+
+func (p *UserPatch) MarshalJSON() ([]byte, error) {
+	fields := map[string]interface{}{}
+	setIf := func(field string, value interface{}, set bool) {
+		if set {
+			fields[field] = value
+		}
+	}
+
+	setIf(FieldUsername, p.Username, p.Username != nil)
+	setIf(FieldDisplayName, p.DisplayName, p.DisplayName != nil)
+	setIf(FieldEmail, p.Email, p.Email != nil)
+	setIf(fieldPassword, p.Password, p.Password != nil)
+	setIf(FieldBio, p.Bio, p.Bio != nil || p.RemoveBio)
+	setIf(FieldBirthday, p.Birthday, p.Birthday != nil || p.RemoveBirthday)
+
+	return json.Marshal(fields)
+}
+
+func (p *UserPatch) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil || fields == nil {
+		return fmt.Errorf("a merge patch must be a JSON object")
+	}
+
+	*p = UserPatch{}
+	for field, value := range fields {
+		if err := p.set(field, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// set sets field to value, or removes it if value is null.
+func (p *UserPatch) set(field string, value json.RawMessage) error {
+	remove := string(bytes.TrimSpace(value)) == "null"
+
+	var target interface{}
+	switch field {
+	case FieldUsername:
+		target = &p.Username
+	case FieldDisplayName:
+		target = &p.DisplayName
+	case FieldEmail:
+		target = &p.Email
+	case fieldPassword:
+		target = &p.Password
+	case FieldBio:
+		p.Bio, p.RemoveBio = nil, remove
+		target = &p.Bio
+	case FieldBirthday:
+		p.Birthday, p.RemoveBirthday = nil, remove
+		target = &p.Birthday
+	case FieldID, FieldCreatedAt, FieldUpdatedAt, FieldDeletedAt, FieldVersion,
+		FieldEmailVerifiedAt, FieldRegistrationIP, FieldBan:
+		return fmt.Errorf(`field "%s" cannot be changed`, field)
+	default:
+		return fmt.Errorf(`unknown field "%s"`, field)
+	}
+
+	if remove {
+		if field == FieldBio || field == FieldBirthday {
+			return nil
+		}
+
+		return fmt.Errorf(`field "%s" cannot be removed`, field)
+	}
+
+	if err := json.Unmarshal(value, target); err != nil {
+		return fmt.Errorf(`invalid value for field "%s"`, field)
+	}
+
+	return nil
+}
+
+// PatchOperation is an operation of a JSON patch (RFC 6902).
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// JSONPatch is a JSON patch (RFC 6902). Only the add, replace, remove and
+// test operations are supported, on the fields of the user itself.
+type JSONPatch []PatchOperation
+
+// UserPatch applies the operations, in order, to user, which should be the
+// whole user as admins see it, and returns the changes they make. It returns
+// ErrPatchTestFailed if a test operation does not match.
+func (jp JSONPatch) UserPatch(user *User) (*UserPatch, error) {
+	encoded, err := json.Marshal(user)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode user: %w", err)
+	}
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(encoded, &doc); err != nil {
+		return nil, fmt.Errorf("could not decode user: %w", err)
+	}
+
+	touched := []string{}
+	for i, op := range jp {
+		field := strings.TrimPrefix(op.Path, "/")
+		if !strings.HasPrefix(op.Path, "/") || field == "" || strings.ContainsAny(field, "/~") {
+			return nil, fmt.Errorf(`operation %d: unsupported path "%s"`, i, op.Path)
+		}
+
+		current, exists := doc[field]
+		switch op.Op {
+		case "add", "replace":
+			if op.Value == nil {
+				return nil, fmt.Errorf("operation %d: no value", i)
+			}
+
+			if op.Op == "replace" && !exists {
+				return nil, fmt.Errorf(`operation %d: "%s" does not exist`, i, op.Path)
+			}
+
+			doc[field] = op.Value
+		case "remove":
+			if !exists {
+				return nil, fmt.Errorf(`operation %d: "%s" does not exist`, i, op.Path)
+			}
+
+			delete(doc, field)
+		case "test":
+			if !exists || !equalJSON(current, op.Value) {
+				return nil, fmt.Errorf(`operation %d: %w on "%s"`, i, ErrPatchTestFailed, op.Path)
+			}
+
+			continue
+		default:
+			return nil, fmt.Errorf(`operation %d: unsupported op "%s"`, i, op.Op)
+		}
+
+		touched = append(touched, field)
+	}
+
+	patch := &UserPatch{}
+	for _, field := range touched {
+		value, exists := doc[field]
+		if !exists {
+			value = json.RawMessage("null")
+		}
+
+		if err := patch.set(field, value); err != nil {
+			return nil, err
+		}
+	}
+
+	return patch, nil
+}
+
+func equalJSON(a, b json.RawMessage) bool {
+	var decodedA, decodedB interface{}
+	if json.Unmarshal(a, &decodedA) != nil || json.Unmarshal(b, &decodedB) != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(decodedA, decodedB)
+}
@@ -0,0 +1,171 @@
+package api
+
+// Role is the role of whoever is asking for a user, and determines which
+// fields of the user they can see.
+type Role string
+
+const (
+	// RoleAnonymous is the role of someone who is not logged in, or who is
+	// looking at another user's data. It is also the role used when none is
+	// provided.
+	RoleAnonymous Role = "anonymous"
+	// RoleSelf is the role of a user looking at their own data.
+	RoleSelf Role = "self"
+	// RoleService is the role of another service that is not acting on
+	// behalf of any user.
+	RoleService Role = "service"
+	// RoleAdmin is the role of a moderator or support staff.
+	RoleAdmin Role = "admin"
+)
+
+const (
+	// HeaderActor is the header services set to tell the users API on
+	// behalf of which user they are making the request. It contains the ID
+	// of the user, or ActorAnonymous.
+	//
+	// When it is not set, the request is made by the service itself.
+	HeaderActor string = "X-Actor"
+	// ActorAnonymous is the value of HeaderActor for users that are not
+	// logged in.
+	ActorAnonymous string = "anonymous"
+)
+
+// Names of the fields of User, which are the same in JSON and in the
+// database.
+const (
+	FieldID              string = "id"
+	FieldCreatedAt       string = "created_at"
+	FieldUpdatedAt       string = "updated_at"
+	FieldDeletedAt       string = "deleted_at"
+	FieldVersion         string = "version"
+	FieldUsername        string = "username"
+	FieldDisplayName     string = "display_name"
+	FieldEmail           string = "email"
+	FieldEmailVerifiedAt string = "email_verified_at"
+	FieldRegistrationIP  string = "registration_ip"
+	FieldBio             string = "bio"
+	FieldBirthday        string = "birthday"
+	FieldBan             string = "ban"
+)
+
+var (
+	everyone  = []Role{RoleAnonymous, RoleSelf, RoleService, RoleAdmin}
+	owner     = []Role{RoleSelf, RoleService, RoleAdmin}
+	adminOnly = []Role{RoleAdmin}
+)
+
+// fieldRoles contains the roles that can see each field: these are the only
+// projection rules and both the database and the serialization follow them.
+//
+// The password is not here as it is never returned to anyone.
+var fieldRoles = map[string][]Role{
+	FieldID:              everyone,
+	FieldCreatedAt:       everyone,
+	FieldUpdatedAt:       owner,
+	FieldDeletedAt:       adminOnly,
+	FieldVersion:         everyone,
+	FieldUsername:        everyone,
+	FieldDisplayName:     everyone,
+	FieldEmail:           owner,
+	FieldEmailVerifiedAt: owner,
+	FieldRegistrationIP:  adminOnly,
+	FieldBio:             everyone,
+	FieldBirthday:        owner,
+	FieldBan:             owner,
+}
+
+// storedFields are the fields that are stored as they are in the database,
+// in the order VisibleFields returns them.
+var storedFields = []string{
+	FieldID,
+	FieldCreatedAt,
+	FieldUpdatedAt,
+	FieldDeletedAt,
+	FieldVersion,
+	FieldUsername,
+	FieldDisplayName,
+	FieldEmail,
+	FieldEmailVerifiedAt,
+	FieldRegistrationIP,
+	FieldBio,
+	FieldBirthday,
+}
+
+// IsValid returns true if r is one of the known roles.
+func (r Role) IsValid() bool {
+	switch r {
+	case RoleAnonymous, RoleSelf, RoleService, RoleAdmin:
+		return true
+	default:
+		return false
+	}
+}
+
+// CanSee returns true if r can see the provided field. Unknown roles are
+// treated as RoleAnonymous.
+func (r Role) CanSee(field string) bool {
+	if !r.IsValid() {
+		r = RoleAnonymous
+	}
+
+	for _, role := range fieldRoles[field] {
+		if role == r {
+			return true
+		}
+	}
+
+	return false
+}
+
+// VisibleFields returns the names of the stored fields that r can see, i.e.
+// the columns to select.
+func VisibleFields(r Role) []string {
+	fields := []string{}
+	for _, field := range storedFields {
+		if r.CanSee(field) {
+			fields = append(fields, field)
+		}
+	}
+
+	return fields
+}
+
+// Project removes from u all the fields that r cannot see, and returns u
+// itself for convenience.
+func (u *User) Project(r Role) *User {
+	u.Password = nil
+
+	if !r.CanSee(FieldUpdatedAt) {
+		u.UpdatedAt = nil
+	}
+
+	if !r.CanSee(FieldDeletedAt) {
+		u.DeletedAt = nil
+	}
+
+	if !r.CanSee(FieldEmail) {
+		u.Email = nil
+	}
+
+	if !r.CanSee(FieldEmailVerifiedAt) {
+		u.EmailVerifiedAt = nil
+	}
+
+	if !r.CanSee(FieldRegistrationIP) {
+		u.RegistrationIP = nil
+	}
+
+	if !r.CanSee(FieldBio) {
+		u.Bio = nil
+	}
+
+	if !r.CanSee(FieldBirthday) {
+		u.Birthday = nil
+	}
+
+	if !r.CanSee(FieldBan) {
+		u.Ban = nil
+	}
+
+	return u
+}
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// visibility is who can see each field, written out again rather than taken
+// from fieldRoles, so that changing who can see what is always deliberate.
+var visibility = map[string]map[Role]bool{
+	FieldID:              {RoleAnonymous: true, RoleSelf: true, RoleService: true, RoleAdmin: true},
+	FieldCreatedAt:       {RoleAnonymous: true, RoleSelf: true, RoleService: true, RoleAdmin: true},
+	FieldUpdatedAt:       {RoleAnonymous: false, RoleSelf: true, RoleService: true, RoleAdmin: true},
+	FieldDeletedAt:       {RoleAnonymous: false, RoleSelf: false, RoleService: false, RoleAdmin: true},
+	FieldVersion:         {RoleAnonymous: true, RoleSelf: true, RoleService: true, RoleAdmin: true},
+	FieldUsername:        {RoleAnonymous: true, RoleSelf: true, RoleService: true, RoleAdmin: true},
+	FieldDisplayName:     {RoleAnonymous: true, RoleSelf: true, RoleService: true, RoleAdmin: true},
+	FieldEmail:           {RoleAnonymous: false, RoleSelf: true, RoleService: true, RoleAdmin: true},
+	FieldEmailVerifiedAt: {RoleAnonymous: false, RoleSelf: true, RoleService: true, RoleAdmin: true},
+	FieldRegistrationIP:  {RoleAnonymous: false, RoleSelf: false, RoleService: false, RoleAdmin: true},
+	FieldBio:             {RoleAnonymous: true, RoleSelf: true, RoleService: true, RoleAdmin: true},
+	FieldBirthday:        {RoleAnonymous: false, RoleSelf: true, RoleService: true, RoleAdmin: true},
+	FieldBan:             {RoleAnonymous: false, RoleSelf: true, RoleService: true, RoleAdmin: true},
+}
+
+// fullUser returns a user with all fields set.
+func fullUser() *User {
+	now := time.Now()
+	password, email, bio := "password", "user@example.com", "bio"
+	ip := net.ParseIP("10.0.0.1")
+
+	return &User{
+		ID:              1,
+		Password:        &password,
+		CreatedAt:       now,
+		UpdatedAt:       &now,
+		DeletedAt:       &now,
+		Username:        "user",
+		DisplayName:     "User",
+		Email:           &email,
+		EmailVerifiedAt: &now,
+		RegistrationIP:  &ip,
+		Bio:             &bio,
+		Birthday:        &now,
+		Ban:             &Ban{ID: 1},
+		Version:         3,
+	}
+}
+
+// jsonFields returns the names of the fields of u that are serialized.
+func jsonFields(t *testing.T, u *User) map[string]bool {
+	data, err := json.Marshal(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+
+	names := map[string]bool{}
+	for name := range fields {
+		names[name] = true
+	}
+
+	return names
+}
+
+func TestEveryFieldHasRoles(t *testing.T) {
+	typ := reflect.TypeOf(User{})
+	for i := 0; i < typ.NumField(); i++ {
+		name := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+		if name == "password" {
+			continue
+		}
+
+		if _, exists := fieldRoles[name]; !exists {
+			t.Errorf("field %s has no roles that can see it", name)
+		}
+
+		if _, exists := visibility[name]; !exists {
+			t.Errorf("field %s is not tested", name)
+		}
+	}
+}
+
+func TestCanSee(t *testing.T) {
+	for field, roles := range visibility {
+		for role, visible := range roles {
+			t.Run(string(role)+"/"+field, func(t *testing.T) {
+				if role.CanSee(field) != visible {
+					t.Fatalf("CanSee returned %t, expected %t", !visible, visible)
+				}
+			})
+		}
+	}
+}
+
+func TestProject(t *testing.T) {
+	roles := []Role{RoleAnonymous, RoleSelf, RoleService, RoleAdmin, "unknown", ""}
+
+	for _, role := range roles {
+		t.Run(string(role), func(t *testing.T) {
+			expected := role
+			if !role.IsValid() {
+				expected = RoleAnonymous
+			}
+
+			fields := jsonFields(t, fullUser().Project(role))
+
+			if fields["password"] {
+				t.Error("password was not removed")
+			}
+
+			for field, roles := range visibility {
+				if fields[field] != roles[expected] {
+					t.Errorf("field %s is visible: %t, expected %t", field, fields[field], roles[expected])
+				}
+			}
+		})
+	}
+}
+
+func TestVisibleFields(t *testing.T) {
+	for _, role := range []Role{RoleAnonymous, RoleSelf, RoleService, RoleAdmin} {
+		t.Run(string(role), func(t *testing.T) {
+			for _, field := range VisibleFields(role) {
+				if !visibility[field][role] {
+					t.Errorf("field %s is selected, but %s cannot see it", field, role)
+				}
+			}
+
+			for _, field := range storedFields {
+				if visibility[field][role] && !contains(VisibleFields(role), field) {
+					t.Errorf("field %s is not selected, but %s can see it", field, role)
+				}
+			}
+		})
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
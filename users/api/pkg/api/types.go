@@ -5,43 +5,66 @@ import (
 	"time"
 )
 
+const (
+	// MinPasswordLength and MaxPasswordLength are the lengths that passwords
+	// must be within, in bytes. Services can check them before doing
+	// anything that cannot be undone, i.e. using a single-use token.
+	MinPasswordLength int = 8
+	MaxPasswordLength int = 256
+)
+
 // TODO: write documentation
 // TODO: convert this into a model for GORM and hide sensitive data for guests
 // TODO: check if these pointers are correct
-// TODO: salt should be readonly
-// TODO: passwordHash needs to be a hash, not plain string
-// TODO: are they good in byte format? I plan to receive the password as string,
-// 		hash it and append the salt, and then call bytes.Equal(hashed, hashedDB)
+// TODO: password is only accepted in input and it is never returned: maybe it
+// should be a separate type?
 
 type User struct {
-	ID                 int64      `json:"id" yaml:"id"`
-	Base64PasswordHash *string    `json:"password_hash,omitempty" yaml:"passwordHash,omitempty"`
-	Base64Salt         *string    `json:"salt,omitempty" yaml:"salt,omitempty"`
-	CreatedAt          time.Time  `json:"created_at" yaml:"createdAt"`
-	UpdatedAt          *time.Time `json:"updated_at,omitempty" yaml:"updatedAt,omitempty"`
-	DeletedAt          *time.Time `json:"deleted_at,omitempty" yaml:"deletedAt,omitempty"`
-	Username           string     `json:"username" yaml:"username"`
-	DisplayName        string     `json:"display_name" yaml:"display_name"`
-	Email              *string    `json:"email,omitempty" yaml:"email,omitempty"`
-	RegistrationIP     *net.IP    `json:"registration_ip,omitempty" yaml:"registrationIP,omitempty"`
-	Bio                *string    `json:"bio,omitempty" yaml:"bio,omitempty"`
-	Birthday           *time.Time `json:"birthday,omitempty" yaml:"birthday,omitempty"`
+	ID          int64      `json:"id" yaml:"id"`
+	Password    *string    `json:"password,omitempty" yaml:"password,omitempty"`
+	CreatedAt   time.Time  `json:"created_at" yaml:"createdAt"`
+	UpdatedAt   *time.Time `json:"updated_at,omitempty" yaml:"updatedAt,omitempty"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty" yaml:"deletedAt,omitempty"`
+	Username    string     `json:"username" yaml:"username"`
+	DisplayName string     `json:"display_name" yaml:"display_name"`
+	Email       *string    `json:"email,omitempty" yaml:"email,omitempty"`
+	// EmailVerifiedAt is when the current email was verified, if it was. It
+	// is only returned, and it is set by verifying the email.
+	EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty" yaml:"emailVerifiedAt,omitempty"`
+	RegistrationIP  *net.IP    `json:"registration_ip,omitempty" yaml:"registrationIP,omitempty"`
+	Bio             *string    `json:"bio,omitempty" yaml:"bio,omitempty"`
+	Birthday        *time.Time `json:"birthday,omitempty" yaml:"birthday,omitempty"`
+	// Ban is the ban currently in effect for the user, if any. It is only
+	// returned, and never taken into account when creating or updating
+	// users.
+	Ban *Ban `json:"ban,omitempty" yaml:"ban,omitempty"`
+	// Version is increased every time the user is changed, banned or
+	// unbanned, and it is also sent as its ETag. It is only returned.
+	Version int64 `json:"version,omitempty" yaml:"version,omitempty"`
 }
 
 func (u *User) Clone() *User {
 	return &User{
-		ID:                 u.ID,
-		Base64PasswordHash: copyStringPointer(u.Base64PasswordHash),
-		Base64Salt:         copyStringPointer(u.Base64Salt),
-		CreatedAt:          u.CreatedAt,
-		UpdatedAt:          copyTimePointer(u.UpdatedAt),
-		DeletedAt:          copyTimePointer(u.DeletedAt),
-		Username:           u.Username,
-		DisplayName:        u.DisplayName,
-		Email:              copyStringPointer(u.Email),
-		RegistrationIP:     copyIpPointer(u.RegistrationIP),
-		Bio:                copyStringPointer(u.Bio),
-		Birthday:           copyTimePointer(u.Birthday),
+		ID:              u.ID,
+		Password:        copyStringPointer(u.Password),
+		CreatedAt:       u.CreatedAt,
+		UpdatedAt:       copyTimePointer(u.UpdatedAt),
+		DeletedAt:       copyTimePointer(u.DeletedAt),
+		Username:        u.Username,
+		DisplayName:     u.DisplayName,
+		Email:           copyStringPointer(u.Email),
+		EmailVerifiedAt: copyTimePointer(u.EmailVerifiedAt),
+		RegistrationIP:  copyIpPointer(u.RegistrationIP),
+		Bio:             copyStringPointer(u.Bio),
+		Birthday:        copyTimePointer(u.Birthday),
+		Ban: func() *Ban {
+			if u.Ban == nil {
+				return nil
+			}
+
+			return u.Ban.Clone()
+		}(),
+		Version: u.Version,
 	}
 }
 
@@ -73,3 +96,56 @@ func copyIpPointer(val *net.IP) *net.IP {
 	copied := *val
 	return &copied
 }
+
+// UserList is a page of users.
+//
+// NextCursor can be used to get the next page, and it is only set if
+// HasMore is true. Total is only set if it was explicitly requested.
+type UserList struct {
+	Users      []*User `json:"users" yaml:"users"`
+	NextCursor string  `json:"next_cursor,omitempty" yaml:"nextCursor,omitempty"`
+	HasMore    bool    `json:"has_more" yaml:"hasMore"`
+	Total      *int64  `json:"total,omitempty" yaml:"total,omitempty"`
+}
+
+// Credentials contains the password to verify for a user.
+type Credentials struct {
+	Password string `json:"password" yaml:"password"`
+}
+
+// CredentialsVerification is the result of the verification of a user's
+// credentials.
+//
+// NeedsRehash is only true when the password matches and the stored hash
+// was produced with an older format or older parameters: the caller should
+// then send the password again in an update, so that it is hashed again.
+type CredentialsVerification struct {
+	Match       bool `json:"match" yaml:"match"`
+	NeedsRehash bool `json:"needs_rehash" yaml:"needsRehash"`
+}
+
+// EmailVerification contains the email to mark as verified.
+type EmailVerification struct {
+	Email string `json:"email" yaml:"email"`
+}
+
+// UserChange is a change to one of the fields of a user.
+//
+// OldValue and NewValue are nil when the field was not set. Birthdays are
+// formatted as RFC3339 dates.
+type UserChange struct {
+	Field     string    `json:"field" yaml:"field"`
+	OldValue  *string   `json:"old_value,omitempty" yaml:"oldValue,omitempty"`
+	NewValue  *string   `json:"new_value,omitempty" yaml:"newValue,omitempty"`
+	ChangedAt time.Time `json:"changed_at" yaml:"changedAt"`
+	// Caller is the name of the service that made the change.
+	Caller string `json:"caller,omitempty" yaml:"caller,omitempty"`
+	// ActorID is the ID of the user on whose behalf the change was made,
+	// if any.
+	ActorID *int64 `json:"actor_id,omitempty" yaml:"actorID,omitempty"`
+}
+
+// UserHistory contains the changes made to a user, the most recent first.
+type UserHistory struct {
+	Changes []*UserChange `json:"changes" yaml:"changes"`
+}
@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Scope is something a service is allowed to do.
+type Scope string
+
+const (
+	// ScopeRead allows getting and listing users, and verifying their
+	// credentials.
+	ScopeRead Scope = "read"
+	// ScopeWrite allows creating and updating users.
+	ScopeWrite Scope = "write"
+	// ScopeDelete allows soft-deleting users.
+	ScopeDelete Scope = "delete"
+	// ScopeHardDelete allows deleting users permanently. It does not imply
+	// ScopeDelete.
+	ScopeHardDelete Scope = "hard-delete"
+	// ScopeCredentials allows setting the password of users. It does not
+	// imply ScopeWrite, nor is it implied by it.
+	ScopeCredentials Scope = "credentials"
+	// ScopeAdmin allows using the admin endpoints.
+	ScopeAdmin Scope = "admin"
+)
+
+const (
+	// HeaderAPIKey is the header containing the API key.
+	HeaderAPIKey string = "X-Api-Key"
+	// HeaderAuthorization is the header containing the service token, after
+	// BearerPrefix.
+	HeaderAuthorization string = "Authorization"
+	BearerPrefix        string = "Bearer "
+)
+
+var (
+	ErrNoCredentials      error = errors.New("no credentials provided")
+	ErrInvalidCredentials error = errors.New("invalid credentials")
+	ErrInvalidScope       error = errors.New("invalid scope")
+)
+
+// IsValid returns true if s is one of the known scopes.
+func (s Scope) IsValid() bool {
+	switch s {
+	case ScopeRead, ScopeWrite, ScopeDelete, ScopeHardDelete, ScopeCredentials, ScopeAdmin:
+		return true
+	default:
+		return false
+	}
+}
+
+func validateScopes(scopes []Scope) error {
+	for _, scope := range scopes {
+		if !scope.IsValid() {
+			return fmt.Errorf("%w: %s", ErrInvalidScope, scope)
+		}
+	}
+
+	return nil
+}
+
+// Identity is who is calling the users API.
+type Identity struct {
+	// Name is the name of the service.
+	Name   string
+	Scopes []Scope
+}
+
+// Has returns true if the identity was granted scope.
+func (i *Identity) Has(scope Scope) bool {
+	return hasScope(i.Scopes, scope)
+}
+
+func hasScope(scopes []Scope, scope Scope) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Authenticator finds out the identity of callers from their credentials.
+type Authenticator struct {
+	keys    []*APIKey
+	issuers map[string]*TokenIssuer
+}
+
+// NewAuthenticator returns an Authenticator that accepts the provided API
+// keys and the tokens of the provided issuers. Either one can be empty, but
+// not both.
+func NewAuthenticator(creds *Credentials) (*Authenticator, error) {
+	if creds == nil || (len(creds.Keys) == 0 && len(creds.Tokens) == 0) {
+		return nil, fmt.Errorf("no api keys or token issuers provided")
+	}
+
+	issuers := make(map[string]*TokenIssuer, len(creds.Tokens))
+	for _, issuer := range creds.Tokens {
+		if len(issuer.Secret) < MinSecretLength {
+			return nil, fmt.Errorf("token secret of %s must be at least %d bytes long", issuer.Name, MinSecretLength)
+		}
+
+		issuers[issuer.Name] = issuer
+	}
+
+	return &Authenticator{
+		keys:    creds.Keys,
+		issuers: issuers,
+	}, nil
+}
+
+// Authenticate returns the identity of the caller from the values of the
+// HeaderAPIKey and HeaderAuthorization headers, the first one that is not
+// empty.
+func (a *Authenticator) Authenticate(apiKey, authorization string) (*Identity, error) {
+	switch {
+	case apiKey != "":
+		return a.authenticateKey(apiKey)
+	case authorization != "":
+		if !strings.HasPrefix(authorization, BearerPrefix) {
+			return nil, ErrInvalidCredentials
+		}
+
+		return VerifyToken(a.issuers, strings.TrimPrefix(authorization, BearerPrefix))
+	default:
+		return nil, ErrNoCredentials
+	}
+}
+
+func (a *Authenticator) authenticateKey(apiKey string) (*Identity, error) {
+	// Compare digests, so that the comparison takes the same time
+	// regardless of the length of the keys, and go through all keys.
+	digest := sha256.Sum256([]byte(apiKey))
+
+	var found *APIKey
+	for _, key := range a.keys {
+		if subtle.ConstantTimeCompare(digest[:], key.digest[:]) == 1 {
+			found = key
+		}
+	}
+
+	if found == nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	return &Identity{
+		Name:   found.Name,
+		Scopes: found.Scopes,
+	}, nil
+}
@@ -0,0 +1,8 @@
+// Package auth contains the credentials that services use to authenticate
+// to the users API, and the scopes that limit what they can do.
+//
+// Services can authenticate with a static API key, sent in the HeaderAPIKey
+// header, or with a short-lived service token signed with a secret of its
+// own, sent as a bearer token in the Authorization header. Either way, the
+// scopes of a service are granted by the users API.
+package auth
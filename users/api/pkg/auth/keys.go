@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+const (
+	// MinKeyLength is the minimum length of an API key.
+	MinKeyLength int = 32
+)
+
+// APIKey is a static key that a service uses to authenticate.
+type APIKey struct {
+	// Name is the name of the service using the key, as it will appear
+	// in logs.
+	Name   string  `json:"name" yaml:"name"`
+	Key    string  `json:"key" yaml:"key"`
+	Scopes []Scope `json:"scopes" yaml:"scopes"`
+
+	digest [sha256.Size]byte
+}
+
+// TokenIssuer is a service that authenticates with service tokens, signed
+// with a secret of its own so that other services cannot sign tokens in its
+// name.
+type TokenIssuer struct {
+	// Name is the name of the service, which its tokens carry as subject.
+	Name   string `json:"name" yaml:"name"`
+	Secret string `json:"secret" yaml:"secret"`
+	// Scopes are the ones the service is granted: its tokens cannot carry
+	// any other.
+	Scopes []Scope `json:"scopes" yaml:"scopes"`
+}
+
+// Credentials are the API keys and the token issuers that the users API
+// accepts, i.e.
+//
+//	{
+//		"keys": [
+//			{"name": "login", "key": "...", "scopes": ["read", "write"]}
+//		],
+//		"tokens": [
+//			{"name": "profile", "secret": "...", "scopes": ["read"]}
+//		]
+//	}
+type Credentials struct {
+	Keys   []*APIKey      `json:"keys" yaml:"keys"`
+	Tokens []*TokenIssuer `json:"tokens" yaml:"tokens"`
+}
+
+// LoadCredentials loads the API keys and the token issuers from the JSON
+// file at the provided path, which is usually mounted from a secret.
+func LoadCredentials(path string) (*Credentials, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read api keys file: %w", err)
+	}
+
+	var creds Credentials
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("could not decode api keys file: %w", err)
+	}
+
+	names := map[string]bool{}
+	for i, key := range creds.Keys {
+		if key == nil || key.Name == "" {
+			return nil, fmt.Errorf("api key #%d has no name", i)
+		}
+
+		if names[key.Name] {
+			return nil, fmt.Errorf("api key %s is repeated", key.Name)
+		}
+		names[key.Name] = true
+
+		if len(key.Key) < MinKeyLength {
+			return nil, fmt.Errorf("api key %s must be at least %d characters long", key.Name, MinKeyLength)
+		}
+
+		if err := validateScopes(key.Scopes); err != nil {
+			return nil, fmt.Errorf("api key %s: %w", key.Name, err)
+		}
+
+		key.digest = sha256.Sum256([]byte(key.Key))
+	}
+
+	issuers := map[string]bool{}
+	for i, issuer := range creds.Tokens {
+		if issuer == nil || issuer.Name == "" {
+			return nil, fmt.Errorf("token issuer #%d has no name", i)
+		}
+
+		if issuers[issuer.Name] {
+			return nil, fmt.Errorf("token issuer %s is repeated", issuer.Name)
+		}
+		issuers[issuer.Name] = true
+
+		if len(issuer.Secret) < MinSecretLength {
+			return nil, fmt.Errorf("token issuer %s: secret must be at least %d bytes long", issuer.Name, MinSecretLength)
+		}
+
+		if err := validateScopes(issuer.Scopes); err != nil {
+			return nil, fmt.Errorf("token issuer %s: %w", issuer.Name, err)
+		}
+	}
+
+	return &creds, nil
+}
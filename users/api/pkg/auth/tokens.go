@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// MinSecretLength is the minimum length of the secret used to sign
+	// service tokens, in bytes.
+	MinSecretLength int = 32
+	// DefaultTokenTTL is how long tokens are valid for, if not specified.
+	DefaultTokenTTL time.Duration = 5 * time.Minute
+	// MaxTokenTTL is the longest that tokens can be valid for.
+	MaxTokenTTL time.Duration = 15 * time.Minute
+	// maxClockSkew is how far in the future tokens can be issued, as the
+	// clocks of services are never quite in sync.
+	maxClockSkew time.Duration = time.Minute
+
+	tokenSeparator string = "."
+)
+
+// tokenClaims is the payload of a service token, which is encoded as
+// base64url(json(claims)) + "." + base64url(hmac-sha256(first part)).
+type tokenClaims struct {
+	Subject   string  `json:"sub"`
+	Scopes    []Scope `json:"scp"`
+	IssuedAt  int64   `json:"iat"`
+	ExpiresAt int64   `json:"exp"`
+}
+
+// TokenSigner creates service tokens for a service.
+type TokenSigner struct {
+	// Name is the name of the service.
+	Name string
+	// Scopes must be granted to the service by the users API.
+	Scopes []Scope
+	// Secret is the one of the service, which only the users API knows
+	// about.
+	Secret []byte
+	// TTL is how long each token is valid for, up to MaxTokenTTL. Defaults
+	// to DefaultTokenTTL.
+	TTL time.Duration
+}
+
+// Sign returns a new token.
+func (s *TokenSigner) Sign() (string, error) {
+	if s.Name == "" {
+		return "", fmt.Errorf("no service name provided")
+	}
+
+	if len(s.Secret) < MinSecretLength {
+		return "", fmt.Errorf("secret must be at least %d bytes long", MinSecretLength)
+	}
+
+	if err := validateScopes(s.Scopes); err != nil {
+		return "", err
+	}
+
+	ttl := s.TTL
+	if ttl <= 0 {
+		ttl = DefaultTokenTTL
+	}
+
+	if ttl > MaxTokenTTL {
+		return "", fmt.Errorf("ttl cannot be longer than %s", MaxTokenTTL)
+	}
+
+	now := time.Now()
+	payload, err := json.Marshal(&tokenClaims{
+		Subject:   s.Name,
+		Scopes:    s.Scopes,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not marshal token claims: %w", err)
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + tokenSeparator + sign(s.Secret, encoded), nil
+}
+
+// VerifyToken checks that token was signed by one of issuers, with its
+// secret, and is not expired, and returns the identity it contains. Tokens
+// can only carry the scopes granted to their issuer, and cannot be valid
+// for longer than MaxTokenTTL.
+func VerifyToken(issuers map[string]*TokenIssuer, token string) (*Identity, error) {
+	parts := strings.Split(token, tokenSeparator)
+	if len(parts) != 2 {
+		return nil, ErrInvalidCredentials
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	// Claims cannot be trusted until the signature is checked, but the
+	// subject tells whose secret to check it with.
+	issuer, exists := issuers[claims.Subject]
+	if !exists {
+		return nil, ErrInvalidCredentials
+	}
+
+	if !hmac.Equal([]byte(sign([]byte(issuer.Secret), parts[0])), []byte(parts[1])) {
+		return nil, ErrInvalidCredentials
+	}
+
+	now := time.Now()
+	switch {
+	case now.Unix() >= claims.ExpiresAt,
+		claims.IssuedAt > now.Add(maxClockSkew).Unix(),
+		claims.ExpiresAt-claims.IssuedAt > int64(MaxTokenTTL/time.Second):
+		return nil, ErrInvalidCredentials
+	}
+
+	for _, scope := range claims.Scopes {
+		if !hasScope(issuer.Scopes, scope) {
+			return nil, ErrInvalidCredentials
+		}
+	}
+
+	return &Identity{
+		Name:   claims.Subject,
+		Scopes: claims.Scopes,
+	}, nil
+}
+
+func sign(secret []byte, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
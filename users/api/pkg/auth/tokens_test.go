@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyToken(t *testing.T) {
+	issuers := map[string]*TokenIssuer{
+		"profile": {Name: "profile", Secret: strings.Repeat("p", MinSecretLength), Scopes: []Scope{ScopeRead}},
+		"login":   {Name: "login", Secret: strings.Repeat("l", MinSecretLength), Scopes: []Scope{ScopeRead, ScopeWrite}},
+	}
+
+	// forge signs claims the way Sign does, but with any values.
+	forge := func(secret string, claims *tokenClaims) string {
+		payload, _ := json.Marshal(claims)
+		encoded := base64.RawURLEncoding.EncodeToString(payload)
+		return encoded + tokenSeparator + sign([]byte(secret), encoded)
+	}
+
+	now := time.Now().Unix()
+	cases := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{
+			name:  "valid",
+			token: forge(issuers["profile"].Secret, &tokenClaims{Subject: "profile", Scopes: []Scope{ScopeRead}, IssuedAt: now, ExpiresAt: now + 60}),
+			valid: true,
+		},
+		{
+			name:  "scope not granted",
+			token: forge(issuers["profile"].Secret, &tokenClaims{Subject: "profile", Scopes: []Scope{ScopeAdmin}, IssuedAt: now, ExpiresAt: now + 60}),
+		},
+		{
+			name:  "signed by another service",
+			token: forge(issuers["profile"].Secret, &tokenClaims{Subject: "login", Scopes: []Scope{ScopeWrite}, IssuedAt: now, ExpiresAt: now + 60}),
+		},
+		{
+			name:  "unknown subject",
+			token: forge(issuers["profile"].Secret, &tokenClaims{Subject: "admin", Scopes: []Scope{ScopeRead}, IssuedAt: now, ExpiresAt: now + 60}),
+		},
+		{
+			name:  "expired",
+			token: forge(issuers["profile"].Secret, &tokenClaims{Subject: "profile", Scopes: []Scope{ScopeRead}, IssuedAt: now - 120, ExpiresAt: now - 60}),
+		},
+		{
+			name:  "valid for too long",
+			token: forge(issuers["profile"].Secret, &tokenClaims{Subject: "profile", Scopes: []Scope{ScopeRead}, IssuedAt: now, ExpiresAt: now + 365*24*3600}),
+		},
+		{
+			name:  "issued in the future",
+			token: forge(issuers["profile"].Secret, &tokenClaims{Subject: "profile", Scopes: []Scope{ScopeRead}, IssuedAt: now + 3600, ExpiresAt: now + 3660}),
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			identity, err := VerifyToken(issuers, c.token)
+			switch {
+			case c.valid && err != nil:
+				t.Fatalf("unexpected error %v", err)
+			case !c.valid && err == nil:
+				t.Fatalf("token was accepted with scopes %v", identity.Scopes)
+			}
+		})
+	}
+}
+
+func TestSignedTokensAreVerified(t *testing.T) {
+	signer := &TokenSigner{Name: "login", Scopes: []Scope{ScopeWrite}, Secret: []byte(strings.Repeat("l", MinSecretLength))}
+	token, err := signer.Sign()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity, err := VerifyToken(map[string]*TokenIssuer{
+		"login": {Name: "login", Secret: string(signer.Secret), Scopes: []Scope{ScopeRead, ScopeWrite}},
+	}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if identity.Name != "login" || !identity.Has(ScopeWrite) || identity.Has(ScopeRead) {
+		t.Fatalf("unexpected identity %+v", identity)
+	}
+
+	signer.TTL = MaxTokenTTL + time.Second
+	if _, err := signer.Sign(); err == nil {
+		t.Fatal("signed a token valid for longer than MaxTokenTTL")
+	}
+}
@@ -0,0 +1,238 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asimpleidea/ship-krew/users/api/pkg/api"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/auth"
+	uerrors "github.com/asimpleidea/ship-krew/users/api/pkg/errors"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/logging"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+const (
+	defaultTimeout time.Duration = time.Minute
+	mimeJSON       string        = "application/json"
+)
+
+// Settings contains the options used to build a new Client.
+type Settings struct {
+	// BaseURL is the address of the users API server, i.e.
+	// http://users-api.
+	BaseURL string `json:"base_url" yaml:"baseURL"`
+	// Timeout is the maximum duration of each request, regardless of the
+	// deadline of the context passed to a method. Defaults to one minute.
+	Timeout time.Duration `json:"timeout" yaml:"timeout"`
+	// Transport is the http.RoundTripper used to perform requests. If nil,
+	// http.DefaultTransport is used. Either way, requests are traced and
+	// carry the trace context and the request ID of the context passed to
+	// each method.
+	Transport http.RoundTripper `json:"-" yaml:"-"`
+	// APIKey is the key used to authenticate to the users API.
+	APIKey string `json:"-" yaml:"-"`
+	// TokenSigner, if not nil, is used to sign a service token for each
+	// request instead of sending APIKey.
+	TokenSigner *auth.TokenSigner `json:"-" yaml:"-"`
+}
+
+// Client performs requests to the users API.
+type Client struct {
+	baseURL     string
+	httpClient  *http.Client
+	apiKey      string
+	tokenSigner *auth.TokenSigner
+}
+
+// NewClient returns a new Client with the provided settings.
+func NewClient(settings *Settings) (*Client, error) {
+	if settings == nil {
+		return nil, fmt.Errorf("no client settings provided")
+	}
+
+	if settings.BaseURL == "" {
+		return nil, fmt.Errorf("no base url provided")
+	}
+
+	baseURL, err := url.Parse(settings.BaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse base url: %w", err)
+	}
+
+	if baseURL.Scheme == "" || baseURL.Host == "" {
+		return nil, fmt.Errorf("base url must contain scheme and host")
+	}
+
+	timeout := settings.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	transport := settings.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	return &Client{
+		baseURL: strings.TrimSuffix(baseURL.String(), "/"),
+		httpClient: &http.Client{
+			Timeout:   timeout,
+			Transport: otelhttp.NewTransport(logging.Transport(transport)),
+		},
+		apiKey:      settings.APIKey,
+		tokenSigner: settings.TokenSigner,
+	}, nil
+}
+
+type actorKey struct{}
+
+// WithActor returns a copy of ctx that makes requests performed with it on
+// behalf of the user with the provided ID, who will only see their own
+// private data.
+func WithActor(ctx context.Context, userID int64) context.Context {
+	return context.WithValue(ctx, actorKey{}, strconv.FormatInt(userID, 10))
+}
+
+// AsAnonymous returns a copy of ctx that makes requests performed with it
+// on behalf of a user that is not logged in, who will only see public data.
+//
+// Requests performed with a context that has no actor are made by the
+// service itself.
+func AsAnonymous(ctx context.Context) context.Context {
+	return context.WithValue(ctx, actorKey{}, api.ActorAnonymous)
+}
+
+type versionKey struct{}
+
+// WithVersion returns a copy of ctx that makes the updates and the
+// deletions performed with it fail with errors.CodeVersionMismatch if the
+// user is not at the provided version anymore, i.e. because someone else
+// changed it in the meantime.
+func WithVersion(ctx context.Context, version int64) context.Context {
+	return context.WithValue(ctx, versionKey{}, version)
+}
+
+// endpoint returns the full address of the provided path elements, each of
+// them escaped on its own so that a slash inside a username does not end up
+// in a different route.
+func (c *Client) endpoint(query url.Values, elems ...string) string {
+	escaped := make([]string, len(elems))
+	for i, elem := range elems {
+		escaped[i] = url.PathEscape(elem)
+	}
+
+	endpoint := c.baseURL + "/" + strings.Join(escaped, "/")
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+
+	return endpoint
+}
+
+// do performs the request and decodes the response body in out, if the
+// server replied with expectedStatus. Otherwise the body is decoded as an
+// error.
+func (c *Client) do(ctx context.Context, method, endpoint string, body interface{}, expectedStatus int, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("could not marshal request body: %w", err)
+		}
+
+		reqBody = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reqBody)
+	if err != nil {
+		return fmt.Errorf("could not create request: %w", err)
+	}
+
+	req.Header.Set("Accept", mimeJSON)
+	if body != nil {
+		contentType := mimeJSON
+		if _, isPatch := body.(*api.UserPatch); isPatch {
+			contentType = api.MIMEMergePatch
+		}
+
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	if actor, ok := ctx.Value(actorKey{}).(string); ok {
+		req.Header.Set(api.HeaderActor, actor)
+	}
+
+	if version, ok := ctx.Value(versionKey{}).(int64); ok && method != http.MethodGet {
+		req.Header.Set("If-Match", api.ETag(version, ""))
+	}
+
+	switch {
+	case c.tokenSigner != nil:
+		token, err := c.tokenSigner.Sign()
+		if err != nil {
+			return fmt.Errorf("could not sign service token: %w", err)
+		}
+
+		req.Header.Set(auth.HeaderAuthorization, auth.BearerPrefix+token)
+	case c.apiKey != "":
+		req.Header.Set(auth.HeaderAPIKey, c.apiKey)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not perform request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return &uerrors.Error{
+			Code:    uerrors.CodeInternalServerError,
+			Message: uerrors.MessageInternalServerError,
+			Err:     fmt.Errorf("could not read response body: %w", err),
+		}
+	}
+
+	if resp.StatusCode != expectedStatus {
+		return decodeError(resp.StatusCode, respBody)
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return &uerrors.Error{
+			Code:    uerrors.CodeInternalServerError,
+			Message: uerrors.MessageInternalServerError,
+			Err:     fmt.Errorf("could not decode response body: %w", err),
+		}
+	}
+
+	return nil
+}
+
+func decodeError(statusCode int, body []byte) error {
+	var e uerrors.Error
+	if err := json.Unmarshal(body, &e); err != nil || e.Code == 0 {
+		return &uerrors.Error{
+			Code:    uerrors.CodeInternalServerError,
+			Message: uerrors.MessageInternalServerError,
+			Err:     fmt.Errorf("unexpected response with status code %d", statusCode),
+		}
+	}
+
+	// The actual error is never sent by the server, so we build one from
+	// what we have.
+	e.Err = fmt.Errorf("users api responded with code %d: %s", e.Code, e.Message)
+	return &e
+}
@@ -0,0 +1,10 @@
+// Package client contains a typed HTTP client for the users API.
+//
+// Every route exposed by the users API server has a corresponding method
+// here, so that frontends such as login and profile do not need to build
+// requests by hand: if a route changes, the change will be caught at
+// compile time.
+//
+// All errors returned by the server are decoded into *errors.Error, the
+// same type the server uses when responding.
+package client
@@ -0,0 +1,388 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asimpleidea/ship-krew/users/api/pkg/api"
+	uerrors "github.com/asimpleidea/ship-krew/users/api/pkg/errors"
+)
+
+const (
+	usersPath    string = "users"
+	byIDPath     string = "id"
+	byUserPath   string = "username"
+	queryPage    string = "page"
+	queryCursor  string = "cursor"
+	queryLimit   string = "limit"
+	querySort    string = "sort"
+	queryTotal   string = "withTotal"
+	queryNameIn  string = "usernameIn"
+	queryEmailIn string = "emailIn"
+	queryIDIn    string = "idIn"
+	queryPrefix  string = "usernameStartsWith"
+	queryDNCont  string = "displayNameContains"
+	queryAfter   string = "createdAfter"
+	queryBefore  string = "createdBefore"
+	queryDeleted string = "includeDeleted"
+	queryHardDel string = "hard_delete"
+	credsPath    string = "credentials"
+	verifyPath   string = "verify"
+	historyPath  string = "history"
+	emailPath    string = "email"
+	passwordPath string = "password"
+	queryFields  string = "fields"
+)
+
+// ListFilters contains the filters that can be applied when listing users.
+type ListFilters struct {
+	// Page is only used when Cursor is empty. Prefer cursors instead.
+	Page *int
+	// Cursor is the NextCursor of the previous page.
+	Cursor string
+	// Limit is the maximum number of users to return. The server may return
+	// less than this even if there are more users.
+	Limit int
+	// Sort is a comma separated list of fields, i.e. "-created_at".
+	Sort string
+	// WithTotal asks the server to count all users that match the filters.
+	WithTotal bool
+
+	// The following filters are all combined with AND.
+
+	UsernameIn          []string
+	EmailIn             []string
+	IDIn                []int64
+	UsernameStartsWith  string
+	DisplayNameContains string
+	CreatedAfter        *time.Time
+	CreatedBefore       *time.Time
+	// IncludeDeleted is only accepted by the admin endpoints, which are
+	// served on the internal port.
+	IncludeDeleted bool
+}
+
+func (f *ListFilters) toQuery() url.Values {
+	query := url.Values{}
+	if f == nil {
+		return query
+	}
+
+	if f.Page != nil {
+		query.Set(queryPage, strconv.Itoa(*f.Page))
+	}
+
+	if f.Cursor != "" {
+		query.Set(queryCursor, f.Cursor)
+	}
+
+	if f.Limit > 0 {
+		query.Set(queryLimit, strconv.Itoa(f.Limit))
+	}
+
+	if f.Sort != "" {
+		query.Set(querySort, f.Sort)
+	}
+
+	if f.WithTotal {
+		query.Set(queryTotal, strconv.FormatBool(f.WithTotal))
+	}
+
+	if len(f.UsernameIn) > 0 {
+		query.Set(queryNameIn, strings.Join(f.UsernameIn, ","))
+	}
+
+	if len(f.EmailIn) > 0 {
+		query.Set(queryEmailIn, strings.Join(f.EmailIn, ","))
+	}
+
+	if len(f.IDIn) > 0 {
+		ids := make([]string, len(f.IDIn))
+		for i, id := range f.IDIn {
+			ids[i] = strconv.FormatInt(id, 10)
+		}
+
+		query.Set(queryIDIn, strings.Join(ids, ","))
+	}
+
+	if f.UsernameStartsWith != "" {
+		query.Set(queryPrefix, f.UsernameStartsWith)
+	}
+
+	if f.DisplayNameContains != "" {
+		query.Set(queryDNCont, f.DisplayNameContains)
+	}
+
+	if f.CreatedAfter != nil {
+		query.Set(queryAfter, f.CreatedAfter.Format(time.RFC3339))
+	}
+
+	if f.CreatedBefore != nil {
+		query.Set(queryBefore, f.CreatedBefore.Format(time.RFC3339))
+	}
+
+	if f.IncludeDeleted {
+		query.Set(queryDeleted, strconv.FormatBool(f.IncludeDeleted))
+	}
+
+	return query
+}
+
+// GetUserByID returns the user with the provided ID.
+func (c *Client) GetUserByID(ctx context.Context, id int64) (*api.User, error) {
+	if id < 1 {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeInvalidUserID,
+			Message: uerrors.MessageInvalidUserID,
+			Err:     uerrors.ErrInvalidUserID,
+		}
+	}
+
+	var user api.User
+	if err := c.do(ctx, http.MethodGet,
+		c.endpoint(nil, usersPath, byIDPath, strconv.FormatInt(id, 10)),
+		nil, http.StatusOK, &user); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// GetUserByUsername returns the user with the provided username.
+func (c *Client) GetUserByUsername(ctx context.Context, username string) (*api.User, error) {
+	if username == "" {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeEmptyUsername,
+			Message: uerrors.MessageEmptyUsername,
+			Err:     uerrors.ErrEmptyUsername,
+		}
+	}
+
+	var user api.User
+	if err := c.do(ctx, http.MethodGet,
+		c.endpoint(nil, usersPath, byUserPath, username),
+		nil, http.StatusOK, &user); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// VerifyCredentialsByID checks if pwd is the password of the user with the
+// provided ID. The password hash never leaves the users API.
+func (c *Client) VerifyCredentialsByID(ctx context.Context, id int64, pwd string) (*api.CredentialsVerification, error) {
+	if id < 1 {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeInvalidUserID,
+			Message: uerrors.MessageInvalidUserID,
+			Err:     uerrors.ErrInvalidUserID,
+		}
+	}
+
+	var verification api.CredentialsVerification
+	if err := c.do(ctx, http.MethodPost,
+		c.endpoint(nil, usersPath, byIDPath, strconv.FormatInt(id, 10), credsPath, verifyPath),
+		&api.Credentials{Password: pwd}, http.StatusOK, &verification); err != nil {
+		return nil, err
+	}
+
+	return &verification, nil
+}
+
+// VerifyCredentialsByUsername checks if pwd is the password of the user
+// with the provided username. The password hash never leaves the users API.
+func (c *Client) VerifyCredentialsByUsername(ctx context.Context, username, pwd string) (*api.CredentialsVerification, error) {
+	if username == "" {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeEmptyUsername,
+			Message: uerrors.MessageEmptyUsername,
+			Err:     uerrors.ErrEmptyUsername,
+		}
+	}
+
+	var verification api.CredentialsVerification
+	if err := c.do(ctx, http.MethodPost,
+		c.endpoint(nil, usersPath, byUserPath, username, credsPath, verifyPath),
+		&api.Credentials{Password: pwd}, http.StatusOK, &verification); err != nil {
+		return nil, err
+	}
+
+	return &verification, nil
+}
+
+// ListUsers returns a page of the users that match the provided filters.
+// Filters can be nil.
+func (c *Client) ListUsers(ctx context.Context, filters *ListFilters) (*api.UserList, error) {
+	var users api.UserList
+	if err := c.do(ctx, http.MethodGet,
+		c.endpoint(filters.toQuery(), usersPath),
+		nil, http.StatusOK, &users); err != nil {
+		return nil, err
+	}
+
+	return &users, nil
+}
+
+// CreateUser creates the provided user and returns it with the values
+// assigned by the server, i.e. its ID.
+func (c *Client) CreateUser(ctx context.Context, user *api.User) (*api.User, error) {
+	if user == nil {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeEmptyBody,
+			Message: uerrors.MessageEmptyBody,
+			Err:     uerrors.ErrEmptyBody,
+		}
+	}
+
+	var created api.User
+	if err := c.do(ctx, http.MethodPost,
+		c.endpoint(nil, usersPath),
+		user, http.StatusCreated, &created); err != nil {
+		return nil, err
+	}
+
+	return &created, nil
+}
+
+// UpdateUser replaces the user with the provided ID with user: its bio and
+// birthday are removed if user has none, and its password is only changed
+// if user has one. Use PatchUser to only change some fields.
+func (c *Client) UpdateUser(ctx context.Context, id int64, user *api.User) error {
+	if id < 1 {
+		return &uerrors.Error{
+			Code:    uerrors.CodeInvalidUserID,
+			Message: uerrors.MessageInvalidUserID,
+			Err:     uerrors.ErrInvalidUserID,
+		}
+	}
+
+	if user == nil {
+		return &uerrors.Error{
+			Code:    uerrors.CodeEmptyBody,
+			Message: uerrors.MessageEmptyBody,
+			Err:     uerrors.ErrEmptyBody,
+		}
+	}
+
+	return c.do(ctx, http.MethodPut,
+		c.endpoint(nil, usersPath, strconv.FormatInt(id, 10)),
+		user, http.StatusOK, nil)
+}
+
+// PatchUser changes the fields of the user with the provided ID that are
+// set in patch, and returns the user.
+func (c *Client) PatchUser(ctx context.Context, id int64, patch *api.UserPatch) (*api.User, error) {
+	if id < 1 {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeInvalidUserID,
+			Message: uerrors.MessageInvalidUserID,
+			Err:     uerrors.ErrInvalidUserID,
+		}
+	}
+
+	if patch == nil || patch.IsEmpty() {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeEmptyBody,
+			Message: uerrors.MessageEmptyBody,
+			Err:     uerrors.ErrEmptyBody,
+		}
+	}
+
+	var patched api.User
+	if err := c.do(ctx, http.MethodPatch,
+		c.endpoint(nil, usersPath, strconv.FormatInt(id, 10)),
+		patch, http.StatusOK, &patched); err != nil {
+		return nil, err
+	}
+
+	return &patched, nil
+}
+
+// GetUserHistory returns the changes made to the user with the provided
+// ID, the most recent first. If no fields are provided, changes to all
+// fields are returned.
+func (c *Client) GetUserHistory(ctx context.Context, id int64, fields ...string) (*api.UserHistory, error) {
+	if id < 1 {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeInvalidUserID,
+			Message: uerrors.MessageInvalidUserID,
+			Err:     uerrors.ErrInvalidUserID,
+		}
+	}
+
+	query := url.Values{}
+	if len(fields) > 0 {
+		query.Set(queryFields, strings.Join(fields, ","))
+	}
+
+	var history api.UserHistory
+	if err := c.do(ctx, http.MethodGet,
+		c.endpoint(query, usersPath, byIDPath, strconv.FormatInt(id, 10), historyPath),
+		nil, http.StatusOK, &history); err != nil {
+		return nil, err
+	}
+
+	return &history, nil
+}
+
+// SetPassword replaces the password of the user with the provided ID, and
+// requires the credentials scope. The users API does not know about
+// sessions, so the caller must invalidate them.
+func (c *Client) SetPassword(ctx context.Context, id int64, pwd string) error {
+	if id < 1 {
+		return &uerrors.Error{
+			Code:    uerrors.CodeInvalidUserID,
+			Message: uerrors.MessageInvalidUserID,
+			Err:     uerrors.ErrInvalidUserID,
+		}
+	}
+
+	return c.do(ctx, http.MethodPut,
+		c.endpoint(nil, usersPath, byIDPath, strconv.FormatInt(id, 10), passwordPath),
+		&api.Credentials{Password: pwd}, http.StatusOK, nil)
+}
+
+// VerifyEmail marks email as the verified email of the user with the
+// provided ID. It fails with errors.CodeEmailMismatch if the user has
+// changed email in the meantime.
+func (c *Client) VerifyEmail(ctx context.Context, id int64, email string) (*api.User, error) {
+	if id < 1 {
+		return nil, &uerrors.Error{
+			Code:    uerrors.CodeInvalidUserID,
+			Message: uerrors.MessageInvalidUserID,
+			Err:     uerrors.ErrInvalidUserID,
+		}
+	}
+
+	var user api.User
+	if err := c.do(ctx, http.MethodPost,
+		c.endpoint(nil, usersPath, byIDPath, strconv.FormatInt(id, 10), emailPath, verifyPath),
+		&api.EmailVerification{Email: email}, http.StatusOK, &user); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// DeleteUser deletes the user with the provided ID. Unless hardDelete is
+// true, the user is only soft-deleted.
+func (c *Client) DeleteUser(ctx context.Context, id int64, hardDelete bool) error {
+	if id < 1 {
+		return &uerrors.Error{
+			Code:    uerrors.CodeInvalidUserID,
+			Message: uerrors.MessageInvalidUserID,
+			Err:     uerrors.ErrInvalidUserID,
+		}
+	}
+
+	query := url.Values{}
+	query.Set(queryHardDel, strconv.FormatBool(hardDelete))
+
+	return c.do(ctx, http.MethodDelete,
+		c.endpoint(query, usersPath, strconv.FormatInt(id, 10)),
+		nil, http.StatusGone, nil)
+}
@@ -0,0 +1,400 @@
+// Package config loads the configuration of the users services from a YAML
+// file, the environment and flags, in this order: each source overrides the
+// ones before it.
+//
+// The configuration is a struct whose fields already have their default
+// values, and are described by these tags:
+//   - yaml: the key in the file.
+//   - flag: the name of the flag. Fields without it are only read from the
+//     file. On struct fields it is the prefix of the flags of their fields,
+//     i.e. "database" and "name" give --database-name, while an empty
+//     flag adds no prefix.
+//   - env: the environment variable, which defaults to the flag in upper
+//     case, i.e. DATABASE_NAME. On struct fields it is the prefix too.
+//   - usage: the description of the flag.
+//   - secret: "true" for values that must never be printed. Secrets can
+//     also be read from files, i.e. mounted Kubernetes secrets, with the
+//     DATABASE_PASSWORD_FILE variable or the --database-password-file flag.
+//
+// Empty environment variables are ignored.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	fileFlag      string = "config"
+	fileEnv       string = "CONFIG_FILE"
+	printFlag     string = "print-config"
+	secretFlag    string = "-file"
+	secretEnv     string = "_FILE"
+	redactedValue string = "<redacted>"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Validator is implemented by configurations that can check their values
+// once they are loaded.
+type Validator interface {
+	Validate() error
+}
+
+// Result is what Load found besides the configuration.
+type Result struct {
+	// Args are the arguments left after the flags, i.e. subcommands.
+	Args []string
+	// File is the configuration file that was loaded, if any.
+	File string
+	// Print is true if the configuration must be printed, and the service
+	// must exit without starting.
+	Print bool
+}
+
+type field struct {
+	value  reflect.Value
+	flag   string
+	env    string
+	usage  string
+	secret bool
+
+	fromFlag     *flagValue
+	fromFlagFile *flagValue
+}
+
+// Load fills cfg, a pointer to a struct, from the configuration file, the
+// environment and args, and validates it if it implements Validator. The
+// file is the one in the --config flag or the CONFIG_FILE variable.
+//
+// Load returns flag.ErrHelp if args contain -h or --help.
+func Load(cfg interface{}, args []string) (*Result, error) {
+	root := reflect.ValueOf(cfg)
+	if root.Kind() != reflect.Ptr || root.Elem().Kind() != reflect.Struct {
+		return nil, errors.New("configuration must be a pointer to a struct")
+	}
+
+	fields, err := collect(root.Elem(), "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{}
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	fs.StringVar(&result.File, fileFlag, "",
+		fmt.Sprintf("the path of the yaml configuration file, also read from %s", fileEnv))
+	fs.BoolVar(&result.Print, printFlag, false,
+		"print the configuration, with secrets redacted, and exit")
+
+	registered := map[string]bool{fileFlag: true, printFlag: true}
+	for _, f := range fields {
+		names := []string{f.flag}
+		if f.secret {
+			names = append(names, f.flag+secretFlag)
+		}
+
+		for _, name := range names {
+			if registered[name] {
+				return nil, fmt.Errorf("flag %s is defined twice", name)
+			}
+			registered[name] = true
+		}
+
+		f.fromFlag = &flagValue{typ: f.value.Type()}
+		if !f.value.IsZero() {
+			f.fromFlag.def = format(f.value, f.secret)
+		}
+		fs.Var(f.fromFlag, f.flag, fmt.Sprintf("%s (env %s)", f.usage, f.env))
+
+		if f.secret {
+			f.fromFlagFile = &flagValue{typ: reflect.TypeOf("")}
+			fs.Var(f.fromFlagFile, f.flag+secretFlag,
+				fmt.Sprintf("the path of the file containing the value of --%s (env %s)", f.flag, f.env+secretEnv))
+		}
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	result.Args = fs.Args()
+
+	if result.File == "" {
+		result.File = os.Getenv(fileEnv)
+	}
+
+	if result.File != "" {
+		if err := loadFile(result.File, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, f := range fields {
+		if err := f.loadEnv(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, f := range fields {
+		if err := f.loadFlags(); err != nil {
+			return nil, err
+		}
+	}
+
+	if v, ok := cfg.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid configuration: %w", err)
+		}
+	}
+
+	return result, nil
+}
+
+func collect(v reflect.Value, flagPrefix, envPrefix string) ([]*field, error) {
+	fields := []*field{}
+
+	for i := 0; i < v.NumField(); i++ {
+		sf := v.Type().Field(i)
+		name, exists := sf.Tag.Lookup("flag")
+		if !exists || name == "-" {
+			continue
+		}
+
+		if !sf.IsExported() {
+			return nil, fmt.Errorf("field %s has a flag but is not exported", sf.Name)
+		}
+
+		env, exists := sf.Tag.Lookup("env")
+		if !exists {
+			env = strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		}
+
+		flagName := join(flagPrefix, name, "-")
+		envName := join(envPrefix, env, "_")
+
+		if sf.Type.Kind() == reflect.Struct {
+			nested, err := collect(v.Field(i), flagName, envName)
+			if err != nil {
+				return nil, err
+			}
+
+			fields = append(fields, nested...)
+			continue
+		}
+
+		if err := set(reflect.New(sf.Type).Elem(), zeroString(sf.Type)); err != nil {
+			return nil, fmt.Errorf("field %s: %w", sf.Name, err)
+		}
+
+		fields = append(fields, &field{
+			value:  v.Field(i),
+			flag:   flagName,
+			env:    envName,
+			usage:  sf.Tag.Get("usage"),
+			secret: sf.Tag.Get("secret") == "true",
+		})
+	}
+
+	return fields, nil
+}
+
+func (f *field) loadEnv() error {
+	val := os.Getenv(f.env)
+
+	if f.secret {
+		if path := os.Getenv(f.env + secretEnv); path != "" {
+			if val != "" {
+				return fmt.Errorf("only one of %s and %s can be set", f.env, f.env+secretEnv)
+			}
+
+			contents, err := readSecret(path)
+			if err != nil {
+				return fmt.Errorf("could not read %s: %w", f.env+secretEnv, err)
+			}
+			val = contents
+		}
+	}
+
+	if val == "" {
+		return nil
+	}
+
+	if err := set(f.value, val); err != nil {
+		return fmt.Errorf("invalid value for %s: %w", f.env, err)
+	}
+
+	return nil
+}
+
+func (f *field) loadFlags() error {
+	val := f.fromFlag.val
+
+	if f.secret && f.fromFlagFile.isSet {
+		if f.fromFlag.isSet {
+			return fmt.Errorf("only one of --%s and --%s can be set", f.flag, f.flag+secretFlag)
+		}
+
+		contents, err := readSecret(f.fromFlagFile.val)
+		if err != nil {
+			return fmt.Errorf("could not read --%s: %w", f.flag+secretFlag, err)
+		}
+		val = contents
+	} else if !f.fromFlag.isSet {
+		return nil
+	}
+
+	if err := set(f.value, val); err != nil {
+		return fmt.Errorf("invalid value for --%s: %w", f.flag, err)
+	}
+
+	return nil
+}
+
+func loadFile(path string, cfg interface{}) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read configuration file: %w", err)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(contents))
+	// So that typos do not go unnoticed.
+	dec.KnownFields(true)
+
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("could not decode configuration file: %w", err)
+	}
+
+	return nil
+}
+
+func readSecret(path string) (string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	// Files usually end with a new line, which is not part of the secret.
+	return string(bytes.TrimSpace(contents)), nil
+}
+
+func set(v reflect.Value, s string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+
+	return nil
+}
+
+// zeroString returns a string that set accepts for typ, to check whether
+// it is supported.
+func zeroString(typ reflect.Type) string {
+	switch {
+	case typ == durationType:
+		return "0s"
+	case typ.Kind() == reflect.String:
+		return ""
+	case typ.Kind() == reflect.Bool:
+		return "false"
+	default:
+		return "0"
+	}
+}
+
+// format returns v as it is shown to users.
+func format(v reflect.Value, secret bool) string {
+	if secret {
+		if v.IsZero() {
+			return ""
+		}
+
+		return redactedValue
+	}
+
+	return fmt.Sprint(v.Interface())
+}
+
+func join(prefix, name, sep string) string {
+	if prefix == "" {
+		return name
+	}
+
+	return prefix + sep + name
+}
+
+// flagValue keeps the value of a flag until it can be applied, as flags
+// must override the file and the environment, which are read after flags.
+type flagValue struct {
+	typ   reflect.Type
+	def   string
+	val   string
+	isSet bool
+}
+
+func (f *flagValue) String() string {
+	if f == nil {
+		return ""
+	}
+
+	return f.def
+}
+
+func (f *flagValue) Set(s string) error {
+	if err := set(reflect.New(f.typ).Elem(), s); err != nil {
+		return err
+	}
+
+	f.val, f.isSet = s, true
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	return f.typ != nil && f.typ.Kind() == reflect.Bool
+}
@@ -0,0 +1,297 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testConfig struct {
+	Name     string        `yaml:"name" flag:"test-name" usage:"the name"`
+	Port     int           `yaml:"port" flag:"test-port" usage:"the port"`
+	Timeout  time.Duration `yaml:"timeout" flag:"test-timeout" usage:"the timeout"`
+	Database struct {
+		User     string `yaml:"user" flag:"user" usage:"the user"`
+		Password string `yaml:"password" flag:"password" secret:"true" usage:"the password"`
+	} `yaml:"database" flag:"test-database"`
+	FileOnly string `yaml:"fileOnly"`
+}
+
+func (c *testConfig) Validate() error {
+	if c.Port < 0 {
+		return errors.New("port cannot be negative")
+	}
+
+	return nil
+}
+
+// testEnv are the variables read for testConfig.
+var testEnv = []string{
+	fileEnv,
+	"TEST_NAME",
+	"TEST_PORT",
+	"TEST_TIMEOUT",
+	"TEST_DATABASE_USER",
+	"TEST_DATABASE_PASSWORD",
+	"TEST_DATABASE_PASSWORD_FILE",
+}
+
+func defaultTestConfig() *testConfig {
+	return &testConfig{Name: "default", Port: 8080, Timeout: time.Second}
+}
+
+// load loads a testConfig with only the provided variables set.
+func load(t *testing.T, env map[string]string, args ...string) (*testConfig, *Result, error) {
+	t.Helper()
+
+	for _, name := range testEnv {
+		t.Setenv(name, env[name])
+	}
+
+	cfg := defaultTestConfig()
+	result, err := Load(cfg, args)
+	return cfg, result, err
+}
+
+// writeFile writes contents to a new file and returns its path.
+func writeFile(t *testing.T, name, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := writeFile(t, "config.yaml", "name: file\nport: 1\ntimeout: 1m\ndatabase:\n  user: file\nfileOnly: file\n")
+
+	cases := []struct {
+		name     string
+		env      map[string]string
+		args     []string
+		expected func(cfg *testConfig)
+	}{
+		{
+			name:     "defaults",
+			expected: func(*testConfig) {},
+		},
+		{
+			name: "file",
+			args: []string{"--config", file},
+			expected: func(cfg *testConfig) {
+				cfg.Name, cfg.Port, cfg.Timeout = "file", 1, time.Minute
+				cfg.Database.User, cfg.FileOnly = "file", "file"
+			},
+		},
+		{
+			name: "file from the environment",
+			env:  map[string]string{fileEnv: file},
+			expected: func(cfg *testConfig) {
+				cfg.Name, cfg.Port, cfg.Timeout = "file", 1, time.Minute
+				cfg.Database.User, cfg.FileOnly = "file", "file"
+			},
+		},
+		{
+			name: "environment over file",
+			env:  map[string]string{"TEST_NAME": "env", "TEST_DATABASE_USER": "env", "TEST_TIMEOUT": "1h"},
+			args: []string{"--config", file},
+			expected: func(cfg *testConfig) {
+				cfg.Name, cfg.Port, cfg.Timeout = "env", 1, time.Hour
+				cfg.Database.User, cfg.FileOnly = "env", "file"
+			},
+		},
+		{
+			name: "flags over environment",
+			env:  map[string]string{"TEST_NAME": "env", "TEST_PORT": "2"},
+			args: []string{"--config", file, "--test-name", "flag", "--test-database-user=flag"},
+			expected: func(cfg *testConfig) {
+				cfg.Name, cfg.Port, cfg.Timeout = "flag", 2, time.Minute
+				cfg.Database.User, cfg.FileOnly = "flag", "file"
+			},
+		},
+		{
+			name:     "empty environment",
+			env:      map[string]string{"TEST_NAME": ""},
+			expected: func(*testConfig) {},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg, _, err := load(t, c.env, c.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := defaultTestConfig()
+			c.expected(expected)
+
+			if !reflect.DeepEqual(cfg, expected) {
+				t.Fatalf("configuration is %+v, expected %+v", cfg, expected)
+			}
+		})
+	}
+}
+
+func TestLoadSecrets(t *testing.T) {
+	secretFile := writeFile(t, "password", "from-file\n")
+
+	cases := []struct {
+		name     string
+		env      map[string]string
+		args     []string
+		expected string
+		invalid  bool
+	}{
+		{
+			name:     "environment",
+			env:      map[string]string{"TEST_DATABASE_PASSWORD": "from-env"},
+			expected: "from-env",
+		},
+		{
+			name:     "file from the environment",
+			env:      map[string]string{"TEST_DATABASE_PASSWORD_FILE": secretFile},
+			expected: "from-file",
+		},
+		{
+			name:     "file from flags",
+			args:     []string{"--test-database-password-file", secretFile},
+			expected: "from-file",
+		},
+		{
+			name:     "flag over file from the environment",
+			env:      map[string]string{"TEST_DATABASE_PASSWORD_FILE": secretFile},
+			args:     []string{"--test-database-password", "from-flag"},
+			expected: "from-flag",
+		},
+		{
+			name:    "value and file in the environment",
+			env:     map[string]string{"TEST_DATABASE_PASSWORD": "from-env", "TEST_DATABASE_PASSWORD_FILE": secretFile},
+			invalid: true,
+		},
+		{
+			name:    "value and file in flags",
+			args:    []string{"--test-database-password", "from-flag", "--test-database-password-file", secretFile},
+			invalid: true,
+		},
+		{
+			name:    "missing file",
+			args:    []string{"--test-database-password-file", filepath.Join(t.TempDir(), "missing")},
+			invalid: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg, _, err := load(t, c.env, c.args...)
+			switch {
+			case c.invalid && err == nil:
+				t.Fatal("invalid configuration was loaded")
+			case c.invalid:
+				return
+			case err != nil:
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			if cfg.Database.Password != c.expected {
+				t.Fatalf("password is %q, expected %q", cfg.Database.Password, c.expected)
+			}
+		})
+	}
+}
+
+func TestLoadArgs(t *testing.T) {
+	cases := []struct {
+		name    string
+		args    []string
+		file    string
+		help    bool
+		invalid bool
+		left    []string
+		print   bool
+	}{
+		{name: "short help", args: []string{"-h"}, help: true},
+		{name: "long help", args: []string{"--help"}, help: true},
+		{name: "unknown flag", args: []string{"--unknown"}, invalid: true},
+		{name: "invalid value", args: []string{"--test-port", "eighty"}, invalid: true},
+		{name: "invalid configuration", args: []string{"--test-port", "-1"}, invalid: true},
+		{name: "unknown key in file", file: "unknown: true\n", invalid: true},
+		{name: "subcommand", args: []string{"--test-port", "1", "migrate", "up"}, left: []string{"migrate", "up"}},
+		{name: "print", args: []string{"--print-config"}, print: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			args := c.args
+			if c.file != "" {
+				args = append([]string{"--config", writeFile(t, "config.yaml", c.file)}, args...)
+			}
+
+			_, result, err := load(t, nil, args...)
+			switch {
+			case c.help:
+				if !errors.Is(err, flag.ErrHelp) {
+					t.Fatalf("error is %v, expected %v", err, flag.ErrHelp)
+				}
+				return
+			case c.invalid:
+				if err == nil || errors.Is(err, flag.ErrHelp) {
+					t.Fatalf("error is %v, expected the arguments to be refused", err)
+				}
+				return
+			case err != nil:
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			if strings.Join(result.Args, " ") != strings.Join(c.left, " ") {
+				t.Errorf("arguments left are %v, expected %v", result.Args, c.left)
+			}
+
+			if result.Print != c.print {
+				t.Errorf("print is %t, expected %t", result.Print, c.print)
+			}
+		})
+	}
+}
+
+func TestPrint(t *testing.T) {
+	cfg := defaultTestConfig()
+	cfg.Database.User = "user"
+	cfg.Database.Password = "a-password"
+
+	var out bytes.Buffer
+	if err := Print(&out, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	printed := out.String()
+	if strings.Contains(printed, cfg.Database.Password) {
+		t.Fatalf("password was printed:\n%s", printed)
+	}
+
+	for _, expected := range []string{"name: default", "port: 8080", "timeout: 1s", "user: user", "password: " + redactedValue} {
+		if !strings.Contains(printed, expected) {
+			t.Errorf("%q was not printed:\n%s", expected, printed)
+		}
+	}
+
+	// Empty secrets are shown as such, so that missing ones can be told.
+	cfg.Database.Password = ""
+	out.Reset()
+	if err := Print(&out, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(out.String(), redactedValue) {
+		t.Fatalf("empty password was redacted:\n%s", out.String())
+	}
+}
@@ -0,0 +1,78 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Print writes cfg to w as YAML, in the same format as the configuration
+// file, with the values of secrets redacted.
+func Print(w io.Writer, cfg interface{}) error {
+	v := reflect.ValueOf(cfg)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+
+	if v.Kind() != reflect.Struct {
+		return fmt.Errorf("configuration must be a struct")
+	}
+
+	node, err := redact(v)
+	if err != nil {
+		return err
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	defer enc.Close()
+
+	return enc.Encode(node)
+}
+
+func redact(v reflect.Value) (*yaml.Node, error) {
+	node := &yaml.Node{Kind: yaml.MappingNode}
+
+	for i := 0; i < v.NumField(); i++ {
+		sf := v.Type().Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+
+		name := strings.Split(sf.Tag.Get("yaml"), ",")[0]
+		switch name {
+		case "-":
+			continue
+		case "":
+			name = strings.ToLower(sf.Name)
+		}
+
+		var val *yaml.Node
+		switch {
+		case sf.Type.Kind() == reflect.Struct:
+			nested, err := redact(v.Field(i))
+			if err != nil {
+				return nil, err
+			}
+			val = nested
+		default:
+			var value interface{} = v.Field(i).Interface()
+			if sf.Tag.Get("secret") == "true" || sf.Type == durationType {
+				value = format(v.Field(i), sf.Tag.Get("secret") == "true")
+			}
+
+			val = &yaml.Node{}
+			if err := val.Encode(value); err != nil {
+				return nil, fmt.Errorf("could not encode %s: %w", sf.Name, err)
+			}
+		}
+
+		node.Content = append(node.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: name}, val)
+	}
+
+	return node, nil
+}
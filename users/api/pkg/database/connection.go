@@ -3,8 +3,10 @@ package database
 import (
 	"fmt"
 	"net/url"
+	"strings"
 	"time"
 
+	"github.com/glebarez/sqlite"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 )
@@ -18,6 +20,8 @@ const (
 	queryReadTimeout   string = "readTimeout"
 	queryWriteTimeout  string = "writeTimeout"
 	queryTimeout       string = "timeout"
+
+	querySQLiteBusyTimeout string = "_pragma=busy_timeout(5000)"
 )
 
 func NewDatabaseConnection(settings *Settings) (*gorm.DB, error) {
@@ -25,12 +29,33 @@ func NewDatabaseConnection(settings *Settings) (*gorm.DB, error) {
 		return nil, fmt.Errorf("no database settings provided")
 	}
 
-	dsn, err := buildDSN(settings)
-	if err != nil {
-		return nil, fmt.Errorf("cannot successfully create database address: %w", err)
+	var dialector gorm.Dialector
+	switch settings.Driver {
+	case DriverMySQL, "":
+		dsn, err := buildDSN(settings)
+		if err != nil {
+			return nil, fmt.Errorf("cannot successfully create database address: %w", err)
+		}
+
+		dialector = mysql.Open(dsn)
+	case DriverSQLite:
+		if settings.Path == "" {
+			return nil, fmt.Errorf("no sqlite path provided")
+		}
+
+		// Concurrent writes wait for each other, rather than failing with
+		// SQLITE_BUSY right away.
+		sep := "?"
+		if strings.Contains(settings.Path, "?") {
+			sep = "&"
+		}
+
+		dialector = sqlite.Open(settings.Path + sep + querySQLiteBusyTimeout)
+	default:
+		return nil, fmt.Errorf(`unsupported database driver "%s"`, settings.Driver)
 	}
 
-	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	db, err := gorm.Open(dialector, &gorm.Config{})
 	if err != nil {
 		return nil, fmt.Errorf("cannot establish connection to database: %w", err)
 	}
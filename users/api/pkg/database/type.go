@@ -4,13 +4,26 @@ import "time"
 
 // TODO: this will be on a separate package
 
+const (
+	// DriverMySQL connects to a MySQL server.
+	DriverMySQL string = "mysql"
+	// DriverSQLite uses a SQLite file, or an in-memory SQLite database if
+	// the path is ":memory:".
+	DriverSQLite string = "sqlite"
+	// DriverMemory keeps users in memory without any database. It is not
+	// handled by NewDatabaseConnection.
+	DriverMemory string = "memory"
+)
+
 type Settings struct {
-	Name         string        `json:"name" yaml:"name"`
-	User         string        `json:"user" yaml:"user"`
-	Password     string        `json:"password" yaml:"password"`
-	Address      string        `json:"address" yaml:"address"`
-	Port         int           `json:"port" yaml:"port"`
-	Charset      string        `json:"charset" yaml:"charset"`
-	ReadTimeout  time.Duration `json:"read_timeout" yaml:"readTimeout"`
-	WriteTimeout time.Duration `json:"write_timeout" yaml:"writeTimeout"`
+	Driver       string        `json:"driver" yaml:"driver" flag:"driver" usage:"the database driver to use: mysql, sqlite or memory"`
+	Path         string        `json:"path" yaml:"path" flag:"path" usage:"the path of the sqlite database file, or :memory:"`
+	Name         string        `json:"name" yaml:"name" flag:"name" usage:"the name of the database to connect to"`
+	User         string        `json:"user" yaml:"user" flag:"user" usage:"the username to connect as"`
+	Password     string        `json:"password" yaml:"password" flag:"password" secret:"true" usage:"the password to use for the provided user"`
+	Address      string        `json:"address" yaml:"address" flag:"address" usage:"the address where mysql is running"`
+	Port         int           `json:"port" yaml:"port" flag:"port" usage:"the port mysql is exposing"`
+	Charset      string        `json:"charset" yaml:"charset" flag:"charset" usage:"the charset used by the database"`
+	ReadTimeout  time.Duration `json:"read_timeout" yaml:"readTimeout" flag:"readtimeout" env:"READ_TIMEOUT" usage:"the timeout for reading from the database"`
+	WriteTimeout time.Duration `json:"write_timeout" yaml:"writeTimeout" flag:"writetimeout" env:"WRITE_TIMEOUT" usage:"the timeout for writing to the database"`
 }
@@ -31,69 +31,171 @@ const (
 	CodeInvalidNameIn
 	CodeInvalidEmailIn
 	CodeInvalidIdIn
+	CodeEmptyPassword
+	CodePasswordTooShort
+	CodePasswordTooLong
+	CodeInvalidCursor
+	CodeInvalidLimit
+	CodeInvalidSort
+	CodeInvalidCreatedAfter
+	CodeInvalidCreatedBefore
+	CodeInvalidDateRange
+	CodeInvalidUsernameStartsWith
+	CodeInvalidDisplayNameContains
+	CodeInvalidIncludeDeleted
+	CodeUserNotDeleted
+	CodeInvalidActor
+	CodeInvalidHistoryField
+	CodeInvalidBanScope
+	CodeEmptyBanReason
+	CodeBanReasonTooLong
+	CodeInvalidBanExpiry
+	CodeInvalidBanID
+	CodeBanAlreadyLifted
+	CodeBanNotFound
+	CodeEmailMismatch
+	CodeInvalidPatch
+	CodePatchTestFailed
+	CodeUnsupportedPatchType
+	CodeVersionMismatch
+	CodeInvalidETag
+	CodeUnsupportedImportFormat
+	CodeInvalidImportOptions
+	CodeInvalidImportRow
+	CodeImportTooLarge
 )
 
 const (
+	CodeUnauthorized        = 401
+	CodeForbidden           = 403
 	CodeUserNotFound        = 404
 	CodeInternalServerError = 500
 )
 
 // Message
 const (
-	MessageEmptyUsername            string = "Username is empty."
-	MessageInvalidUsername          string = "Username contains invalid characters."
-	MessageUsernameTooLong          string = "Username is too long."
-	MessageInvalidUserID            string = "User ID is not valid."
-	MessageEmptyBody                string = "Request doesn't contain any body."
-	MessageInvalidUserPost          string = "Provided request body is not valid."
-	MessageEmptyDisplayName         string = "Display name is empty."
-	MessageDisplayNameTooLong       string = "Display name is too long."
-	MessageEmptyEmail               string = "Email is missing."
-	MessageEmptyRegistrationIP      string = "Empty registration IP."
-	MessageBioTooLong               string = "Bio is too long."
-	MessageUsernameAlreadyExists    string = "Username already exists."
-	MessageEmailAlreadyExists       string = "Email already registered."
-	MessageInvalidEmail             string = "Email is not valid."
-	MessageEmailTooLong             string = "Email is too long."
-	MessageEmptyPasswordHash        string = "Password hash is empty."
-	MessageIncompatiblePasswordHash string = "Provided password hash does not look like a valid sha256-encoded value."
-	MessageInvalidSaltLength        string = "Salt length should be at least the same length of the password hash."
-	MessageInvalidBase64Salt        string = "This doesn't look like a valid base64 value."
-	MessageInvalidPage              string = "Invalid page provided."
-	MessageInvalidNameIn            string = `Invalid "nameIn" filter provided.`
-	MessageInvalidEmailIn           string = `Invalid "emailIn" filter provided.`
-	MessageInvalidIdIn              string = `Invalid "idIn" filter provided.`
+	MessageEmptyUsername              string = "Username is empty."
+	MessageInvalidUsername            string = "Username contains invalid characters."
+	MessageUsernameTooLong            string = "Username is too long."
+	MessageInvalidUserID              string = "User ID is not valid."
+	MessageEmptyBody                  string = "Request doesn't contain any body."
+	MessageInvalidUserPost            string = "Provided request body is not valid."
+	MessageEmptyDisplayName           string = "Display name is empty."
+	MessageDisplayNameTooLong         string = "Display name is too long."
+	MessageEmptyEmail                 string = "Email is missing."
+	MessageEmptyRegistrationIP        string = "Empty registration IP."
+	MessageBioTooLong                 string = "Bio is too long."
+	MessageUsernameAlreadyExists      string = "Username already exists."
+	MessageEmailAlreadyExists         string = "Email already registered."
+	MessageInvalidEmail               string = "Email is not valid."
+	MessageEmailTooLong               string = "Email is too long."
+	MessageEmptyPasswordHash          string = "Password hash is empty."
+	MessageIncompatiblePasswordHash   string = "Provided password hash does not look like a valid sha256-encoded value."
+	MessageInvalidSaltLength          string = "Salt length should be at least the same length of the password hash."
+	MessageInvalidBase64Salt          string = "This doesn't look like a valid base64 value."
+	MessageInvalidPage                string = "Invalid page provided."
+	MessageInvalidNameIn              string = `Invalid "nameIn" filter provided.`
+	MessageInvalidEmailIn             string = `Invalid "emailIn" filter provided.`
+	MessageInvalidIdIn                string = `Invalid "idIn" filter provided.`
+	MessageEmptyPassword              string = "Password is empty."
+	MessagePasswordTooShort           string = "Password is too short."
+	MessagePasswordTooLong            string = "Password is too long."
+	MessageInvalidCursor              string = "Invalid cursor provided."
+	MessageInvalidLimit               string = "Invalid limit provided."
+	MessageInvalidSort                string = "Invalid sort provided."
+	MessageInvalidCreatedAfter        string = `Invalid "createdAfter" filter provided: it must be an RFC3339 date.`
+	MessageInvalidCreatedBefore       string = `Invalid "createdBefore" filter provided: it must be an RFC3339 date.`
+	MessageInvalidDateRange           string = `"createdAfter" must come before "createdBefore".`
+	MessageInvalidUsernameStartsWith  string = `Invalid "usernameStartsWith" filter provided.`
+	MessageInvalidDisplayNameContains string = `Invalid "displayNameContains" filter provided.`
+	MessageInvalidIncludeDeleted      string = `Invalid "includeDeleted" filter provided.`
+	MessageUserNotDeleted             string = "User is not deleted."
+	MessageInvalidActor               string = "Invalid actor provided."
+	MessageInvalidHistoryField        string = "The history of the provided field is not recorded."
+	MessageInvalidBanScope            string = "Invalid ban scope provided."
+	MessageEmptyBanReason             string = "Ban reason is empty."
+	MessageBanReasonTooLong           string = "Ban reason is too long."
+	MessageInvalidBanExpiry           string = "Ban must expire after it starts."
+	MessageInvalidBanID               string = "Ban ID is not valid."
+	MessageBanAlreadyLifted           string = "Ban was already lifted."
+	MessageEmailMismatch              string = "The email of the user has changed."
+	MessageInvalidPatch               string = "Provided patch is not valid."
+	MessagePatchTestFailed            string = "The user does not match the test operations of the patch."
+	MessageUnsupportedPatchType       string = "Patches must be application/merge-patch+json or application/json-patch+json."
+	MessageVersionMismatch            string = "The user has changed since the provided version."
+	MessageInvalidETag                string = "Provided entity tag is not valid."
+	MessageUnsupportedImportFormat    string = "Users must be imported and exported as application/x-ndjson or text/csv."
+	MessageInvalidImportOptions       string = "Provided import options are not valid."
+	MessageInvalidImportRow           string = "Provided user cannot be read."
+	MessageImportTooLarge             string = "Provided import is too large: split it in smaller ones."
 
+	MessageUnauthorized        string = "Valid credentials are required to perform this operation."
+	MessageForbidden           string = "You are not allowed to perform this operation."
 	MessageUserNotFound        string = "No user was found with provided username or ID."
+	MessageBanNotFound         string = "No ban was found with provided ID."
 	MessageInternalServerError string = "An error occurred while processing the request. Please try again later."
 )
 
 // Sentinel errors
 var (
-	ErrUserNotFound             error = errors.New("user not found")
-	ErrInternalServerError      error = errors.New("internal server error")
-	ErrEmptyUsername            error = errors.New("empty username")
-	ErrInvalidUsername          error = errors.New("invalid username")
-	ErrUsernameTooLong          error = errors.New("username too long")
-	ErrInvalidUserID            error = errors.New("invalid user id")
-	ErrEmptyBody                error = errors.New("empty request body")
-	ErrEmptyDisplayName         error = errors.New("empty display name")
-	ErrDisplayNameTooLong       error = errors.New("display name too long")
-	ErrEmptyEmail               error = errors.New("empty email")
-	ErrEmptyRegistrationIP      error = errors.New("empty registration IP")
-	ErrBioTooLong               error = errors.New("bio too long")
-	ErrUsernameAlreadyExists    error = errors.New("username already exists")
-	ErrEmailAlreadyExists       error = errors.New("email already exists")
-	ErrInvalidEmail             error = errors.New("email is not valid")
-	ErrEmailTooLong             error = errors.New("email is too long")
-	ErrEmptyPasswordHash        error = errors.New("empty password hash")
-	ErrIncompatiblePasswordHash error = errors.New("incompatible password hash")
-	ErrInvalidSaltLength        error = errors.New("invalid salt length")
-	ErrInvalidBase64Salt        error = errors.New("invalid base64 salt")
-	ErrInvalidPage              error = errors.New("invalid page")
-	ErrInvalidNameIn            error = errors.New("invalid nameIn parameter provided")
-	ErrInvalidEmailIn           error = errors.New("invalid emailIn parameter provided")
-	ErrInvalidIdIn              error = errors.New("invalid idIn parameter provided")
+	ErrUserNotFound               error = errors.New("user not found")
+	ErrInternalServerError        error = errors.New("internal server error")
+	ErrEmptyUsername              error = errors.New("empty username")
+	ErrInvalidUsername            error = errors.New("invalid username")
+	ErrUsernameTooLong            error = errors.New("username too long")
+	ErrInvalidUserID              error = errors.New("invalid user id")
+	ErrEmptyBody                  error = errors.New("empty request body")
+	ErrEmptyDisplayName           error = errors.New("empty display name")
+	ErrDisplayNameTooLong         error = errors.New("display name too long")
+	ErrEmptyEmail                 error = errors.New("empty email")
+	ErrEmptyRegistrationIP        error = errors.New("empty registration IP")
+	ErrBioTooLong                 error = errors.New("bio too long")
+	ErrUsernameAlreadyExists      error = errors.New("username already exists")
+	ErrEmailAlreadyExists         error = errors.New("email already exists")
+	ErrInvalidEmail               error = errors.New("email is not valid")
+	ErrEmailTooLong               error = errors.New("email is too long")
+	ErrEmptyPasswordHash          error = errors.New("empty password hash")
+	ErrIncompatiblePasswordHash   error = errors.New("incompatible password hash")
+	ErrInvalidSaltLength          error = errors.New("invalid salt length")
+	ErrInvalidBase64Salt          error = errors.New("invalid base64 salt")
+	ErrInvalidPage                error = errors.New("invalid page")
+	ErrInvalidNameIn              error = errors.New("invalid nameIn parameter provided")
+	ErrInvalidEmailIn             error = errors.New("invalid emailIn parameter provided")
+	ErrInvalidIdIn                error = errors.New("invalid idIn parameter provided")
+	ErrEmptyPassword              error = errors.New("empty password")
+	ErrPasswordTooShort           error = errors.New("password too short")
+	ErrPasswordTooLong            error = errors.New("password too long")
+	ErrInvalidCursor              error = errors.New("invalid cursor")
+	ErrInvalidLimit               error = errors.New("invalid limit")
+	ErrInvalidSort                error = errors.New("invalid sort")
+	ErrInvalidCreatedAfter        error = errors.New("invalid createdAfter parameter provided")
+	ErrInvalidCreatedBefore       error = errors.New("invalid createdBefore parameter provided")
+	ErrInvalidDateRange           error = errors.New("invalid date range")
+	ErrInvalidUsernameStartsWith  error = errors.New("invalid usernameStartsWith parameter provided")
+	ErrInvalidDisplayNameContains error = errors.New("invalid displayNameContains parameter provided")
+	ErrInvalidIncludeDeleted      error = errors.New("invalid includeDeleted parameter provided")
+	ErrUserNotDeleted             error = errors.New("user is not deleted")
+	ErrInvalidActor               error = errors.New("invalid actor")
+	ErrInvalidHistoryField        error = errors.New("invalid history field")
+	ErrInvalidBanScope            error = errors.New("invalid ban scope")
+	ErrEmptyBanReason             error = errors.New("empty ban reason")
+	ErrBanReasonTooLong           error = errors.New("ban reason too long")
+	ErrInvalidBanExpiry           error = errors.New("invalid ban expiry")
+	ErrInvalidBanID               error = errors.New("invalid ban id")
+	ErrBanAlreadyLifted           error = errors.New("ban already lifted")
+	ErrBanNotFound                error = errors.New("ban not found")
+	ErrEmailMismatch              error = errors.New("email mismatch")
+	ErrInvalidPatch               error = errors.New("invalid patch")
+	ErrPatchTestFailed            error = errors.New("patch test failed")
+	ErrUnsupportedPatchType       error = errors.New("unsupported patch type")
+	ErrVersionMismatch            error = errors.New("version mismatch")
+	ErrInvalidETag                error = errors.New("invalid entity tag")
+	ErrUnsupportedImportFormat    error = errors.New("unsupported import format")
+	ErrInvalidImportOptions       error = errors.New("invalid import options")
+	ErrInvalidImportRow           error = errors.New("invalid import row")
+	ErrImportTooLarge             error = errors.New("import too large")
+	ErrForbidden                  error = errors.New("forbidden")
+	ErrUnauthorized               error = errors.New("unauthorized")
 )
 
 // TODO: this should contain ranges
@@ -119,12 +221,51 @@ func ToHTTPStatusCode(code int) int {
 		CodeInvalidPage,
 		CodeInvalidNameIn,
 		CodeInvalidEmailIn,
-		CodeInvalidIdIn:
+		CodeInvalidIdIn,
+		CodeEmptyPassword,
+		CodePasswordTooShort,
+		CodePasswordTooLong,
+		CodeInvalidCursor,
+		CodeInvalidLimit,
+		CodeInvalidSort,
+		CodeInvalidCreatedAfter,
+		CodeInvalidCreatedBefore,
+		CodeInvalidDateRange,
+		CodeInvalidUsernameStartsWith,
+		CodeInvalidDisplayNameContains,
+		CodeInvalidIncludeDeleted,
+		CodeInvalidActor,
+		CodeInvalidHistoryField,
+		CodeInvalidBanScope,
+		CodeEmptyBanReason,
+		CodeBanReasonTooLong,
+		CodeInvalidBanExpiry,
+		CodeInvalidBanID,
+		CodeInvalidPatch,
+		CodeInvalidETag,
+		CodeInvalidImportOptions,
+		CodeInvalidImportRow:
 		return fiber.StatusBadRequest
 	case CodeUsernameAlreadyExists,
-		CodeEmailAlreadyExists:
+		CodeEmailAlreadyExists,
+		CodeUserNotDeleted,
+		CodeBanAlreadyLifted,
+		CodeEmailMismatch,
+		CodePatchTestFailed:
 		return fiber.StatusConflict
-	case CodeUserNotFound:
+	case CodeUnsupportedPatchType,
+		CodeUnsupportedImportFormat:
+		return fiber.StatusUnsupportedMediaType
+	case CodeImportTooLarge:
+		return fiber.StatusRequestEntityTooLarge
+	case CodeVersionMismatch:
+		return fiber.StatusPreconditionFailed
+	case CodeUnauthorized:
+		return fiber.StatusUnauthorized
+	case CodeForbidden:
+		return fiber.StatusForbidden
+	case CodeUserNotFound,
+		CodeBanNotFound:
 		return fiber.StatusNotFound
 	default:
 		return fiber.StatusInternalServerError
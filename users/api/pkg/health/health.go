@@ -0,0 +1,234 @@
+// Package health checks whether the dependencies of the users services can
+// be reached, so that a replica is taken out of rotation when they cannot,
+// and serves the results to the probes of kubernetes.
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	StatusOK   string = "ok"
+	StatusFail string = "fail"
+
+	stoppedCheck string = "shutdown"
+
+	defaultTimeout  time.Duration = 2 * time.Second
+	defaultCacheTTL time.Duration = 5 * time.Second
+)
+
+// Check is a dependency of a service.
+type Check struct {
+	Name string
+	// Check returns an error if the dependency cannot be used. It must
+	// return when ctx is done.
+	Check func(ctx context.Context) error
+}
+
+// Result is the outcome of a Check.
+type Result struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Latency string `json:"latency,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Report is the outcome of all the checks of a Checker.
+type Report struct {
+	Status    string    `json:"status"`
+	CheckedAt time.Time `json:"checked_at"`
+	Checks    []*Result `json:"checks"`
+}
+
+// Checker runs checks and caches their report, so that frequent probes do
+// not flood dependencies. A Checker with no checks is always healthy.
+type Checker struct {
+	Checks []Check
+	// Timeout is how long each check can take. Defaults to two seconds.
+	Timeout time.Duration
+	// CacheTTL is how long a report is served before checks run again.
+	// Defaults to five seconds.
+	CacheTTL time.Duration
+
+	lock sync.Mutex
+	last *Report
+	// started is the first report where all checks succeeded.
+	started *Report
+	stopped bool
+}
+
+// Run returns the last report if it is recent enough, or runs all checks
+// concurrently otherwise. Probes that arrive while checks are running wait
+// for their report rather than running them again.
+func (c *Checker) Run(ctx context.Context) *Report {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	ttl := c.CacheTTL
+	if ttl <= 0 {
+		ttl = defaultCacheTTL
+	}
+
+	if c.stopped {
+		return &Report{
+			Status:    StatusFail,
+			CheckedAt: time.Now(),
+			Checks: []*Result{
+				{Name: stoppedCheck, Status: StatusFail, Error: "shutting down"},
+			},
+		}
+	}
+
+	if c.last != nil && time.Since(c.last.CheckedAt) < ttl {
+		return c.last
+	}
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	report := &Report{
+		Status:    StatusOK,
+		CheckedAt: time.Now(),
+		Checks:    make([]*Result, len(c.Checks)),
+	}
+
+	var wg sync.WaitGroup
+	for i, check := range c.Checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			report.Checks[i] = run(ctx, check, timeout)
+		}(i, check)
+	}
+	wg.Wait()
+
+	for _, res := range report.Checks {
+		if res.Status != StatusOK {
+			report.Status = StatusFail
+		}
+	}
+
+	if report.Status == StatusOK && c.started == nil {
+		c.started = report
+	}
+
+	c.last = report
+	return report
+}
+
+func run(ctx context.Context, check Check, timeout time.Duration) *Result {
+	ctx, canc := context.WithTimeout(ctx, timeout)
+	defer canc()
+
+	start := time.Now()
+	err := check.Check(ctx)
+
+	res := &Result{
+		Name:    check.Name,
+		Status:  StatusOK,
+		Latency: time.Since(start).String(),
+	}
+	if err != nil {
+		res.Status = StatusFail
+		res.Error = err.Error()
+	}
+
+	return res
+}
+
+// Stop makes all reports fail from now on, so that the service is taken
+// out of rotation before it stops serving.
+func (c *Checker) Stop() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.stopped = true
+}
+
+// Started returns the first report where all checks succeeded, or nil if
+// they never did.
+func (c *Checker) Started() *Report {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.started
+}
+
+// ReadinessHandler serves whether the dependencies can be reached right
+// now. With the verbose query parameter, it also tells the status and the
+// latency of each of them.
+func (c *Checker) ReadinessHandler() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		report := c.Run(ctx.UserContext())
+
+		status := fiber.StatusOK
+		if report.Status != StatusOK {
+			status = fiber.StatusServiceUnavailable
+		}
+
+		return respond(ctx, status, report)
+	}
+}
+
+// StartupHandler serves whether the service has been ready at least once:
+// after that, only the readiness probe takes it out of rotation.
+func (c *Checker) StartupHandler() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		report := c.Started()
+		if report == nil {
+			report = c.Run(ctx.UserContext())
+		}
+
+		status := fiber.StatusOK
+		if report.Status != StatusOK {
+			status = fiber.StatusServiceUnavailable
+		}
+
+		return respond(ctx, status, report)
+	}
+}
+
+func respond(ctx *fiber.Ctx, status int, report *Report) error {
+	if ctx.Context().QueryArgs().Has("verbose") {
+		return ctx.Status(status).JSON(report)
+	}
+
+	return ctx.Status(status).SendString(report.Status)
+}
+
+// HTTPCheck returns a check that succeeds if the server at url responds
+// without a server error, whatever the route: it only tells whether the
+// server can be reached.
+func HTTPCheck(name, url string) Check {
+	client := &http.Client{}
+
+	return Check{
+		Name: name,
+		Check: func(ctx context.Context) error {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+			if err != nil {
+				return fmt.Errorf("could not create request: %w", err)
+			}
+
+			resp, err := client.Do(req)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode >= http.StatusInternalServerError {
+				return fmt.Errorf("responded with status %d", resp.StatusCode)
+			}
+
+			return nil
+		},
+	}
+}
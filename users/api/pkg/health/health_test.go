@@ -0,0 +1,156 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// switchable is a check that fails while failing is set, and counts how
+// many times it ran.
+type switchable struct {
+	failing int32
+	runs    int32
+}
+
+func (s *switchable) check() Check {
+	return Check{
+		Name: "switchable",
+		Check: func(context.Context) error {
+			atomic.AddInt32(&s.runs, 1)
+			if atomic.LoadInt32(&s.failing) == 1 {
+				return errors.New("unreachable")
+			}
+
+			return nil
+		},
+	}
+}
+
+func (s *switchable) fail(failing bool) {
+	value := int32(0)
+	if failing {
+		value = 1
+	}
+
+	atomic.StoreInt32(&s.failing, value)
+}
+
+// probe calls handler at path and returns the status and the body.
+func probe(t *testing.T, handler fiber.Handler, path string) (int, string) {
+	t.Helper()
+
+	app := fiber.New()
+	app.Get("/probe", handler)
+
+	resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, path, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.StatusCode, string(body)
+}
+
+func TestReadiness(t *testing.T) {
+	dependency := &switchable{}
+	checker := &Checker{Checks: []Check{dependency.check()}, CacheTTL: time.Hour}
+
+	status, body := probe(t, checker.ReadinessHandler(), "/probe")
+	if status != fiber.StatusOK || body != StatusOK {
+		t.Fatalf("readiness is %d %s, expected %d %s", status, body, fiber.StatusOK, StatusOK)
+	}
+
+	// Reports are cached, so failures are only noticed once they expire.
+	dependency.fail(true)
+	if status, _ := probe(t, checker.ReadinessHandler(), "/probe"); status != fiber.StatusOK {
+		t.Fatalf("readiness is %d before the report expired", status)
+	}
+
+	if runs := atomic.LoadInt32(&dependency.runs); runs != 1 {
+		t.Fatalf("check ran %d times, expected 1", runs)
+	}
+
+	checker.CacheTTL = time.Nanosecond
+	status, body = probe(t, checker.ReadinessHandler(), "/probe?verbose")
+	if status != fiber.StatusServiceUnavailable {
+		t.Fatalf("readiness is %d, expected %d", status, fiber.StatusServiceUnavailable)
+	}
+
+	if !strings.Contains(body, `"name":"switchable"`) || !strings.Contains(body, `"error":"unreachable"`) {
+		t.Fatalf("verbose report does not tell the failed check: %s", body)
+	}
+}
+
+func TestReadinessTimesOut(t *testing.T) {
+	checker := &Checker{
+		Timeout: 10 * time.Millisecond,
+		Checks: []Check{{
+			Name: "slow",
+			Check: func(ctx context.Context) error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+		}},
+	}
+
+	if report := checker.Run(context.Background()); report.Status != StatusFail {
+		t.Fatalf("report is %s, expected %s", report.Status, StatusFail)
+	}
+}
+
+func TestStartup(t *testing.T) {
+	dependency := &switchable{}
+	dependency.fail(true)
+	checker := &Checker{Checks: []Check{dependency.check()}, CacheTTL: time.Nanosecond}
+
+	if status, _ := probe(t, checker.StartupHandler(), "/probe"); status != fiber.StatusServiceUnavailable {
+		t.Fatalf("startup is %d before the checks succeeded", status)
+	}
+
+	dependency.fail(false)
+	if status, _ := probe(t, checker.StartupHandler(), "/probe"); status != fiber.StatusOK {
+		t.Fatalf("startup is %d after the checks succeeded", status)
+	}
+
+	// Once started, only readiness fails.
+	dependency.fail(true)
+	if status, _ := probe(t, checker.StartupHandler(), "/probe"); status != fiber.StatusOK {
+		t.Fatalf("startup is %d after it succeeded once", status)
+	}
+
+	if status, _ := probe(t, checker.ReadinessHandler(), "/probe"); status != fiber.StatusServiceUnavailable {
+		t.Fatalf("readiness is %d with a failing check", status)
+	}
+}
+
+func TestReadinessAfterStop(t *testing.T) {
+	checker := &Checker{Checks: []Check{(&switchable{}).check()}, CacheTTL: time.Hour}
+
+	if status, _ := probe(t, checker.ReadinessHandler(), "/probe"); status != fiber.StatusOK {
+		t.Fatalf("readiness is %d before stopping", status)
+	}
+
+	// The cached report must not keep the replica in rotation.
+	checker.Stop()
+	status, body := probe(t, checker.ReadinessHandler(), "/probe?verbose")
+	if status != fiber.StatusServiceUnavailable || !strings.Contains(body, stoppedCheck) {
+		t.Fatalf("readiness is %d %s after stopping", status, body)
+	}
+
+	if status, _ := probe(t, checker.StartupHandler(), "/probe"); status != fiber.StatusOK {
+		t.Fatalf("startup is %d after stopping", status)
+	}
+}
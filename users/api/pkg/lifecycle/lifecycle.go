@@ -0,0 +1,150 @@
+// Package lifecycle stops the users services gracefully when they are asked
+// to, so that requests in flight are served rather than dropped.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/asimpleidea/ship-krew/users/api/pkg/health"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+// ErrTimeout is returned when servers or resources did not shut down before
+// the timeout.
+var ErrTimeout = errors.New("shutdown timed out")
+
+// Settings contains the options used to shut down.
+type Settings struct {
+	// Delay gives load balancers, i.e. kubernetes endpoints, the time to
+	// notice that the service is not ready and stop sending requests to it.
+	Delay   time.Duration `json:"delay" yaml:"delay" flag:"delay" usage:"how long to keep serving once asked to stop, while readiness fails"`
+	Timeout time.Duration `json:"timeout" yaml:"timeout" flag:"timeout" usage:"how long to wait for requests in flight and resources to close"`
+}
+
+// DefaultSettings returns settings that fit in the default grace period of
+// kubernetes, which is thirty seconds.
+func DefaultSettings() *Settings {
+	return &Settings{
+		Delay:   5 * time.Second,
+		Timeout: 20 * time.Second,
+	}
+}
+
+// Validate returns an error if the settings cannot be used.
+func (s *Settings) Validate() error {
+	if s.Delay < 0 {
+		return fmt.Errorf("shutdown delay cannot be negative")
+	}
+
+	if s.Timeout <= 0 {
+		return fmt.Errorf("shutdown timeout must be positive")
+	}
+
+	return nil
+}
+
+// Closer is a resource released once servers stopped serving requests, i.e.
+// a database pool.
+type Closer struct {
+	Name  string
+	Close func(ctx context.Context) error
+}
+
+// WaitForSignal blocks until the process receives SIGTERM, which is what
+// kubernetes sends, or SIGINT, and returns it.
+func WaitForSignal() os.Signal {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(stop)
+
+	return <-stop
+}
+
+// Shutdown stops a service: it makes its readiness fail, waits for the
+// delay, stops its servers and then releases its resources in order.
+type Shutdown struct {
+	Settings  *Settings
+	Logger    zerolog.Logger
+	Readiness *health.Checker
+	Apps      []*fiber.App
+	Closers   []Closer
+}
+
+// Run shuts down and returns ErrTimeout if it took longer than the timeout,
+// in which case the caller should exit with a non-zero code.
+func (s *Shutdown) Run() error {
+	settings := s.Settings
+	if settings == nil {
+		settings = DefaultSettings()
+	}
+
+	if s.Readiness != nil {
+		s.Readiness.Stop()
+	}
+
+	if settings.Delay > 0 {
+		s.Logger.Info().Dur("delay", settings.Delay).
+			Msg("waiting for load balancers to stop sending requests")
+		time.Sleep(settings.Delay)
+	}
+
+	ctx, canc := context.WithTimeout(context.Background(), settings.Timeout)
+	defer canc()
+
+	if err := s.shutdownApps(ctx); err != nil {
+		return err
+	}
+
+	var firstErr error
+	for _, closer := range s.Closers {
+		err := closer.Close(ctx)
+		if ctx.Err() != nil {
+			return fmt.Errorf("%w while closing %s", ErrTimeout, closer.Name)
+		}
+
+		if err != nil {
+			s.Logger.Err(err).Str("resource", closer.Name).Msg("error while closing")
+			if firstErr == nil {
+				firstErr = fmt.Errorf("could not close %s: %w", closer.Name, err)
+			}
+		}
+	}
+
+	return firstErr
+}
+
+// shutdownApps stops all servers at the same time, as fiber waits for all
+// connections to be closed with no deadline.
+func (s *Shutdown) shutdownApps(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, app := range s.Apps {
+		wg.Add(1)
+		go func(app *fiber.App) {
+			defer wg.Done()
+			if err := app.Shutdown(); err != nil {
+				s.Logger.Err(err).Msg("error while waiting for server to shutdown")
+			}
+		}(app)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%w while waiting for requests in flight", ErrTimeout)
+	}
+}
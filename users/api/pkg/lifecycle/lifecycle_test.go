@@ -0,0 +1,188 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asimpleidea/ship-krew/users/api/pkg/health"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+// events records what happened during a shutdown, in order.
+type events struct {
+	lock sync.Mutex
+	list []string
+}
+
+func (e *events) add(event string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.list = append(e.list, event)
+}
+
+func (e *events) get() []string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return append([]string{}, e.list...)
+}
+
+// serve starts app on a random port and returns its address.
+func serve(t *testing.T, app *fiber.App) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go app.Listener(ln)
+	return ln.Addr().String()
+}
+
+func TestShutdownOrder(t *testing.T) {
+	happened := &events{}
+	readiness := &health.Checker{}
+
+	started := make(chan struct{})
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Get("/slow", func(c *fiber.Ctx) error {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		happened.add("request served")
+		return c.SendString("done")
+	})
+	addr := serve(t, app)
+
+	served := make(chan error, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr + "/slow")
+		if err == nil {
+			_, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		served <- err
+	}()
+	<-started
+
+	closer := func(name string) Closer {
+		return Closer{Name: name, Close: func(context.Context) error {
+			if readiness.Run(context.Background()).Status != health.StatusFail {
+				t.Errorf("readiness did not fail before closing %s", name)
+			}
+
+			happened.add(name + " closed")
+			return nil
+		}}
+	}
+
+	shutdown := &Shutdown{
+		Settings:  &Settings{Timeout: time.Second},
+		Logger:    zerolog.Nop(),
+		Readiness: readiness,
+		Apps:      []*fiber.App{app},
+		Closers:   []Closer{closer("database"), closer("cache")},
+	}
+
+	if err := shutdown.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-served; err != nil {
+		t.Fatalf("request in flight was dropped: %v", err)
+	}
+
+	expected := []string{"request served", "database closed", "cache closed"}
+	if got := happened.get(); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("events are %v, expected %v", got, expected)
+	}
+}
+
+func TestShutdownDelay(t *testing.T) {
+	readiness := &health.Checker{}
+	shutdown := &Shutdown{
+		Settings:  &Settings{Delay: 50 * time.Millisecond, Timeout: time.Second},
+		Logger:    zerolog.Nop(),
+		Readiness: readiness,
+	}
+
+	done := make(chan error)
+	start := time.Now()
+	go func() { done <- shutdown.Run() }()
+
+	// Readiness fails during the delay, while requests are still served.
+	time.Sleep(10 * time.Millisecond)
+	if report := readiness.Run(context.Background()); report.Status != health.StatusFail {
+		t.Errorf("readiness is %s during the delay", report.Status)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed < shutdown.Settings.Delay {
+		t.Fatalf("shutdown took %s, less than the delay", elapsed)
+	}
+}
+
+func TestShutdownErrors(t *testing.T) {
+	var closed []string
+	failing := errors.New("failing")
+	closer := func(name string, err error) Closer {
+		return Closer{Name: name, Close: func(context.Context) error {
+			closed = append(closed, name)
+			return err
+		}}
+	}
+
+	shutdown := &Shutdown{
+		Settings: &Settings{Timeout: time.Second},
+		Logger:   zerolog.Nop(),
+		Closers:  []Closer{closer("first", failing), closer("second", errors.New("second")), closer("third", nil)},
+	}
+
+	// Resources after a failing one are still released.
+	err := shutdown.Run()
+	if !errors.Is(err, failing) {
+		t.Fatalf("error is %v, expected the first failure", err)
+	}
+
+	if len(closed) != 3 {
+		t.Fatalf("closed %v, expected all resources", closed)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	released := false
+	shutdown := &Shutdown{
+		Settings: &Settings{Timeout: 20 * time.Millisecond},
+		Logger:   zerolog.Nop(),
+		Closers: []Closer{
+			{Name: "stuck", Close: func(ctx context.Context) error {
+				<-ctx.Done()
+				return ctx.Err()
+			}},
+			{Name: "after", Close: func(context.Context) error {
+				released = true
+				return nil
+			}},
+		},
+	}
+
+	if err := shutdown.Run(); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("error is %v, expected %v", err, ErrTimeout)
+	}
+
+	if released {
+		t.Fatal("resources were released after the timeout")
+	}
+}
@@ -0,0 +1,161 @@
+// Package logging gives each request served by the users services an ID
+// and a logger that includes it, so that the lines logged while serving a
+// request, in this service or in the ones it calls, can be told apart.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// HeaderRequestID is the header that carries the ID of a request, both
+	// in the request, if the caller already has one, and in the response.
+	HeaderRequestID string = "X-Request-ID"
+
+	requestIDLength    int    = 16
+	maxRequestIDLength int    = 128
+	unmatchedRoute     string = "unmatched"
+)
+
+type requestIDKey struct{}
+
+// Middleware assigns an ID to each request, or uses the one sent by the
+// caller, and stores a logger that includes it in c.UserContext(). Once the
+// request is served, it logs its outcome with that logger, so that fields
+// added by handlers, i.e. the user, are included.
+func Middleware(log zerolog.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+
+		id := c.Get(HeaderRequestID)
+		if !validRequestID(id) {
+			id = newRequestID()
+		} else {
+			id = utils.CopyString(id)
+		}
+		c.Set(HeaderRequestID, id)
+
+		l := log.With().
+			Str("request-id", id).
+			Str("method", utils.CopyString(c.Method())).
+			Logger()
+		ctx := context.WithValue(c.UserContext(), requestIDKey{}, id)
+		c.SetUserContext(l.WithContext(ctx))
+
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		route := c.Route().Path
+		if err != nil {
+			// The error handler sets the status only after the middleware
+			// returns.
+			status = fiber.StatusInternalServerError
+
+			var ferr *fiber.Error
+			if errors.As(err, &ferr) {
+				status = ferr.Code
+			}
+
+			if status == fiber.StatusNotFound {
+				route = unmatchedRoute
+			}
+		}
+
+		// Reads are way more frequent and less interesting.
+		ev := l.Info()
+		switch {
+		case status >= fiber.StatusInternalServerError:
+			ev = l.Error().Err(err)
+		case c.Method() == fiber.MethodGet:
+			ev = l.Debug()
+		}
+
+		ev.Str("route", route).
+			Str("path", c.Path()).
+			Str("ip", c.IP()).
+			Int("status", status).
+			Dur("latency", time.Since(start)).
+			Msg("request served")
+		return err
+	}
+}
+
+// Logger returns the logger of the request, which includes its ID.
+func Logger(c *fiber.Ctx) *zerolog.Logger {
+	return zerolog.Ctx(c.UserContext())
+}
+
+// With adds fields to the logger of the request, i.e. the user who made it
+// once it is known, so that every line logged after includes them.
+func With(c *fiber.Ctx, fields func(zerolog.Context) zerolog.Context) {
+	Logger(c).UpdateContext(fields)
+}
+
+// RequestID returns the ID of the request being served with ctx, or an
+// empty string.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Transport returns an http.RoundTripper that sends the ID of the request
+// that is being served with each request made while serving it. If base is
+// nil, http.DefaultTransport is used.
+func Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return roundTripper(func(req *http.Request) (*http.Response, error) {
+		id := RequestID(req.Context())
+		if id == "" || req.Header.Get(HeaderRequestID) != "" {
+			return base.RoundTrip(req)
+		}
+
+		// Round trippers must not modify the request.
+		req = req.Clone(req.Context())
+		req.Header.Set(HeaderRequestID, id)
+		return base.RoundTrip(req)
+	})
+}
+
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func newRequestID() string {
+	id := make([]byte, requestIDLength)
+	if _, err := rand.Read(id); err != nil {
+		// Only used to correlate logs: the time is unique enough.
+		return time.Now().UTC().Format("20060102150405.000000000")
+	}
+
+	return hex.EncodeToString(id)
+}
+
+// validRequestID tells whether the ID sent by the caller can be used, as it
+// ends up in logs and in the headers of other requests.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, r := range id {
+		if r < '!' || r > '~' {
+			return false
+		}
+	}
+
+	return true
+}
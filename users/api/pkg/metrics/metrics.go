@@ -0,0 +1,89 @@
+// Package metrics exposes the Prometheus metrics of the users services on
+// their internal endpoints.
+package metrics
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+)
+
+const (
+	// Namespace prefixes the domain metrics of the services, i.e.
+	// users_login_attempts_total.
+	Namespace string = "users"
+
+	unmatchedRoute string = "unmatched"
+)
+
+var (
+	requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "The number of HTTP requests served, by route and status.",
+	}, []string{"method", "route", "status"})
+
+	requestsDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "How long HTTP requests took to be served, by route and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+)
+
+// Middleware counts the requests served by an app and how long they took.
+// Routes are the registered paths, i.e. /users/id/:id, so that the number
+// of series does not grow with the number of users.
+func Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		route := c.Route().Path
+		if err != nil {
+			// The error handler sets the status only after the middleware
+			// returns.
+			status = fiber.StatusInternalServerError
+
+			var ferr *fiber.Error
+			if errors.As(err, &ferr) {
+				status = ferr.Code
+			}
+
+			// Handlers reply with a not found status rather than returning
+			// an error, so this comes from the router: no route matched and
+			// the path could be anything.
+			if status == fiber.StatusNotFound {
+				route = unmatchedRoute
+			}
+		}
+
+		labels := prometheus.Labels{
+			// The method and the path are only valid during the request.
+			"method": utils.CopyString(c.Method()),
+			"route":  utils.CopyString(route),
+			"status": strconv.Itoa(status),
+		}
+		requests.With(labels).Inc()
+		requestsDuration.With(labels).Observe(time.Since(start).Seconds())
+
+		return err
+	}
+}
+
+// Handler serves the metrics of the default Prometheus registry, which
+// also include the ones of the Go runtime and the process.
+func Handler() fiber.Handler {
+	handler := fasthttpadaptor.NewFastHTTPHandler(promhttp.Handler())
+
+	return func(c *fiber.Ctx) error {
+		handler(c.Context())
+		return nil
+	}
+}
@@ -0,0 +1,90 @@
+package tracing
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/valyala/fasthttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Middleware starts a server span for each request, as a child of the span
+// of the caller if the request has a traceparent header. Handlers find the
+// span in c.UserContext(), which they should pass on to whatever they call.
+func Middleware() fiber.Handler {
+	tracer := Tracer()
+
+	return func(c *fiber.Ctx) error {
+		ctx := otel.GetTextMapPropagator().Extract(c.UserContext(),
+			headerCarrier{&c.Request().Header})
+
+		method := utils.CopyString(c.Method())
+		ctx, span := tracer.Start(ctx, method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPMethodKey.String(method),
+				semconv.HTTPTargetKey.String(utils.CopyString(c.OriginalURL())),
+				semconv.HTTPUserAgentKey.String(utils.CopyString(c.Get(fiber.HeaderUserAgent))),
+				semconv.NetPeerIPKey.String(c.IP()),
+			))
+		defer span.End()
+
+		c.SetUserContext(ctx)
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		if err != nil {
+			// Same as for metrics, the error handler has not run yet.
+			status = fiber.StatusInternalServerError
+
+			var ferr *fiber.Error
+			if errors.As(err, &ferr) {
+				status = ferr.Code
+			}
+
+			span.RecordError(err)
+		}
+
+		// The route is only known once the router has matched it.
+		route := utils.CopyString(c.Route().Path)
+		if status != fiber.StatusNotFound || err == nil {
+			span.SetName(method + " " + route)
+			span.SetAttributes(semconv.HTTPRouteKey.String(route))
+		}
+
+		span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(status)...)
+		span.SetStatus(semconv.SpanStatusFromHTTPStatusCodeAndSpanKind(status, trace.SpanKindServer))
+		if err != nil && status >= fiber.StatusInternalServerError {
+			span.SetStatus(codes.Error, err.Error())
+		}
+
+		return err
+	}
+}
+
+// headerCarrier lets propagators read the trace context from the headers
+// of a fasthttp request.
+type headerCarrier struct {
+	header *fasthttp.RequestHeader
+}
+
+func (h headerCarrier) Get(key string) string {
+	return string(h.header.Peek(key))
+}
+
+func (h headerCarrier) Set(key, value string) {
+	h.header.Set(key, value)
+}
+
+func (h headerCarrier) Keys() []string {
+	keys := []string{}
+	h.header.VisitAll(func(key, _ []byte) {
+		keys = append(keys, string(key))
+	})
+
+	return keys
+}
@@ -0,0 +1,123 @@
+// Package tracing sets up OpenTelemetry tracing for the users services, so
+// that a request can be followed from one service to the others it calls.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// ExporterNone does not export spans. Trace context is still
+	// propagated, so that services after this one can be traced.
+	ExporterNone string = "none"
+	// ExporterOTLP sends spans to an OpenTelemetry collector over HTTP.
+	ExporterOTLP string = "otlp"
+	// ExporterStdout writes spans to stdout, for local runs.
+	ExporterStdout string = "stdout"
+
+	instrumentationName string = "github.com/asimpleidea/ship-krew/users"
+)
+
+// Settings contains the options used to set up tracing.
+type Settings struct {
+	Exporter string `json:"exporter" yaml:"exporter" flag:"exporter" usage:"where to export spans: none, otlp or stdout"`
+	// Endpoint is the host:port of the collector. If empty, the standard
+	// OTEL_EXPORTER_OTLP_* environment variables are used.
+	Endpoint    string  `json:"endpoint" yaml:"endpoint" flag:"endpoint" usage:"the host:port of the OTLP HTTP collector"`
+	Insecure    bool    `json:"insecure" yaml:"insecure" flag:"insecure" usage:"send spans to the collector over plain HTTP"`
+	SampleRatio float64 `json:"sample_ratio" yaml:"sampleRatio" flag:"sample-ratio" usage:"the ratio of traces started by this service that are sampled, from 0 to 1"`
+}
+
+// DefaultSettings returns settings that only propagate trace context and
+// sample every trace if an exporter is set.
+func DefaultSettings() *Settings {
+	return &Settings{
+		Exporter:    ExporterNone,
+		SampleRatio: 1,
+	}
+}
+
+// Validate returns an error if the settings cannot be used.
+func (s *Settings) Validate() error {
+	switch s.Exporter {
+	case ExporterNone, ExporterOTLP, ExporterStdout:
+	default:
+		return fmt.Errorf(`unknown tracing exporter "%s"`, s.Exporter)
+	}
+
+	if s.SampleRatio < 0 || s.SampleRatio > 1 {
+		return fmt.Errorf("tracing sample ratio must be between 0 and 1")
+	}
+
+	return nil
+}
+
+// Setup registers the global tracer provider and the W3C trace context
+// propagator, and returns a function that flushes the spans left on
+// shutdown.
+func Setup(ctx context.Context, service string, settings *Settings) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+
+	if settings == nil || settings.Exporter == ExporterNone || settings.Exporter == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var (
+		exporter sdktrace.SpanExporter
+		err      error
+	)
+	switch settings.Exporter {
+	case ExporterOTLP:
+		opts := []otlptracehttp.Option{}
+		if settings.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(settings.Endpoint))
+		}
+		if settings.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		err = fmt.Errorf(`unknown tracing exporter "%s"`, settings.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not create span exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(),
+		resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(service)))
+	if err != nil {
+		return nil, fmt.Errorf("could not create tracing resource: %w", err)
+	}
+
+	// Callers decide for the traces they are part of, so that traces are
+	// not cut in the middle.
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(settings.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the tracer used by the users services for their own
+// spans, i.e. the ones of policy evaluations.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
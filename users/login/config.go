@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/asimpleidea/ship-krew/users/api/pkg/lifecycle"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/tracing"
+)
+
+type loginConfig struct {
+	Verbosity         int                `yaml:"verbosity" flag:"verbosity" usage:"the verbosity level"`
+	UsersAPIAddress   string             `yaml:"usersApiAddress" flag:"users-api-address" usage:"the address of the users server API"`
+	UsersAPIKey       string             `yaml:"usersApiKey" flag:"users-api-key" secret:"true" usage:"the key to authenticate to the users server API"`
+	Timeout           time.Duration      `yaml:"timeout" flag:"timeout" usage:"requests timeout"`
+	CookieKey         string             `yaml:"cookieKey" flag:"cookie-key" secret:"true" usage:"the key to un-encrypt cookies"`
+	Redis             redisConfig        `yaml:"redis" flag:"redis"`
+	ViewsDirectory    string             `yaml:"viewsDirectory" flag:"views-directory" usage:"root directory containing views"`
+	PublicAddress     string             `yaml:"publicAddress" flag:"public-address" usage:"the address users reach this service at, used in links sent by email"`
+	Mail              mailConfig         `yaml:"mail" flag:"mail"`
+	SMTP              smtpConfig         `yaml:"smtp" flag:"smtp"`
+	EmailVerification verificationConfig `yaml:"emailVerification" flag:"email-verification"`
+	PasswordResetTTL  time.Duration      `yaml:"passwordResetTtl" flag:"password-reset-ttl" usage:"how long password reset links are valid"`
+	Tracing           tracing.Settings   `yaml:"tracing" flag:"tracing"`
+	Shutdown          lifecycle.Settings `yaml:"shutdown" flag:"shutdown"`
+}
+
+type redisConfig struct {
+	// TODO:
+	// - what is a good default for this?
+	// - this must be a certificate when stable.
+	Endpoints string `yaml:"endpoints" flag:"endpoints" usage:"endpoints where to contact redis"`
+	Password  string `yaml:"password" flag:"password" secret:"true" usage:"authentication password for redis"`
+}
+
+type mailConfig struct {
+	Sender string `yaml:"sender" flag:"sender" usage:"how emails are sent: smtp, or file and stdout to just write them for local runs"`
+	File   string `yaml:"file" flag:"file" usage:"the file where emails are appended when the mail sender is file"`
+	From   string `yaml:"from" flag:"from" usage:"the sender of emails"`
+}
+
+type smtpConfig struct {
+	Address  string `yaml:"address" flag:"address" usage:"the host:port of the SMTP server"`
+	Username string `yaml:"username" flag:"username" usage:"the username to authenticate to the SMTP server, if needed"`
+	Password string `yaml:"password" flag:"password" secret:"true" usage:"the password to authenticate to the SMTP server"`
+}
+
+type verificationConfig struct {
+	TTL     time.Duration `yaml:"ttl" flag:"ttl" usage:"how long email verification links are valid"`
+	Resends int           `yaml:"resends" flag:"resends" usage:"how many verification emails a user can ask for in an hour"`
+}
+
+func defaultConfig() *loginConfig {
+	return &loginConfig{
+		Verbosity:       1,
+		UsersAPIAddress: "http://users-api",
+		Timeout:         2 * time.Minute,
+		Redis: redisConfig{
+			Endpoints: "http://localhost:6379",
+		},
+		ViewsDirectory: defaultViewsDirectory,
+		PublicAddress:  "http://localhost:8080",
+		Mail: mailConfig{
+			Sender: mailSenderStdout,
+			From:   "Ship Krew <no-reply@localhost>",
+		},
+		SMTP: smtpConfig{
+			Address: "localhost:25",
+		},
+		EmailVerification: verificationConfig{
+			TTL:     24 * time.Hour,
+			Resends: 3,
+		},
+		PasswordResetTTL: 30 * time.Minute,
+		Tracing:          *tracing.DefaultSettings(),
+		Shutdown:         *lifecycle.DefaultSettings(),
+	}
+}
+
+func (c *loginConfig) Validate() error {
+	if c.Verbosity < 0 || c.Verbosity > 2 {
+		return fmt.Errorf("verbosity must be between 0 and 2")
+	}
+
+	if c.CookieKey == "" {
+		return fmt.Errorf("no cookie key set")
+	}
+
+	switch c.Mail.Sender {
+	case mailSenderSMTP, mailSenderStdout:
+	case mailSenderFile:
+		if c.Mail.File == "" {
+			return fmt.Errorf("no mail file set")
+		}
+	default:
+		return fmt.Errorf(`unknown mail sender "%s"`, c.Mail.Sender)
+	}
+
+	if c.EmailVerification.TTL <= 0 || c.PasswordResetTTL <= 0 {
+		return fmt.Errorf("links must be valid for a positive duration")
+	}
+
+	if c.EmailVerification.Resends < 0 {
+		return fmt.Errorf("email verification resends cannot be negative")
+	}
+
+	if err := c.Tracing.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Shutdown.Validate(); err != nil {
+		return err
+	}
+
+	return nil
+}
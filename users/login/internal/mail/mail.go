@@ -0,0 +1,50 @@
+// Package mail sends emails to users, i.e. to let them verify their
+// address.
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender sends emails.
+type Sender interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// ErrInvalidHeader is returned when the recipient or the subject contain
+// new lines.
+var ErrInvalidHeader = errors.New("header contains new lines")
+
+// format returns msg as it is sent, with its headers.
+func format(from string, msg *Message) ([]byte, error) {
+	for _, header := range []string{from, msg.To, msg.Subject} {
+		// Otherwise anyone could add headers, or even recipients.
+		if strings.ContainsAny(header, "\r\n") {
+			return nil, ErrInvalidHeader
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	b.WriteString("\r\n")
+
+	return []byte(b.String()), nil
+}
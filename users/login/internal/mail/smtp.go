@@ -0,0 +1,48 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+)
+
+// SMTPSender sends emails through an SMTP server.
+type SMTPSender struct {
+	// Address is the host:port of the server.
+	Address string
+	// Username and Password are only used if Username is not empty.
+	Username string
+	Password string
+	// From is the sender of all emails, i.e. "Ship Krew <no-reply@...>".
+	From string
+}
+
+// Send sends msg. Note that ctx is only checked before connecting, as
+// net/smtp does not support contexts.
+func (s *SMTPSender) Send(ctx context.Context, msg *Message) error {
+	body, err := format(s.From, msg)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Address)
+		if err != nil {
+			return fmt.Errorf("invalid smtp address: %w", err)
+		}
+
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	if err := smtp.SendMail(s.Address, auth, s.From, []string{msg.To}, body); err != nil {
+		return fmt.Errorf("could not send email: %w", err)
+	}
+
+	return nil
+}
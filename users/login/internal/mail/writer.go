@@ -0,0 +1,36 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const separator string = "-----"
+
+// WriterSender does not send emails, but writes them to a writer, i.e.
+// stdout or a file. It is meant for local runs, where no SMTP server is
+// available.
+type WriterSender struct {
+	Writer io.Writer
+	From   string
+
+	lock sync.Mutex
+}
+
+func (w *WriterSender) Send(ctx context.Context, msg *Message) error {
+	body, err := format(w.From, msg)
+	if err != nil {
+		return err
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if _, err := fmt.Fprintf(w.Writer, "%s\n%s%s\n", separator, body, separator); err != nil {
+		return fmt.Errorf("could not write email: %w", err)
+	}
+
+	return nil
+}
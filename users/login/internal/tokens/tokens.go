@@ -0,0 +1,85 @@
+// Package tokens creates the single-use tokens sent to users, i.e. to
+// verify their email, and keeps them in Redis.
+//
+// Only the hash of a token is stored, so whoever can read Redis cannot use
+// the tokens.
+package tokens
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"gopkg.in/yaml.v3"
+)
+
+const tokenLength int = 32
+
+// ErrInvalidToken is returned when a token does not exist, which also
+// happens when it expired or was already used.
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// Store keeps tokens in Redis.
+type Store struct {
+	Client *redis.Client
+	// Prefix is prepended to the keys, i.e. "email-verifications".
+	Prefix string
+	// TTL is how long tokens are valid.
+	TTL time.Duration
+}
+
+// Create returns a new token that can be exchanged for value once.
+func (s *Store) Create(ctx context.Context, value interface{}) (string, error) {
+	raw := make([]byte, tokenLength)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("could not generate token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	val, err := yaml.Marshal(value)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal data: %w", err)
+	}
+
+	if err := s.Client.Set(ctx, s.key(token), val, s.TTL).Err(); err != nil {
+		return "", fmt.Errorf("could not store token: %w", err)
+	}
+
+	return token, nil
+}
+
+// Consume decodes the value of token into value and deletes the token, so
+// that it cannot be used again.
+func (s *Store) Consume(ctx context.Context, token string, value interface{}) error {
+	if token == "" {
+		return ErrInvalidToken
+	}
+
+	// Getting and deleting at once prevents using the same token twice.
+	val, err := s.Client.GetDel(ctx, s.key(token)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return ErrInvalidToken
+		}
+
+		return fmt.Errorf("could not get token: %w", err)
+	}
+
+	if err := yaml.Unmarshal([]byte(val), value); err != nil {
+		return fmt.Errorf("could not unmarshal data: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Store) key(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return path.Join(s.Prefix, hex.EncodeToString(sum[:]))
+}
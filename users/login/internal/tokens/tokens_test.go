@@ -0,0 +1,106 @@
+package tokens
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+type reset struct {
+	UserID int64 `yaml:"userId"`
+}
+
+func newStore(t *testing.T) (*Store, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	return &Store{Client: client, Prefix: "password-resets", TTL: time.Hour}, server
+}
+
+func TestConsume(t *testing.T) {
+	ctx := context.Background()
+
+	cases := []struct {
+		name string
+		// before is run between creating and consuming the token.
+		before func(t *testing.T, store *Store, server *miniredis.Miniredis, token string)
+		valid  bool
+	}{
+		{
+			name:   "valid",
+			before: func(*testing.T, *Store, *miniredis.Miniredis, string) {},
+			valid:  true,
+		},
+		{
+			name: "used twice",
+			before: func(t *testing.T, store *Store, _ *miniredis.Miniredis, token string) {
+				if err := store.Consume(ctx, token, &reset{}); err != nil {
+					t.Fatalf("first use failed with %v", err)
+				}
+			},
+		},
+		{
+			name: "expired",
+			before: func(_ *testing.T, store *Store, server *miniredis.Miniredis, _ string) {
+				server.FastForward(store.TTL + time.Second)
+			},
+		},
+		{
+			name: "another token",
+			before: func(t *testing.T, store *Store, _ *miniredis.Miniredis, _ string) {
+				if _, err := store.Create(ctx, &reset{UserID: 2}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			valid: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			store, server := newStore(t)
+
+			token, err := store.Create(ctx, &reset{UserID: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c.before(t, store, server, token)
+
+			var value reset
+			err = store.Consume(ctx, token, &value)
+			switch {
+			case !c.valid && !errors.Is(err, ErrInvalidToken):
+				t.Fatalf("error is %v, expected %v", err, ErrInvalidToken)
+			case c.valid && err != nil:
+				t.Fatalf("unexpected error %v", err)
+			case c.valid && value.UserID != 1:
+				t.Fatalf("token is for user %d, expected 1", value.UserID)
+			}
+		})
+	}
+}
+
+func TestOnlyHashesAreStored(t *testing.T) {
+	store, server := newStore(t)
+
+	token, err := store.Create(context.Background(), &reset{UserID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range server.Keys() {
+		if key == store.Prefix+"/"+token {
+			t.Fatalf("token is stored as it is: %s", key)
+		}
+	}
+
+	if len(server.Keys()) != 1 {
+		t.Fatalf("%d keys were stored, expected 1", len(server.Keys()))
+	}
+}
@@ -1,30 +1,39 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"crypto/sha256"
+	"crypto/rand"
 	"encoding/base64"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"net"
-	"net/http"
 	"os"
-	"os/signal"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/asimpleidea/ship-krew/users/api/pkg/api"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/client"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/config"
 	uerrors "github.com/asimpleidea/ship-krew/users/api/pkg/errors"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/health"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/lifecycle"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/logging"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/metrics"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/tracing"
+	"github.com/asimpleidea/ship-krew/users/login/internal/mail"
+	"github.com/asimpleidea/ship-krew/users/login/internal/tokens"
+	"github.com/go-redis/redis/extra/redisotel/v8"
 	"github.com/go-redis/redis/v8"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/encryptcookie"
+	"github.com/gofiber/fiber/v2/utils"
 	"github.com/gofiber/template/html"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/trace"
 	"gopkg.in/yaml.v3"
 )
 
@@ -33,9 +42,19 @@ import (
 
 const (
 	fiberAppName          string        = "Login Backend"
+	tracingServiceName    string        = "users-login"
 	defaultApiTimeout     time.Duration = time.Minute
 	defaultPongTimeout    time.Duration = 30 * time.Second
 	defaultViewsDirectory string        = "/views"
+	mailSenderSMTP        string        = "smtp"
+	mailSenderFile        string        = "file"
+	mailSenderStdout      string        = "stdout"
+	verificationsPrefix   string        = "email-verifications"
+	resetsPrefix          string        = "password-resets"
+	sessionsPrefix        string        = "sessions"
+	userSessionsPrefix    string        = "user-sessions"
+	sessionIDLength       int           = 32
+	resendsWindow         time.Duration = time.Hour
 )
 
 var (
@@ -44,49 +63,32 @@ var (
 
 func main() {
 	var (
-		verbosity      int
-		usersApiAddr   string
-		timeout        time.Duration
-		cookieKey      string
-		redisEndpoint  string
-		redisPassword  string
-		viewsDirectory string
-		appViews       string
+		cfg      = defaultConfig()
+		appViews string
 	)
 
-	flag.IntVar(&verbosity, "verbosity", 1, "the verbosity level")
-
-	// TODO: https, not http
-	flag.StringVar(&usersApiAddr, "users-api-address", "http://users-api", "the address of the users server API")
-	flag.DurationVar(&timeout, "timeout", 2*time.Minute, "requests timeout")
-
-	// TODO: this should be pulled from secrets
-	flag.StringVar(&cookieKey, "cookie-key", "", "The key to un-encrypt cookies")
+	log = zerolog.New(os.Stderr).With().Logger()
 
-	// TODO:
-	// - use default
-	// - use secrets for authentication
-	// - what is a good default for this?
-	flag.StringVar(&redisEndpoint, "redis-endpoints", "http://localhost:6379",
-		"Endpoints where to contact redis.")
-	// TODO: this must be a certificate when stable.
-	flag.StringVar(&redisPassword, "redis-password", "",
-		"Authentication password for redis.")
+	loaded, err := config.Load(cfg, os.Args[1:])
+	if err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			log.Err(err).Msg("error while loading configuration")
+		}
+		return
+	}
 
-	flag.StringVar(&viewsDirectory, "views-directory", defaultViewsDirectory,
-		"Root directory containing views.")
-	flag.Parse()
+	if loaded.Print {
+		if err := config.Print(os.Stdout, cfg); err != nil {
+			log.Err(err).Msg("error while printing configuration")
+		}
+		return
+	}
 
-	log = zerolog.New(os.Stderr).With().Logger()
-	log.Info().Int("verbosity", verbosity).Msg("starting...")
+	log.Info().Int("verbosity", cfg.Verbosity).Str("config", loaded.File).Msg("starting...")
 
 	{
 		logLevels := [4]zerolog.Level{zerolog.DebugLevel, zerolog.InfoLevel, zerolog.ErrorLevel}
-		log = log.Level(logLevels[verbosity])
-	}
-
-	if cookieKey == "" {
-		log.Fatal().Err(errors.New("no cookie key set")).Msg("fatal error occurred")
+		log = log.Level(logLevels[cfg.Verbosity])
 	}
 
 	// ------------------------------------
@@ -94,12 +96,12 @@ func main() {
 	// ------------------------------------
 
 	sessClient := redis.NewClient(&redis.Options{
-		Addr:     redisEndpoint,
-		Password: redisPassword,
+		Addr:     cfg.Redis.Endpoints,
+		Password: cfg.Redis.Password,
 		// TODO: define the database from flags.
 		DB: 0,
 	})
-	defer sessClient.Close()
+	sessClient.AddHook(redisotel.NewTracingHook())
 
 	if err := func() error {
 		ctx, canc := context.WithTimeout(context.TODO(), defaultPongTimeout)
@@ -112,28 +114,81 @@ func main() {
 		return // unnecessary but for readability
 	}
 
-	viewsDir := path.Join(viewsDirectory, "public")
+	prometheus.MustRegister(newSessionsCollector(sessClient))
+
+	shutdownTracing, err := tracing.Setup(context.Background(), tracingServiceName, &cfg.Tracing)
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not set up tracing")
+		return // unnecessary but for readability
+	}
+
+	var sender mail.Sender
+	switch cfg.Mail.Sender {
+	case mailSenderSMTP:
+		sender = &mail.SMTPSender{
+			Address:  cfg.SMTP.Address,
+			Username: cfg.SMTP.Username,
+			Password: cfg.SMTP.Password,
+			From:     cfg.Mail.From,
+		}
+	case mailSenderFile:
+		f, err := os.OpenFile(cfg.Mail.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not open mail file")
+			return // unnecessary but for readability
+		}
+		defer f.Close()
+
+		sender = &mail.WriterSender{Writer: f, From: cfg.Mail.From}
+	case mailSenderStdout:
+		log.Warn().Msg("emails are written to stdout and not sent")
+		sender = &mail.WriterSender{Writer: os.Stdout, From: cfg.Mail.From}
+	}
+
+	verifications := &tokens.Store{
+		Client: sessClient,
+		Prefix: verificationsPrefix,
+		TTL:    cfg.EmailVerification.TTL,
+	}
+
+	resets := &tokens.Store{
+		Client: sessClient,
+		Prefix: resetsPrefix,
+		TTL:    cfg.PasswordResetTTL,
+	}
+
+	viewsDir := path.Join(cfg.ViewsDirectory, "public")
 	appViews = path.Join("apps", "login")
 
 	// TODO: if not available should fail
 	engine := html.New(viewsDir, ".html")
 
-	// TODO: authenticate to users server with APIKey
+	usersClient, err := client.NewClient(&client.Settings{
+		BaseURL: cfg.UsersAPIAddress,
+		Timeout: cfg.Timeout,
+		APIKey:  cfg.UsersAPIKey,
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not create users api client")
+		return // unnecessary but for readability
+	}
 
 	app := fiber.New(fiber.Config{
 		AppName:               fiberAppName,
 		ReadTimeout:           time.Minute,
-		DisableStartupMessage: verbosity > 0,
+		DisableStartupMessage: cfg.Verbosity > 0,
 		Views:                 engine,
 	})
 
+	app.Use(metrics.Middleware(), tracing.Middleware(), logging.Middleware(log))
+
 	app.Use(encryptcookie.New(encryptcookie.Config{
-		Key: cookieKey,
+		Key: cfg.CookieKey,
 	}))
 
 	app.Get("/login", func(c *fiber.Ctx) error {
 		// TODO: make this whole function better
-		ctx, canc := context.WithTimeout(context.Background(), defaultApiTimeout)
+		ctx, canc := context.WithTimeout(c.UserContext(), defaultApiTimeout)
 		usrSession, sessionID, _ := getSessionFromRedis(ctx, c, sessClient)
 		// TODO: check if error is from redis, if so internal server error
 		// otherwise just login
@@ -141,12 +196,12 @@ func main() {
 		if usrSession != nil {
 			if !usrSession.Expired() {
 				if usrSession.DaysTillExpiration() < 3 {
-					crCtx, crCanc := context.WithTimeout(context.Background(), defaultApiTimeout)
+					crCtx, crCanc := context.WithTimeout(c.UserContext(), defaultApiTimeout)
 					usrSession.Expiration = time.Now().AddDate(0, 0, 7)
 					err := createSessionOnRedis(crCtx, sessClient, *sessionID, usrSession)
 					crCanc()
 					if err != nil {
-						log.Err(err).Str("session-id", *sessionID).
+						logging.Logger(c).Err(err).Str("session-id", *sessionID).
 							Int64("user-id", usrSession.UserID).
 							Msg("error while trying to update session")
 					}
@@ -157,10 +212,10 @@ func main() {
 			}
 
 			func() {
-				delCtx, delCanc := context.WithTimeout(context.Background(), defaultApiTimeout)
+				delCtx, delCanc := context.WithTimeout(c.UserContext(), defaultApiTimeout)
 				defer delCanc()
 				if err := deleteSession(delCtx, c, sessClient, *sessionID); err != nil {
-					log.Err(err).Str("session-id", *sessionID).
+					logging.Logger(c).Err(err).Str("session-id", *sessionID).
 						Int64("user-id", usrSession.UserID).
 						Msg("error while trying to delete session")
 				}
@@ -180,7 +235,7 @@ func main() {
 	})
 
 	app.Post("/login", func(c *fiber.Ctx) error {
-		ctx, canc := context.WithTimeout(context.Background(), defaultApiTimeout)
+		ctx, canc := context.WithTimeout(c.UserContext(), defaultApiTimeout)
 		usrSession, sessionID, _ := getSessionFromRedis(ctx, c, sessClient)
 		// TODO: check if error is from Redis, if so internal server error
 		// otherwise just login
@@ -188,12 +243,12 @@ func main() {
 		if usrSession != nil {
 			if !usrSession.Expired() {
 				if usrSession.DaysTillExpiration() < 3 {
-					crCtx, crCanc := context.WithTimeout(context.Background(), defaultApiTimeout)
+					crCtx, crCanc := context.WithTimeout(c.UserContext(), defaultApiTimeout)
 					usrSession.Expiration = time.Now().AddDate(0, 0, 7)
 					err := createSessionOnRedis(crCtx, sessClient, *sessionID, usrSession)
 					crCanc()
 					if err != nil {
-						log.Err(err).Str("session-id", *sessionID).
+						logging.Logger(c).Err(err).Str("session-id", *sessionID).
 							Int64("user-id", usrSession.UserID).
 							Msg("error while trying to update session")
 					}
@@ -203,10 +258,10 @@ func main() {
 			}
 
 			func() {
-				delCtx, delCanc := context.WithTimeout(context.Background(), defaultApiTimeout)
+				delCtx, delCanc := context.WithTimeout(c.UserContext(), defaultApiTimeout)
 				defer delCanc()
 				if err := deleteSession(delCtx, c, sessClient, *sessionID); err != nil {
-					log.Err(err).Str("session-id", *sessionID).
+					logging.Logger(c).Err(err).Str("session-id", *sessionID).
 						Int64("user-id", usrSession.UserID).
 						Msg("error while trying to delete session")
 				}
@@ -225,8 +280,8 @@ func main() {
 		username := c.FormValue(formUsername)
 		pwd := c.FormValue(formPassword)
 
-		ctx, canc = context.WithTimeout(context.Background(), defaultApiTimeout)
-		usr, err := getUserByUsername(ctx, usersApiAddr, username)
+		ctx, canc = context.WithTimeout(c.UserContext(), defaultApiTimeout)
+		usr, err := usersClient.GetUserByUsername(ctx, username)
 		if err != nil {
 			canc()
 			// TODO:
@@ -234,45 +289,98 @@ func main() {
 			// 	that this user-pwd combination was not found
 			var e *uerrors.Error
 			if errors.As(err, &e) {
-				return c.Status(uerrors.ToHTTPStatusCode(e.Code)).
-					JSON(e)
+				status := uerrors.ToHTTPStatusCode(e.Code)
+				if status >= fiber.StatusInternalServerError {
+					loginAttempts.WithLabelValues(loginErrored).Inc()
+				} else {
+					loginAttempts.WithLabelValues(loginFailed).Inc()
+				}
+
+				return c.Status(status).JSON(e)
 			}
 
+			loginAttempts.WithLabelValues(loginErrored).Inc()
 			return c.Status(fiber.StatusBadRequest).SendString("not ok")
 		}
 		canc()
 
-		if passwordIsCorrect(pwd, usr.Base64PasswordHash, usr.Base64Salt) {
-			fmt.Println("password is correct")
-			// TODO: generate a good session ID
-			sessionID := "testing"
+		ctx, canc = context.WithTimeout(c.UserContext(), defaultApiTimeout)
+		verification, err := usersClient.VerifyCredentialsByID(ctx, usr.ID, pwd)
+		canc()
+		if err != nil {
+			loginAttempts.WithLabelValues(loginErrored).Inc()
+			var e *uerrors.Error
+			if errors.As(err, &e) {
+				return c.Status(uerrors.ToHTTPStatusCode(e.Code)).
+					JSON(e)
+			}
+
+			return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+		}
+
+		if verification.Match {
+			// The ban is only disclosed to who knows the password.
+			if usr.Ban != nil && usr.Ban.Prevents(api.BanScopeAccount) {
+				logging.Logger(c).Info().Int64("user-id", usr.ID).Int64("ban-id", usr.Ban.ID).
+					Msg("banned user tried to log in")
+				loginAttempts.WithLabelValues(loginBanned).Inc()
+
+				msg := "account banned: " + usr.Ban.Reason
+				if usr.Ban.ExpiresAt != nil {
+					msg = fmt.Sprintf("account banned until %s: %s",
+						usr.Ban.ExpiresAt.Format(time.RFC1123), usr.Ban.Reason)
+				}
+
+				return c.Status(fiber.StatusForbidden).SendString(msg)
+			}
+
+			if verification.NeedsRehash {
+				// Let the users API hash it again with the current parameters.
+				ctx, canc = context.WithTimeout(c.UserContext(), defaultApiTimeout)
+				if _, err := usersClient.PatchUser(ctx, usr.ID, &api.UserPatch{Password: &pwd}); err != nil {
+					logging.Logger(c).Err(err).Int64("user-id", usr.ID).
+						Msg("error while trying to rehash password")
+				}
+				canc()
+			}
+
+			sessionID, err := newSessionID()
+			if err != nil {
+				loginAttempts.WithLabelValues(loginErrored).Inc()
+				return c.Status(fiber.StatusInternalServerError).
+					Send([]byte(err.Error()))
+			}
+
 			c.Cookie(&fiber.Cookie{
 				Name:  "session",
 				Value: sessionID,
 			})
 
-			ctx, canc = context.WithTimeout(context.Background(), defaultApiTimeout)
+			ctx, canc = context.WithTimeout(c.UserContext(), defaultApiTimeout)
 			defer canc()
 			if err := createSessionOnRedis(ctx, sessClient, sessionID, &UserSession{
 				CreatedAt:  time.Now(),
 				UserID:     usr.ID,
 				Expiration: time.Now().AddDate(0, 0, 7),
 			}); err != nil {
+				loginAttempts.WithLabelValues(loginErrored).Inc()
 				return c.Status(fiber.StatusInternalServerError).
 					Send([]byte(err.Error()))
 			}
 
+			loginAttempts.WithLabelValues(loginSucceeded).Inc()
 			return c.Status(fiber.StatusOK).Send([]byte("ok"))
 		}
 
 		// TODO: cookie
 
+		loginAttempts.WithLabelValues(loginFailed).Inc()
 		return c.Status(fiber.StatusOK).
 			Send([]byte("does not match"))
 	})
 
 	app.Get("/logout", func(c *fiber.Ctx) error {
-		ctx, canc := context.WithTimeout(context.Background(), defaultApiTimeout)
+		ctx, canc := context.WithTimeout(c.UserContext(), defaultApiTimeout)
 		usrSession, sessID, _ := getSessionFromRedis(ctx, c, sessClient)
 		canc()
 
@@ -287,9 +395,9 @@ func main() {
 		// - check if not expired
 
 		c.ClearCookie("session")
-		ctx, canc = context.WithTimeout(context.Background(), defaultApiTimeout)
+		ctx, canc = context.WithTimeout(c.UserContext(), defaultApiTimeout)
 		if err := deleteSession(ctx, c, sessClient, *sessID); err != nil {
-			log.Err(err).Str("session-id", *sessID).
+			logging.Logger(c).Err(err).Str("session-id", *sessID).
 				Int64("user-id", usrSession.UserID).
 				Msg("error while trying to delete session")
 			canc()
@@ -301,17 +409,17 @@ func main() {
 	})
 
 	app.Get("/signup", func(c *fiber.Ctx) error {
-		ctx, canc := context.WithTimeout(context.Background(), defaultApiTimeout)
+		ctx, canc := context.WithTimeout(c.UserContext(), defaultApiTimeout)
 		usrSession, sessionID, _ := getSessionFromRedis(ctx, c, sessClient)
 		canc()
 
 		if usrSession != nil {
 			if usrSession.Expired() {
 				func() {
-					delCtx, delCanc := context.WithTimeout(context.Background(), defaultApiTimeout)
+					delCtx, delCanc := context.WithTimeout(c.UserContext(), defaultApiTimeout)
 					defer delCanc()
 					if err := deleteSession(delCtx, c, sessClient, *sessionID); err != nil {
-						log.Err(err).Str("session-id", *sessionID).
+						logging.Logger(c).Err(err).Str("session-id", *sessionID).
 							Int64("user-id", usrSession.UserID).
 							Msg("error while trying to delete session")
 					}
@@ -332,8 +440,8 @@ func main() {
 		// - check if email already exists
 
 		{
-			ctx, canc := context.WithTimeout(context.Background(), defaultApiTimeout)
-			usr, err := getUserByUsername(ctx, usersApiAddr, c.FormValue("signup_username"))
+			ctx, canc := context.WithTimeout(c.UserContext(), defaultApiTimeout)
+			usr, err := usersClient.GetUserByUsername(ctx, c.FormValue("signup_username"))
 			canc()
 			if err != nil {
 				var e *uerrors.Error
@@ -377,166 +485,294 @@ func main() {
 		}
 
 		{
-			passBytes := bytes.NewBufferString(c.FormValue("signup_password")).Bytes()
-			// TODO: this should not use sha256!
-			passHash := sha256.Sum256(passBytes)
-			base64Pass := base64.StdEncoding.EncodeToString(passHash[:])
-			userToCreate.Base64PasswordHash = &base64Pass
+			// The users API takes care of hashing it.
+			pwd := c.FormValue("signup_password")
+			userToCreate.Password = &pwd
 		}
 
-		{
-			ctx, canc := context.WithTimeout(context.Background(), defaultApiTimeout)
-			if err := createUser(ctx, usersApiAddr, userToCreate); err != nil {
-				canc()
-				var e *uerrors.Error
-				if errors.As(err, &e) {
-					// TODO:
-					// - html
-					// - better parsing
-					return c.Status(uerrors.ToHTTPStatusCode(e.Code)).
-						JSON(e)
-				}
-
-				return c.Status(fiber.StatusInternalServerError).SendString(e.Error())
+		ctx, canc := context.WithTimeout(c.UserContext(), defaultApiTimeout)
+		created, err := usersClient.CreateUser(ctx, userToCreate)
+		canc()
+		if err != nil {
+			var e *uerrors.Error
+			if errors.As(err, &e) {
+				// TODO:
+				// - html
+				// - better parsing
+				return c.Status(uerrors.ToHTTPStatusCode(e.Code)).
+					JSON(e)
 			}
-			canc()
+
+			return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+		}
+
+		// The account exists anyway, so the user can ask for another email
+		// if this one does not arrive.
+		ctx, canc = context.WithTimeout(c.UserContext(), defaultApiTimeout)
+		defer canc()
+		if err := sendVerificationEmail(ctx, verifications, sender, cfg.PublicAddress, created.ID, *userToCreate.Email); err != nil {
+			logging.Logger(c).Err(err).Int64("user-id", created.ID).
+				Msg("error while trying to send verification email")
 		}
 
 		return c.Status(fiber.StatusOK).SendString("ok")
 	})
 
-	go func() {
-		if err := app.Listen(":8080"); err != nil {
-			log.Err(err).Msg("error while listening")
-		}
-	}()
+	app.Get("/verify-email", func(c *fiber.Ctx) error {
+		ctx, canc := context.WithTimeout(c.UserContext(), defaultApiTimeout)
+		defer canc()
 
-	// Graceful Shutdown
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt)
-	<-stop
+		var verification emailVerification
+		if err := verifications.Consume(ctx, c.Query("token"), &verification); err != nil {
+			if errors.Is(err, tokens.ErrInvalidToken) {
+				return c.Status(fiber.StatusNotFound).
+					SendString("this link is not valid or it has expired")
+			}
 
-	log.Info().Msg("shutting down...")
-	if err := app.Shutdown(); err != nil {
-		log.Err(err).Msg("error while waiting for server to shutdown")
-	}
-	log.Info().Msg("goodbye!")
-}
+			logging.Logger(c).Err(err).Msg("error while trying to get email verification")
+			return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+		}
 
-// TODO: this must be integrated in the client
-func getUserByUsername(ctx context.Context, usersApiAddr, username string) (*api.User, error) {
-	req, err := http.NewRequestWithContext(ctx,
-		http.MethodGet,
-		fmt.Sprintf("%s/users/username/%s", usersApiAddr, username),
-		nil)
-	if err != nil {
-		return nil, err
-	}
+		if _, err := usersClient.VerifyEmail(ctx, verification.UserID, verification.Email); err != nil {
+			var e *uerrors.Error
+			if errors.As(err, &e) {
+				switch e.Code {
+				case uerrors.CodeEmailMismatch, uerrors.CodeUserNotFound:
+					return c.Status(fiber.StatusNotFound).
+						SendString("this link is not valid or it has expired")
+				}
+			}
 
-	// TODO: use cookies in client?
-	cl := &http.Client{}
-	resp, err := cl.Do(req)
-	if err != nil {
-		return nil, err
-	}
+			logging.Logger(c).Err(err).Int64("user-id", verification.UserID).
+				Msg("error while trying to verify email")
+			return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+		}
 
-	defer resp.Body.Close()
+		logging.Logger(c).Info().Int64("user-id", verification.UserID).Msg("email verified")
 
-	// TODO: better way to handle these internal server error
+		// TODO: redirect
+		return c.Status(fiber.StatusOK).SendString("email verified")
+	})
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, &uerrors.Error{
-			Err:     uerrors.ErrInternalServerError,
-			Code:    uerrors.CodeInternalServerError,
-			Message: uerrors.MessageInternalServerError,
+	app.Post("/verify-email/resend", func(c *fiber.Ctx) error {
+		ctx, canc := context.WithTimeout(c.UserContext(), defaultApiTimeout)
+		defer canc()
+
+		usrSession, _, _ := getSessionFromRedis(ctx, c, sessClient)
+		if usrSession == nil || usrSession.Expired() {
+			return c.Status(fiber.StatusUnauthorized).SendString("not logged in")
 		}
-	}
 
-	if resp.StatusCode != fiber.StatusOK {
-		var e uerrors.Error
-		if err := json.Unmarshal(body, &e); err != nil {
-			return nil, &uerrors.Error{
-				Err:     uerrors.ErrInternalServerError,
-				Code:    uerrors.CodeInternalServerError,
-				Message: uerrors.MessageInternalServerError,
+		usr, err := usersClient.GetUserByID(ctx, usrSession.UserID)
+		if err != nil {
+			var e *uerrors.Error
+			if errors.As(err, &e) {
+				return c.Status(uerrors.ToHTTPStatusCode(e.Code)).
+					JSON(e)
 			}
+
+			return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
 		}
 
-		return nil, &e
-	}
+		if usr.EmailVerifiedAt != nil {
+			return c.Status(fiber.StatusConflict).SendString("email already verified")
+		}
 
-	var user api.User
-	if err := json.Unmarshal(body, &user); err != nil {
-		return nil, &uerrors.Error{
-			Err:     uerrors.ErrInternalServerError,
-			Code:    uerrors.CodeInternalServerError,
-			Message: uerrors.MessageInternalServerError,
+		allowed, err := allowResend(ctx, sessClient, usr.ID, cfg.EmailVerification.Resends)
+		if err != nil {
+			logging.Logger(c).Err(err).Int64("user-id", usr.ID).
+				Msg("error while checking verification emails rate limit")
+			return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
 		}
-	}
 
-	return &user, nil
-}
+		if !allowed {
+			return c.Status(fiber.StatusTooManyRequests).
+				SendString("too many verification emails: please try again later")
+		}
 
-func createUser(ctx context.Context, usersApiAddr string, usr *api.User) error {
-	bodyToSend, err := json.Marshal(usr)
-	if err != nil {
-		return err
-	}
+		if err := sendVerificationEmail(ctx, verifications, sender, cfg.PublicAddress, usr.ID, *usr.Email); err != nil {
+			logging.Logger(c).Err(err).Int64("user-id", usr.ID).
+				Msg("error while trying to send verification email")
+			return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+		}
 
-	req, err := http.NewRequestWithContext(ctx,
-		http.MethodPost,
-		fmt.Sprintf("%s/users", usersApiAddr),
-		bytes.NewBuffer(bodyToSend))
-	if err != nil {
-		return err
-	}
+		return c.Status(fiber.StatusOK).SendString("ok")
+	})
 
-	// TODO: use cookies in client?
-	cl := &http.Client{}
-	resp, err := cl.Do(req)
-	if err != nil {
-		return err
-	}
+	app.Get("/forgot-password", func(c *fiber.Ctx) error {
+		return c.Render(path.Join(appViews, "forgot_password"), fiber.Map{
+			"Title": "Forgot password",
+		})
+	})
 
-	defer resp.Body.Close()
+	app.Post("/forgot-password", func(c *fiber.Ctx) error {
+		// Fiber reuses the memory of the request once the handler returns.
+		email := utils.CopyString(c.FormValue("forgot_email"))
+
+		// Whether the email exists must not be disclosed, not even by how
+		// long this takes: so the email is sent in the background and the
+		// response is always the same.
+		// The trace and the logs of the request go on in the background, but
+		// not its cancellation.
+		bgCtx := logging.Logger(c).WithContext(
+			trace.ContextWithSpan(context.Background(), trace.SpanFromContext(c.UserContext())))
+		go func() {
+			ctx, canc := context.WithTimeout(bgCtx, defaultApiTimeout)
+			defer canc()
 
-	// TODO: better way to handle these internal server error
+			if err := sendResetEmail(ctx, usersClient, resets, sender, cfg.PublicAddress, email); err != nil {
+				zerolog.Ctx(ctx).Err(err).Msg("error while trying to send password reset email")
+			}
+		}()
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return &uerrors.Error{
-			Err:     uerrors.ErrInternalServerError,
-			Code:    uerrors.CodeInternalServerError,
-			Message: uerrors.MessageInternalServerError,
+		return c.Status(fiber.StatusOK).
+			SendString("if an account with this email exists, we sent you a link to reset your password")
+	})
+
+	app.Get("/reset-password", func(c *fiber.Ctx) error {
+		// The token is only consumed when the form is submitted.
+		return c.Render(path.Join(appViews, "reset_password"), fiber.Map{
+			"Title": "Reset password",
+			"Token": c.Query("token"),
+		})
+	})
+
+	app.Post("/reset-password", func(c *fiber.Ctx) error {
+		const (
+			formToken           = "reset_token"
+			formPassword        = "reset_password"
+			formConfirmPassword = "reset_confirm_password"
+		)
+
+		pwd := c.FormValue(formPassword)
+		if pwd != c.FormValue(formConfirmPassword) {
+			return c.Status(fiber.StatusBadRequest).SendString("passwords do not match")
+		}
+
+		// Checked before the token is consumed, so that the link can be
+		// used again with a better password.
+		switch {
+		case len(pwd) < api.MinPasswordLength:
+			return c.Status(fiber.StatusBadRequest).SendString(uerrors.MessagePasswordTooShort)
+		case len(pwd) > api.MaxPasswordLength:
+			return c.Status(fiber.StatusBadRequest).SendString(uerrors.MessagePasswordTooLong)
+		}
+
+		ctx, canc := context.WithTimeout(c.UserContext(), defaultApiTimeout)
+		defer canc()
+
+		var reset passwordReset
+		if err := resets.Consume(ctx, c.FormValue(formToken), &reset); err != nil {
+			if errors.Is(err, tokens.ErrInvalidToken) {
+				return c.Status(fiber.StatusNotFound).
+					SendString("this link is not valid or it has expired")
+			}
+
+			logging.Logger(c).Err(err).Msg("error while trying to get password reset")
+			return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+		}
+
+		// The link was sent to an email that the user may not own anymore.
+		usr, err := usersClient.GetUserByID(ctx, reset.UserID)
+		if err != nil || !strings.EqualFold(*usr.Email, reset.Email) {
+			if err != nil {
+				logging.Logger(c).Err(err).Int64("user-id", reset.UserID).
+					Msg("error while trying to get user to reset password")
+			}
+
+			return c.Status(fiber.StatusNotFound).
+				SendString("this link is not valid or it has expired")
 		}
-	}
 
-	if resp.StatusCode >= 300 {
-		var e uerrors.Error
-		if err := json.Unmarshal(body, &e); err != nil {
-			return &uerrors.Error{
-				Err:     uerrors.ErrInternalServerError,
-				Code:    uerrors.CodeInternalServerError,
-				Message: uerrors.MessageInternalServerError,
+		if err := usersClient.SetPassword(ctx, reset.UserID, pwd); err != nil {
+			var e *uerrors.Error
+			if errors.As(err, &e) {
+				// The token was used anyway, so a new one must be requested.
+				return c.Status(uerrors.ToHTTPStatusCode(e.Code)).
+					SendString(e.Message + " Please ask for a new link.")
 			}
+
+			return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+		}
+
+		// Whoever knew the old password must not stay logged in.
+		c.ClearCookie("session")
+		if err := deleteUserSessions(ctx, sessClient, reset.UserID); err != nil {
+			logging.Logger(c).Err(err).Int64("user-id", reset.UserID).
+				Msg("error while trying to delete sessions after password reset")
+			return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
 		}
 
-		return &e
+		logging.Logger(c).Info().Int64("user-id", reset.UserID).Msg("password reset")
+
+		// TODO: redirect
+		return c.Status(fiber.StatusOK).SendString("password changed")
+	})
+
+	internalEndpoints := fiber.New(fiber.Config{
+		AppName:               fiberAppName,
+		ReadTimeout:           time.Minute,
+		DisableStartupMessage: cfg.Verbosity > 0,
+	})
+
+	internalEndpoints.Use(logging.Middleware(log))
+
+	readiness := &health.Checker{
+		Checks: []health.Check{
+			{
+				Name: "redis",
+				Check: func(ctx context.Context) error {
+					return sessClient.Ping(ctx).Err()
+				},
+			},
+		},
 	}
 
-	return nil
-}
+	internalEndpoints.Get("/startupz", readiness.StartupHandler())
+	internalEndpoints.Get("/readyz", readiness.ReadinessHandler())
 
-// TODO: this may need to be better and maybe done on client
-func passwordIsCorrect(provided string, expected, salt *string) bool {
-	decodedExpected, _ := base64.URLEncoding.DecodeString(*expected)
-	decodedSalt, _ := base64.URLEncoding.DecodeString(*salt)
+	internalEndpoints.Get("/livez", func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	})
 
-	digestProvided := sha256.Sum256([]byte(provided))
-	passWithSalt := append(digestProvided[:], decodedSalt...)
+	internalEndpoints.Get("/metrics", metrics.Handler())
 
-	return bytes.Equal(passWithSalt, decodedExpected)
+	go func() {
+		if err := app.Listen(":8080"); err != nil {
+			log.Err(err).Msg("error while listening")
+		}
+	}()
+
+	go func() {
+		if err := internalEndpoints.Listen(":8081"); err != nil {
+			log.Err(err).Msg("error while listening")
+		}
+	}()
+
+	// Graceful Shutdown
+	sig := lifecycle.WaitForSignal()
+	log.Info().Str("signal", sig.String()).Msg("shutting down...")
+
+	shutdown := &lifecycle.Shutdown{
+		Settings:  &cfg.Shutdown,
+		Logger:    log,
+		Readiness: readiness,
+		Apps:      []*fiber.App{app, internalEndpoints},
+		Closers: []lifecycle.Closer{
+			{
+				Name: "redis",
+				Close: func(context.Context) error {
+					return sessClient.Close()
+				},
+			},
+			{Name: "tracing", Close: shutdownTracing},
+		},
+	}
+	if err := shutdown.Run(); err != nil {
+		log.Err(err).Msg("error while shutting down")
+		os.Exit(1)
+	}
+	log.Info().Msg("goodbye!")
 }
 
 type UserSession struct {
@@ -564,7 +800,7 @@ func getSessionFromRedis(ctx context.Context, fctx *fiber.Ctx, sessionsClient *r
 		return nil, nil, nil
 	}
 
-	val, err := sessionsClient.Get(ctx, path.Join("sessions", sessionID)).Result()
+	val, err := sessionsClient.Get(ctx, path.Join(sessionsPrefix, sessionID)).Result()
 	if err != nil {
 		if err == redis.Nil {
 			return nil, nil, nil
@@ -578,6 +814,10 @@ func getSessionFromRedis(ctx context.Context, fctx *fiber.Ctx, sessionsClient *r
 		return nil, nil, fmt.Errorf("error while unmarshalling value from value: %w", err)
 	}
 
+	logging.With(fctx, func(l zerolog.Context) zerolog.Context {
+		return l.Int64("actor-id", usrSession.UserID)
+	})
+
 	return &usrSession, &sessionID, nil
 }
 
@@ -587,13 +827,147 @@ func createSessionOnRedis(ctx context.Context, sessionClient *redis.Client, sess
 		return fmt.Errorf("could not marshal data: %w", err)
 	}
 
-	return sessionClient.
-		Set(ctx, path.Join("sessions", sessionID), val, time.Until(usrSession.Expiration)).
-		Err()
+	// Sessions of each user are indexed, so that they can all be deleted
+	// at once. Sessions always expire a fixed time after they are created
+	// or extended, so the index lasts as long as the last one.
+	index := path.Join(userSessionsPrefix, strconv.FormatInt(usrSession.UserID, 10))
+	_, err = sessionClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, path.Join(sessionsPrefix, sessionID), val, time.Until(usrSession.Expiration))
+		pipe.SAdd(ctx, index, sessionID)
+		pipe.Expire(ctx, index, time.Until(usrSession.Expiration))
+		return nil
+	})
+
+	return err
+}
+
+// newSessionID returns a random session ID.
+func newSessionID() (string, error) {
+	id := make([]byte, sessionIDLength)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("could not generate session ID: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(id), nil
 }
 
 func deleteSession(ctx context.Context, fctx *fiber.Ctx, sessionClient *redis.Client, sessionID string) error {
 	fctx.ClearCookie("session")
 
-	return sessionClient.Del(ctx, path.Join("sessions", sessionID)).Err()
+	// The session is not removed from the index of the user's sessions:
+	// deleting it again when deleting all of them is harmless.
+	return sessionClient.Del(ctx, path.Join(sessionsPrefix, sessionID)).Err()
+}
+
+// deleteUserSessions logs the user out everywhere.
+func deleteUserSessions(ctx context.Context, sessionClient *redis.Client, userID int64) error {
+	index := path.Join(userSessionsPrefix, strconv.FormatInt(userID, 10))
+
+	sessionIDs, err := sessionClient.SMembers(ctx, index).Result()
+	if err != nil {
+		return fmt.Errorf("could not get sessions of user: %w", err)
+	}
+
+	keys := []string{index}
+	for _, sessionID := range sessionIDs {
+		keys = append(keys, path.Join(sessionsPrefix, sessionID))
+	}
+
+	return sessionClient.Del(ctx, keys...).Err()
+}
+
+// emailVerification is what an email verification token is exchanged for.
+type emailVerification struct {
+	UserID int64  `yaml:"userId"`
+	Email  string `yaml:"email"`
+}
+
+// sendVerificationEmail sends a link to verify email to the user.
+func sendVerificationEmail(ctx context.Context, verifications *tokens.Store, sender mail.Sender, publicAddress string, userID int64, email string) error {
+	token, err := verifications.Create(ctx, &emailVerification{
+		UserID: userID,
+		Email:  email,
+	})
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/verify-email?token=%s", strings.TrimSuffix(publicAddress, "/"), token)
+	return sender.Send(ctx, &mail.Message{
+		To:      email,
+		Subject: "Verify your email",
+		Body: fmt.Sprintf("Hi!\n\nPlease verify your email by opening this link: %s\n\n"+
+			"The link expires in %s. If you did not sign up, you can ignore this email.\n",
+			link, verifications.TTL),
+	})
+}
+
+// allowResend returns true if the user has not asked for more than limit
+// verification emails in the current window.
+func allowResend(ctx context.Context, client *redis.Client, userID int64, limit int) (bool, error) {
+	key := path.Join(verificationsPrefix, "resends", strconv.FormatInt(userID, 10))
+
+	count, err := client.Incr(ctx, key).Result()
+	if err != nil {
+		return false, fmt.Errorf("could not increment resends: %w", err)
+	}
+
+	if count == 1 {
+		// The window starts with the first email.
+		if err := client.Expire(ctx, key, resendsWindow).Err(); err != nil {
+			return false, fmt.Errorf("could not set resends window: %w", err)
+		}
+	}
+
+	return count <= int64(limit), nil
+}
+
+// passwordReset is what a password reset token is exchanged for.
+type passwordReset struct {
+	UserID int64  `yaml:"userId"`
+	Email  string `yaml:"email"`
+}
+
+// sendResetEmail sends a link to reset the password to the user with the
+// provided email, if there is one.
+func sendResetEmail(ctx context.Context, usersClient *client.Client, resets *tokens.Store, sender mail.Sender, publicAddress, email string) error {
+	if email == "" {
+		return nil
+	}
+
+	users, err := usersClient.ListUsers(ctx, &client.ListFilters{
+		EmailIn: []string{email},
+		Limit:   1,
+	})
+	if err != nil {
+		var e *uerrors.Error
+		if errors.As(err, &e) && uerrors.ToHTTPStatusCode(e.Code) == fiber.StatusBadRequest {
+			// Not even an email.
+			return nil
+		}
+
+		return fmt.Errorf("could not get user: %w", err)
+	}
+
+	if len(users.Users) == 0 {
+		return nil
+	}
+
+	usr := users.Users[0]
+	token, err := resets.Create(ctx, &passwordReset{
+		UserID: usr.ID,
+		Email:  *usr.Email,
+	})
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/reset-password?token=%s", strings.TrimSuffix(publicAddress, "/"), token)
+	return sender.Send(ctx, &mail.Message{
+		To:      *usr.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s!\n\nYou can choose a new password by opening this link: %s\n\n"+
+			"The link expires in %s. If you did not ask for this, you can ignore this email.\n",
+			usr.DisplayName, link, resets.TTL),
+	})
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"path"
+	"time"
+
+	"github.com/asimpleidea/ship-krew/users/api/pkg/metrics"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	loginSucceeded string = "success"
+	loginFailed    string = "failure"
+	loginBanned    string = "banned"
+	loginErrored   string = "error"
+
+	sessionsScanCount   int64         = 1000
+	sessionsScanTimeout time.Duration = 5 * time.Second
+)
+
+var (
+	loginAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "login",
+		Name:      "attempts_total",
+		Help:      "The number of login attempts, by result: success, failure for wrong credentials, banned or error.",
+	}, []string{"result"})
+)
+
+// sessionsCollector counts the sessions stored on redis whenever metrics
+// are scraped, as they also disappear when they expire.
+type sessionsCollector struct {
+	client *redis.Client
+	desc   *prometheus.Desc
+}
+
+func newSessionsCollector(client *redis.Client) *sessionsCollector {
+	return &sessionsCollector{
+		client: client,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(metrics.Namespace, "login", "active_sessions"),
+			"The number of sessions that did not expire yet.",
+			nil, nil),
+	}
+}
+
+func (s *sessionsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.desc
+}
+
+func (s *sessionsCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, canc := context.WithTimeout(context.Background(), sessionsScanTimeout)
+	defer canc()
+
+	// TODO: keep a counter on redis if scanning becomes too slow.
+	count := 0
+	iter := s.client.Scan(ctx, 0, path.Join(sessionsPrefix, "*"), sessionsScanCount).Iterator()
+	for iter.Next(ctx) {
+		count++
+	}
+
+	if err := iter.Err(); err != nil {
+		ch <- prometheus.NewInvalidMetric(s.desc, err)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(s.desc, prometheus.GaugeValue, float64(count))
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/asimpleidea/ship-krew/users/api/pkg/lifecycle"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/tracing"
+)
+
+type policyConfig struct {
+	Verbosity     int                `yaml:"verbosity" flag:"verbosity" usage:"the verbosity level"`
+	RegoDirectory string             `yaml:"regoDirectory" flag:"rego-directory" usage:"root directory containing rego files"`
+	Tracing       tracing.Settings   `yaml:"tracing" flag:"tracing"`
+	Shutdown      lifecycle.Settings `yaml:"shutdown" flag:"shutdown"`
+}
+
+func (c *policyConfig) Validate() error {
+	if c.Verbosity < 0 || c.Verbosity > 2 {
+		return fmt.Errorf("verbosity must be between 0 and 2")
+	}
+
+	if c.RegoDirectory == "" {
+		return fmt.Errorf("no rego directory set")
+	}
+
+	if err := c.Tracing.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Shutdown.Validate(); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -2,18 +2,29 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
-	"os/signal"
 	"time"
 
+	"github.com/asimpleidea/ship-krew/users/api/pkg/config"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/health"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/lifecycle"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/logging"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/metrics"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/tracing"
 	"github.com/asimpleidea/ship-krew/users/policy/pkg/types"
 	"github.com/gofiber/fiber/v2"
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/rego"
 	"github.com/open-policy-agent/opa/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -21,40 +32,68 @@ const (
 	defaultApiTimeout    time.Duration = time.Minute
 	defaultPongTimeout   time.Duration = 30 * time.Second
 	fiberAppName         string        = "users-policy"
+	querySettingsPerms   string        = "settings.permissions"
+	tracingServiceName   string        = "users-policy"
 )
 
 var (
 	log zerolog.Logger
+
+	evaluationsDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "policy",
+		Name:      "evaluation_duration_seconds",
+		Help:      "How long policies took to be evaluated, by query.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"query"})
 )
 
 func main() {
-	var (
-		verbosity     int
-		regoDirectory string
-	)
+	cfg := &policyConfig{
+		Verbosity:     1,
+		RegoDirectory: defaultRegoDirectory,
+		Tracing:       *tracing.DefaultSettings(),
+		Shutdown:      *lifecycle.DefaultSettings(),
+	}
+
+	log = zerolog.New(os.Stderr).With().Logger()
 
-	flag.IntVar(&verbosity, "verbosity", 1, "the verbosity level")
+	loaded, err := config.Load(cfg, os.Args[1:])
+	if err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			log.Err(err).Msg("error while loading configuration")
+		}
+		return
+	}
 
-	flag.StringVar(&regoDirectory, "rego-directory", defaultRegoDirectory,
-		"Root directory containing rego files.")
-	flag.Parse()
+	if loaded.Print {
+		if err := config.Print(os.Stdout, cfg); err != nil {
+			log.Err(err).Msg("error while printing configuration")
+		}
+		return
+	}
 
-	log = zerolog.New(os.Stderr).With().Logger()
-	log.Info().Int("verbosity", verbosity).Msg("starting...")
+	log.Info().Int("verbosity", cfg.Verbosity).Str("config", loaded.File).Msg("starting...")
 
 	{
 		logLevels := [4]zerolog.Level{zerolog.DebugLevel, zerolog.InfoLevel, zerolog.ErrorLevel}
-		log = log.Level(logLevels[verbosity])
+		log = log.Level(logLevels[cfg.Verbosity])
 	}
 
 	ctx, canc := context.WithCancel(context.Background())
-	_ = canc
+	defer canc()
+
+	shutdownTracing, err := tracing.Setup(ctx, tracingServiceName, &cfg.Tracing)
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not set up tracing")
+		return
+	}
 
 	// --------------------------------------------
 	// Load rego files from directory
 	// --------------------------------------------
 
-	ver, err := newVerifier(ctx, regoDirectory)
+	ver, err := newVerifier(ctx, cfg.RegoDirectory)
 	if err != nil {
 		log.Fatal().Err(err).Msg("could not load verifier")
 		return
@@ -67,15 +106,20 @@ func main() {
 	app := fiber.New(fiber.Config{
 		AppName:               fiberAppName,
 		ReadTimeout:           time.Minute,
-		DisableStartupMessage: verbosity > 0,
+		DisableStartupMessage: cfg.Verbosity > 0,
 	})
+	app.Use(metrics.Middleware(), tracing.Middleware(), logging.Middleware(log))
 
 	app.Post("/settings/permissions", func(c *fiber.Ctx) error {
-		vctx, vcanc := context.WithTimeout(ctx, 10*time.Second)
+		// Evaluations stop on shutdown, but are part of the request trace.
+		vctx, vcanc := context.WithTimeout(
+			trace.ContextWithSpan(ctx, trace.SpanFromContext(c.UserContext())),
+			10*time.Second)
 		defer vcanc()
 
 		perms, err := ver.verifySettingsPermissions(vctx, c.Body())
 		if err != nil {
+			logging.Logger(c).Err(err).Msg("could not verify settings permissions")
 			return c.Status(fiber.StatusInternalServerError).
 				SendString(err.Error())
 		}
@@ -91,19 +135,28 @@ func main() {
 	internalEndpoints := fiber.New(fiber.Config{
 		AppName:               fiberAppName,
 		ReadTimeout:           time.Minute,
-		DisableStartupMessage: verbosity > 0,
+		DisableStartupMessage: cfg.Verbosity > 0,
 	})
 
-	// TODO: have startup probe
+	internalEndpoints.Use(logging.Middleware(log))
 
-	internalEndpoints.Get("/readyz", func(c *fiber.Ctx) error {
-		return c.SendStatus(fiber.StatusOK)
-	})
+	// Policies are loaded before serving and have no dependencies, but
+	// evaluating them tells if they still can be.
+	readiness := &health.Checker{
+		Checks: []health.Check{
+			{Name: "policies", Check: ver.check},
+		},
+	}
+
+	internalEndpoints.Get("/startupz", readiness.StartupHandler())
+	internalEndpoints.Get("/readyz", readiness.ReadinessHandler())
 
 	internalEndpoints.Get("/livez", func(c *fiber.Ctx) error {
 		return c.SendStatus(fiber.StatusOK)
 	})
 
+	internalEndpoints.Get("/metrics", metrics.Handler())
+
 	go func() {
 		if err := app.Listen(":8080"); err != nil {
 			log.Err(err).Msg("error while listening")
@@ -117,18 +170,22 @@ func main() {
 	}()
 
 	// Graceful Shutdown
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt)
-	<-stop
-	if err := app.Shutdown(); err != nil {
-		log.Err(err).Msg("could not successfully shutdown server")
+	sig := lifecycle.WaitForSignal()
+	log.Info().Str("signal", sig.String()).Msg("shutting down...")
+
+	shutdown := &lifecycle.Shutdown{
+		Settings:  &cfg.Shutdown,
+		Logger:    log,
+		Readiness: readiness,
+		Apps:      []*fiber.App{app, internalEndpoints},
+		Closers: []lifecycle.Closer{
+			{Name: "tracing", Close: shutdownTracing},
+		},
 	}
-	if err := internalEndpoints.Shutdown(); err != nil {
-		log.Err(err).Msg("could not successfully shutdown internal server")
+	if err := shutdown.Run(); err != nil {
+		log.Err(err).Msg("error while shutting down")
+		os.Exit(1)
 	}
-	canc()
-
-	log.Info().Msg("shutting down...")
 	log.Info().Msg("goodbye!")
 }
 
@@ -165,7 +222,7 @@ func newVerifier(mainCtx context.Context, regoPath string) (*verifier, error) {
 	settingsPermissions := rego.New(rego.Query("data.users.settings.permissions"), bundles)
 	spEval, err := settingsPermissions.PrepareForEval(mainCtx)
 	if err != nil {
-		return nil, fmt.Errorf(`could not set up "settings.permissions" evaluator: %w`, err)
+		return nil, fmt.Errorf(`could not set up "%s" evaluator: %w`, querySettingsPerms, err)
 	}
 
 	return &verifier{
@@ -173,6 +230,16 @@ func newVerifier(mainCtx context.Context, regoPath string) (*verifier, error) {
 	}, nil
 }
 
+// check evaluates the prepared queries with no input, outside of metrics
+// and traces, to tell whether they can be evaluated.
+func (v *verifier) check(ctx context.Context) error {
+	if _, err := v.settingsPermissions.Eval(ctx, rego.EvalInput(map[string]interface{}{})); err != nil {
+		return fmt.Errorf(`cannot evaluate "%s": %w`, querySettingsPerms, err)
+	}
+
+	return nil
+}
+
 func (v *verifier) verifySettingsPermissions(ctx context.Context, data []byte) (*types.UserSettingsPermissions, error) {
 	const (
 		notAllowedChangeSettings string = "not_allowed_change_settings"
@@ -190,7 +257,16 @@ func (v *verifier) verifySettingsPermissions(ctx context.Context, data []byte) (
 		return nil, fmt.Errorf("unable to process input: %w", err)
 	}
 
+	ctx, span := tracing.Tracer().Start(ctx, "opa.eval "+querySettingsPerms,
+		trace.WithAttributes(attribute.String("opa.query", querySettingsPerms)))
+	start := time.Now()
 	result, err := v.settingsPermissions.Eval(ctx, rego.EvalParsedInput(inputValue))
+	evaluationsDuration.WithLabelValues(querySettingsPerms).Observe(time.Since(start).Seconds())
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
 	if err != nil {
 		return nil, fmt.Errorf("cannot check permissions: %w", err)
 	}
@@ -51,6 +51,10 @@ not_allowed_change_settings["user_is_deleted"] {
     input.user.deleted_at
 }
 
+not_allowed_change_settings["email_not_verified"] {
+    not input.user.email_verified
+}
+
 cant_change_username["not_allowed_change_settings"] {
     count(not_allowed_change_settings) > 0
 }
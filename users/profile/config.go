@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/asimpleidea/ship-krew/users/api/pkg/lifecycle"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/tracing"
+)
+
+type profileConfig struct {
+	Verbosity          int                `yaml:"verbosity" flag:"verbosity" usage:"the verbosity level"`
+	UsersAPIAddress    string             `yaml:"usersApiAddress" flag:"users-api-address" usage:"the address of the users server API"`
+	UsersAPIKey        string             `yaml:"usersApiKey" flag:"users-api-key" secret:"true" usage:"the key to authenticate to the users server API"`
+	UsersPolicyAddress string             `yaml:"usersPolicyAddress" flag:"users-pol-address" env:"USERS_POLICY_ADDRESS" usage:"the address of the users policy server"`
+	Timeout            time.Duration      `yaml:"timeout" flag:"timeout" usage:"requests timeout"`
+	ViewsDirectory     string             `yaml:"viewsDirectory" flag:"views-directory" usage:"directory containing views"`
+	Profile            profileSettings    `yaml:"profile" flag:""`
+	Tracing            tracing.Settings   `yaml:"tracing" flag:"tracing"`
+	Shutdown           lifecycle.Settings `yaml:"shutdown" flag:"shutdown"`
+}
+
+func defaultConfig() *profileConfig {
+	return &profileConfig{
+		Verbosity:          1,
+		UsersAPIAddress:    "http://users-api",
+		UsersPolicyAddress: "http://users-policy",
+		Timeout:            2 * time.Minute,
+		ViewsDirectory:     defaultViewsDirectory,
+		Profile: profileSettings{
+			UsernameUpdateDays: 30,
+			DOBUpdateDays:      365,
+		},
+		Tracing:  *tracing.DefaultSettings(),
+		Shutdown: *lifecycle.DefaultSettings(),
+	}
+}
+
+func (c *profileConfig) Validate() error {
+	if c.Verbosity < 0 || c.Verbosity > 2 {
+		return fmt.Errorf("verbosity must be between 0 and 2")
+	}
+
+	if c.Profile.UsernameUpdateDays < 0 || c.Profile.DOBUpdateDays < 0 {
+		return fmt.Errorf("update days cannot be negative")
+	}
+
+	if err := c.Tracing.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Shutdown.Validate(); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -9,20 +9,29 @@ import (
 	"fmt"
 	"net/http"
 	"os"
-	"os/signal"
 	"path"
+	"strconv"
 	"time"
 
 	"github.com/asimpleidea/ship-krew/users/api/pkg/api"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/client"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/config"
 	uerrors "github.com/asimpleidea/ship-krew/users/api/pkg/errors"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/health"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/lifecycle"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/logging"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/metrics"
+	"github.com/asimpleidea/ship-krew/users/api/pkg/tracing"
 	upoltypes "github.com/asimpleidea/ship-krew/users/policy/pkg/types"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/template/html"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
 const (
 	fiberAppName          string        = "Profile Backend"
+	tracingServiceName    string        = "users-profile"
 	defaultApiTimeout     time.Duration = time.Minute
 	defaultViewsDirectory string        = "/views"
 )
@@ -38,51 +47,70 @@ type Elems struct {
 
 func main() {
 	var (
-		verbosity      int
-		usersApiAddr   string
-		usersPolAddr   string
-		timeout        time.Duration
-		viewsDirectory string
-		appViews       string
+		cfg      = defaultConfig()
+		appViews string
 	)
 
-	flag.IntVar(&verbosity, "verbosity", 1, "the verbosity level")
+	log = zerolog.New(os.Stderr).With().Logger()
 
-	// TODO: https, not http
-	flag.StringVar(&usersApiAddr, "users-api-address", "http://users-api", "the address of the users server API")
-	flag.StringVar(&usersPolAddr, "users-pol-address", "http://users-policy", "the address of the users policy server")
-	flag.DurationVar(&timeout, "timeout", 2*time.Minute, "requests timeout")
-	flag.StringVar(&viewsDirectory, "views-directory", defaultViewsDirectory,
-		"Directory containing views.")
-	flag.Parse()
+	loaded, err := config.Load(cfg, os.Args[1:])
+	if err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			log.Err(err).Msg("error while loading configuration")
+		}
+		return
+	}
 
-	log = zerolog.New(os.Stderr).With().Logger()
-	log.Info().Int("verbosity", verbosity).Msg("starting...")
+	if loaded.Print {
+		if err := config.Print(os.Stdout, cfg); err != nil {
+			log.Err(err).Msg("error while printing configuration")
+		}
+		return
+	}
+
+	log.Info().Int("verbosity", cfg.Verbosity).Str("config", loaded.File).Msg("starting...")
 
 	{
 		logLevels := [4]zerolog.Level{zerolog.DebugLevel, zerolog.InfoLevel, zerolog.ErrorLevel}
-		log = log.Level(logLevels[verbosity])
+		log = log.Level(logLevels[cfg.Verbosity])
 	}
 
-	viewsDir := path.Join(viewsDirectory, "public")
+	viewsDir := path.Join(cfg.ViewsDirectory, "public")
 	appViews = path.Join("apps", "profile")
 
 	// TODO: if not available should fail
 	engine := html.New(viewsDir, ".html")
 
-	// TODO: authenticate to users server with APIKey
+	shutdownTracing, err := tracing.Setup(context.Background(), tracingServiceName, &cfg.Tracing)
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not set up tracing")
+		return // unnecessary but for readability
+	}
+
+	usersClient, err := client.NewClient(&client.Settings{
+		BaseURL: cfg.UsersAPIAddress,
+		Timeout: cfg.Timeout,
+		APIKey:  cfg.UsersAPIKey,
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not create users api client")
+		return // unnecessary but for readability
+	}
 
 	app := fiber.New(fiber.Config{
 		AppName:               fiberAppName,
 		ReadTimeout:           time.Minute,
-		DisableStartupMessage: verbosity > 0,
+		DisableStartupMessage: cfg.Verbosity > 0,
 		Views:                 engine,
 	})
+	app.Use(metrics.Middleware(), tracing.Middleware(), logging.Middleware(log))
 
 	app.Get("/profiles/:username", func(c *fiber.Ctx) error {
 		// TODO: should username be sanitized?
-		ctx, canc := context.WithTimeout(context.Background(), defaultApiTimeout)
-		user, err := getUserByUsername(ctx, usersApiAddr, c.Params("username"))
+		// TODO: act on behalf of the logged in user, so that they can see
+		// their own private data.
+		ctx, canc := context.WithTimeout(c.UserContext(), defaultApiTimeout)
+		user, err := usersClient.GetUserByUsername(client.AsAnonymous(ctx), c.Params("username"))
 		if err != nil {
 			// TODO: parse the erorr and return an html of the error, not
 			// simple text.
@@ -92,8 +120,8 @@ func main() {
 		canc()
 
 		// Get their permissions
-		ctx, canc = context.WithTimeout(context.Background(), defaultApiTimeout)
-		uperm, err := getUserPermissions(ctx, user, usersPolAddr)
+		ctx, canc = context.WithTimeout(c.UserContext(), defaultApiTimeout)
+		uperm, err := getUserPermissions(ctx, usersClient, user, &cfg.Profile, cfg.UsersPolicyAddress)
 		if err != nil {
 			canc()
 			return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
@@ -111,8 +139,8 @@ func main() {
 
 	app.Get("/profiles/:username/edit", func(c *fiber.Ctx) error {
 		// TODO: get API users username
-		ctx, canc := context.WithTimeout(context.Background(), defaultApiTimeout)
-		user, err := getUserByUsername(ctx, usersApiAddr, c.Params("username"))
+		ctx, canc := context.WithTimeout(c.UserContext(), defaultApiTimeout)
+		user, err := usersClient.GetUserByUsername(ctx, c.Params("username"))
 		if err != nil {
 			// TODO: parse the erorr and return an html of the error, not
 			// simple text.
@@ -122,8 +150,8 @@ func main() {
 		canc()
 
 		// Get their permissions
-		ctx, canc = context.WithTimeout(context.Background(), defaultApiTimeout)
-		uperm, err := getUserPermissions(ctx, user, usersPolAddr)
+		ctx, canc = context.WithTimeout(c.UserContext(), defaultApiTimeout)
+		uperm, err := getUserPermissions(ctx, usersClient, user, &cfg.Profile, cfg.UsersPolicyAddress)
 		if err != nil {
 			canc()
 			return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
@@ -136,7 +164,8 @@ func main() {
 		}
 
 		return c.Render(path.Join(appViews, "edit_profile"), fiber.Map{
-			"User": user,
+			"Title": "Edit your profile",
+			"User":  user,
 		})
 	})
 
@@ -145,8 +174,8 @@ func main() {
 		// - Check if you can do this (OPA) or maybe let the API do this?
 		// - Handle case in which this is called via AJAX
 
-		ctx, canc := context.WithTimeout(context.Background(), defaultApiTimeout)
-		usr, err := getUserByUsername(ctx, usersApiAddr, c.Params("username"))
+		ctx, canc := context.WithTimeout(c.UserContext(), defaultApiTimeout)
+		usr, err := usersClient.GetUserByUsername(ctx, c.Params("username"))
 		if err != nil {
 			// TODO: parse the error and return an html of the error, not
 			// simple text.
@@ -156,8 +185,8 @@ func main() {
 		canc()
 
 		// Get their permissions
-		ctx, canc = context.WithTimeout(context.Background(), defaultApiTimeout)
-		uperm, err := getUserPermissions(ctx, usr, usersPolAddr)
+		ctx, canc = context.WithTimeout(c.UserContext(), defaultApiTimeout)
+		uperm, err := getUserPermissions(ctx, usersClient, usr, &cfg.Profile, cfg.UsersPolicyAddress)
 		if err != nil {
 			canc()
 			return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
@@ -169,12 +198,15 @@ func main() {
 			return c.Status(fiber.StatusForbidden).SendString("cannot update your profile")
 		}
 
-		usrToUpdate := usr.Clone()
+		// Only the edited fields are sent, so that the ones that are not in
+		// the form are left as they are.
+		patch := &api.UserPatch{}
 
 		const (
 			formUsername    = "edit_username"
 			formDisplayName = "edit_display_name"
 			formBio         = "edit_bio"
+			formVersion     = "edit_version"
 		)
 
 		{
@@ -183,7 +215,7 @@ func main() {
 			// - check from settings how many times you can change it in x days.
 			editedUsername := c.FormValue(formUsername)
 			if editedUsername != "" && editedUsername != usr.Username {
-				usrToUpdate.Username = editedUsername
+				patch.Username = &editedUsername
 			}
 		}
 
@@ -192,7 +224,7 @@ func main() {
 			// - validation and check for prohibited words
 			editedDisplayName := c.FormValue(formDisplayName)
 			if editedDisplayName != "" && editedDisplayName != usr.DisplayName {
-				usrToUpdate.DisplayName = editedDisplayName
+				patch.DisplayName = &editedDisplayName
 			}
 		}
 
@@ -201,20 +233,41 @@ func main() {
 			// - validation
 			editedBio := c.FormValue(formBio)
 			if editedBio != "" {
-				if usrToUpdate.Bio == nil || (usrToUpdate.Bio != nil && editedBio != *usrToUpdate.Bio) {
-					usrToUpdate.Bio = &editedBio
+				if usr.Bio == nil || editedBio != *usr.Bio {
+					patch.Bio = &editedBio
 				}
 			}
 		}
 
-		ctx, canc = context.WithTimeout(context.Background(), defaultApiTimeout)
+		if patch.IsEmpty() {
+			return c.SendStatus(fiber.StatusOK)
+		}
+
+		ctx, canc = context.WithTimeout(c.UserContext(), defaultApiTimeout)
 		defer canc()
-		if err := updateUser(ctx, usersApiAddr, usrToUpdate); err != nil {
+
+		// The version the form was rendered with, so that changes made in
+		// the meantime, i.e. from another tab, are not overwritten.
+		if version := c.FormValue(formVersion); version != "" {
+			v, err := strconv.ParseInt(version, 10, 64)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).SendString("invalid version")
+			}
+
+			ctx = client.WithVersion(ctx, v)
+		}
+
+		if _, err := usersClient.PatchUser(ctx, usr.ID, patch); err != nil {
 			// TODO:
 			// - Parse the error and decide what to do
 			// - Send json if ajax or html if not
 			var e *uerrors.Error
 			if errors.As(err, &e) {
+				if e.Code == uerrors.CodeVersionMismatch {
+					return c.Status(fiber.StatusPreconditionFailed).
+						SendString("your profile has changed in the meantime: reload the page and try again")
+				}
+
 				return c.Status(uerrors.ToHTTPStatusCode(e.Code)).
 					JSON(e)
 			}
@@ -226,98 +279,86 @@ func main() {
 		return c.SendStatus(fiber.StatusOK)
 	})
 
-	// TODO: only do readiness probe.
-	go func() {
-		if err := app.Listen(":8080"); err != nil {
-			log.Err(err).Msg("error while listening")
-		}
-	}()
-
-	// Graceful Shutdown
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt)
-	<-stop
-
-	log.Info().Msg("shutting down...")
-	if err := app.Shutdown(); err != nil {
-		log.Err(err).Msg("error while waiting for server to shutdown")
-	}
-	log.Info().Msg("goodbye!")
-}
-
-// TODO: this must be integrated in the client
-func getUserByUsername(ctx context.Context, usersApiAddr, username string) (*api.User, error) {
-	req, err := http.NewRequestWithContext(ctx,
-		http.MethodGet,
-		fmt.Sprintf("%s/users/username/%s", usersApiAddr, username),
-		nil)
-	if err != nil {
-		return nil, err
-	}
-
-	// TODO: use cookies in client?
-	cl := &http.Client{}
-	resp, err := cl.Do(req)
-	if err != nil {
-		return nil, err
-	}
+	internalEndpoints := fiber.New(fiber.Config{
+		AppName:               fiberAppName,
+		ReadTimeout:           time.Minute,
+		DisableStartupMessage: cfg.Verbosity > 0,
+	})
 
-	defer resp.Body.Close()
+	internalEndpoints.Use(logging.Middleware(log))
 
-	var user api.User
-	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
-		return nil, err
+	readiness := &health.Checker{
+		Checks: []health.Check{
+			health.HTTPCheck("users-api", cfg.UsersAPIAddress),
+			health.HTTPCheck("users-policy", cfg.UsersPolicyAddress),
+		},
 	}
 
-	return &user, nil
-}
+	internalEndpoints.Get("/startupz", readiness.StartupHandler())
+	internalEndpoints.Get("/readyz", readiness.ReadinessHandler())
 
-// TODO: this must be integrated in the client
-func updateUser(ctx context.Context, usersApiAddr string, user *api.User) error {
-	usrBody, err := json.Marshal(user)
-	if err != nil {
-		return err
-	}
+	internalEndpoints.Get("/livez", func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	})
 
-	req, err := http.NewRequestWithContext(ctx,
-		http.MethodPut,
-		fmt.Sprintf("%s/users/%d", usersApiAddr, user.ID),
-		bytes.NewReader(usrBody))
-	if err != nil {
-		return err
-	}
+	internalEndpoints.Get("/metrics", metrics.Handler())
 
-	// TODO: use cookies in client?
-	cl := &http.Client{}
-	resp, err := cl.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
+	go func() {
+		if err := app.Listen(":8080"); err != nil {
+			log.Err(err).Msg("error while listening")
+		}
+	}()
 
-	// TODO: handle errors better
-	if resp.StatusCode != fiber.StatusOK {
-		var oerr uerrors.Error
-		if err := json.NewDecoder(resp.Body).Decode(&err); err != nil {
-			return &oerr
+	go func() {
+		if err := internalEndpoints.Listen(":8081"); err != nil {
+			log.Err(err).Msg("error while listening")
 		}
+	}()
 
-		return &oerr
+	// Graceful Shutdown
+	sig := lifecycle.WaitForSignal()
+	log.Info().Str("signal", sig.String()).Msg("shutting down...")
+
+	shutdown := &lifecycle.Shutdown{
+		Settings:  &cfg.Shutdown,
+		Logger:    log,
+		Readiness: readiness,
+		Apps:      []*fiber.App{app, internalEndpoints},
+		Closers: []lifecycle.Closer{
+			{Name: "tracing", Close: shutdownTracing},
+		},
 	}
+	if err := shutdown.Run(); err != nil {
+		log.Err(err).Msg("error while shutting down")
+		os.Exit(1)
+	}
+	log.Info().Msg("goodbye!")
+}
 
-	return nil
+// permissionsInput is the input of the settings permissions policy.
+type permissionsInput struct {
+	User            userCheckPermissions `json:"user"`
+	ProfileSettings *profileSettings     `json:"profile_settings"`
 }
 
 // TODO: this is temporary, if this is going to become stable I will send
 // the user struct.
 type userCheckPermissions struct {
 	IsBanned      bool          `json:"is_banned"`
+	EmailVerified bool          `json:"email_verified"`
 	UserID        int64         `json:"user_id"`
 	Username      string        `json:"username"`
-	DOB           time.Time     `json:"dob,omitempty"`
+	DOB           *time.Time    `json:"dob,omitempty"`
 	UpdateHistory updateHistory `json:"update_history"`
 }
 
+type profileSettings struct {
+	UsernameUpdateDays int `json:"username_update_days" yaml:"usernameUpdateDays" flag:"username-update-days" usage:"the number of days that must pass before a user can change their username again"`
+	DOBUpdateDays      int `json:"dob_update_days" yaml:"dobUpdateDays" flag:"dob-update-days" usage:"the number of days that must pass before a user can change their date of birth again"`
+}
+
+// updateHistory contains the changes to the user, the most recent first as
+// the policy expects.
 type updateHistory struct {
 	Usernames []*userUpdateChange `json:"usernames,omitempty"`
 	DOBs      []*userUpdateChange `json:"dobs,omitempty"`
@@ -337,12 +378,46 @@ type userPermissionsDenied struct {
 	CantChangeDOB            []string `json:"cant_change_dob"`
 }
 
-func getUserPermissions(ctx context.Context, user *api.User, addr string) (*upoltypes.UserSettingsPermissions, error) {
-	checkPermissions := &userCheckPermissions{
-		IsBanned:      false,
-		UserID:        user.ID,
-		Username:      user.Username,
-		UpdateHistory: updateHistory{},
+func getUserPermissions(ctx context.Context, usersClient *client.Client, user *api.User, settings *profileSettings, addr string) (*upoltypes.UserSettingsPermissions, error) {
+	// Bans and birthdays are private and user may have been got on behalf
+	// of someone else, so they are got again as the service itself.
+	user, err := usersClient.GetUserByID(ctx, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("could not get user: %w", err)
+	}
+
+	history, err := usersClient.GetUserHistory(ctx, user.ID, api.FieldUsername, api.FieldBirthday)
+	if err != nil {
+		return nil, fmt.Errorf("could not get user history: %w", err)
+	}
+
+	checkPermissions := &permissionsInput{
+		User: userCheckPermissions{
+			IsBanned:      user.Ban != nil && user.Ban.Prevents(api.BanScopeProfile),
+			EmailVerified: user.EmailVerifiedAt != nil,
+			UserID:        user.ID,
+			Username:      user.Username,
+			DOB:           user.Birthday,
+		},
+		ProfileSettings: settings,
+	}
+
+	for _, change := range history.Changes {
+		updateChange := &userUpdateChange{Time: change.ChangedAt}
+		if change.NewValue != nil {
+			updateChange.NewValue = *change.NewValue
+		}
+
+		if change.OldValue != nil {
+			updateChange.PreviousValue = *change.OldValue
+		}
+
+		switch change.Field {
+		case api.FieldUsername:
+			checkPermissions.User.UpdateHistory.Usernames = append(checkPermissions.User.UpdateHistory.Usernames, updateChange)
+		case api.FieldBirthday:
+			checkPermissions.User.UpdateHistory.DOBs = append(checkPermissions.User.UpdateHistory.DOBs, updateChange)
+		}
 	}
 
 	reqBody, err := json.Marshal(checkPermissions)
@@ -359,7 +434,7 @@ func getUserPermissions(ctx context.Context, user *api.User, addr string) (*upol
 	}
 
 	// TODO: use cookies in client?
-	cl := &http.Client{}
+	cl := &http.Client{Transport: otelhttp.NewTransport(logging.Transport(nil))}
 	resp, err := cl.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("could not do request: %w", err)